@@ -6,29 +6,61 @@
 from __future__ import annotations
 
 import argparse
+import base64
+import contextlib
+import copy
+import csv
 import datetime
+import decimal
+import hashlib
 import importlib.metadata
 import json
+import math
+import os
+import plistlib
+import pprint
 import re
+import secrets
+import struct
+import subprocess
 import sys
+import threading
+import time
 import traceback
-from dataclasses import dataclass
+import urllib.parse
+import warnings
+from collections import Counter, OrderedDict
+from dataclasses import dataclass, field, fields, replace
 from io import StringIO
 from pathlib import Path
 from typing import (
     TYPE_CHECKING,
     Any,
     Callable,
+    Iterable,
     Literal,
     Mapping,
     Sequence,
+    Tuple,
     Union,
     cast,
 )
+from xml.etree import ElementTree
+from xml.parsers.expat import ExpatError
+from xml.sax.saxutils import escape as xml_escape
+from xml.sax.saxutils import quoteattr as xml_quoteattr
 
 import cbor2  # type: ignore
 import colorama
+import hcl2  # type: ignore
+import hjson
+import json5
+import lark
+import nestedtext
 import tomlkit
+import tomlkit.exceptions
+import tomlkit.items
+import ubjson  # type: ignore
 from rich_argparse import RichHelpFormatter
 
 try:
@@ -37,11 +69,15 @@ except ModuleNotFoundError:
     import tomli as tomllib
 
 import ruamel.yaml
+import ruamel.yaml.constructor
+import ruamel.yaml.error
 import ruamel.yaml.parser
 import ruamel.yaml.representer
 import ruamel.yaml.scanner
 import umsgpack
 
+from remarshal.template import render_template
+
 if TYPE_CHECKING:
     from rich.style import StyleType
 
@@ -49,18 +85,49 @@ if TYPE_CHECKING:
 @dataclass(frozen=True)
 class YAMLOptions:
     indent: int = 2
+    split: bool = False
     style: Literal["", "'", '"', "|", ">"] = ""
     width: int = 80
 
 
 __all__ = [
+    "BSON_TYPES",
+    "CLIPBOARD",
+    "COERCE_TYPES",
+    "DATETIME_STYLES",
     "DEFAULT_MAX_VALUES",
+    "DOCUMENT_TYPES",
+    "DUPLICATE_KEY_POLICIES",
+    "FLATTEN_STYLES",
     "FORMATS",
+    "HCL_BLOCK_LABELS",
+    "INPUT_FORMATS",
+    "ION_FORMATS",
     "JSON_INDENT_TRUE",
+    "K8S_KIND_ORDER",
+    "KEY_CASES",
+    "KEY_POLICIES",
+    "NON_FINITE_STYLES",
+    "OUTPUT_FORMATS",
+    "PLIST_FORMATS",
     "RICH_ARGPARSE_STYLES",
+    "TOML_VERSIONS",
+    "URLENCODED_STYLES",
+    "XML_ATTRIBUTE_PREFIX",
+    "XML_CONVENTIONS",
+    "XML_TEXT_KEY",
+    "YAML_MERGE_STYLES",
+    "YAML_VERSIONS",
+    "CachedConverter",
+    "ConvertOptions",
+    "DecodeError",
+    "DecodeOptions",
     "Document",
+    "EncodeError",
+    "EncodeOptions",
     "TooManyValuesError",
     "YAMLOptions",
+    "convert",
     "decode",
     "encode",
     "identity",
@@ -69,14 +136,200 @@ __all__ = [
     "traverse",
 ]
 
+CLIPBOARD = "clipboard"
 CLI_DEFAULTS: dict[str, Any] = {
+    "asn1_schema": None,
+    "asn1_type": None,
+    "c_prefix": "",
+    "cbor_canonical": False,
+    "csv_columns": None,
+    "csv_delimiter": ",",
+    "go_package": None,
+    "go_var": None,
+    "hcl_expressions": False,
+    "ion_format": "text",
+    "json_canonical": False,
     "json_indent": None,
+    "json_non_finite": "error",
+    "jsonnet_ext_vars": None,
+    "jsonnet_path": None,
+    "k8s_kind_order": None,
+    "k8s_sort": False,
+    "lua_return": False,
+    "plist_format": "xml",
     "sort_keys": False,
+    "sql_table": "data",
+    "starlark_var": None,
     "stringify": False,
+    "toml_descriptions": None,
+    "toml_preserve_inline": False,
+    "toml_root_key": None,
+    "toml_version": "1.0",
+    "urlencoded_style": "bracket",
+    "xml_convention": "xmltodict",
+    "yaml_merge": "expand",
+    "yaml_version": "1.2",
 }
+BSON_TYPES = ("extended", "native", "string")
+COERCE_TYPES = ("bool", "float", "int", "string")
+DATETIME_STYLES = ("epoch", "native", "string")
 DEFAULT_MAX_VALUES = 1000000
-FORMATS = ["cbor", "json", "msgpack", "toml", "yaml"]
+DOCUMENT_TYPES = ("array", "bool", "null", "number", "object", "string")
+DUPLICATE_KEY_POLICIES = ("error", "first", "last")
+FLATTEN_STYLES = ("bracket", "dot")
+FORMATS = [
+    "bson",
+    "cbor",
+    "csv",
+    "gron",
+    "hcl",
+    "headers",
+    "hjson",
+    "ini",
+    "ion",
+    "json",
+    "jsonl",
+    "kdl",
+    "msgpack",
+    "nestedtext",
+    "plist",
+    "properties",
+    "reg",
+    "ron",
+    "sdl",
+    "smile",
+    "tnetstring",
+    "toml",
+    "tsv",
+    "ubjson",
+    "ucl",
+    "unit",
+    "urlencoded",
+    "xml",
+    "yaml",
+]
+INPUT_FORMATS = sorted([*FORMATS, "asn1", "json5", "jsonc", "jsonnet", "parquet"])
+ION_FORMATS = ("binary", "text")
+OUTPUT_FORMATS = sorted(
+    [*FORMATS, "cheader", "cue", "go", "lua", "pyliteral", "sql", "starlark"]
+)
+# File extensions that are not format names.
+EXTENSIONS = {
+    "automount": "unit",
+    "ber": "asn1",
+    "der": "asn1",
+    "desktop": "unit",
+    "h": "cheader",
+    "libsonnet": "jsonnet",
+    "mount": "unit",
+    "ndjson": "jsonl",
+    "netdev": "unit",
+    "network": "unit",
+    "nt": "nestedtext",
+    "pem": "asn1",
+    "service": "unit",
+    "slice": "unit",
+    "socket": "unit",
+    "target": "unit",
+    "tf": "hcl",
+    "tfvars": "hcl",
+    "timer": "unit",
+    "yml": "yaml",
+}
+# The number of labels of Terraform block types that have them.
+HCL_BLOCK_LABELS = {
+    "backend": 1,
+    "data": 2,
+    "dynamic": 1,
+    "module": 1,
+    "output": 1,
+    "provider": 1,
+    "provisioner": 1,
+    "resource": 2,
+    "variable": 1,
+}
 JSON_INDENT_TRUE = 4
+KEY_CASES = ("camel", "kebab", "pascal", "snake")
+KEY_POLICIES = ("error", "stringify")
+NON_FINITE_STYLES = ("error", "null", "string")
+PLIST_FORMATS = ("binary", "xml")
+TEXT_FORMATS = {
+    "csv",
+    "gron",
+    "hcl",
+    "headers",
+    "hjson",
+    "ini",
+    "json",
+    "json5",
+    "jsonc",
+    "jsonl",
+    "jsonnet",
+    "kdl",
+    "nestedtext",
+    "ron",
+    "sdl",
+    "toml",
+    "tsv",
+    "ucl",
+    "unit",
+    "urlencoded",
+    "yaml",
+}
+TOML_VERSIONS = ("0.4", "1.0", "1.1")
+URLENCODED_STYLES = ("bracket", "dot")
+YAML_MERGE_STYLES = ("error", "expand", "keep")
+YAML_VERSIONS = ("1.1", "1.2")
+XML_ATTRIBUTE_PREFIX = "@"
+XML_CONVENTIONS = ("badgerfish", "folded", "mxj", "xmltodict")
+XML_TEXT_KEY = "#text"
+# The attribute prefix and the text key of each XML convention.
+_XML_KEYS = {
+    "badgerfish": ("@", "$"),
+    "folded": (XML_ATTRIBUTE_PREFIX, XML_TEXT_KEY),
+    "mxj": ("-", XML_TEXT_KEY),
+    "xmltodict": (XML_ATTRIBUTE_PREFIX, XML_TEXT_KEY),
+}
+# The tag of array items in the "folded" XML convention.
+_XML_ITEM_TAG = "item"
+# The order in which Helm installs resources.
+K8S_KIND_ORDER = (
+    "Namespace",
+    "NetworkPolicy",
+    "ResourceQuota",
+    "LimitRange",
+    "PodSecurityPolicy",
+    "PodDisruptionBudget",
+    "ServiceAccount",
+    "Secret",
+    "SecretList",
+    "ConfigMap",
+    "StorageClass",
+    "PersistentVolume",
+    "PersistentVolumeClaim",
+    "CustomResourceDefinition",
+    "ClusterRole",
+    "ClusterRoleList",
+    "ClusterRoleBinding",
+    "ClusterRoleBindingList",
+    "Role",
+    "RoleList",
+    "RoleBinding",
+    "RoleBindingList",
+    "Service",
+    "DaemonSet",
+    "Pod",
+    "ReplicationController",
+    "ReplicaSet",
+    "Deployment",
+    "HorizontalPodAutoscaler",
+    "StatefulSet",
+    "Job",
+    "CronJob",
+    "IngressClass",
+    "Ingress",
+    "APIService",
+)
 UTF_8 = "utf-8"
 
 RICH_ARGPARSE_STYLES: dict[str, StyleType] = {
@@ -95,22 +348,233 @@ RICH_ARGPARSE_STYLES: dict[str, StyleType] = {
 
 
 def _argv0_to_format(argv0: str) -> tuple[str, str]:
-    possible_format = "(" + "|".join(FORMATS) + ")"
-    match = re.search("^" + possible_format + "2" + possible_format, argv0)
+    def possible_format(formats: Sequence[str]) -> str:
+        # Try longer names first, so a name is not matched by its prefix.
+        return "(" + "|".join(sorted(formats, key=len, reverse=True)) + ")"
+
+    match = re.search(
+        "^" + possible_format(INPUT_FORMATS) + "2" + possible_format(OUTPUT_FORMATS),
+        argv0,
+    )
     from_, to = match.groups() if match else ("", "")
     return from_, to
 
 
-def _extension_to_format(path: str) -> str:
+def _extension_to_format(path: str, formats: Sequence[str] = FORMATS) -> str:
     ext = Path(path).suffix[1:]
+    ext = EXTENSIONS.get(ext, ext)
+
+    return ext if ext in formats else ""
+
+
+def _load_file(path: str, kind: str) -> Document:
+    input_format = _extension_to_format(path, INPUT_FORMATS)
+    if input_format == "":
+        msg = f"cannot determine the format of {kind} file {path!r}"
+        raise argparse.ArgumentTypeError(msg)
+
+    try:
+        return decode(input_format, Path(path).read_bytes())
+    except (OSError, ValueError) as e:
+        msg = f"cannot read {kind} file {path!r} ({e})"
+        raise argparse.ArgumentTypeError(msg)
+
+
+def _load_descriptions(path: str) -> dict[str, str]:
+    doc = _load_file(path, "descriptions")
+    if not isinstance(doc, Mapping) or not all(
+        isinstance(k, str) and isinstance(v, str) for k, v in doc.items()
+    ):
+        msg = f"descriptions file {path!r} must map dotted keys to strings"
+        raise argparse.ArgumentTypeError(msg)
+
+    return dict(doc)
+
+
+def _load_renames(path: str) -> list[tuple[str, str]]:
+    doc = _load_file(path, "rename")
+    if not isinstance(doc, Mapping) or not all(
+        isinstance(k, str) and isinstance(v, str) for k, v in doc.items()
+    ):
+        msg = f"rename file {path!r} must map dotted paths to dotted paths"
+        raise argparse.ArgumentTypeError(msg)
+
+    return list(doc.items())
+
+
+def _parse_diff_command_line(argv: Sequence[str]) -> argparse.Namespace:
+    RichHelpFormatter.group_name_formatter = lambda x: x
+    RichHelpFormatter.styles = RICH_ARGPARSE_STYLES
+
+    parser = argparse.ArgumentParser(
+        description=(
+            "Compare two files, which can be in different formats, "
+            "and print the paths where their data differs."
+        ),
+        formatter_class=RichHelpFormatter,
+        prog="remarshal diff",
+    )
+
+    parser.add_argument("old", help=f'old file, "-" for stdin, or "{CLIPBOARD}"')
+    parser.add_argument("new", help=f'new file, "-" for stdin, or "{CLIPBOARD}"')
+
+    parser.add_argument(
+        "--old-format",
+        dest="old_format",
+        default="",
+        help="format of the old file",
+        choices=INPUT_FORMATS,
+    )
+    parser.add_argument(
+        "--new-format",
+        dest="new_format",
+        default="",
+        help="format of the new file",
+        choices=INPUT_FORMATS,
+    )
+
+    parser.add_argument(
+        "--json-patch",
+        dest="json_patch",
+        action="store_true",
+        help="output a JSON Patch (RFC 6902) that turns the old data into the new",
+    )
+    parser.add_argument(
+        "--of",
+        "--output-format",
+        "-t",
+        "--to",
+        dest="output_format",
+        default="json",
+        help='output format of "--json-patch"',
+        choices=OUTPUT_FORMATS,
+    )
+
+    args = parser.parse_args(args=argv)
+
+    for path, format_key in ((args.old, "old_format"), (args.new, "new_format")):
+        if vars(args)[format_key] == "":
+            vars(args)[format_key] = _extension_to_format(path, INPUT_FORMATS)
+            if vars(args)[format_key] == "":
+                parser.error(f"Need an explicit format for {path!r}")
+
+    return args
+
+
+def _parse_validate_command_line(argv: Sequence[str]) -> argparse.Namespace:
+    RichHelpFormatter.group_name_formatter = lambda x: x
+    RichHelpFormatter.styles = RICH_ARGPARSE_STYLES
+
+    parser = argparse.ArgumentParser(
+        description=(
+            "Check that files can be decoded and print the errors in those "
+            "that cannot."
+        ),
+        formatter_class=RichHelpFormatter,
+        prog="remarshal validate",
+    )
+
+    parser.add_argument(
+        "inputs",
+        metavar="input",
+        nargs="+",
+        help=f'input file, "-" for stdin, or "{CLIPBOARD}"',
+    )
+
+    parser.add_argument(
+        "--if",
+        "--input-format",
+        "-f",
+        "--from",
+        dest="input_format",
+        default="",
+        help="input format (default: from each file extension)",
+        choices=INPUT_FORMATS,
+    )
+
+    args = parser.parse_args(args=argv)
+
+    if args.input_format == "":
+        for path in args.inputs:
+            if _extension_to_format(path, INPUT_FORMATS) == "":
+                parser.error(f"Need an explicit input format for {path!r}")
+
+    return args
+
+
+def _parse_schema_command_line(argv: Sequence[str]) -> argparse.Namespace:
+    RichHelpFormatter.group_name_formatter = lambda x: x
+    RichHelpFormatter.styles = RICH_ARGPARSE_STYLES
+
+    parser = argparse.ArgumentParser(
+        description="Work with JSON Schema.",
+        formatter_class=RichHelpFormatter,
+        prog="remarshal schema",
+    )
+    subparsers = parser.add_subparsers(dest="command", required=True)
+
+    infer = subparsers.add_parser(
+        "infer",
+        description=(
+            "Generate a JSON Schema that describes the data in the input files. "
+            "Several files are samples of the same kind of data "
+            "and give one schema."
+        ),
+        formatter_class=RichHelpFormatter,
+        help="generate a JSON Schema from sample data",
+    )
+
+    infer.add_argument(
+        "inputs",
+        metavar="input",
+        nargs="*",
+        default=["-"],
+        help=f'input file, "-" for stdin, or "{CLIPBOARD}" (default: stdin)',
+    )
+
+    infer.add_argument(
+        "--each",
+        dest="each",
+        action="store_true",
+        help=(
+            "treat every element of a top-level array, "
+            "like every document in a YAML stream, as a sample"
+        ),
+    )
+    infer.add_argument(
+        "--if",
+        "--input-format",
+        "-f",
+        "--from",
+        dest="input_format",
+        default="",
+        help="input format",
+        choices=INPUT_FORMATS,
+    )
+    infer.add_argument(
+        "--of",
+        "--output-format",
+        "-t",
+        "--to",
+        dest="output_format",
+        default="json",
+        help="output format of the schema",
+        choices=OUTPUT_FORMATS,
+    )
+
+    args = parser.parse_args(args=argv)
 
-    if ext == "yml":
-        ext = "yaml"
+    if args.input_format == "":
+        for path in args.inputs:
+            if _extension_to_format(path, INPUT_FORMATS) == "":
+                parser.error(f"Need an explicit input format for {path!r}")
 
-    return ext if ext in FORMATS else ""
+    return args
 
 
-def _parse_command_line(argv: Sequence[str]) -> argparse.Namespace:  # noqa: C901.
+def _parse_command_line(  # noqa: C901, PLR0912, PLR0915.
+    argv: Sequence[str],
+) -> argparse.Namespace:
     me = Path(argv[0]).name
     argv0_from, argv0_to = _argv0_to_format(me)
     format_from_argv0 = argv0_to != ""
@@ -119,7 +583,14 @@ def _parse_command_line(argv: Sequence[str]) -> argparse.Namespace:  # noqa: C90
     RichHelpFormatter.styles = RICH_ARGPARSE_STYLES
 
     parser = argparse.ArgumentParser(
-        description="Convert between CBOR, JSON, MessagePack, TOML, and YAML.",
+        description=(
+            "Convert between ASN.1, BSON, CBOR, CSV, gron, HCL, HJSON, INI, Ion, "
+            "JSON, JSON5, JSONC, JSON Lines, Jsonnet, KDL, MessagePack, "
+            "NestedText, Parquet, plist, Java properties, RFC 822 headers, RON, "
+            "SDLang, Smile, systemd units, tnetstrings, TOML, TSV, UBJSON, UCL, "
+            "URL-encoded data, Windows Registry files, XML, and YAML, and output "
+            "C headers, CUE, Go, Lua, Python, SQL, and Starlark."
+        ),
         formatter_class=RichHelpFormatter,
         prog="remarshal",
     )
@@ -131,14 +602,16 @@ def _parse_command_line(argv: Sequence[str]) -> argparse.Namespace:  # noqa: C90
     )
 
     input_group = parser.add_mutually_exclusive_group()
-    input_group.add_argument("input", nargs="?", default="-", help="input file")
+    input_group.add_argument(
+        "input", nargs="?", default="-", help=f'input file or "{CLIPBOARD}"'
+    )
     input_group.add_argument(
         "-i",
         "--input",
         dest="input_flag",
         metavar="<input>",
         default=None,
-        help="input file",
+        help=f'input file or "{CLIPBOARD}"',
     )
 
     if not format_from_argv0:
@@ -150,650 +623,9770 @@ def _parse_command_line(argv: Sequence[str]) -> argparse.Namespace:  # noqa: C90
             dest="input_format",
             default="",
             help="input format",
-            choices=FORMATS,
+            choices=INPUT_FORMATS,
         )
         parser.add_argument(
             "-if",
             dest="input_format",
             default="",
             help=argparse.SUPPRESS,
-            choices=FORMATS,
-        )
-
-    if not format_from_argv0 or argv0_to == "json":
-        parser.add_argument(
-            "--json-indent",
-            dest="json_indent",
-            metavar="<n>",
-            type=int,
-            default=CLI_DEFAULTS["json_indent"],
-            help="JSON indentation",
-        )
-        parser.add_argument(
-            "--indent-json",
-            dest="json_indent",
-            type=int,
-            help=argparse.SUPPRESS,
-        )
-
-    if not format_from_argv0 or argv0_to in {"json", "toml"}:
-        parser.add_argument(
-            "-k",
-            "--stringify",
-            dest="stringify",
-            action="store_true",
-            help=(
-                "turn into strings: boolean and null keys and date-time keys "
-                "and values for JSON; boolean, date-time, and null keys and "
-                "null values for TOML"
-            ),
+            choices=INPUT_FORMATS,
         )
 
     parser.add_argument(
-        "--max-values",
-        dest="max_values",
-        metavar="<n>",
-        type=int,
-        default=DEFAULT_MAX_VALUES,
+        "--bson-types",
+        dest="bson_types",
+        default="native",
         help=(
-            "maximum number of values in input data (default %(default)s, "
-            "negative for unlimited)"
+            "how to convert BSON ObjectId, date-time, and binary values: "
+            "ObjectIds as strings and the rest as is, "
+            "MongoDB Extended JSON, or all as strings"
         ),
+        choices=BSON_TYPES,
     )
 
-    output_group = parser.add_mutually_exclusive_group()
-    output_group.add_argument("output", nargs="?", default="-", help="output file")
-    output_group.add_argument(
-        "-o",
-        "--output",
-        dest="output_flag",
-        metavar="<output>",
-        default=None,
-        help="output file",
+    parser.add_argument(
+        "--all-properties",
+        dest="all_properties",
+        action="store_true",
+        help='include optional properties with "--from-schema"',
     )
 
-    if not format_from_argv0:
-        parser.add_argument(
-            "--of",
-            "--output-format",
-            "-t",
-            "--to",
-            dest="output_format",
-            default="",
-            help="output format",
-            choices=FORMATS,
-        )
-        parser.add_argument(
-            "-of",
-            dest="output_format",
-            default="",
-            help=argparse.SUPPRESS,
-            choices=FORMATS,
-        )
+    def coerce_rules(value: str) -> list[tuple[str, str]]:
+        rules = []
+
+        for rule in value.split(","):
+            path, sep, type_name = rule.partition("=")
+            if not sep or not path:
+                msg = f"expected <path>=<type>, got {rule!r}"
+                raise argparse.ArgumentTypeError(msg)
+            if type_name not in COERCE_TYPES:
+                msg = (
+                    f"unknown type {type_name!r} "
+                    f"(choose from {', '.join(COERCE_TYPES)})"
+                )
+                raise argparse.ArgumentTypeError(msg)
+
+            rules.append((path, type_name))
+
+        return rules
 
     parser.add_argument(
-        "-p",
-        "--preserve-key-order",
-        help=argparse.SUPPRESS,
+        "--coerce",
+        dest="coerce",
+        metavar="<path>=<type>",
+        type=coerce_rules,
+        action="append",
+        default=None,
+        help=(
+            "convert the value at a dotted path to bool, float, int, or string; "
+            "repeat or separate rules with commas"
+        ),
     )
 
-    if not format_from_argv0 or argv0_to in {"json", "toml", "yaml"}:
-        parser.add_argument(
-            "-s",
-            "--sort-keys",
-            action="store_true",
-            help="sort JSON and TOML keys instead of preserving key order",
-        )
+    parser.add_argument(
+        "--coerce-types",
+        dest="coerce_types",
+        action="store_true",
+        help=(
+            "turn strings that look like numbers, booleans, or null into them "
+            "in any input"
+        ),
+    )
 
     parser.add_argument(
-        "--unwrap",
-        dest="unwrap",
-        metavar="<key>",
+        "--cue",
+        dest="cue_schema",
+        metavar="<file>[#<definition>]",
         default=None,
-        help="only output the data stored under the given key",
+        help=(
+            "validate the data against a CUE file or a definition in it "
+            'like "schema.cue#Config" with the program "cue"'
+        ),
     )
 
     parser.add_argument(
-        "--verbose",
+        "--cast-schema",
+        dest="cast_schema",
+        metavar="<file>",
+        type=lambda path: _load_file(path, "schema"),
+        default=None,
+        help="convert values to the types a JSON Schema declares for them",
+    )
+
+    def float_format(value: str) -> str:
+        try:
+            _reformat_float(1.0, float_format=value)
+        except ValueError as e:
+            raise argparse.ArgumentTypeError(str(e))
+
+        return value
+
+    parser.add_argument(
+        "--dedup-arrays",
+        dest="dedup_arrays",
         action="store_true",
-        dest="verbose",
-        help="print debug information when an error occurs",
+        help="remove repeated elements from arrays of scalars",
     )
 
     parser.add_argument(
-        "--wrap",
-        dest="wrap",
-        metavar="<key>",
+        "--dedup-objects",
+        dest="dedup_objects",
+        action="store_true",
+        help="also remove repeated elements from arrays of arrays or maps",
+    )
+    parser.add_argument(
+        "--dedup-path",
+        dest="dedup_paths",
+        metavar="<path>",
+        action="append",
         default=None,
-        help="wrap the data in a map type with the given key",
+        help=(
+            "remove repeated elements, including arrays and maps, "
+            "from the array at a dotted path (can be repeated)"
+        ),
     )
 
-    if not format_from_argv0 or argv0_to == "yaml":
-        parser.add_argument(
-            "--yaml-indent",
-            dest="yaml_indent",
-            metavar="<n>",
-            type=int,
-            default=YAMLOptions().indent,
-            help="YAML indentation",
-        )
-        parser.add_argument(
-            "--yaml-style",
-            dest="yaml_style",
-            default=YAMLOptions().style,
-            help="YAML formatting style",
-            choices=["", "'", '"', "|", ">"],
-        )
-
-        def yaml_width(value: str) -> int:
-            # This is theoretically compatible with LibYAML.
-            return (1 << 32) - 1 if value.lower() == "inf" else int(value)
+    parser.add_argument(
+        "--sort-arrays",
+        dest="sort_arrays",
+        action="store_true",
+        help="sort arrays of scalars",
+    )
 
-        parser.add_argument(
-            "--yaml-width",
-            dest="yaml_width",
-            metavar="<n>",
-            type=yaml_width,  # Allow "inf".
-            default=YAMLOptions().width,
-            help="YAML line width for long strings",
-        )
+    def sort_path(value: str) -> tuple[str, str | None]:
+        path, sep, key = value.partition("=")
+        if not path or (sep and not key):
+            msg = f"expected <path> or <path>=<key>, got {value!r}"
+            raise argparse.ArgumentTypeError(msg)
 
-    colorama.init()
-    args = parser.parse_args(args=argv[1:])
+        return path, key if sep else None
 
-    # Use the positional input and output arguments.
-    if args.input_flag is not None:
-        args.input = args.input_flag
+    parser.add_argument(
+        "--sort-path",
+        dest="sort_paths",
+        metavar="<path>[=<key>]",
+        type=sort_path,
+        action="append",
+        default=None,
+        help=(
+            "sort the array at a dotted path, "
+            "or an array of maps by the value of a key (can be repeated)"
+        ),
+    )
 
-    if args.output_flag is not None:
-        args.output = args.output_flag
+    parser.add_argument(
+        "--delete",
+        dest="delete",
+        metavar="<path>",
+        action="append",
+        default=None,
+        help="remove the key or array element at a dotted path (can be repeated)",
+    )
+    parser.add_argument(
+        "--keep",
+        dest="keep",
+        metavar="<path>",
+        action="append",
+        default=None,
+        help="remove everything but the values at dotted paths (can be repeated)",
+    )
 
-    # Determine the implicit input and output format if possible.
-    if format_from_argv0:
-        args.input_format = argv0_from
-        args.output_format = argv0_to
-    else:
-        if args.input_format == "":
-            args.input_format = _extension_to_format(args.input)
-            if args.input_format == "":
-                parser.error("Need an explicit input format")
+    def pair_keys(value: str) -> tuple[str, str]:
+        name, _, value_key = value.partition(",")
+        if not name or not value_key or name == value_key:
+            msg = f"expected two different keys like name,value, got {value!r}"
+            raise argparse.ArgumentTypeError(msg)
 
-        if args.output_format == "":
-            args.output_format = _extension_to_format(args.output)
-            if args.output_format == "":
-                parser.error("Need an explicit output format")
+        return name, value_key
 
-    for key, value in CLI_DEFAULTS.items():
-        vars(args).setdefault(key, value)
+    def map_path(value: str) -> tuple[str, str, str]:
+        path, sep, keys = value.partition("=")
+        if not path:
+            msg = f"expected <path> or <path>=<name>,<value>, got {value!r}"
+            raise argparse.ArgumentTypeError(msg)
 
-    # Wrap `yaml_*` options in `YAMLOptions` if they are present.
-    vars(args)["yaml_options"] = YAMLOptions()
+        return (path, *(pair_keys(keys) if sep else ("name", "value")))
 
-    if "yaml_indent" in vars(args):
+    parser.add_argument(
+        "--pairs-to-map",
+        dest="pairs_to_map",
+        metavar="<name>,<value>",
+        type=pair_keys,
+        default=None,
+        help=(
+            "turn arrays of maps with only the given two keys, "
+            "like [{name: a, value: 1}], into maps like {a: 1}"
+        ),
+    )
+    parser.add_argument(
+        "--map-to-pairs",
+        dest="map_to_pairs",
+        metavar="<path>[=<name>,<value>]",
+        type=map_path,
+        action="append",
+        default=None,
+        help=(
+            "turn the map at a dotted path into an array of maps "
+            'with the keys "name" and "value" or the given keys (can be repeated)'
+        ),
+    )
+
+    def regex(value: str) -> str:
+        try:
+            re.compile(value)
+        except re.error as e:
+            msg = f"invalid regular expression {value!r} ({e})"
+            raise argparse.ArgumentTypeError(msg)
+
+        return value
+
+    parser.add_argument(
+        "--redact",
+        dest="redact",
+        metavar="<regex>",
+        type=regex,
+        action="append",
+        default=None,
+        help=(
+            "replace the values at dotted paths that match a regular expression "
+            "with a placeholder (can be repeated)"
+        ),
+    )
+    parser.add_argument(
+        "--redact-placeholder",
+        dest="redact_placeholder",
+        metavar="<text>",
+        default="***",
+        help='text to replace redacted values with (default: "***")',
+    )
+
+    parser.add_argument(
+        "--defaults",
+        dest="defaults",
+        metavar="<file>",
+        type=lambda path: _load_file(path, "defaults"),
+        action="append",
+        default=None,
+        help=(
+            "fill in keys missing from the input from a file in any input format "
+            "(can be repeated)"
+        ),
+    )
+    parser.add_argument(
+        "--merge",
+        dest="merge",
+        metavar="<file>",
+        type=lambda path: _load_file(path, "merge"),
+        action="append",
+        default=None,
+        help="merge a file in any input format over the input (can be repeated)",
+    )
+
+    parser.add_argument(
+        "--patch",
+        dest="patch",
+        metavar="<file>",
+        type=lambda path: _load_file(path, "patch"),
+        action="append",
+        default=None,
+        help=(
+            "apply a JSON Patch (RFC 6902) in any input format to the input "
+            "(can be repeated)"
+        ),
+    )
+
+    parser.add_argument(
+        "--merge-patch",
+        dest="merge_patch",
+        metavar="<file>",
+        type=lambda path: _load_file(path, "merge patch"),
+        action="append",
+        default=None,
+        help=(
+            "apply a JSON Merge Patch (RFC 7386) in any input format to the input "
+            "(can be repeated)"
+        ),
+    )
+
+    def array_merge(value: str) -> str:
+        try:
+            _merge_arrays([], [], strategy=value)
+        except ValueError as e:
+            raise argparse.ArgumentTypeError(str(e))
+
+        return value
+
+    parser.add_argument(
+        "--array-merge",
+        dest="array_merge",
+        metavar="<strategy>",
+        type=array_merge,
+        default="replace",
+        help=(
+            'how "--merge" combines arrays: "append", "merge-by-index", '
+            '"merge-by-key=<key>", or "replace" (default)'
+        ),
+    )
+
+    def rename_rule(value: str) -> tuple[str, str]:
+        old, sep, new = value.partition("=")
+        if not sep or not old or not new:
+            msg = f"expected <old>=<new>, got {value!r}"
+            raise argparse.ArgumentTypeError(msg)
+
+        return old, new
+
+    parser.add_argument(
+        "--rename",
+        dest="rename",
+        metavar="<old>=<new>",
+        type=rename_rule,
+        action="append",
+        default=None,
+        help="move the value at a dotted path to another path (can be repeated)",
+    )
+    parser.add_argument(
+        "--rename-file",
+        dest="rename",
+        metavar="<file>",
+        type=_load_renames,
+        action="extend",
+        default=None,
+        help="file that maps dotted paths to the paths to move their values to",
+    )
+
+    parser.add_argument(
+        "--expand-env",
+        dest="expand_env",
+        action="store_true",
+        help='replace "$VAR", "${VAR}", and "${VAR:-default}" in string values',
+    )
+
+    parser.add_argument(
+        "--force",
+        action="store_true",
+        help="write the output file even if its content would not change",
+    )
+
+    parser.add_argument(
+        "--from-schema",
+        dest="from_schema",
+        action="store_true",
+        help="treat the input as a JSON Schema and output an example document",
+    )
+
+    parser.add_argument(
+        "--big-numbers",
+        dest="big_numbers",
+        action="store_true",
+        help=(
+            "read decimal numbers from JSON, JSON5, TOML, and YAML exactly "
+            "and write them without an exponent"
+        ),
+    )
+    parser.add_argument(
+        "--float-format",
+        dest="float_format",
+        metavar="<format>",
+        type=float_format,
+        default=None,
+        help='round floating-point values with a printf-style format like "%%.6g"',
+    )
+    parser.add_argument(
+        "--datetime",
+        dest="datetime_style",
+        default="native",
+        help=(
+            "keep dates and times as they are, turn them into RFC 3339 strings, "
+            "or turn dates and date-times into Unix timestamps"
+        ),
+        choices=DATETIME_STYLES,
+    )
+
+    if not format_from_argv0 or argv0_from == "asn1":
+        parser.add_argument(
+            "--asn1-schema",
+            dest="asn1_schema",
+            metavar="<file>",
+            action="append",
+            default=CLI_DEFAULTS["asn1_schema"],
+            help="decode ASN.1 with the types in this module (can be repeated)",
+        )
+        parser.add_argument(
+            "--asn1-type",
+            dest="asn1_type",
+            metavar="<type>",
+            default=CLI_DEFAULTS["asn1_type"],
+            help="ASN.1 type of the input for --asn1-schema",
+        )
+
+    if not format_from_argv0 or argv0_to == "cheader":
+        parser.add_argument(
+            "--c-prefix",
+            dest="c_prefix",
+            metavar="<prefix>",
+            default="",
+            help='prefix for C header constant names, like "CONFIG_"',
+        )
+
+    def identifier(value: str) -> str:
+        if not value.isidentifier():
+            msg = f"not an identifier: {value!r}"
+            raise argparse.ArgumentTypeError(msg)
+        return value
+
+    if not format_from_argv0 or argv0_to == "go":
+        parser.add_argument(
+            "--go-package",
+            dest="go_package",
+            metavar="<name>",
+            type=identifier,
+            default=CLI_DEFAULTS["go_package"],
+            help="write Go output as a source file in this package",
+        )
+
+        parser.add_argument(
+            "--go-var",
+            dest="go_var",
+            metavar="<name>",
+            type=identifier,
+            default=CLI_DEFAULTS["go_var"],
+            help='assign Go output to this variable (default with a package: "Data")',
+        )
+
+    def csv_delimiter(value: str) -> str:
+        value = "\t" if value == "\\t" else value
+        if len(value) != 1:
+            msg = "delimiter must be a single character or \"\\t\""
+            raise argparse.ArgumentTypeError(msg)
+
+        return value
+
+    def jsonnet_ext_var(value: str) -> tuple[str, str]:
+        name, sep, var = value.partition("=")
+        if not name:
+            msg = f"expected <name>[=<value>], got {value!r}"
+            raise argparse.ArgumentTypeError(msg)
+        # Like `jsonnet --ext-str`, a name alone takes the value from the environment.
+        if not sep:
+            if name not in os.environ:
+                msg = f"environment variable {name!r} is not set"
+                raise argparse.ArgumentTypeError(msg)
+            var = os.environ[name]
+
+        return name, var
+
+    if not format_from_argv0 or argv0_from == "jsonnet":
+        parser.add_argument(
+            "--jsonnet-ext-var",
+            dest="jsonnet_ext_vars",
+            metavar="<name>[=<value>]",
+            type=jsonnet_ext_var,
+            action="append",
+            default=CLI_DEFAULTS["jsonnet_ext_vars"],
+            help="set a Jsonnet external variable for std.extVar (can be repeated)",
+        )
+
+        parser.add_argument(
+            "--jsonnet-path",
+            dest="jsonnet_path",
+            metavar="<dir>",
+            action="append",
+            default=CLI_DEFAULTS["jsonnet_path"],
+            help="add a Jsonnet library search directory (can be repeated)",
+        )
+
+    if not format_from_argv0 or argv0_to in {"csv", "tsv"}:
+        parser.add_argument(
+            "--csv-columns",
+            dest="csv_columns",
+            metavar="<columns>",
+            type=lambda value: tuple(column.strip() for column in value.split(",")),
+            default=CLI_DEFAULTS["csv_columns"],
+            help=(
+                "comma-separated CSV columns to put first "
+                "(the rest follow in the order they appear)"
+            ),
+        )
+
+    if not format_from_argv0 or "csv" in {argv0_from, argv0_to}:
+        parser.add_argument(
+            "--csv-delimiter",
+            dest="csv_delimiter",
+            metavar="<char>",
+            type=csv_delimiter,
+            default=CLI_DEFAULTS["csv_delimiter"],
+            help='CSV field delimiter ("\\t" for tab)',
+        )
+
+    if not format_from_argv0 or argv0_to == "hcl":
+        parser.add_argument(
+            "--hcl-expressions",
+            dest="hcl_expressions",
+            action="store_true",
+            help=(
+                'write strings like "${var.x}" as HCL expressions '
+                "and keep templates in other strings (default for HCL input)"
+            ),
+        )
+
+    if not format_from_argv0 or argv0_to == "ion":
+        parser.add_argument(
+            "--ion-format",
+            dest="ion_format",
+            default=CLI_DEFAULTS["ion_format"],
+            help="Amazon Ion output encoding",
+            choices=ION_FORMATS,
+        )
+
+    if not format_from_argv0 or argv0_to == "lua":
+        parser.add_argument(
+            "--lua-return",
+            dest="lua_return",
+            action="store_true",
+            help='start Lua output with "return" to make it a module',
+        )
+
+    if not format_from_argv0 or argv0_to == "starlark":
+        parser.add_argument(
+            "--starlark-var",
+            dest="starlark_var",
+            metavar="<name>",
+            type=identifier,
+            default=CLI_DEFAULTS["starlark_var"],
+            help="assign Starlark output to this variable for a .bzl file",
+        )
+
+    if not format_from_argv0 or argv0_to == "sql":
+        parser.add_argument(
+            "--sql-table",
+            dest="sql_table",
+            metavar="<name>",
+            default=CLI_DEFAULTS["sql_table"],
+            help='table for SQL INSERT statements, like "public.users"',
+        )
+
+    if not format_from_argv0 or argv0_to == "plist":
+        parser.add_argument(
+            "--plist-format",
+            dest="plist_format",
+            default=CLI_DEFAULTS["plist_format"],
+            help="property list output encoding",
+            choices=PLIST_FORMATS,
+        )
+
+    if not format_from_argv0 or argv0_to == "urlencoded":
+        parser.add_argument(
+            "--urlencoded-style",
+            dest="urlencoded_style",
+            default=CLI_DEFAULTS["urlencoded_style"],
+            help='nested URL-encoded keys like "a[b][0]" or like "a.b.0"',
+            choices=URLENCODED_STYLES,
+        )
+
+    flatten_group = parser.add_mutually_exclusive_group()
+    flatten_group.add_argument(
+        "--flatten",
+        action="store_true",
+        help='flatten nested data into a map with dotted keys like "a.0.b"',
+    )
+    flatten_group.add_argument(
+        "--unflatten",
+        action="store_true",
+        help="turn a map with dotted keys into nested data",
+    )
+    parser.add_argument(
+        "--flatten-style",
+        dest="flatten_style",
+        default="dot",
+        help='flat keys for array elements like "a.0.b" or like "a[0].b"',
+        choices=FLATTEN_STYLES,
+    )
+
+    parser.add_argument(
+        "--infer-types",
+        dest="infer_types",
+        action="store_true",
+        help=(
+            "turn strings that look like numbers or booleans into them "
+            "in CSV, INI, NestedText, Java properties, TSV, unit-file, "
+            "and URL-encoded input"
+        ),
+    )
+
+    if not format_from_argv0 or argv0_to == "cbor":
+        parser.add_argument(
+            "--cbor-canonical",
+            dest="cbor_canonical",
+            action="store_true",
+            help="output deterministic CBOR (RFC 8949) to hash or sign",
+        )
+
+    if not format_from_argv0 or argv0_to == "json":
+        parser.add_argument(
+            "--json-indent",
+            dest="json_indent",
+            metavar="<n>",
+            type=int,
+            default=CLI_DEFAULTS["json_indent"],
+            help="JSON indentation",
+        )
+        parser.add_argument(
+            "--indent-json",
+            dest="json_indent",
+            type=int,
+            help=argparse.SUPPRESS,
+        )
+        parser.add_argument(
+            "--canonical",
+            dest="json_canonical",
+            action="store_true",
+            help="output canonical JSON (RFC 8785) to hash or sign",
+        )
+
+    if not format_from_argv0 or argv0_to in {"json", "jsonl"}:
+        parser.add_argument(
+            "--non-finite",
+            dest="json_non_finite",
+            default=CLI_DEFAULTS["json_non_finite"],
+            help=(
+                "fail on NaN and infinity in JSON output, "
+                'or turn them into null or strings like "Infinity"'
+            ),
+            choices=NON_FINITE_STYLES,
+        )
+
+    if not format_from_argv0 or argv0_to in {
+        "gron",
+        "json",
+        "jsonl",
+        "smile",
+        "tnetstring",
+        "toml",
+        "ubjson",
+    }:
+        parser.add_argument(
+            "-k",
+            "--stringify",
+            dest="stringify",
+            action="store_true",
+            help=(
+                "turn into strings: boolean and null keys and date-time keys "
+                "and values for gron, JSON, JSON Lines, Smile, tnetstrings, "
+                "and UBJSON; "
+                "boolean, date-time, and null keys and null values for TOML"
+            ),
+        )
+
+    if not format_from_argv0 or argv0_to == "toml":
+        parser.add_argument(
+            "--descriptions",
+            dest="toml_descriptions",
+            metavar="<file>",
+            type=_load_descriptions,
+            default=None,
+            help=(
+                "file that maps dotted keys to descriptions "
+                "to emit as TOML comments"
+            ),
+        )
+
+    if not format_from_argv0 or argv0_to == "yaml":
+        parser.add_argument(
+            "--k8s-kind-order",
+            dest="k8s_kind_order",
+            metavar="<kinds>",
+            type=lambda value: tuple(kind.strip() for kind in value.split(",")),
+            default=None,
+            help=(
+                "comma-separated order of resource kinds for --k8s-sort "
+                "(default: Helm install order)"
+            ),
+        )
+        parser.add_argument(
+            "--k8s-sort",
+            dest="k8s_sort",
+            action="store_true",
+            help=(
+                "output an array of Kubernetes resources as YAML documents "
+                "sorted by kind"
+            ),
+        )
+
+    parser.add_argument(
+        "--error-format",
+        dest="error_format",
+        default="text",
+        help="format of error messages (default %(default)s)",
+        choices=["json", "text"],
+    )
+
+    parser.add_argument(
+        "--max-values",
+        dest="max_values",
+        metavar="<n>",
+        type=int,
+        default=DEFAULT_MAX_VALUES,
+        help=(
+            "maximum number of values in input data (default %(default)s, "
+            "negative for unlimited)"
+        ),
+    )
+
+    output_group = parser.add_mutually_exclusive_group()
+    output_group.add_argument(
+        "output", nargs="?", default="-", help=f'output file or "{CLIPBOARD}"'
+    )
+    output_group.add_argument(
+        "-o",
+        "--output",
+        dest="output_flag",
+        metavar="<output>",
+        default=None,
+        help=f'output file or "{CLIPBOARD}"',
+    )
+
+    if not format_from_argv0:
+        parser.add_argument(
+            "--of",
+            "--output-format",
+            "-t",
+            "--to",
+            dest="output_format",
+            default="",
+            help="output format",
+            choices=OUTPUT_FORMATS,
+        )
+        parser.add_argument(
+            "-of",
+            dest="output_format",
+            default="",
+            help=argparse.SUPPRESS,
+            choices=OUTPUT_FORMATS,
+        )
+
+    parser.add_argument(
+        "-p",
+        "--preserve-key-order",
+        help=argparse.SUPPRESS,
+    )
+
+    parser.add_argument(
+        "-q",
+        "--query",
+        dest="query",
+        metavar="<expression>",
+        default=None,
+        help="transform the data with a jq expression like '.items[].name'",
+    )
+    parser.add_argument(
+        "--query-all",
+        dest="query_all",
+        action="store_true",
+        help="put all results of the query in an array, even one or none",
+    )
+    parser.add_argument(
+        "--filter",
+        dest="filter_commands",
+        metavar="<command>",
+        action="append",
+        default=None,
+        help=(
+            "pipe the data as JSON through a shell command "
+            "and use the JSON it outputs, once for all YAML documents "
+            "(can be repeated)"
+        ),
+    )
+
+    def positive_int(value: str) -> int:
+        n = int(value)
+        if n < 1:
+            msg = f"must be positive, got {n}"
+            raise argparse.ArgumentTypeError(msg)
+
+        return n
+
+    parser.add_argument(
+        "--sample",
+        dest="sample",
+        metavar="<n>",
+        type=positive_int,
+        default=None,
+        help=(
+            "only output n elements of a top-level array or map "
+            "spread evenly from the first to the last"
+        ),
+    )
+
+    parser.add_argument(
+        "--sanitize-utf8",
+        dest="sanitize_utf8",
+        action="store_true",
+        help="replace invalid UTF-8 in input text and strings with U+FFFD",
+    )
+
+    parser.add_argument(
+        "--key-case",
+        dest="key_case",
+        default=None,
+        help=(
+            "convert every map key to camelCase, kebab-case, PascalCase, "
+            "or snake_case"
+        ),
+        choices=KEY_CASES,
+    )
+    parser.add_argument(
+        "--key-policy",
+        dest="key_policy",
+        default=None,
+        help=(
+            "turn map keys that are not strings, like numbers, booleans, "
+            "and YAML sequences, into strings, or fail on them"
+        ),
+        choices=KEY_POLICIES,
+    )
+
+    parser.add_argument(
+        "--select-type",
+        dest="select_type",
+        default=None,
+        help="only output values of the given type and the keys leading to them",
+        choices=DOCUMENT_TYPES,
+    )
+
+    def path_value(value: str, *, typed: bool) -> tuple[str, Any]:
+        path, sep, text = value.partition("=")
+        if not sep or not path:
+            msg = f"expected <path>=<value>, got {value!r}"
+            raise argparse.ArgumentTypeError(msg)
+
+        if typed:
+            # Values that are not JSON, like "1.2.3", stay strings.
+            with contextlib.suppress(json.JSONDecodeError):
+                return path, json.loads(text)
+
+        return path, text
+
+    parser.add_argument(
+        "--set",
+        dest="set_values",
+        metavar="<path>=<value>",
+        type=lambda value: path_value(value, typed=True),
+        action="append",
+        default=None,
+        help=(
+            "set the value at a dotted path, parsed as JSON if possible "
+            "(can be repeated)"
+        ),
+    )
+    parser.add_argument(
+        "--set-string",
+        dest="set_values",
+        metavar="<path>=<value>",
+        type=lambda value: path_value(value, typed=False),
+        action="append",
+        default=None,
+        help="set the value at a dotted path to a string (can be repeated)",
+    )
+
+    if not format_from_argv0 or argv0_to in {
+        "csv",
+        "cue",
+        "go",
+        "gron",
+        "hcl",
+        "headers",
+        "hjson",
+        "ini",
+        "ion",
+        "json",
+        "jsonl",
+        "kdl",
+        "lua",
+        "nestedtext",
+        "plist",
+        "properties",
+        "pyliteral",
+        "reg",
+        "ron",
+        "sdl",
+        "smile",
+        "sql",
+        "starlark",
+        "tnetstring",
+        "toml",
+        "tsv",
+        "ubjson",
+        "ucl",
+        "unit",
+        "urlencoded",
+        "xml",
+        "yaml",
+    }:
+        parser.add_argument(
+            "-s",
+            "--sort-keys",
+            action="store_true",
+            help="sort JSON and TOML keys instead of preserving key order",
+        )
+
+    if not format_from_argv0 or (argv0_from, argv0_to) == ("toml", "toml"):
+        parser.add_argument(
+            "--toml-preserve-inline",
+            dest="toml_preserve_inline",
+            action="store_true",
+            help="keep inline tables inline when converting TOML to TOML",
+        )
+
+    if not format_from_argv0 or "toml" in {argv0_from, argv0_to}:
+        parser.add_argument(
+            "--toml-version",
+            dest="toml_version",
+            default=CLI_DEFAULTS["toml_version"],
+            help="TOML specification version to read and write",
+            choices=TOML_VERSIONS,
+        )
+
+    if not format_from_argv0 or argv0_to == "toml":
+        parser.add_argument(
+            "--toml-root-key",
+            dest="toml_root_key",
+            metavar="<key>",
+            default=CLI_DEFAULTS["toml_root_key"],
+            help=(
+                "wrap a top-level value that is not a map under this key "
+                'for TOML output (default: "items" for an array, else "value")'
+            ),
+        )
+
+    parser.add_argument(
+        "--stringify-all",
+        dest="stringify_all",
+        action="store_true",
+        help=(
+            "turn every boolean, date-time, and number value into a string "
+            "and null into an empty string"
+        ),
+    )
+
+    parser.add_argument(
+        "--strip-empty",
+        dest="strip_empty",
+        action="store_true",
+        help="remove empty strings, arrays, and maps from arrays and maps",
+    )
+    parser.add_argument(
+        "--strip-nulls",
+        dest="strip_nulls",
+        action="store_true",
+        help="remove null values from arrays and maps",
+    )
+
+    parser.add_argument(
+        "--template",
+        dest="template",
+        action="store_true",
+        help="render the input as a Go text/template before decoding it",
+    )
+    parser.add_argument(
+        "--template-values",
+        dest="template_values",
+        metavar="<file>",
+        type=lambda path: _load_file(path, "template values"),
+        default=None,
+        help='file in any input format to use as the data of "--template"',
+    )
+
+    parser.add_argument(
+        "--trim-strings",
+        dest="trim_strings",
+        action="store_true",
+        help="remove leading and trailing whitespace from string values",
+    )
+
+    unwrap_group = parser.add_mutually_exclusive_group()
+    unwrap_group.add_argument(
+        "--unwrap",
+        dest="unwrap",
+        metavar="<key>",
+        default=None,
+        help='only output the data stored under the given key or path like "a.b"',
+    )
+    unwrap_group.add_argument(
+        "--unwrap-pointer",
+        dest="unwrap_pointer",
+        metavar="<pointer>",
+        default=None,
+        help='only output the value at a JSON Pointer like "/spec/containers/0"',
+    )
+
+    parser.add_argument(
+        "--verbose",
+        action="store_true",
+        dest="verbose",
+        help="print debug information when an error occurs",
+    )
+
+    parser.add_argument(
+        "--watch",
+        action="store_true",
+        dest="watch",
+        help="convert again every time the input file changes",
+    )
+
+    parser.add_argument(
+        "--duplicate-keys",
+        dest="duplicate_keys",
+        default=None,
+        help=(
+            "fail on duplicate keys in HJSON, JSON, JSON Lines, JSON5, JSONC, and YAML "
+            "input, or keep the first or the last value "
+            "(default: last for the JSON formats, error for YAML)"
+        ),
+        choices=DUPLICATE_KEY_POLICIES,
+    )
+
+    parser.add_argument(
+        "--strict",
+        dest="strict",
+        action="store_true",
+        help=(
+            "fail instead of losing data, like on duplicate JSON and JSON5 keys, "
+            "null in TOML, dates that would become strings, "
+            "or integers too large for the output"
+        ),
+    )
+
+    parser.add_argument(
+        "--verify-roundtrip",
+        dest="verify_roundtrip",
+        action="store_true",
+        help=(
+            "read the output back and fail if it does not have the same data, "
+            "like when dates become strings"
+        ),
+    )
+
+    parser.add_argument(
+        "--check-syntax",
+        dest="check_syntax",
+        action="store_true",
+        help="only decode the input to check it and write no output",
+    )
+
+    parser.add_argument(
+        "--wrap",
+        dest="wrap",
+        metavar="<key>",
+        default=None,
+        help='wrap the data in a map type with the given key or path like "a.b"',
+    )
+
+    def doc_selector(value: str) -> int | tuple[str, Any]:
+        if re.fullmatch(r"-?[0-9]+", value):
+            return int(value)
+
+        return path_value(value, typed=True)
+
+    parser.add_argument(
+        "--doc",
+        dest="doc",
+        metavar="<n>|<path>=<value>",
+        type=doc_selector,
+        default=None,
+        help=(
+            "only convert one YAML document or element of a top-level array: "
+            "the n-th from 0 or the first with the value at a dotted path"
+        ),
+    )
+
+    parser.add_argument(
+        "--yaml-stream",
+        dest="yaml_stream",
+        action="store_true",
+        help=(
+            "read YAML input as an array of documents "
+            "even when it has only one"
+        ),
+    )
+
+    if not format_from_argv0 or "xml" in {argv0_from, argv0_to}:
+        parser.add_argument(
+            "--xml-convention",
+            dest="xml_convention",
+            default=CLI_DEFAULTS["xml_convention"],
+            help="how XML maps to and from dictionaries",
+            choices=XML_CONVENTIONS,
+        )
+
+    if not format_from_argv0 or "yaml" in {argv0_from, argv0_to}:
+        parser.add_argument(
+            "--yaml-version",
+            dest="yaml_version",
+            default=CLI_DEFAULTS["yaml_version"],
+            help="YAML specification version to read and write",
+            choices=YAML_VERSIONS,
+        )
+
+    if not format_from_argv0 or argv0_from == "yaml":
+        parser.add_argument(
+            "--yaml-merge",
+            dest="yaml_merge",
+            default=CLI_DEFAULTS["yaml_merge"],
+            help=(
+                'expand merge keys ("<<") in YAML input into their maps, '
+                "keep them as ordinary keys, or fail on them"
+            ),
+            choices=YAML_MERGE_STYLES,
+        )
+
+    if not format_from_argv0 or argv0_to == "yaml":
+        parser.add_argument(
+            "--yaml-indent",
+            dest="yaml_indent",
+            metavar="<n>",
+            type=int,
+            default=YAMLOptions().indent,
+            help="YAML indentation",
+        )
+        parser.add_argument(
+            "--yaml-split",
+            dest="yaml_split",
+            action="store_true",
+            help="output each element of a top-level array as a YAML document",
+        )
+        parser.add_argument(
+            "--yaml-style",
+            dest="yaml_style",
+            default=YAMLOptions().style,
+            help="YAML formatting style",
+            choices=["", "'", '"', "|", ">"],
+        )
+
+        def yaml_width(value: str) -> int:
+            # This is theoretically compatible with LibYAML.
+            return (1 << 32) - 1 if value.lower() == "inf" else int(value)
+
+        parser.add_argument(
+            "--yaml-width",
+            dest="yaml_width",
+            metavar="<n>",
+            type=yaml_width,  # Allow "inf".
+            default=YAMLOptions().width,
+            help="YAML line width for long strings",
+        )
+
+    colorama.init()
+    args = parser.parse_args(args=argv[1:])
+
+    # Use the positional input and output arguments.
+    if args.input_flag is not None:
+        args.input = args.input_flag
+
+    if args.output_flag is not None:
+        args.output = args.output_flag
+
+    if args.watch and args.input in ("-", CLIPBOARD):
+        parser.error('"--watch" needs an input file')
+
+    # Determine the implicit input and output format if possible.
+    if format_from_argv0:
+        args.input_format = argv0_from
+        args.output_format = argv0_to
+    else:
+        if args.input_format == "":
+            args.input_format = _extension_to_format(args.input, INPUT_FORMATS)
+            if args.input_format == "":
+                parser.error("Need an explicit input format")
+
+        if args.output_format == "" and not args.check_syntax:
+            args.output_format = _extension_to_format(args.output, OUTPUT_FORMATS)
+            if args.output_format == "":
+                parser.error("Need an explicit output format")
+
+    if args.coerce is not None:
+        args.coerce = dict(rule for rules in args.coerce for rule in rules)
+
+    if getattr(args, "asn1_schema", None) and not args.asn1_type:
+        parser.error('"--asn1-schema" needs "--asn1-type"')
+
+    if getattr(args, "jsonnet_ext_vars", None) is not None:
+        args.jsonnet_ext_vars = dict(args.jsonnet_ext_vars)
+
+    for key, value in CLI_DEFAULTS.items():
+        vars(args).setdefault(key, value)
+
+    # Wrap `yaml_*` options in `YAMLOptions` if they are present.
+    vars(args)["yaml_options"] = YAMLOptions()
+
+    if "yaml_indent" in vars(args):
         vars(args)["yaml_options"] = YAMLOptions(
             indent=args.yaml_indent,
+            split=args.yaml_split,
             style=args.yaml_style,
             width=args.yaml_width,
         )
 
-        for key in ("yaml_indent", "yaml_style", "yaml_width"):
-            del vars(args)[key]
+        for key in ("yaml_indent", "yaml_split", "yaml_style", "yaml_width"):
+            del vars(args)[key]
+
+    return args
+
+
+# === Parser/serializer wrappers ===
+
+
+def identity(x: Any) -> Any:
+    return x
+
+
+def _strip_bom(text: str) -> str:
+    # `str.removeprefix` needs Python 3.9.
+    return text[1:] if text.startswith("\ufeff") else text
+
+
+def traverse(
+    col: Any,
+    dict_callback: Callable[[Sequence[tuple[Any, Any]]], Any] = dict,
+    list_callback: Callable[[Sequence[tuple[Any, Any]]], Any] = identity,
+    key_callback: Callable[[Any], Any] = identity,
+    instance_callbacks: Sequence[tuple[type, Any]] = (),
+    default_callback: Callable[[Any], Any] = identity,
+) -> Any:
+    if isinstance(col, dict):
+        res = dict_callback(
+            [
+                (
+                    key_callback(k),
+                    traverse(
+                        v,
+                        dict_callback,
+                        list_callback,
+                        key_callback,
+                        instance_callbacks,
+                        default_callback,
+                    ),
+                )
+                for (k, v) in col.items()
+            ]
+        )
+    elif isinstance(col, list):
+        res = list_callback(
+            [
+                traverse(
+                    x,
+                    dict_callback,
+                    list_callback,
+                    key_callback,
+                    instance_callbacks,
+                    default_callback,
+                )
+                for x in col
+            ]
+        )
+    else:
+        for t, callback in instance_callbacks:
+            if isinstance(col, t):
+                res = callback(col)
+                break
+        else:
+            res = default_callback(col)
+
+    return res
+
+
+Document = Union[bool, bytes, datetime.datetime, Mapping, None, Sequence, str]
+
+
+class DecodeError(ValueError):
+    def __init__(self, msg: str, *, format: str, line: int | None = None) -> None:
+        super().__init__(msg)
+        self.format = format
+        self.line = line
+
+
+class EncodeError(ValueError):
+    def __init__(self, msg: str, *, format: str) -> None:
+        super().__init__(msg)
+        self.format = format
+
+
+_ASN1_CLASSES = ("UNIVERSAL", "APPLICATION", "CONTEXT", "PRIVATE")
+_ASN1_PEM = re.compile(rb"-----BEGIN [^-]+-----(.*?)-----END [^-]+-----", re.DOTALL)
+# Universal string types and their encodings.
+_ASN1_STRINGS = {
+    7: "latin-1",  # ObjectDescriptor
+    12: UTF_8,  # UTF8String
+    18: "ascii",  # NumericString
+    19: "ascii",  # PrintableString
+    20: "latin-1",  # TeletexString
+    21: "latin-1",  # VideotexString
+    22: "ascii",  # IA5String
+    25: "latin-1",  # GraphicString
+    26: "ascii",  # VisibleString
+    27: "latin-1",  # GeneralString
+    28: "utf-32-be",  # UniversalString
+    30: "utf-16-be",  # BMPString
+}
+
+
+def _asn1tools() -> Any:
+    try:
+        import asn1tools  # type: ignore
+    except ModuleNotFoundError:
+        msg = (
+            'ASN.1 schema support requires the package "asn1tools"; '
+            'install "remarshal[asn1]"'
+        )
+        raise OSError(msg)
+
+    return asn1tools
+
+
+def _asn1_tag(tag_class: int, number: int) -> str:
+    # Context-specific tags are the most common and have no class name.
+    if tag_class == 2:
+        return f"[{number}]"
+    return f"[{_ASN1_CLASSES[tag_class]} {number}]"
+
+
+def _asn1_error(message: str, pos: int) -> DecodeError:
+    msg = f"Cannot parse as ASN.1 (offset {pos}: {message})"
+    return DecodeError(msg, format="asn1")
+
+
+def _asn1_header(data: bytes, pos: int) -> tuple[int, bool, int, int | None, int]:
+    # Return the class, whether the value is constructed, the tag number,
+    # the content length or `None` for indefinite length, and the content offset.
+    if pos + 2 > len(data):
+        msg = "unexpected end of input"
+        raise _asn1_error(msg, pos)
+
+    first = data[pos]
+    tag_class, constructed, number = first >> 6, bool(first & 0x20), first & 0x1F
+    i = pos + 1
+    if number == 0x1F:
+        # High tag numbers use base-128 digits.
+        number = 0
+        while True:
+            if i >= len(data):
+                msg = "unexpected end of input"
+                raise _asn1_error(msg, i)
+            number = (number << 7) | (data[i] & 0x7F)
+            i += 1
+            if not data[i - 1] & 0x80:
+                break
+
+    if i >= len(data):
+        msg = "unexpected end of input"
+        raise _asn1_error(msg, i)
+    length_byte = data[i]
+    i += 1
+    if length_byte == 0x80:
+        if not constructed:
+            msg = "indefinite length of a primitive value"
+            raise _asn1_error(msg, pos)
+        return tag_class, constructed, number, None, i
+    if length_byte & 0x80:
+        n = length_byte & 0x7F
+        length = int.from_bytes(data[i : i + n], "big")
+        i += n
+    else:
+        length = length_byte
+
+    if i + length > len(data):
+        msg = "value runs past the end of input"
+        raise _asn1_error(msg, pos)
+    return tag_class, constructed, number, length, i
+
+
+def _asn1_oid(content: bytes, *, relative: bool) -> str:
+    numbers = []
+    n = 0
+    for byte in content:
+        n = (n << 7) | (byte & 0x7F)
+        if not byte & 0x80:
+            numbers.append(n)
+            n = 0
+
+    if not relative and numbers:
+        first = min(numbers[0] // 40, 2)
+        numbers[:1] = [first, numbers[0] - 40 * first]
+    return ".".join(str(n) for n in numbers)
+
+
+def _asn1_real(content: bytes) -> float:
+    if not content:
+        return 0.0
+
+    first = content[0]
+    if first in {0x40, 0x41, 0x42, 0x43}:
+        return (math.inf, -math.inf, math.nan, -0.0)[first - 0x40]
+    if not first & 0x80:
+        # ISO 6093 decimal forms.
+        return float(content[1:].decode("ascii").replace(",", "."))
+
+    # The bases 2, 8, and 16 take 1, 3, and 4 bits per digit.
+    bits = (1, 3, 4, 1)[(first >> 4) & 0x03]
+    scale = (first >> 2) & 0x03
+    exponent_length = (first & 0x03) + 1
+    start = 1
+    if exponent_length == 4:
+        exponent_length = content[1]
+        start = 2
+    exponent = int.from_bytes(
+        content[start : start + exponent_length], "big", signed=True
+    )
+    mantissa = int.from_bytes(content[start + exponent_length :], "big")
+    sign = -1 if first & 0x40 else 1
+
+    return sign * math.ldexp(mantissa, scale + bits * exponent)
+
+
+def _asn1_time(text: str, *, generalized: bool) -> datetime.datetime | str:
+    year_digits = 4 if generalized else 2
+    match = re.fullmatch(
+        rf"(\d{{{year_digits}}})(\d{{2}})(\d{{2}})(\d{{2}})(\d{{2}})?(\d{{2}})?"
+        r"(?:[.,](\d+))?(Z|[+-]\d{4})?",
+        text,
+    )
+    if not match:
+        return text
+
+    year = int(match.group(1))
+    if not generalized:
+        # RFC 5280 puts two-digit years in 1950-2049.
+        year += 1900 if year >= 50 else 2000
+    fraction = match.group(7) or ""
+    zone = match.group(8)
+    tz = None
+    if zone == "Z":
+        tz = datetime.timezone.utc
+    elif zone:
+        offset = datetime.timedelta(hours=int(zone[1:3]), minutes=int(zone[3:]))
+        tz = datetime.timezone(-offset if zone[0] == "-" else offset)
+
+    try:
+        return datetime.datetime(
+            year,
+            int(match.group(2)),
+            int(match.group(3)),
+            int(match.group(4)),
+            int(match.group(5) or 0),
+            int(match.group(6) or 0),
+            int(fraction[:6].ljust(6, "0")),
+            tzinfo=tz,
+        )
+    except ValueError:
+        return text
+
+
+def _asn1_bits(content: bytes, unused: int) -> bytes | str:
+    # A bit string that fills its bytes becomes a byte string.
+    if not unused:
+        return content
+    bits = "".join(f"{byte:08b}" for byte in content)
+    return bits[: len(bits) - unused]
+
+
+def _asn1_universal(  # noqa: C901, PLR0911.
+    number: int, content: bytes, pos: int
+) -> Any:
+    try:
+        if number == 1:
+            return content != b"\x00"
+        if number in {2, 10}:
+            return int.from_bytes(content, "big", signed=True)
+        if number == 3:
+            return _asn1_bits(content[1:], content[0] if content else 0)
+        if number == 4:
+            return content
+        if number == 5:
+            return None
+        if number in {6, 13}:
+            return _asn1_oid(content, relative=number == 13)
+        if number == 9:
+            return _asn1_real(content)
+        if number in _ASN1_STRINGS:
+            return content.decode(_ASN1_STRINGS[number])
+        if number in {23, 24}:
+            return _asn1_time(content.decode("ascii"), generalized=number == 24)
+    except (IndexError, OverflowError, UnicodeDecodeError, ValueError) as e:
+        msg = f"invalid value of universal type {number} ({e})"
+        raise _asn1_error(msg, pos)
+
+    return {_asn1_tag(0, number): content}
+
+
+def _asn1_value(data: bytes, pos: int) -> tuple[Any, int]:  # noqa: C901, PLR0912.
+    tag_class, constructed, number, length, start = _asn1_header(data, pos)
+
+    if constructed:
+        items = []
+        i = start
+        end = len(data) if length is None else start + length
+        while True:
+            if length is None and data[i : i + 2] == b"\x00\x00":
+                i += 2
+                break
+            if i >= end:
+                if length is None:
+                    msg = "missing end-of-contents marker"
+                    raise _asn1_error(msg, pos)
+                break
+            item, i = _asn1_value(data, i)
+            items.append(item)
+        if i > end:
+            msg = "value runs past its length"
+            raise _asn1_error(msg, pos)
+
+        if tag_class == 0 and number in {8, 11, 16, 17}:
+            # SEQUENCE, SET, EXTERNAL, and EMBEDDED PDV.
+            value: Any = items
+        elif tag_class == 0 and all(isinstance(x, bytes) for x in items):
+            # BER can split a string into segments of octet strings.
+            value = _asn1_universal(number, b"".join(items), pos)
+        else:
+            value = {_asn1_tag(tag_class, number): items}
+        return value, i
+
+    content = data[start : start + (length or 0)]
+    if tag_class == 0:
+        return _asn1_universal(number, content, pos), start + len(content)
+
+    # The type of an implicitly tagged value is unknown without a schema.
+    return {_asn1_tag(tag_class, number): content}, start + len(content)
+
+
+def _asn1_schema_value(value: Any) -> Any:
+    # asn1tools uses tuples for CHOICE values and bit strings.
+    if isinstance(value, tuple) and len(value) == 2:
+        if isinstance(value[0], str):
+            return {value[0]: _asn1_schema_value(value[1])}
+        if isinstance(value[0], bytes) and isinstance(value[1], int):
+            return _asn1_bits(value[0], len(value[0]) * 8 - value[1])
+    if isinstance(value, (list, tuple)):
+        return [_asn1_schema_value(x) for x in value]
+    if isinstance(value, Mapping):
+        return {k: _asn1_schema_value(v) for k, v in value.items()}
+    return value
+
+
+def _decode_asn1(
+    input_data: bytes,
+    *,
+    schema: Sequence[str] | None = None,
+    type_name: str | None = None,
+) -> Document:
+    # PEM files like certificates hold Base64 DER between armor lines.
+    blocks = _ASN1_PEM.findall(input_data)
+    if blocks:
+        try:
+            ders = [base64.b64decode(b"".join(block.split())) for block in blocks]
+        except ValueError as e:
+            msg = f"Cannot parse as ASN.1 (invalid PEM: {e})"
+            raise DecodeError(msg, format="asn1")
+    else:
+        ders = [input_data]
+
+    if schema:
+        asn1tools = _asn1tools()
+        try:
+            spec = asn1tools.compile_files(list(schema), "ber")
+            docs = [_asn1_schema_value(spec.decode(type_name, der)) for der in ders]
+        except asn1tools.Error as e:
+            msg = f"Cannot parse as ASN.1 ({e})"
+            raise DecodeError(msg, format="asn1")
+        return cast(Document, docs[0] if len(docs) == 1 else docs)
+
+    docs = []
+    for der in ders:
+        pos = 0
+        while pos < len(der):
+            value, pos = _asn1_value(der, pos)
+            docs.append(value)
+
+    return cast(Document, docs[0] if len(docs) == 1 else docs)
+
+
+def _bson() -> Any:
+    try:
+        import bson  # type: ignore
+        import bson.json_util  # type: ignore
+    except ModuleNotFoundError:
+        msg = (
+            'BSON support requires the package "pymongo"; '
+            'install "remarshal[bson]"'
+        )
+        raise OSError(msg)
+
+    return bson
+
+
+def _bson_extended(obj: Any) -> Any:
+    bson = _bson()
+    return json.loads(
+        bson.json_util.dumps(obj, json_options=bson.json_util.RELAXED_JSON_OPTIONS)
+    )
+
+
+def _bson_value(obj: Any, *, types: str) -> Any:  # noqa: PLR0911.
+    bson = _bson()
+
+    if obj is None or isinstance(obj, (bool, float, str)):
+        return obj
+    if isinstance(obj, int):
+        # Convert `Int64`.
+        return int(obj)
+
+    if types == "extended":
+        return _bson_extended(obj)
+
+    if isinstance(obj, bson.ObjectId):
+        return str(obj)
+    if isinstance(obj, datetime.datetime):
+        return obj if types == "native" else obj.isoformat()
+    if isinstance(obj, bytes):
+        # Convert `Binary`.
+        return bytes(obj) if types == "native" else base64.b64encode(obj).decode()
+
+    # Other types have no equivalent elsewhere.
+    return _bson_extended(obj)
+
+
+def _decode_bson(input_data: bytes, *, types: str) -> Document:
+    bson = _bson()
+
+    try:
+        docs = bson.decode_all(
+            input_data,
+            bson.CodecOptions(tz_aware=True, tzinfo=datetime.timezone.utc),
+        )
+    except bson.errors.BSONError as e:
+        msg = f"Cannot parse as BSON ({e})"
+        raise DecodeError(msg, format="bson")
+
+    doc = traverse(
+        docs[0] if len(docs) == 1 else docs,
+        default_callback=lambda x: _bson_value(x, types=types),
+    )
+    return cast(Document, doc)
+
+
+def _decode_cbor(input_data: bytes, *, sanitize_utf8: bool = False) -> Document:
+    try:
+        doc = cbor2.loads(
+            input_data, str_errors="replace" if sanitize_utf8 else "strict"
+        )
+        return cast(Document, doc)
+    except cbor2.CBORDecodeError as e:
+        msg = f"Cannot parse as CBOR ({e})"
+        raise DecodeError(msg, format="cbor")
+
+
+def _decode_csv(
+    input_data: bytes, *, delimiter: str, infer_types: bool, input_format: str
+) -> Document:
+    # Spreadsheet exports often start with a byte order mark.
+    text = _strip_bom(input_data.decode(UTF_8))
+
+    reader = csv.reader(StringIO(text, newline=""), delimiter=delimiter, strict=True)
+
+    def error(message: str) -> DecodeError:
+        lineno = reader.line_num
+        msg = f"Cannot parse as {input_format.upper()} (line {lineno}: {message})"
+        return DecodeError(msg, format=input_format, line=lineno)
+
+    rows: list[dict[str, Any]] = []
+    try:
+        header = next(reader, None)
+        if header is None:
+            return rows
+
+        for column in header:
+            if header.count(column) > 1:
+                raise error(f"duplicate column {column!r}")
+
+        for fields in reader:
+            # Skip blank lines.
+            if not fields:
+                continue
+            if len(fields) != len(header):
+                msg = f"row has {len(fields)} fields but header has {len(header)}"
+                raise error(msg)
+
+            rows.append(dict(zip(header, fields)))
+    except csv.Error as e:
+        raise error(str(e))
+
+    if not infer_types:
+        return rows
+
+    return _map_values(rows, str, lambda x: None if x == "" else _infer_type(x))
+
+
+_GRON_LINE = re.compile(
+    r'(json(?:\.[A-Za-z_$][\w$]*|\[\d+\]|\["(?:[^"\\]|\\.)*"\])*) = (.*);\Z'
+)
+_GRON_PART = re.compile(r'\.([A-Za-z_$][\w$]*)|\[(\d+)\]|\[("(?:[^"\\]|\\.)*")\]')
+
+
+def _gron_set(root: list[Any], path: list[int | str], value: Any) -> None:
+    # Create missing containers, since filtering gron output with `grep`
+    # often removes the lines that assign them.
+    target: Any = root
+    parts: list[int | str] = [0, *path]
+
+    for part, next_part in zip(parts, [*parts[1:], None]):
+        if isinstance(part, int) != isinstance(target, list):
+            msg = f"cannot index {type(target).__name__} with {part!r}"
+            raise TypeError(msg)
+        if isinstance(target, list) and len(target) <= part:
+            target.extend([None] * (cast(int, part) + 1 - len(target)))
+
+        if next_part is None:
+            current = target[part] if isinstance(target, list) else target.get(part)
+            # Do not replace a container with an empty one of the same type.
+            if not (value in ({}, []) and type(current) is type(value)):
+                target[part] = value
+            return
+
+        if isinstance(target, dict) and part not in target:
+            target[part] = None
+        if target[part] is None:
+            target[part] = [] if isinstance(next_part, int) else {}
+        target = target[part]
+
+
+def _decode_gron(input_data: bytes) -> Document:
+    root: list[Any] = [None]
+
+    for lineno, line in enumerate(input_data.decode(UTF_8).splitlines(), 1):
+        if not line.strip():
+            continue
+
+        try:
+            match = _GRON_LINE.match(line.strip())
+            if not match:
+                msg = "expected an assignment like 'json.a[0] = 1;'"
+                raise ValueError(msg)
+
+            path: list[int | str] = [
+                json.loads(quoted) if quoted else int(index) if index else name
+                for name, index, quoted in _GRON_PART.findall(match.group(1)[4:])
+            ]
+            _gron_set(root, path, json.loads(match.group(2)))
+        except (TypeError, ValueError) as e:
+            msg = f"Cannot parse as gron (line {lineno}: {e})"
+            raise DecodeError(msg, format="gron", line=lineno)
+
+    return cast(Document, root[0])
+
+
+def _decode_hcl(input_data: bytes) -> Document:
+    try:
+        doc = hcl2.loads(input_data.decode(UTF_8))
+        return cast(Document, doc)
+    except lark.exceptions.LarkError as e:
+        msg = f"Cannot parse as HCL ({e})"
+        raise DecodeError(msg, format="hcl", line=getattr(e, "line", None))
+
+
+_HEADERS_FIELD = re.compile(r"([!-9;-~]+)[ \t]*:[ \t]*(.*)\Z")
+_HEADERS_START_LINE = re.compile(r"HTTP/\S+ .*|\S+ \S+ HTTP/\S+\Z")
+
+
+def _headers_error(message: str, lineno: int) -> DecodeError:
+    msg = f"Cannot parse as headers (line {lineno}: {message})"
+    return DecodeError(msg, format="headers", line=lineno)
+
+
+def _decode_headers(input_data: bytes) -> Document:
+    lines = _strip_bom(input_data.decode(UTF_8)).splitlines()
+    fields: list[tuple[str, str]] = []
+
+    for lineno, line in enumerate(lines, 1):
+        if not line.strip():
+            # A blank line ends the header block.
+            for rest, after in enumerate(lines[lineno:], lineno + 1):
+                if after.strip():
+                    msg = "unexpected data after the blank line"
+                    raise _headers_error(msg, rest)
+            break
+
+        if line[0] in " \t":
+            if not fields:
+                msg = "continuation line before the first header"
+                raise _headers_error(msg, lineno)
+            # Unfold continuation lines like RFC 5322 does.
+            name, value = fields[-1]
+            fields[-1] = (name, f"{value} {line.strip()}".lstrip())
+            continue
+
+        match = _HEADERS_FIELD.match(line)
+        if match:
+            fields.append((match.group(1), match.group(2).rstrip()))
+        elif lineno != 1 or not _HEADERS_START_LINE.match(line):
+            # Only the status or request line of an HTTP message is skipped.
+            msg = "expected 'Name: value'"
+            raise _headers_error(msg, lineno)
+
+    doc: dict[str, Any] = {}
+    repeated: set[str] = set()
+    for name, value in fields:
+        _add_repeated(doc, repeated, name, value)
+
+    return doc
+
+
+def _decode_hjson(input_data: bytes, *, duplicate_keys: str | None = None) -> Document:
+    try:
+        doc = hjson.loads(
+            input_data.decode(UTF_8),
+            object_pairs_hook=_object_pairs_hook(duplicate_keys),
+        )
+        return cast(Document, doc)
+    except hjson.HjsonDecodeError as e:
+        msg = f"Cannot parse as HJSON ({e})"
+        raise DecodeError(msg, format="hjson", line=e.lineno)
+    except ValueError as e:
+        msg = f"Cannot parse as HJSON ({e})"
+        raise DecodeError(msg, format="hjson")
+
+
+def _ion() -> Any:
+    try:
+        import amazon.ion.core  # type: ignore
+        import amazon.ion.exceptions  # type: ignore
+        import amazon.ion.simple_types  # type: ignore
+        import amazon.ion.simpleion  # type: ignore
+    except ModuleNotFoundError:
+        msg = (
+            'Ion support requires the package "amazon.ion"; '
+            'install "remarshal[ion]"'
+        )
+        raise OSError(msg)
+
+    return amazon.ion
+
+
+def _ion_value(obj: Any) -> Any:  # noqa: C901, PLR0911.
+    ion = _ion()
+
+    # Annotations are dropped, and typed nulls become plain null.
+    if obj is None or isinstance(obj, ion.simple_types.IonPyNull):
+        return None
+    if isinstance(obj, Mapping):
+        return {str(k): _ion_value(v) for k, v in obj.items()}
+    if isinstance(obj, (list, tuple)):
+        # Lists and S-expressions.
+        return [_ion_value(x) for x in obj]
+
+    # Ion booleans are not instances of `bool`.
+    if isinstance(obj, bool) or getattr(obj, "ion_type", None) == ion.core.IonType.BOOL:
+        return bool(obj)
+    if isinstance(obj, int):
+        return int(obj)
+    if isinstance(obj, (decimal.Decimal, float)):
+        return float(obj)
+    if isinstance(obj, datetime.datetime):
+        return datetime.datetime(
+            obj.year,
+            obj.month,
+            obj.day,
+            obj.hour,
+            obj.minute,
+            obj.second,
+            obj.microsecond,
+            obj.tzinfo,
+        )
+    if isinstance(obj, bytes):
+        # Blobs and clobs.
+        return bytes(obj)
+
+    # Strings and symbols.
+    return str(obj)
+
+
+def _decode_ion(input_data: bytes) -> Document:
+    ion = _ion()
+
+    try:
+        values = ion.simpleion.loads(input_data, single_value=False)
+    except (ion.exceptions.IonException, ValueError) as e:
+        msg = f"Cannot parse as Ion ({e})"
+        raise DecodeError(msg, format="ion")
+
+    # A stream of several top-level values becomes an array.
+    docs = [_ion_value(value) for value in values]
+    return docs[0] if len(docs) == 1 else docs
+
+
+def _infer_type(value: str) -> Any:
+    """Guess the type of a string value from a format without types."""
+    if value.lower() in ("true", "false"):
+        return value.lower() == "true"
+    # Keep numbers with leading zeros like ZIP codes as strings.
+    if re.fullmatch(r"[-+]?(0|[1-9]\d*)", value):
+        return int(value)
+    if re.fullmatch(r"[-+]?(0|[1-9]\d*)(\.\d+)?([eE][-+]?\d+)?", value):
+        return float(value)
+
+    return value
+
+
+def _decode_ini(input_data: bytes, *, infer_types: bool) -> Document:
+    doc: dict[str, Any] = {}
+    target = doc
+    key = None
+
+    def error(message: str, lineno: int) -> DecodeError:
+        msg = f"Cannot parse as INI (line {lineno}: {message})"
+        return DecodeError(msg, format="ini", line=lineno)
+
+    for lineno, line in enumerate(input_data.decode(UTF_8).splitlines(), 1):
+        stripped = line.strip()
+
+        if not stripped:
+            key = None
+            continue
+        if stripped[0] in "#;":
+            continue
+
+        # An indented line continues the previous value.
+        if line[0] in " \t" and key is not None:
+            target[key] += "\n" + stripped
+            continue
+
+        if stripped.startswith("["):
+            if not stripped.endswith("]"):
+                raise error("unterminated section header", lineno)
+
+            name = stripped[1:-1].strip()
+            if name in doc:
+                raise error(f"duplicate section {name!r}", lineno)
+
+            target = doc[name] = {}
+            key = None
+            continue
+
+        match = re.match(r"([^=:]+?)\s*[=:]\s*(.*)\Z", stripped)
+        if not match:
+            raise error(f"expected a key and a value, got {stripped!r}", lineno)
+
+        key, value = match.groups()
+        if key in target:
+            raise error(f"duplicate key {key!r}", lineno)
+        target[key] = value
+
+    return _map_values(doc, str, _infer_type) if infer_types else doc
+
+
+def _reject_duplicate_keys(pairs: list[tuple[Any, Any]]) -> dict[Any, Any]:
+    doc = {}
+
+    for k, v in pairs:
+        if k in doc:
+            msg = f"duplicate key {k!r}"
+            raise ValueError(msg)
+        doc[k] = v
+
+    return doc
+
+
+def _keep_first_keys(pairs: list[tuple[Any, Any]]) -> dict[Any, Any]:
+    doc: dict[Any, Any] = {}
+
+    for k, v in pairs:
+        doc.setdefault(k, v)
+
+    return doc
+
+
+def _object_pairs_hook(
+    duplicate_keys: str | None,
+) -> Callable[[list[tuple[Any, Any]]], dict[Any, Any]]:
+    if duplicate_keys == "error":
+        return _reject_duplicate_keys
+    if duplicate_keys == "first":
+        return _keep_first_keys
+
+    # The last value wins by default.
+    return dict
+
+
+def _big_float(text: str) -> decimal.Decimal | float:
+    number = decimal.Decimal(text)
+    # Infinities and NaN have no more precision as decimals.
+    return number if number.is_finite() else float(text)
+
+
+def _decode_json(
+    input_data: bytes, *, big_numbers: bool = False, duplicate_keys: str | None = None
+) -> Document:
+    try:
+        doc = json.loads(
+            input_data.decode(UTF_8),
+            object_pairs_hook=_object_pairs_hook(duplicate_keys),
+            parse_float=_big_float if big_numbers else None,
+        )
+
+        return cast(Document, doc)
+    except json.JSONDecodeError as e:
+        msg = f"Cannot parse as JSON ({e})"
+        raise DecodeError(msg, format="json", line=e.lineno)
+    except ValueError as e:
+        msg = f"Cannot parse as JSON ({e})"
+        raise DecodeError(msg, format="json")
+
+
+def _decode_json5(
+    input_data: bytes, *, big_numbers: bool = False, duplicate_keys: str | None = None
+) -> Document:
+    try:
+        doc = json5.loads(
+            input_data.decode(UTF_8),
+            object_pairs_hook=_object_pairs_hook(duplicate_keys),
+            parse_float=_big_float if big_numbers else None,
+        )
+
+        return cast(Document, doc)
+    except ValueError as e:
+        msg = f"Cannot parse as JSON5 ({e})"
+        match = re.match(r"<string>:(\d+)", str(e))
+        raise DecodeError(
+            msg, format="json5", line=int(match.group(1)) if match else None
+        )
+
+
+def _strip_jsonc(text: str) -> str:  # noqa: C901.
+    """Replace comments and trailing commas with spaces, keeping the lines."""
+    chars = list(text)
+    comma = None
+    i = 0
+
+    def blank(start: int, end: int) -> None:
+        for j in range(start, end):
+            if chars[j] != "\n":
+                chars[j] = " "
+
+    while i < len(text):
+        if text[i] == '"':
+            i += 1
+            while i < len(text) and text[i] != '"':
+                i += 2 if text[i] == "\\" else 1
+            comma = None
+        elif text.startswith("//", i):
+            end = text.find("\n", i)
+            end = len(text) if end == -1 else end
+            blank(i, end)
+            i = end
+            continue
+        elif text.startswith("/*", i):
+            end = text.find("*/", i + 2)
+            if end == -1:
+                lineno = text.count("\n", 0, i) + 1
+                msg = f"Cannot parse as JSONC (line {lineno}: unterminated comment)"
+                raise DecodeError(msg, format="jsonc", line=lineno)
+            blank(i, end + 2)
+            i = end + 2
+            continue
+        elif text[i] == ",":
+            comma = i
+        elif text[i] in "]}":
+            if comma is not None:
+                chars[comma] = " "
+            comma = None
+        elif not text[i].isspace():
+            comma = None
+
+        i += 1
+
+    return "".join(chars)
+
+
+def _decode_jsonc(
+    input_data: bytes, *, big_numbers: bool = False, duplicate_keys: str | None = None
+) -> Document:
+    text = _strip_jsonc(input_data.decode(UTF_8))
+
+    try:
+        doc = json.loads(
+            text,
+            object_pairs_hook=_object_pairs_hook(duplicate_keys),
+            parse_float=_big_float if big_numbers else None,
+        )
+
+        return cast(Document, doc)
+    except json.JSONDecodeError as e:
+        msg = f"Cannot parse as JSONC ({e})"
+        raise DecodeError(msg, format="jsonc", line=e.lineno)
+    except ValueError as e:
+        msg = f"Cannot parse as JSONC ({e})"
+        raise DecodeError(msg, format="jsonc")
+
+
+def _jsonnet() -> Any:
+    try:
+        import _jsonnet as jsonnet  # type: ignore
+    except ModuleNotFoundError:
+        msg = (
+            'Jsonnet support requires the package "jsonnet"; '
+            'install "remarshal[jsonnet]"'
+        )
+        raise OSError(msg)
+
+    return jsonnet
+
+
+def _decode_jsonnet(
+    input_data: bytes,
+    *,
+    ext_vars: Mapping[str, str] | None,
+    library_path: Sequence[str] | None,
+) -> Document:
+    jsonnet = _jsonnet()
+    filename = "<input>"
+
+    try:
+        output = jsonnet.evaluate_snippet(
+            filename,
+            input_data.decode(UTF_8),
+            ext_vars=dict(ext_vars or {}),
+            jpathdir=list(library_path or []),
+        )
+    except RuntimeError as e:
+        # The first line of the error says where evaluation failed.
+        message = str(e).strip()
+        match = re.search(rf"{re.escape(filename)}:(\d+)", message)
+        msg = f"Cannot evaluate Jsonnet ({message.splitlines()[0]})"
+        raise DecodeError(
+            msg, format="jsonnet", line=int(match.group(1)) if match else None
+        )
+
+    return cast(Document, json.loads(output))
+
+
+def _decode_jsonl(
+    input_data: bytes, *, big_numbers: bool = False, duplicate_keys: str | None = None
+) -> Document:
+    docs = []
+    hook = _object_pairs_hook(duplicate_keys)
+    parse_float = _big_float if big_numbers else None
+
+    # Do not use `splitlines`, which also splits on characters valid in JSON strings.
+    for lineno, line in enumerate(input_data.decode(UTF_8).split("\n"), 1):
+        if not line.strip():
+            continue
+
+        try:
+            docs.append(
+                json.loads(line, object_pairs_hook=hook, parse_float=parse_float)
+            )
+        except json.JSONDecodeError as e:
+            msg = (
+                "Cannot parse as JSON Lines "
+                f"(line {lineno} column {e.colno}: {e.msg})"
+            )
+            raise DecodeError(msg, format="jsonl", line=lineno)
+        except ValueError as e:
+            msg = f"Cannot parse as JSON Lines (line {lineno}: {e})"
+            raise DecodeError(msg, format="jsonl", line=lineno)
+
+    return docs
+
+
+_KDL_BARE = re.compile(r'[^\s\\/(){}<>;\[\]=,"#]+')
+_KDL_CONTINUATION = re.compile(r"\\[^\S\n]*(?://[^\n]*)?(?:\n|\Z)")
+_KDL_ESCAPE = re.compile(r"\\(u\{[0-9A-Fa-f]{1,6}\}|\s+|.)", re.DOTALL)
+_KDL_ESCAPES = {
+    '"': '"',
+    "\\": "\\",
+    "/": "/",
+    "b": "\b",
+    "f": "\f",
+    "n": "\n",
+    "r": "\r",
+    "s": " ",
+    "t": "\t",
+}
+_KDL_HASH_KEYWORD = re.compile(r"#(-?\w+)")
+_KDL_KEYWORDS = {
+    "true": True,
+    "false": False,
+    "null": None,
+    "inf": math.inf,
+    "-inf": -math.inf,
+    "nan": math.nan,
+}
+_KDL_NUMBER = re.compile(
+    r"[+-]?(?:0x[\dA-Fa-f][\dA-Fa-f_]*|0o[0-7][0-7_]*|0b[01][01_]*"
+    r"|\d[\d_]*(?:\.\d[\d_]*)?(?:[Ee][+-]?\d[\d_]*)?)\Z"
+)
+_KDL_STRING = re.compile(r'r?(#*)("""|")')
+
+
+def _kdl_error(message: str, lineno: int) -> DecodeError:
+    msg = f"Cannot parse as KDL (line {lineno}: {message})"
+    return DecodeError(msg, format="kdl", line=lineno)
+
+
+def _kdl_unescape(s: str, lineno: int) -> str:
+    def replace(match: re.Match[str]) -> str:
+        escape = match.group(1)
+        if escape.startswith("u{"):
+            code = int(escape[2:-1], 16)
+            # Only Unicode scalar values can be escaped.
+            if code > 0x10FFFF or 0xD800 <= code <= 0xDFFF:
+                msg = f"invalid code point in '\\{escape}'"
+                raise _kdl_error(msg, lineno)
+            return chr(code)
+        # KDL 2 drops whitespace after a backslash.
+        if escape.isspace():
+            return ""
+        if escape not in _KDL_ESCAPES:
+            msg = f"invalid escape '\\{escape}'"
+            raise _kdl_error(msg, lineno)
+        return _KDL_ESCAPES[escape]
+
+    return _KDL_ESCAPE.sub(replace, s)
+
+
+def _kdl_dedent(s: str, lineno: int) -> str:
+    lines = s.split("\n")
+    if len(lines) < 2 or lines[0].strip() or lines[-1].strip():
+        msg = "multi-line strings must start and end with a newline"
+        raise _kdl_error(msg, lineno)
+
+    prefix = lines[-1]
+    dedented = []
+    for line in lines[1:-1]:
+        if not line.strip():
+            dedented.append("")
+        elif line.startswith(prefix):
+            dedented.append(line[len(prefix) :])
+        else:
+            msg = "multi-line string lines must start with the final indentation"
+            raise _kdl_error(msg, lineno)
+
+    return "\n".join(dedented)
+
+
+def _kdl_string(text: str, pos: int, lineno: int) -> tuple[str, int] | None:
+    """Read a quoted or raw string at `pos` if there is one."""
+    match = _KDL_STRING.match(text, pos)
+    if not match:
+        return None
+
+    hashes, quote = match.groups()
+    raw = text[pos] in "#r"
+    start = match.end()
+
+    if raw:
+        end = text.find(quote + hashes, start)
+    else:
+        end = start
+        while end < len(text) and not text.startswith(quote, end):
+            end += 2 if text[end] == "\\" else 1
+    if end == -1 or end >= len(text):
+        msg = "unterminated string"
+        raise _kdl_error(msg, lineno)
+
+    value = text[start:end]
+    if quote == '"""':
+        value = _kdl_dedent(value, lineno)
+    if not raw:
+        value = _kdl_unescape(value, lineno)
+
+    return value, end + len(quote) + len(hashes)
+
+
+def _kdl_tokens(text: str) -> list[tuple[str, Any, int]]:  # noqa: C901, PLR0912.
+    tokens: list[tuple[str, Any, int]] = []
+    pos = 0
+    lineno = 1
+
+    while pos < len(text):
+        char = text[pos]
+        start = pos
+
+        if char == "\n":
+            tokens.append(("newline", None, lineno))
+            pos += 1
+        elif char.isspace():
+            pos += 1
+        elif text.startswith("//", pos):
+            pos = text.find("\n", pos)
+            if pos == -1:
+                pos = len(text)
+        elif text.startswith("/*", pos):
+            depth = 0
+            while depth or pos == start:
+                if pos >= len(text):
+                    msg = "unterminated comment"
+                    raise _kdl_error(msg, lineno)
+                if text.startswith("/*", pos):
+                    depth += 1
+                    pos += 2
+                elif text.startswith("*/", pos):
+                    depth -= 1
+                    pos += 2
+                else:
+                    pos += 1
+        elif text.startswith("/-", pos):
+            tokens.append(("slashdash", None, lineno))
+            pos += 2
+        elif char == "\\":
+            # A line continuation.
+            match = _KDL_CONTINUATION.match(text, pos)
+            if not match:
+                msg = "expected a newline after '\\'"
+                raise _kdl_error(msg, lineno)
+            pos = match.end()
+        elif char in "{};=":
+            tokens.append((char, None, lineno))
+            pos += 1
+        elif char == "(":
+            end = text.find(")", pos)
+            if end == -1:
+                msg = "unterminated type annotation"
+                raise _kdl_error(msg, lineno)
+            tokens.append(("type", None, lineno))
+            pos = end + 1
+        elif string := _kdl_string(text, pos, lineno):
+            tokens.append(("string", string[0], lineno))
+            pos = string[1]
+        elif char == "#":
+            match = _KDL_HASH_KEYWORD.match(text, pos)
+            if not match or match.group(1) not in _KDL_KEYWORDS:
+                msg = "unknown keyword"
+                raise _kdl_error(msg, lineno)
+            tokens.append(("value", _KDL_KEYWORDS[match.group(1)], lineno))
+            pos = match.end()
+        else:
+            match = _KDL_BARE.match(text, pos)
+            if not match:
+                msg = f"unexpected character {char!r}"
+                raise _kdl_error(msg, lineno)
+            word = match.group()
+            pos = match.end()
+
+            # KDL 1 keywords have no "#".
+            if word in {"true", "false", "null"}:
+                tokens.append(("value", _KDL_KEYWORDS[word], lineno))
+            elif _KDL_NUMBER.match(word):
+                number = word.replace("_", "")
+                if number.lstrip("+-")[:2] in {"0x", "0o", "0b"}:
+                    value: Any = int(number, 0)
+                elif any(c in number for c in ".Ee"):
+                    value = float(number)
+                else:
+                    value = int(number)
+                tokens.append(("value", value, lineno))
+            elif re.match(r"[+-]?\.?\d", word):
+                msg = f"invalid number {word!r}"
+                raise _kdl_error(msg, lineno)
+            else:
+                tokens.append(("string", word, lineno))
+
+        lineno += text.count("\n", start, pos)
+
+    tokens.append(("eof", None, lineno))
+    return tokens
+
+
+def _add_repeated(
+    doc: dict[str, Any], repeated: set[str], name: str, value: Any
+) -> None:
+    # Repeated nodes become an array, like repeated XML elements.
+    if name not in doc:
+        doc[name] = value
+    elif name in repeated:
+        doc[name].append(value)
+    else:
+        doc[name] = [doc[name], value]
+        repeated.add(name)
+
+
+def _kdl_node(  # noqa: C901, PLR0912.
+    tokens: list[tuple[str, Any, int]], pos: int
+) -> tuple[str, Any, int]:
+    if tokens[pos][0] == "type":
+        pos += 1
+    kind, name, lineno = tokens[pos]
+    if kind != "string":
+        msg = "expected a node name"
+        raise _kdl_error(msg, lineno)
+    pos += 1
+
+    args: list[Any] = []
+    props: dict[str, Any] = {}
+    children: dict[str, Any] | None = None
+
+    while tokens[pos][0] not in {"newline", ";", "}", "eof"}:
+        discard = tokens[pos][0] == "slashdash"
+        if discard:
+            pos += 1
+        kind, value, lineno = tokens[pos]
+
+        if kind == "{":
+            nodes, pos = _kdl_nodes(tokens, pos + 1, nested=True)
+            if not discard:
+                children = nodes
+            continue
+
+        if children is not None and not discard:
+            msg = "unexpected entry after children"
+            raise _kdl_error(msg, lineno)
+
+        if kind == "type":
+            pos += 1
+            kind, value, lineno = tokens[pos]
+
+        if kind == "string" and tokens[pos + 1][0] == "=":
+            pos += 2
+            if tokens[pos][0] == "type":
+                pos += 1
+            if tokens[pos][0] not in {"string", "value"}:
+                msg = f"expected a value for property {value!r}"
+                raise _kdl_error(msg, lineno)
+            if not discard:
+                # The rightmost property wins.
+                props[value] = tokens[pos][1]
+        elif kind in {"string", "value"}:
+            if not discard:
+                args.append(value)
+        else:
+            msg = f"unexpected {kind!r}"
+            raise _kdl_error(msg, lineno)
+        pos += 1
+
+    if tokens[pos][0] in {"newline", ";"}:
+        pos += 1
+
+    if not props and children is None:
+        return name, None if not args else args[0] if len(args) == 1 else args, pos
+
+    doc: dict[str, Any] = {}
+    if args:
+        doc["-"] = args[0] if len(args) == 1 else args
+    doc.update(props)
+
+    for key, value in (children or {}).items():
+        if key in doc:
+            msg = f"node {name!r} has a property and a child named {key!r}"
+            raise _kdl_error(msg, lineno)
+        doc[key] = value
+
+    return name, doc, pos
+
+
+def _kdl_nodes(
+    tokens: list[tuple[str, Any, int]], pos: int, *, nested: bool
+) -> tuple[dict[str, Any], int]:
+    doc: dict[str, Any] = {}
+    repeated: set[str] = set()
+
+    while True:
+        kind, _, lineno = tokens[pos]
+
+        if kind in {"newline", ";"}:
+            pos += 1
+        elif kind == "eof":
+            if nested:
+                msg = "expected '}'"
+                raise _kdl_error(msg, lineno)
+            return doc, pos
+        elif kind == "}":
+            if not nested:
+                msg = "unexpected '}'"
+                raise _kdl_error(msg, lineno)
+            return doc, pos + 1
+        elif kind == "slashdash":
+            pos += 1
+            while tokens[pos][0] == "newline":
+                pos += 1
+            _, _, pos = _kdl_node(tokens, pos)
+        else:
+            name, value, pos = _kdl_node(tokens, pos)
+            _add_repeated(doc, repeated, name, value)
+
+
+def _decode_kdl(input_data: bytes) -> Document:
+    text = _strip_bom(input_data.decode(UTF_8))
+    text = text.replace("\r\n", "\n").replace("\r", "\n")
+
+    doc, _ = _kdl_nodes(_kdl_tokens(text), 0, nested=False)
+    return doc
+
+
+def _decode_msgpack(input_data: bytes, *, sanitize_utf8: bool = False) -> Document:
+    try:
+        if not sanitize_utf8:
+            return cast(Document, umsgpack.unpackb(input_data))
+
+        def replace_invalid(x: Any) -> Any:
+            if isinstance(x, umsgpack.InvalidString):
+                return bytes(x).decode(UTF_8, errors="replace")
+
+            return x
+
+        doc = traverse(
+            umsgpack.unpackb(input_data, allow_invalid_utf8=True),
+            key_callback=replace_invalid,
+            default_callback=replace_invalid,
+        )
+        return cast(Document, doc)
+    except umsgpack.UnpackException as e:
+        msg = f"Cannot parse as MessagePack ({e})"
+        raise DecodeError(msg, format="msgpack")
+
+
+def _decode_nestedtext(input_data: bytes, *, infer_types: bool) -> Document:
+    try:
+        doc = nestedtext.loads(input_data.decode(UTF_8), top="any")
+    except nestedtext.NestedTextError as e:
+        lineno = None if e.lineno is None else e.lineno + 1
+        msg = f"Cannot parse as NestedText ({e.get_message()})"
+        raise DecodeError(msg, format="nestedtext", line=lineno)
+
+    return _map_values(doc, str, _infer_type) if infer_types else doc
+
+
+def _pyarrow() -> Any:
+    try:
+        import pyarrow  # type: ignore
+        import pyarrow.parquet  # type: ignore
+    except ModuleNotFoundError:
+        msg = (
+            'Parquet support requires the package "pyarrow"; '
+            'install "remarshal[parquet]"'
+        )
+        raise OSError(msg)
+
+    return pyarrow
+
+
+def _decode_parquet(input_data: bytes) -> Document:
+    pyarrow = _pyarrow()
+
+    try:
+        table = pyarrow.parquet.read_table(pyarrow.BufferReader(input_data))
+        rows = table.to_pylist(maps_as_pydicts="strict")
+    except (pyarrow.ArrowException, ValueError) as e:
+        msg = f"Cannot parse as Parquet ({e})"
+        raise DecodeError(msg, format="parquet")
+
+    doc = traverse(
+        rows,
+        instance_callbacks=[
+            (decimal.Decimal, float),
+            (datetime.timedelta, lambda x: x.total_seconds()),
+        ],
+    )
+    return cast(Document, doc)
+
+
+def _decode_plist(input_data: bytes) -> Document:
+    try:
+        doc = plistlib.loads(input_data, dict_type=dict)
+    except (ExpatError, plistlib.InvalidFileException, ValueError) as e:
+        msg = f"Cannot parse as property list ({e})"
+        raise DecodeError(msg, format="plist")
+
+    # Property list dates are in UTC.
+    # UIDs only appear in keyed archives and are integers.
+    doc = traverse(
+        doc,
+        instance_callbacks=[
+            (
+                datetime.datetime,
+                lambda x: x.replace(tzinfo=datetime.timezone.utc),
+            ),
+            (plistlib.UID, lambda x: x.data),
+        ],
+    )
+    return cast(Document, doc)
+
+
+def _properties_unescape(s: str, lineno: int) -> str:
+    specials = {"f": "\f", "n": "\n", "r": "\r", "t": "\t"}
+
+    def replace(match: re.Match[str]) -> str:
+        escape = match.group(1)
+
+        if escape == "u":
+            msg = (
+                "Cannot parse as Java properties "
+                f"(line {lineno}: malformed \\uXXXX escape)"
+            )
+            raise DecodeError(msg, format="properties", line=lineno)
+        if len(escape) == 5:
+            return chr(int(escape[1:], 16))
+
+        return specials.get(escape, escape)
+
+    unescaped = re.sub(r"\\(u[0-9a-fA-F]{4}|.)", replace, s, flags=re.DOTALL)
+
+    # Join the UTF-16 surrogate pairs of "\uXXXX\uXXXX" escapes.
+    return unescaped.encode("utf-16-le", "surrogatepass").decode(
+        "utf-16-le", "replace"
+    )
+
+
+def _decode_properties(input_data: bytes, *, infer_types: bool) -> Document:
+    # Like Java 9 and later, read UTF-8 and fall back to ISO 8859-1.
+    try:
+        text = input_data.decode(UTF_8)
+    except UnicodeDecodeError:
+        text = input_data.decode("iso-8859-1")
+
+    lines = text.splitlines()
+    flat = {}
+    # The line of each key and of the first key under each prefix like "a.b".
+    key_lines: dict[str, int] = {}
+    prefix_lines: dict[str, tuple[str, int]] = {}
+    i = 0
+
+    while i < len(lines):
+        lineno = i + 1
+        line = lines[i].lstrip(" \t\f")
+        i += 1
+
+        if not line or line[0] in "#!":
+            continue
+
+        # An odd number of trailing backslashes continues the line.
+        while (len(line) - len(line.rstrip("\\"))) % 2 == 1:
+            line = line[:-1]
+            if i < len(lines):
+                line += lines[i].lstrip(" \t\f")
+                i += 1
+
+        # The key ends at the first unescaped separator or whitespace.
+        match = re.match(r"((?:\\.|[^\\=:\s])*)\s*[=:]?\s*(.*)\Z", line, re.DOTALL)
+        key, value = match.groups() if match else (line, "")
+        key = _properties_unescape(key, lineno)
+
+        # A key cannot have both a value and keys under it.
+        parts = key.split(".")
+        prefixes = [".".join(parts[:j]) for j in range(1, len(parts))]
+        conflict = prefix_lines.get(key) or next(
+            ((prefix, key_lines[prefix]) for prefix in prefixes if prefix in key_lines),
+            None,
+        )
+        if conflict:
+            other, other_lineno = conflict
+            msg = (
+                f"Cannot parse as Java properties (line {lineno}: "
+                f"key {key!r} conflicts with key {other!r} on line {other_lineno})"
+            )
+            raise DecodeError(msg, format="properties", line=lineno)
+
+        flat[key] = _properties_unescape(value, lineno)
+        key_lines[key] = lineno
+        for prefix in prefixes:
+            prefix_lines.setdefault(prefix, (key, lineno))
+
+    try:
+        doc = _unflatten(flat)
+    except ValueError as e:
+        msg = f"Cannot parse as Java properties ({e})"
+        raise DecodeError(msg, format="properties")
+
+    return _map_values(doc, str, _infer_type) if infer_types else doc
+
+
+_REG_HEADER = "Windows Registry Editor Version 5.00"
+_REG_VALUE = re.compile(r'("(?:[^"\\]|\\.)*"|@)\s*=\s*(.*)\Z', re.DOTALL)
+
+
+def _reg_unquote(s: str) -> str:
+    return re.sub(r"\\(.)", r"\1", s[1:-1], flags=re.DOTALL)
+
+
+def _reg_data(data: str) -> Any:  # noqa: PLR0911.
+    if data == "-":
+        # A deleted value.
+        return None
+    if data.startswith('"') and data.endswith('"') and len(data) > 1:
+        return _reg_unquote(data)
+    if data.lower().startswith("dword:"):
+        return int(data[6:], 16)
+
+    match = re.match(r"hex(?:\(([0-9a-fA-F]+)\))?:(.*)\Z", data, re.DOTALL)
+    if not match:
+        msg = f"unknown value {data!r}"
+        raise ValueError(msg)
+
+    kind = int(match.group(1) or "3", 16)
+    raw = bytes(int(x, 16) for x in re.split(r"[\s,]+", match.group(2)) if x)
+    if kind in (1, 2):
+        # REG_SZ and REG_EXPAND_SZ.
+        return raw.decode("utf-16-le").rstrip("\0")
+    if kind == 7:
+        # REG_MULTI_SZ.
+        return [s for s in raw.decode("utf-16-le").split("\0") if s]
+    if kind in (4, 11):
+        # REG_DWORD and REG_QWORD.
+        return int.from_bytes(raw, "little")
+
+    return raw
+
+
+def _decode_reg(input_data: bytes) -> Document:  # noqa: C901.
+    # Registry Editor exports UTF-16 with a byte order mark.
+    if input_data.startswith((b"\xff\xfe", b"\xfe\xff")):
+        text = input_data.decode("utf-16")
+    else:
+        text = input_data.decode(UTF_8)
+
+    def error(message: str, lineno: int) -> DecodeError:
+        msg = f"Cannot parse as a registry file (line {lineno}: {message})"
+        return DecodeError(msg, format="reg", line=lineno)
+
+    lines = text.lstrip("\ufeff").splitlines()
+    doc: dict[str, Any] = {}
+    header = False
+    target = None
+    i = 0
+
+    while i < len(lines):
+        lineno = i + 1
+        line = lines[i].strip()
+        i += 1
+
+        # A trailing backslash continues hexadecimal data.
+        while line.endswith("\\") and i < len(lines):
+            line = line[:-1] + lines[i].strip()
+            i += 1
+
+        if not line or line.startswith(";"):
+            continue
+        if not header:
+            if line not in (_REG_HEADER, "REGEDIT4"):
+                raise error(f"expected {_REG_HEADER!r}", lineno)
+            header = True
+            continue
+
+        if line.startswith("[") and line.endswith("]"):
+            path = line[1:-1]
+            *parents, name = path.lstrip("-").split("\\")
+            if path.startswith("-"):
+                # A deleted key.
+                name = "-" + name
+
+            target = doc
+            for part in parents:
+                child = target.setdefault(part, {})
+                if not isinstance(child, dict):
+                    raise error(f"key {part!r} conflicts with a value", lineno)
+                target = child
+            target = target.setdefault(name, {})
+            if not isinstance(target, dict):
+                raise error(f"key {name!r} conflicts with a value", lineno)
+            continue
+
+        match = _REG_VALUE.match(line)
+        if not match:
+            raise error(f"expected a value, got {line!r}", lineno)
+        if target is None:
+            raise error("value outside of a key", lineno)
+
+        name, data = match.groups()
+        try:
+            target[name if name == "@" else _reg_unquote(name)] = _reg_data(data)
+        except (UnicodeDecodeError, ValueError) as e:
+            raise error(str(e), lineno)
+
+    return doc
+
+
+_RON_ESCAPES = {
+    "0": "\0",
+    "b": "\b",
+    "f": "\f",
+    "n": "\n",
+    "r": "\r",
+    "t": "\t",
+}
+_RON_NUMBER = re.compile(
+    r"""
+    (?P<digits>[+-]?(?:inf|NaN|0x[\dA-Fa-f_]+|0o[0-7_]+|0b[01_]+
+    |(?:\d[\d_]*(?:\.[\d_]*)?|\.\d[\d_]*)(?:[Ee][+-]?[\d_]+)?))
+    (?P<suffix>[iu](?:8|16|32|64|128|size)|f32|f64)?\Z
+    """,
+    re.VERBOSE,
+)
+_RON_TOKEN = re.compile(
+    r"""
+    (?P<space>[ \t\r\f]+|//[^\n]*|/\*.*?\*/|\#!\[[^\]]*\])
+    | (?P<newline>\n)
+    | (?P<punct>[()\[\]{}:,])
+    | (?P<raw>(?P<raw_prefix>b?r)(?P<hashes>\#*)"(?P<raw_body>.*?)"(?P=hashes))
+    | (?P<string>(?P<string_prefix>b?)"(?P<string_body>(?:[^"\\]|\\.)*)")
+    | (?P<char>'(?P<char_body>\\(?:u\{[\dA-Fa-f]+\}|x[\dA-Fa-f]{2}|.)|[^'\\\n])')
+    | (?P<number>[+-]?(?:inf|NaN)(?!\w)|[+-]?\.?\d(?:[Ee][+-]\d|[\w.])*)
+    | (?P<ident>(?:r\#)?[^\W\d]\w*)
+    """,
+    re.DOTALL | re.VERBOSE,
+)
+
+
+def _ron_error(message: str, lineno: int) -> DecodeError:
+    msg = f"Cannot parse as RON (line {lineno}: {message})"
+    return DecodeError(msg, format="ron", line=lineno)
+
+
+def _ron_unescape(body: str, lineno: int) -> str:
+    def replace(match: re.Match[str]) -> str:
+        escape = match.group(1)
+        if escape.startswith("\n"):
+            # A backslash at the end of a line skips the line break
+            # and the indentation of the next line.
+            return ""
+        if escape in _RON_ESCAPES:
+            return _RON_ESCAPES[escape]
+        if escape in "\"'\\":
+            return escape
+        if escape[0] in "ux":
+            return chr(int(escape.strip("ux{}"), 16))
+
+        msg = f"invalid escape '\\{escape}'"
+        raise _ron_error(msg, lineno)
+
+    return re.sub(
+        r"\\(u\{[\dA-Fa-f]{1,6}\}|u[\dA-Fa-f]{4}|x[\dA-Fa-f]{2}|\n[ \t]*|.)",
+        replace,
+        body,
+        flags=re.DOTALL,
+    )
+
+
+def _ron_number(token: str, lineno: int) -> float | int:
+    match = _RON_NUMBER.match(token)
+    if not match:
+        msg = f"invalid number {token!r}"
+        raise _ron_error(msg, lineno)
+
+    digits = match.group("digits").replace("_", "")
+    if digits.lstrip("+-") in {"inf", "NaN"}:
+        return float(digits.replace("NaN", "nan"))
+    if digits.lstrip("+-")[:2] in {"0x", "0o", "0b"}:
+        return int(digits, 0)
+    if match.group("suffix") in {"f32", "f64"} or any(c in digits for c in ".Ee"):
+        return float(digits)
+    return int(digits)
+
+
+def _ron_tokens(text: str) -> list[tuple[str, Any, int]]:  # noqa: C901.
+    tokens: list[tuple[str, Any, int]] = []
+    pos = 0
+    lineno = 1
+
+    while pos < len(text):
+        match = _RON_TOKEN.match(text, pos)
+        if not match:
+            msg = (
+                "unterminated string"
+                if text[pos] in "\"'"
+                else f"unexpected character {text[pos]!r}"
+            )
+            raise _ron_error(msg, lineno)
+        kind = cast(str, match.lastgroup)
+        token = match.group()
+
+        if kind in {"newline", "punct"}:
+            tokens.append((token, None, lineno))
+        elif kind in {"raw", "string", "char"}:
+            if kind == "raw":
+                value = match.group("raw_body")
+                binary = match.group("raw_prefix") == "br"
+            else:
+                body = match.group(f"{kind}_body")
+                value = _ron_unescape(body, lineno)
+                binary = kind == "string" and match.group("string_prefix") == "b"
+            if binary:
+                try:
+                    # Escapes like "\xff" are bytes in byte strings.
+                    value = value.encode("latin-1")
+                except UnicodeEncodeError:
+                    msg = "byte strings cannot contain non-ASCII characters"
+                    raise _ron_error(msg, lineno)
+            tokens.append(("value", value, lineno))
+        elif kind == "number":
+            tokens.append(("value", _ron_number(token, lineno), lineno))
+        elif kind == "ident":
+            # Raw identifiers like `r#type` lose their prefix.
+            name = token[2:] if token.startswith("r#") else token
+            tokens.append(("ident", name, lineno))
+
+        lineno += token.count("\n")
+        pos = match.end()
+
+    tokens.append(("eof", None, lineno))
+    return tokens
+
+
+def _ron_skip(tokens: list[tuple[str, Any, int]], pos: int) -> int:
+    while tokens[pos][0] == "\n":
+        pos += 1
+    return pos
+
+
+def _ron_items(
+    tokens: list[tuple[str, Any, int]], pos: int, *, end: str, fields: bool
+) -> tuple[list[tuple[Any, Any]], int]:
+    """Parse comma-separated items up to `end`, with keys when `fields`."""
+    items = []
+    pos = _ron_skip(tokens, pos)
+
+    while tokens[pos][0] != end:
+        key = None
+        if fields:
+            kind = tokens[pos][0]
+            if end == ")" and kind != "ident":
+                msg = "expected a field name"
+                raise _ron_error(msg, tokens[pos][2])
+            if end == ")":
+                key, pos = tokens[pos][1], pos + 1
+            else:
+                key, pos = _ron_value(tokens, pos)
+                if isinstance(key, (dict, list)):
+                    msg = "map keys must be scalars"
+                    raise _ron_error(msg, tokens[pos - 1][2])
+            pos = _ron_skip(tokens, pos)
+            if tokens[pos][0] != ":":
+                msg = "expected ':'"
+                raise _ron_error(msg, tokens[pos][2])
+            pos = _ron_skip(tokens, pos + 1)
+
+        value, pos = _ron_value(tokens, pos)
+        items.append((key, value))
+
+        pos = _ron_skip(tokens, pos)
+        if tokens[pos][0] == ",":
+            pos = _ron_skip(tokens, pos + 1)
+        elif tokens[pos][0] != end:
+            msg = f"expected ',' or {end!r}"
+            raise _ron_error(msg, tokens[pos][2])
+
+    return items, pos + 1
+
+
+def _ron_dict(items: list[tuple[Any, Any]], lineno: int) -> dict[Any, Any]:
+    doc = {}
+    for key, value in items:
+        if key in doc:
+            msg = f"duplicate key {key!r}"
+            raise _ron_error(msg, lineno)
+        doc[key] = value
+    return doc
+
+
+def _ron_value(  # noqa: C901, PLR0911.
+    tokens: list[tuple[str, Any, int]], pos: int
+) -> tuple[Any, int]:
+    kind, value, lineno = tokens[pos]
+
+    if kind == "value":
+        return value, pos + 1
+    if kind == "[":
+        items, pos = _ron_items(tokens, pos + 1, end="]", fields=False)
+        return [value for _, value in items], pos
+    if kind == "{":
+        items, pos = _ron_items(tokens, pos + 1, end="}", fields=True)
+        return _ron_dict(items, lineno), pos
+
+    name = None
+    if kind == "ident":
+        if value in {"true", "false"}:
+            return value == "true", pos + 1
+        if value == "None":
+            return None, pos + 1
+        if tokens[pos + 1][0] != "(":
+            # A unit struct or an enum variant without data.
+            return value, pos + 1
+        name = value
+        pos += 1
+        kind = "("
+
+    if kind == "(":
+        start = _ron_skip(tokens, pos + 1)
+        if tokens[start][0] == ")":
+            return None if name is None else {}, start + 1
+
+        # A struct has named fields; a tuple does not.
+        fields = tokens[start][0] == "ident" and tokens[
+            _ron_skip(tokens, start + 1)
+        ][0] == ":"
+        items, pos = _ron_items(tokens, start, end=")", fields=fields)
+        if fields:
+            return _ron_dict(items, lineno), pos
+
+        values = [value for _, value in items]
+        # A newtype like `Some(1)` is its value.
+        if name is not None and len(values) == 1:
+            return values[0], pos
+        return values, pos
+
+    msg = "unexpected end of input" if kind == "eof" else f"unexpected {kind!r}"
+    raise _ron_error(msg, lineno)
+
+
+def _decode_ron(input_data: bytes) -> Document:
+    text = _strip_bom(input_data.decode(UTF_8))
+    text = text.replace("\r\n", "\n")
+    tokens = _ron_tokens(text)
+
+    doc, pos = _ron_value(tokens, _ron_skip(tokens, 0))
+
+    pos = _ron_skip(tokens, pos)
+    if tokens[pos][0] != "eof":
+        msg = "unexpected data after the top-level value"
+        raise _ron_error(msg, tokens[pos][2])
+
+    return cast(Document, doc)
+
+
+_SDL_TOKEN = re.compile(
+    r"""
+    (?P<space>[ \t\r\f]+|\\[ \t]*\n|(?://|\#|--)[^\n]*|/\*.*?\*/)
+    | (?P<newline>\n)
+    | (?P<punct>[{};=])
+    | (?P<string>"(?:[^"\\\n]|\\.|\\\n)*")
+    | (?P<raw>`[^`]*`)
+    | (?P<binary>\[[A-Za-z0-9+/=\s]*\])
+    | (?P<datetime>
+        (?P<date>-?\d+/\d{2}/\d{2})
+        (?:[ \t]+(?P<time>\d{1,2}:\d{2}(?::\d{2}(?:\.\d+)?)?)
+        (?:-(?P<zone>[A-Za-z]+(?:[+-]\d{1,2}(?::\d{2})?)?))?)?
+    )
+    | (?P<span>-?(?:\d+d:)?\d+:\d{2}:\d{2}(?:\.\d+)?)
+    | (?P<number>-?\d+(?:\.\d+)?(?:[Ee][+-]?\d+)?)(?P<suffix>BD|bd|[LlFfDd])?
+    | (?P<name>[A-Za-z_][\w.$-]*(?::[A-Za-z_][\w.$-]*)?)
+    """,
+    re.DOTALL | re.VERBOSE,
+)
+_SDL_ESCAPES = {"n": "\n", "r": "\r", "t": "\t"}
+_SDL_KEYWORDS = {"true": True, "false": False, "on": True, "off": False, "null": None}
+
+
+def _sdl_error(message: str, lineno: int) -> DecodeError:
+    msg = f"Cannot parse as SDLang (line {lineno}: {message})"
+    return DecodeError(msg, format="sdl", line=lineno)
+
+
+def _sdl_datetime(match: re.Match[str]) -> datetime.date:
+    year, month, day = (int(x) for x in match.group("date").split("/"))
+    if not match.group("time"):
+        return datetime.date(year, month, day)
+
+    hour, minute, *rest = match.group("time").split(":")
+    second = float(rest[0]) if rest else 0.0
+    tz = None
+    zone = match.group("zone")
+    if zone:
+        offset = re.fullmatch(r"(?:UTC|GMT)(?:([+-])(\d{1,2})(?::(\d{2}))?)?", zone)
+        if not offset:
+            msg = f"unsupported time zone {zone!r}"
+            raise ValueError(msg)
+        sign, hours, minutes = offset.groups()
+        delta = datetime.timedelta(hours=int(hours or 0), minutes=int(minutes or 0))
+        tz = datetime.timezone(-delta if sign == "-" else delta)
+
+    return datetime.datetime(
+        year,
+        month,
+        day,
+        int(hour),
+        int(minute),
+        int(second),
+        round(second % 1 * 1000000),
+        tzinfo=tz,
+    )
+
+
+def _sdl_span(span: str) -> float:
+    sign = -1 if span.startswith("-") else 1
+    days, _, clock = span.lstrip("-").rpartition("d:")
+    hours, minutes, seconds = clock.split(":")
+    delta = datetime.timedelta(
+        days=int(days or 0),
+        hours=int(hours),
+        minutes=int(minutes),
+        seconds=float(seconds),
+    )
+    return sign * delta.total_seconds()
+
+
+def _sdl_tokens(text: str) -> list[tuple[str, Any, int]]:  # noqa: C901, PLR0912.
+    tokens: list[tuple[str, Any, int]] = []
+    pos = 0
+    lineno = 1
+
+    while pos < len(text):
+        match = _SDL_TOKEN.match(text, pos)
+        if not match or match.end() == pos:
+            msg = (
+                "unterminated string"
+                if text[pos] in "\"`"
+                else f"unexpected character {text[pos]!r}"
+            )
+            raise _sdl_error(msg, lineno)
+        kind = cast(str, match.lastgroup)
+        token = match.group()
+
+        if kind == "suffix":
+            kind = "number"
+        if kind in {"newline", "punct"}:
+            tokens.append((token, None, lineno))
+        elif kind == "string":
+            # A backslash at the end of a line continues the string.
+            joined = re.sub(r"\\\n\s*", "", token[1:-1])
+            value = re.sub(
+                r"\\(.)",
+                lambda m: _SDL_ESCAPES.get(m.group(1), m.group(1)),
+                joined,
+            )
+            tokens.append(("value", value, lineno))
+        elif kind == "raw":
+            tokens.append(("value", token[1:-1], lineno))
+        elif kind == "binary":
+            try:
+                encoded = "".join(token[1:-1].split())
+                value = base64.b64decode(encoded, validate=True)
+            except ValueError as e:
+                msg = f"invalid binary literal ({e})"
+                raise _sdl_error(msg, lineno)
+            tokens.append(("value", value, lineno))
+        elif kind == "datetime":
+            try:
+                tokens.append(("value", _sdl_datetime(match), lineno))
+            except ValueError as e:
+                raise _sdl_error(str(e), lineno)
+        elif kind == "span":
+            tokens.append(("value", _sdl_span(token), lineno))
+        elif kind == "number":
+            number = match.group("number")
+            suffix = (match.group("suffix") or "").lower()
+            integer = suffix == "l" or (
+                not suffix and not any(c in number for c in ".Ee")
+            )
+            value = int(number) if integer else float(number)
+            tokens.append(("value", value, lineno))
+        elif kind == "name":
+            if token in _SDL_KEYWORDS:
+                tokens.append(("value", _SDL_KEYWORDS[token], lineno))
+            else:
+                tokens.append(("name", token, lineno))
+
+        lineno += token.count("\n")
+        pos = match.end()
+
+    tokens.append(("eof", None, lineno))
+    return tokens
+
+
+def _sdl_tag(  # noqa: C901.
+    tokens: list[tuple[str, Any, int]], pos: int
+) -> tuple[str, Any, int]:
+    kind, name, lineno = tokens[pos]
+    if kind == "name":
+        pos += 1
+    elif kind == "value":
+        # A tag without a name is an anonymous tag.
+        name = "content"
+    else:
+        msg = f"unexpected {kind!r}"
+        raise _sdl_error(msg, lineno)
+
+    values: list[Any] = []
+    attributes: dict[str, Any] = {}
+    children: dict[str, Any] | None = None
+
+    while tokens[pos][0] not in {"\n", ";", "}", "eof"}:
+        kind, value, lineno = tokens[pos]
+
+        if kind == "{":
+            children, pos = _sdl_tags(tokens, pos + 1, nested=True)
+            break
+        if kind == "value":
+            values.append(value)
+            pos += 1
+        elif kind == "name" and tokens[pos + 1][0] == "=":
+            if tokens[pos + 2][0] != "value":
+                msg = f"expected a value for attribute {value!r}"
+                raise _sdl_error(msg, lineno)
+            attributes[XML_ATTRIBUTE_PREFIX + value] = tokens[pos + 2][1]
+            pos += 3
+        else:
+            msg = f"unexpected {value or kind!r}"
+            raise _sdl_error(msg, lineno)
+
+    if tokens[pos][0] in {"\n", ";"}:
+        pos += 1
+
+    if not attributes and children is None:
+        if len(values) > 1:
+            return name, values, pos
+        return name, values[0] if values else None, pos
+
+    doc: dict[str, Any] = {}
+    if values:
+        doc[XML_TEXT_KEY] = values[0] if len(values) == 1 else values
+    doc.update(attributes)
+    doc.update(children or {})
+
+    return name, doc, pos
+
+
+def _sdl_tags(
+    tokens: list[tuple[str, Any, int]], pos: int, *, nested: bool
+) -> tuple[dict[str, Any], int]:
+    doc: dict[str, Any] = {}
+    repeated: set[str] = set()
+
+    while True:
+        kind, _, lineno = tokens[pos]
+
+        if kind in {"\n", ";"}:
+            pos += 1
+        elif kind == "eof":
+            if nested:
+                msg = "expected '}'"
+                raise _sdl_error(msg, lineno)
+            return doc, pos
+        elif kind == "}":
+            if not nested:
+                msg = "unexpected '}'"
+                raise _sdl_error(msg, lineno)
+            return doc, pos + 1
+        else:
+            name, value, pos = _sdl_tag(tokens, pos)
+            _add_repeated(doc, repeated, name, value)
+
+
+def _decode_sdl(input_data: bytes) -> Document:
+    text = _strip_bom(input_data.decode(UTF_8))
+    text = text.replace("\r\n", "\n")
+
+    doc, _ = _sdl_tags(_sdl_tokens(text), 0, nested=False)
+    return doc
+
+
+_SMILE_HEADER = b":)\n"
+# Shared name and string value tables reset when they are full.
+_SMILE_MAX_SHARED = 1024
+
+
+def _smile_error(message: str, pos: int) -> DecodeError:
+    msg = f"Cannot parse as Smile (offset {pos}: {message})"
+    return DecodeError(msg, format="smile")
+
+
+def _smile_share(table: list[str], value: str) -> None:
+    if len(table) >= _SMILE_MAX_SHARED:
+        table.clear()
+    table.append(value)
+
+
+class _SmileReader:
+    def __init__(self, data: bytes) -> None:
+        if not data.startswith(_SMILE_HEADER) or len(data) < len(_SMILE_HEADER) + 1:
+            msg = "missing the header ':)\\n'"
+            raise _smile_error(msg, 0)
+
+        flags = data[3]
+        if flags >> 4 != 0:
+            msg = f"unsupported version {flags >> 4}"
+            raise _smile_error(msg, 3)
+
+        self.data = data
+        self.pos = 4
+        self.names: list[str] | None = [] if flags & 0x01 else None
+        self.strings: list[str] | None = [] if flags & 0x02 else None
+
+    def byte(self) -> int:
+        if self.pos >= len(self.data):
+            msg = "unexpected end of input"
+            raise _smile_error(msg, self.pos)
+        self.pos += 1
+        return self.data[self.pos - 1]
+
+    def take(self, n: int) -> bytes:
+        if self.pos + n > len(self.data):
+            msg = "unexpected end of input"
+            raise _smile_error(msg, self.pos)
+        self.pos += n
+        return self.data[self.pos - n : self.pos]
+
+    def text(self, n: int) -> str:
+        start = self.pos
+        try:
+            return self.take(n).decode(UTF_8)
+        except UnicodeDecodeError as e:
+            raise _smile_error(str(e), start)
+
+    def until_end_marker(self) -> str:
+        end = self.data.find(b"\xfc", self.pos)
+        if end == -1:
+            msg = "unterminated string"
+            raise _smile_error(msg, self.pos)
+        s = self.text(end - self.pos)
+        self.pos += 1
+        return s
+
+    def vint(self) -> int:
+        # All bytes but the last have 7 bits; the last has 6 and its top bit set.
+        value = 0
+        while True:
+            b = self.byte()
+            if b & 0x80:
+                return (value << 6) | (b & 0x3F)
+            value = (value << 7) | b
+
+    def zigzag(self) -> int:
+        n = self.vint()
+        return (n >> 1) ^ -(n & 1)
+
+    def seven_bit(self, n: int, groups: int) -> int:
+        value = 0
+        for b in self.take(groups):
+            if b & 0x80:
+                msg = "invalid 7-bit byte"
+                raise _smile_error(msg, self.pos)
+            value = (value << 7) | b
+        return value & ((1 << n) - 1)
+
+    def binary(self, length: int) -> bytes:
+        out = bytearray()
+        while len(out) < length:
+            # Each chunk of up to 7 bytes takes one more 7-bit byte.
+            chunk = min(7, length - len(out))
+            start = self.pos
+            value = 0
+            for i, b in enumerate(self.take(chunk + 1)):
+                # The last byte has only the remaining bits of the chunk.
+                bits = chunk if i == chunk else 7
+                if b >> bits:
+                    msg = "invalid 7-bit byte"
+                    raise _smile_error(msg, start + i)
+                value = (value << bits) | b
+            out += value.to_bytes(chunk, "big")
+        return bytes(out)
+
+    def shared(self, table: list[str] | None, index: int) -> str:
+        if table is None or index >= len(table):
+            msg = f"invalid shared string reference {index}"
+            raise _smile_error(msg, self.pos - 1)
+        return table[index]
+
+    def key(self, b: int) -> str:
+        if b == 0x20:
+            return ""
+        if 0x30 <= b <= 0x33:
+            return self.shared(self.names, ((b & 0x03) << 8) | self.byte())
+        if 0x40 <= b <= 0x7F:
+            return self.shared(self.names, b & 0x3F)
+        if b == 0x34:
+            name = self.until_end_marker()
+        elif 0x80 <= b <= 0xBF:
+            name = self.text((b & 0x3F) + 1)
+        elif 0xC0 <= b <= 0xF7:
+            name = self.text((b & 0x3F) + 2)
+        else:
+            msg = f"invalid key token 0x{b:02x}"
+            raise _smile_error(msg, self.pos - 1)
+
+        if self.names is not None and len(name.encode(UTF_8)) <= 64:
+            _smile_share(self.names, name)
+        return name
+
+    def value(self) -> Any:  # noqa: C901, PLR0911, PLR0912.
+        b = self.byte()
+
+        if 0x01 <= b <= 0x1F:
+            return self.shared(self.strings, b - 1)
+        if b in {0x20, 0x21, 0x22, 0x23}:
+            return ("", None, False, True)[b - 0x20]
+        if b in {0x24, 0x25}:
+            return self.zigzag()
+        if b == 0x26:
+            raw = self.binary(self.vint())
+            return int.from_bytes(raw, "big", signed=True)
+        if b == 0x28:
+            return struct.unpack(">f", self.seven_bit(32, 5).to_bytes(4, "big"))[0]
+        if b == 0x29:
+            return struct.unpack(">d", self.seven_bit(64, 10).to_bytes(8, "big"))[0]
+        if b == 0x2A:
+            scale = self.zigzag()
+            unscaled = int.from_bytes(self.binary(self.vint()), "big", signed=True)
+            return float(decimal.Decimal(unscaled).scaleb(-scale))
+        if 0x40 <= b <= 0xBF:
+            # Tiny and short ASCII and Unicode strings.
+            base = (1, 33, 2, 34)[(b >> 5) - 2]
+            s = self.text((b & 0x1F) + base)
+            if self.strings is not None:
+                _smile_share(self.strings, s)
+            return s
+        if 0xC0 <= b <= 0xDF:
+            n = b & 0x1F
+            return (n >> 1) ^ -(n & 1)
+        if b in {0xE0, 0xE4}:
+            return self.until_end_marker()
+        if b == 0xE8:
+            return self.binary(self.vint())
+        if 0xEC <= b <= 0xEF:
+            return self.shared(self.strings, ((b & 0x03) << 8) | self.byte())
+        if b == 0xF8:
+            items = []
+            while self.data[self.pos : self.pos + 1] != b"\xf9":
+                items.append(self.value())
+            self.pos += 1
+            return items
+        if b == 0xFA:
+            doc = {}
+            while (k := self.byte()) != 0xFB:
+                name = self.key(k)
+                doc[name] = self.value()
+            return doc
+        if b == 0xFD:
+            return self.take(self.vint())
+
+        msg = f"invalid value token 0x{b:02x}"
+        raise _smile_error(msg, self.pos - 1)
+
+
+def _decode_smile(input_data: bytes) -> Document:
+    reader = _SmileReader(input_data)
+    doc = reader.value()
+
+    # The end-of-content marker is optional.
+    if reader.data[reader.pos : reader.pos + 1] == b"\xff":
+        reader.pos += 1
+    if reader.pos != len(input_data):
+        msg = "unexpected data after the top-level value"
+        raise _smile_error(msg, reader.pos)
+
+    return cast(Document, doc)
+
+
+def _tnetstring_value(  # noqa: C901.
+    data: bytes, pos: int, limit: int
+) -> tuple[Any, int]:
+    colon = data.find(b":", pos, min(pos + 10, limit))
+    if colon == -1 or not data[pos:colon].isdigit():
+        msg = f"Cannot parse as tnetstring (offset {pos}: expected a length)"
+        raise DecodeError(msg, format="tnetstring")
+
+    end = colon + 1 + int(data[pos:colon])
+    if end >= limit:
+        msg = f"Cannot parse as tnetstring (offset {pos}: value runs past the end)"
+        raise DecodeError(msg, format="tnetstring")
+    payload = data[colon + 1 : end]
+    kind = chr(data[end])
+
+    try:
+        if kind == ",":
+            try:
+                value: Any = payload.decode(UTF_8)
+            except UnicodeDecodeError:
+                value = payload
+        elif kind == "#":
+            value = int(payload)
+        elif kind == "^":
+            value = float(payload)
+        elif kind == "!" and payload in {b"true", b"false"}:
+            value = payload == b"true"
+        elif kind == "~" and not payload:
+            value = None
+        elif kind == "]":
+            value = []
+            i = colon + 1
+            while i < end:
+                item, i = _tnetstring_value(data, i, end)
+                value.append(item)
+        elif kind == "}":
+            value = {}
+            i = colon + 1
+            while i < end:
+                key, i = _tnetstring_value(data, i, end)
+                if not isinstance(key, str) or i >= end:
+                    msg = "a key must be a string followed by a value"
+                    raise ValueError(msg)
+                value[key], i = _tnetstring_value(data, i, end)
+        else:
+            msg = f"invalid type {kind!r}"
+            raise ValueError(msg)
+    except ValueError as e:
+        msg = f"Cannot parse as tnetstring (offset {pos}: {e})"
+        raise DecodeError(msg, format="tnetstring")
+
+    return value, end + 1
+
+
+def _decode_tnetstring(input_data: bytes) -> Document:
+    docs = []
+    pos = 0
+
+    # A stream of several tnetstrings becomes an array.
+    while pos < len(input_data):
+        value, pos = _tnetstring_value(input_data, pos, len(input_data))
+        docs.append(value)
+        while input_data[pos : pos + 1].isspace():
+            pos += 1
+
+    return cast(Document, docs[0] if len(docs) == 1 else docs)
+
+
+_TOML_BARE_KEY = re.compile(r"[A-Za-z0-9_-]+")
+_TOML_BASIC_ESCAPE = re.compile(r"\\(e|x[0-9A-Fa-f]{2}|.)", re.DOTALL)
+_TOML_SHORT_TIME = re.compile(r"\d{2}:\d{2}(?![:\d])")
+
+
+def _toml_error(message: str, lineno: int | None) -> DecodeError:
+    where = f"line {lineno}: " if lineno else ""
+    msg = f"Cannot parse as TOML ({where}{message})"
+    return DecodeError(msg, format="toml", line=lineno)
+
+
+def _toml_string_end(text: str, pos: int, quote: str) -> int:
+    # Return the position after the closing quote or -1.
+    i = pos + len(quote)
+    while i < len(text):
+        if quote[0] == '"' and text[i] == "\\":
+            i += 2
+        elif text.startswith(quote, i):
+            i += len(quote)
+            # A multiline string can end with up to two quotes of its own.
+            extra = 0
+            while len(quote) == 3 and extra < 2 and text[i : i + 1] == quote[0]:
+                i += 1
+                extra += 1
+            return i
+        elif text[i] == "\n" and len(quote) == 1:
+            return -1
+        else:
+            i += 1
+    return -1
+
+
+def _toml_basic_escape(match: re.Match[str]) -> str:
+    escape = match.group(1)
+    if escape == "e":
+        return "\\u001B"
+    if len(escape) == 3:
+        return "\\u00" + escape[1:]
+    return match.group()
+
+
+def _toml_compat(text: str, *, version: str) -> str:  # noqa: C901, PLR0912, PLR0915.
+    # Check for syntax that TOML 0.4 lacks or rewrite TOML 1.1 as TOML 1.0.
+    out: list[str] = []
+    brackets: list[str] = []
+    expect_key = True
+    last_comma = None
+    deferred = 0
+    lineno = 1
+    pos = 0
+
+    while pos < len(text):
+        char = text[pos]
+        inline = bool(brackets) and brackets[-1] == "{"
+        token = char
+
+        if char == "#":
+            end = text.find("\n", pos)
+            token = text[pos:] if end == -1 else text[pos:end]
+            pos += len(token)
+            # TOML 1.1 allows comments in inline tables.
+            if not (inline and version == "1.1"):
+                out.append(token)
+            continue
+
+        if char == "\n":
+            lineno += 1
+            pos += 1
+            if inline and version == "1.1":
+                # Keep the line count by emitting newlines after the table.
+                deferred += 1
+                out.append(" ")
+            else:
+                out.append(char)
+                expect_key = not brackets
+            continue
+
+        if char in "\"'":
+            quote = char * 3 if text.startswith(char * 3, pos) else char
+            end = _toml_string_end(text, pos, quote)
+            if end == -1:
+                out.append(text[pos:])
+                break
+            token = text[pos:end]
+            if char == '"' and version == "1.1":
+                token = _TOML_BASIC_ESCAPE.sub(_toml_basic_escape, token)
+            lineno += token.count("\n")
+            pos = end
+        elif expect_key and _TOML_BARE_KEY.match(text, pos):
+            token = cast("re.Match[str]", _TOML_BARE_KEY.match(text, pos)).group()
+            pos += len(token)
+        elif (
+            version == "1.1"
+            and not expect_key
+            and _TOML_SHORT_TIME.match(text, pos)
+            and text[pos - 1] in " \tTt=[,{"
+        ):
+            # TOML 1.1 makes the seconds optional.
+            token = text[pos : pos + 5] + ":00"
+            pos += 5
+        else:
+            pos += 1
+
+        if expect_key and char not in " \t{[":
+            after = pos
+            while text[after : after + 1] in {" ", "\t"}:
+                after += 1
+            if version == "0.4" and text[after : after + 1] == ".":
+                msg = "dotted keys require TOML 0.5 or later"
+                raise _toml_error(msg, lineno)
+            expect_key = char == ","
+
+        if token == "," and inline:
+            last_comma = len(out)
+            expect_key = True
+        elif token in {"[", "{"}:
+            brackets.append(token)
+            expect_key = token == "{"
+        elif token in {"]", "}"} and brackets:
+            brackets.pop()
+            if token == "}" and version == "1.1":
+                # TOML 1.1 allows a trailing comma in inline tables.
+                if last_comma is not None:
+                    out[last_comma] = " "
+                if deferred and "{" not in brackets:
+                    token += "\n" * deferred
+                    deferred = 0
+        if token.strip() and token != ",":
+            last_comma = None
+
+        out.append(token)
+
+    return "".join(out)
+
+
+def _toml_type(value: Any) -> str:
+    for kind in (bool, int, float, str, datetime.datetime, datetime.date, list):
+        if isinstance(value, kind):
+            return kind.__name__
+    return type(value).__name__
+
+
+def _toml_v04_problem(value: Any) -> str | None:
+    # Describe the first value that TOML 0.4 cannot represent.
+    if isinstance(value, Mapping):
+        value = list(value.values())
+    elif isinstance(value, list):
+        if len({_toml_type(item) for item in value}) > 1:
+            return "arrays must not mix types in TOML 0.4"
+    elif isinstance(value, datetime.datetime):
+        if value.tzinfo is None:
+            return "local date-times require TOML 0.5 or later"
+        return None
+    elif isinstance(value, (datetime.date, datetime.time)):
+        return "local dates and times require TOML 0.5 or later"
+    else:
+        return None
+
+    return next(
+        (problem for item in value if (problem := _toml_v04_problem(item))), None
+    )
+
+
+def _decode_toml(
+    input_data: bytes, *, big_numbers: bool = False, version: str = "1.0"
+) -> Document:
+    text = input_data.decode(UTF_8)
+    if version != "1.0":
+        text = _toml_compat(text.replace("\r\n", "\n"), version=version)
+
+    try:
+        doc = tomllib.loads(text, parse_float=_big_float if big_numbers else float)
+        if version == "0.4" and (problem := _toml_v04_problem(doc)):
+            raise _toml_error(problem, None)
+        return cast(Document, doc)
+    except tomllib.TOMLDecodeError as e:
+        msg = f"Cannot parse as TOML ({e})"
+        # `TOMLDecodeError` only has the position in its message before Python 3.14.
+        match = re.search(r"at line (\d+)", str(e))
+        raise DecodeError(
+            msg, format="toml", line=int(match.group(1)) if match else None
+        )
+
+
+def _xml_element_to_value(  # noqa: C901, PLR0911.
+    element: ElementTree.Element, *, convention: str = "xmltodict"
+) -> Any:
+    attribute_prefix, text_key = _XML_KEYS[convention]
+    value: dict[str, Any] = {
+        attribute_prefix + k: v for k, v in element.attrib.items()
+    }
+    text = [element.text or ""]
+
+    for child in element:
+        child_value = _xml_element_to_value(child, convention=convention)
+
+        # Repeated elements become an array.
+        if child.tag not in value:
+            value[child.tag] = child_value
+        elif isinstance(value[child.tag], list):
+            value[child.tag].append(child_value)
+        else:
+            value[child.tag] = [value[child.tag], child_value]
+
+        text.append(child.tail or "")
+
+    stripped = "".join(text).strip()
+
+    if (
+        convention == "folded"
+        and len(element) > 1
+        and not element.attrib
+        and not stripped
+        and len(value) == 1
+    ):
+        # An element of repeated children becomes an array of them.
+        return next(iter(value.values()))
+
+    if not value and convention != "badgerfish":
+        if stripped:
+            return stripped
+        return "" if convention == "mxj" else None
+
+    if stripped:
+        value[text_key] = stripped
+
+    return value
+
+
+def _ubjson_number(number: decimal.Decimal) -> float | int:
+    # Like JSON, a high-precision number is an integer without a fraction or exponent.
+    if number.is_finite() and number.as_tuple().exponent == 0:
+        return int(number)
+
+    return float(number)
+
+
+def _decode_ubjson(input_data: bytes) -> Document:
+    try:
+        doc = ubjson.loadb(input_data, object_pairs_hook=dict)
+    except ubjson.DecoderException as e:
+        msg = f"Cannot parse as UBJSON ({e})"
+        raise DecodeError(msg, format="ubjson")
+
+    doc = traverse(doc, instance_callbacks=[(decimal.Decimal, _ubjson_number)])
+    return cast(Document, doc)
+
+
+_UCL_TOKEN = re.compile(
+    r"""
+    (?P<space>[ \t\r\f]+|\#[^\n]*)
+    | (?P<newline>\n)
+    | (?P<punct>[{}\[\]=:;,])
+    | (?P<string>"(?:[^"\\\n]|\\.)*")
+    | (?P<single>'(?:[^'\\]|\\.)*')
+    | (?P<heredoc><<([A-Z]+)\n(?:.*?\n)??\7(?=\n|\Z))
+    | (?P<atom>[^\s{}\[\]=:;,"'\#]+(?::(?!\s)[^\s{}\[\]=;,"'\#]*)*)
+    """,
+    re.DOTALL | re.VERBOSE,
+)
+_UCL_MULTIPLIERS = {
+    "k": 1000,
+    "m": 1000**2,
+    "g": 1000**3,
+    "kb": 1024,
+    "mb": 1024**2,
+    "gb": 1024**3,
+}
+_UCL_NUMBER = re.compile(
+    r"([+-]?(?:0x[\dA-Fa-f]+|\d+(?:\.\d+)?(?:[Ee][+-]?\d+)?))"
+    r"(kb|mb|gb|k|m|g|ms|min|s|h|d|w|y)?\Z",
+    re.IGNORECASE,
+)
+_UCL_SECONDS = {
+    "ms": 0.001,
+    "s": 1,
+    "min": 60,
+    "h": 60 * 60,
+    "d": 24 * 60 * 60,
+    "w": 7 * 24 * 60 * 60,
+    "y": 365 * 24 * 60 * 60,
+}
+_UCL_WORDS = {
+    "true": True,
+    "yes": True,
+    "on": True,
+    "false": False,
+    "no": False,
+    "off": False,
+    "null": None,
+}
+
+
+def _ucl_error(message: str, lineno: int) -> DecodeError:
+    msg = f"Cannot parse as UCL (line {lineno}: {message})"
+    return DecodeError(msg, format="ucl", line=lineno)
+
+
+def _ucl_atom(atom: str) -> Any:
+    if atom.lower() in _UCL_WORDS:
+        return _UCL_WORDS[atom.lower()]
+
+    match = _UCL_NUMBER.match(atom)
+    if not match:
+        return atom
+
+    number, suffix = match.group(1), (match.group(2) or "").lower()
+    value: float | int
+    if "x" in number.lower():
+        value = int(number, 16)
+    elif any(c in number for c in ".Ee"):
+        value = float(number)
+    else:
+        value = int(number)
+    if suffix in _UCL_SECONDS:
+        return float(value * _UCL_SECONDS[suffix])
+    return value * _UCL_MULTIPLIERS.get(suffix, 1)
+
+
+def _ucl_tokens(text: str) -> list[tuple[str, Any, int]]:  # noqa: C901.
+    tokens: list[tuple[str, Any, int]] = []
+    pos = 0
+    lineno = 1
+
+    while pos < len(text):
+        if text.startswith("/*", pos):
+            # Comments nest.
+            depth, start = 0, pos
+            while depth or pos == start:
+                if pos >= len(text):
+                    msg = "unterminated comment"
+                    raise _ucl_error(msg, lineno)
+                if text.startswith("/*", pos):
+                    depth += 1
+                    pos += 2
+                elif text.startswith("*/", pos):
+                    depth -= 1
+                    pos += 2
+                else:
+                    pos += 1
+            lineno += text.count("\n", start, pos)
+            continue
+
+        match = _UCL_TOKEN.match(text, pos)
+        if not match:
+            msg = (
+                "unterminated string"
+                if text[pos] in "\"'<"
+                else f"unexpected character {text[pos]!r}"
+            )
+            raise _ucl_error(msg, lineno)
+        kind = cast(str, match.lastgroup)
+        token = match.group()
+
+        if kind in {"newline", "punct"}:
+            tokens.append((token, None, lineno))
+        elif kind == "string":
+            try:
+                tokens.append(("string", json.loads(token), lineno))
+            except json.JSONDecodeError as e:
+                raise _ucl_error(e.msg, lineno)
+        elif kind == "single":
+            value = re.sub(r"\\\n|\\(')", lambda m: m.group(1) or "", token[1:-1])
+            tokens.append(("string", value, lineno))
+        elif kind == "heredoc":
+            terminator = match.group(7)
+            body = token[len(terminator) + 3 : -len(terminator)]
+            if body.endswith("\n"):
+                body = body[:-1]
+            tokens.append(("string", body, lineno))
+        elif kind == "atom":
+            tokens.append(("atom", token, lineno))
+
+        lineno += token.count("\n")
+        pos = match.end()
+
+    tokens.append(("eof", None, lineno))
+    return tokens
+
+
+def _ucl_skip(tokens: list[tuple[str, Any, int]], pos: int, skip: set[str]) -> int:
+    while tokens[pos][0] in skip:
+        pos += 1
+    return pos
+
+
+def _ucl_value(tokens: list[tuple[str, Any, int]], pos: int) -> tuple[Any, int]:
+    kind, value, lineno = tokens[pos]
+
+    if kind == "{":
+        return _ucl_object(tokens, pos + 1, end="}")
+    if kind == "[":
+        items = []
+        pos = _ucl_skip(tokens, pos + 1, {"\n"})
+        while tokens[pos][0] != "]":
+            item, pos = _ucl_value(tokens, pos)
+            items.append(item)
+            pos = _ucl_skip(tokens, pos, {"\n"})
+            if tokens[pos][0] in {",", ";"}:
+                pos = _ucl_skip(tokens, pos + 1, {"\n"})
+            elif tokens[pos][0] != "]":
+                msg = "expected ',' or ']'"
+                raise _ucl_error(msg, tokens[pos][2])
+        return items, pos + 1
+    if kind == "string":
+        return value, pos + 1
+    if kind == "atom":
+        return _ucl_atom(value), pos + 1
+
+    msg = "expected a value" if kind != "eof" else "unexpected end of input"
+    raise _ucl_error(msg, lineno)
+
+
+def _ucl_object(  # noqa: C901.
+    tokens: list[tuple[str, Any, int]], pos: int, *, end: str
+) -> tuple[dict[str, Any], int]:
+    doc: dict[str, Any] = {}
+    repeated: set[str] = set()
+
+    while True:
+        pos = _ucl_skip(tokens, pos, {"\n", ";", ","})
+        kind, key, lineno = tokens[pos]
+
+        if kind == end:
+            return doc, pos + (end != "eof")
+        if kind not in {"atom", "string"}:
+            msg = "expected a key" if kind != "eof" else "expected '}'"
+            raise _ucl_error(msg, lineno)
+        if kind == "atom" and key.startswith("."):
+            msg = f"macros like {key!r} are not supported"
+            raise _ucl_error(msg, lineno)
+        pos += 1
+
+        path = [key]
+        if tokens[pos][0] in {"=", ":"}:
+            pos = _ucl_skip(tokens, pos + 1, {"\n"})
+        else:
+            # `section "name" { ... }` is short for `section { name { ... } }`.
+            names = pos
+            while tokens[names][0] in {"atom", "string"}:
+                names += 1
+            after = _ucl_skip(tokens, names, {"\n"})
+            if tokens[after][0] in {"{", "["}:
+                path.extend(value for _, value, _ in tokens[pos:names])
+                pos = after
+
+        value, pos = _ucl_value(tokens, pos)
+        for name in reversed(path[1:]):
+            value = {name: value}
+
+        # Repeated keys make an implicit array.
+        _add_repeated(doc, repeated, str(path[0]), value)
+
+        if tokens[pos][0] not in {"\n", ";", ",", end, "eof"}:
+            msg = "expected ';' or a newline"
+            raise _ucl_error(msg, tokens[pos][2])
+
+
+def _decode_ucl(input_data: bytes) -> Document:
+    text = _strip_bom(input_data.decode(UTF_8))
+    text = text.replace("\r\n", "\n")
+    tokens = _ucl_tokens(text)
+
+    pos = _ucl_skip(tokens, 0, {"\n"})
+    if tokens[pos][0] == "[":
+        doc, pos = _ucl_value(tokens, pos)
+    else:
+        # The braces around the top-level object are optional.
+        braced = tokens[pos][0] == "{"
+        doc, pos = _ucl_object(tokens, pos + braced, end="}" if braced else "eof")
+
+    pos = _ucl_skip(tokens, pos, {"\n", ";"})
+    if tokens[pos][0] != "eof":
+        msg = "unexpected data after the top-level value"
+        raise _ucl_error(msg, tokens[pos][2])
+
+    return cast(Document, doc)
+
+
+def _unit_error(message: str, lineno: int) -> DecodeError:
+    msg = f"Cannot parse as a unit file (line {lineno}: {message})"
+    return DecodeError(msg, format="unit", line=lineno)
+
+
+def _decode_unit(input_data: bytes, *, infer_types: bool) -> Document:
+    doc: dict[str, Any] = {}
+    repeated: dict[str, set[str]] = {}
+    name = None
+    lines = _strip_bom(input_data.decode(UTF_8)).splitlines()
+    i = 0
+
+    while i < len(lines):
+        lineno = i + 1
+        line = lines[i].strip()
+        i += 1
+
+        if not line or line[0] in "#;":
+            continue
+
+        if line.startswith("["):
+            if not line.endswith("]"):
+                msg = "unterminated section header"
+                raise _unit_error(msg, lineno)
+
+            # A repeated section continues the earlier one, like in systemd.
+            name = line[1:-1]
+            doc.setdefault(name, {})
+            repeated.setdefault(name, set())
+            continue
+
+        # A backslash at the end of a line joins it to the next with a space.
+        while line.endswith("\\") and i < len(lines):
+            continued = lines[i].strip()
+            i += 1
+            if continued[:1] not in {"#", ";"}:
+                line = line[:-1].rstrip() + " " + continued
+
+        key, sep, value = line.partition("=")
+        if not sep or not key.strip():
+            msg = f"expected a key and a value, got {line!r}"
+            raise _unit_error(msg, lineno)
+        if name is None:
+            msg = f"key {key.strip()!r} is outside of a section"
+            raise _unit_error(msg, lineno)
+
+        # Repeated keys become an array.
+        _add_repeated(doc[name], repeated[name], key.strip(), value.strip())
+
+    return _map_values(doc, str, _infer_type) if infer_types else doc
+
+
+_URLENCODED_KEY = re.compile(r"([^\[.]*)((?:\[[^\]]*\]|\.[^\[.]*)*)\Z")
+
+
+def _urlencoded_unquote(text: str) -> str:
+    return urllib.parse.unquote_plus(text, errors="strict")
+
+
+def _urlencoded_key(key: str) -> tuple[tuple[str, ...], bool]:
+    """Turn "a[b][]" or "a.b[]" into ("a", "b") and whether to append to it.
+
+    The key is split before it is decoded,
+    so "%2E" and "%5B" are part of a name like in "a%2Eb".
+    """
+    match = _URLENCODED_KEY.match(key)
+    if not match:
+        return (_urlencoded_unquote(key),), False
+
+    parts = [match.group(1)]
+    parts.extend(
+        part.group(1) if part.group(1) is not None else part.group(2)
+        for part in re.finditer(r"\[([^\]]*)\]|\.([^\[.]*)", match.group(2))
+    )
+    append = len(parts) > 1 and key.endswith("[]")
+
+    return tuple(
+        _urlencoded_unquote(part) for part in (parts[:-1] if append else parts)
+    ), append
+
+
+def _decode_urlencoded(input_data: bytes, *, infer_types: bool) -> Document:
+    text = input_data.decode(UTF_8).strip()
+    if text.startswith("?"):
+        text = text[1:]
+
+    try:
+        pairs = []
+        for pair in text.split("&"):
+            if not pair:
+                continue
+            key, _, value = pair.partition("=")
+            pairs.append((key, *_urlencoded_key(key), _urlencoded_unquote(value)))
+    except UnicodeDecodeError as e:
+        msg = f"Cannot parse as URL-encoded data (invalid UTF-8 in {e.object!r})"
+        raise DecodeError(msg, format="urlencoded")
+
+    # A key that repeats or ends with "[]" is an array.
+    counts = Counter(path for _, path, _, _ in pairs)
+    indices: Counter[tuple[str, ...]] = Counter()
+    items = []
+    for key, path, append, value in pairs:
+        if append or counts[path] > 1:
+            items.append((key, [*path, str(indices[path])], value))
+            indices[path] += 1
+        else:
+            items.append((key, list(path), value))
+
+    try:
+        doc = _unflatten_paths(items)
+    except ValueError as e:
+        msg = f"Cannot parse as URL-encoded data ({e})"
+        raise DecodeError(msg, format="urlencoded")
+
+    return _map_values(doc, str, _infer_type) if infer_types else doc
+
+
+def _decode_xml(input_data: bytes, *, convention: str = "xmltodict") -> Document:
+    try:
+        # Expat 2.4.1 and later protect against exponential entity expansion.
+        # External entities are not loaded.
+        root = ElementTree.fromstring(input_data)  # noqa: S314.
+    except ElementTree.ParseError as e:
+        msg = f"Cannot parse as XML ({e})"
+        raise DecodeError(msg, format="xml", line=e.position[0])
+
+    return {root.tag: _xml_element_to_value(root, convention=convention)}
+
+
+class _YAMLConstructor(ruamel.yaml.constructor.SafeConstructor):
+    # Subclasses from `_yaml_constructor` set these.
+    big_numbers = False
+    last_key_wins = False
+    merge = "expand"
+
+    def construct_big_float(self, node: Any) -> Any:
+        if not self.big_numbers:
+            return self.construct_yaml_float(node)
+
+        try:
+            return _big_float(self.construct_scalar(node).replace("_", ""))
+        except decimal.InvalidOperation:
+            # Infinities, NaN, and YAML 1.1 base 60 numbers like "1:30.5".
+            return self.construct_yaml_float(node)
+
+    def check_mapping_key(
+        self, node: Any, key_node: Any, mapping: Any, key: Any, value: Any
+    ) -> bool:
+        # ruamel.yaml keeps the first value when duplicate keys are allowed.
+        if self.last_key_wins and key in mapping:
+            mapping[key] = value
+            return False
+
+        return bool(super().check_mapping_key(node, key_node, mapping, key, value))
+
+    def flatten_mapping(self, node: Any) -> Any:
+        if self.merge == "expand":
+            return super().flatten_mapping(node)
+
+        for key_node, _ in node.value:
+            if key_node.tag != "tag:yaml.org,2002:merge":
+                continue
+            if self.merge == "error":
+                raise ruamel.yaml.constructor.ConstructorError(
+                    problem='found a merge key "<<"',
+                    problem_mark=key_node.start_mark,
+                )
+            # An ordinary key with the merged map or maps as its value.
+            key_node.tag = "tag:yaml.org,2002:str"
+
+        return None
+
+
+_YAMLConstructor.add_constructor(
+    "tag:yaml.org,2002:float", _YAMLConstructor.construct_big_float
+)
+
+
+def _yaml_constructor(
+    *, big_numbers: bool, duplicate_keys: str | None, merge: str
+) -> type:
+    return type(
+        "YAMLConstructor",
+        (_YAMLConstructor,),
+        {
+            "big_numbers": big_numbers,
+            "last_key_wins": duplicate_keys == "last",
+            "merge": merge,
+        },
+    )
+
+
+def _decode_yaml(
+    input_data: bytes,
+    *,
+    big_numbers: bool = False,
+    duplicate_keys: str | None = None,
+    merge: str = "expand",
+    stream: bool,
+    version: str = "1.2",
+) -> Document:
+    try:
+        yaml = ruamel.yaml.YAML(typ="safe")
+        yaml.Constructor = _yaml_constructor(
+            big_numbers=big_numbers, duplicate_keys=duplicate_keys, merge=merge
+        )
+        yaml.allow_duplicate_keys = duplicate_keys in {"first", "last"}
+        # Without a version, a `%YAML` directive in the input chooses one.
+        if version != "1.2":
+            yaml.version = _yaml_version(version)
+        with warnings.catch_warnings():
+            # YAML 1.1 floats need a dot, but ruamel.yaml reads "1e3" as a float
+            # anyway and only warns.
+            warnings.simplefilter(
+                "ignore", ruamel.yaml.error.MantissaNoDotYAML1_1Warning
+            )
+            docs = list(yaml.load_all(input_data))
+
+        # A stream of several documents becomes an array.
+        if stream or len(docs) > 1:
+            return docs
+        return cast(Document, docs[0] if docs else None)
+    except (
+        ruamel.yaml.constructor.ConstructorError,
+        ruamel.yaml.constructor.DuplicateKeyError,
+        ruamel.yaml.parser.ParserError,
+        ruamel.yaml.scanner.ScannerError,
+    ) as e:
+        msg = f"Cannot parse as YAML ({e})"
+        mark = e.problem_mark
+        raise DecodeError(
+            msg, format="yaml", line=None if mark is None else mark.line + 1
+        )
+
+
+def _yaml_version(version: str) -> tuple[int, int]:
+    major, minor = version.split(".")
+    return int(major), int(minor)
+
+
+def _validate_utf8(input_format: str, input_data: bytes, *, sanitize: bool) -> bytes:
+    # YAML can also be UTF-16 or UTF-32 with a byte order mark.
+    if input_format == "yaml" and input_data.startswith(
+        (b"\xff\xfe", b"\xfe\xff", b"\x00\x00\xfe\xff")
+    ):
+        return input_data
+
+    try:
+        input_data.decode(UTF_8)
+    except UnicodeDecodeError as e:
+        if sanitize:
+            return input_data.decode(UTF_8, errors="replace").encode(UTF_8)
+
+        msg = (
+            f"Cannot parse as {input_format.upper()} "
+            f"(invalid UTF-8 at byte offset {e.start})"
+        )
+        line = input_data[: e.start].count(b"\n") + 1
+        raise DecodeError(msg, format=input_format, line=line)
+
+    return input_data
+
+
+@dataclass(frozen=True)
+class DecodeOptions:
+    asn1_schema: Sequence[str] | None = None
+    asn1_type: str | None = None
+    big_numbers: bool = False
+    bson_types: str = "native"
+    csv_delimiter: str = ","
+    duplicate_keys: str | None = None
+    infer_types: bool = False
+    jsonnet_ext_vars: Mapping[str, str] | None = None
+    jsonnet_path: Sequence[str] | None = None
+    sanitize_utf8: bool = False
+    toml_version: str = "1.0"
+    xml_convention: str = "xmltodict"
+    yaml_merge: str = "expand"
+    yaml_stream: bool = False
+    yaml_version: str = "1.2"
+
+
+def decode(
+    input_format: str,
+    input_data: bytes,
+    options: DecodeOptions | None = None,
+    **kwargs: Any,
+) -> Document:
+    # Keyword arguments override the fields of `options`.
+    options = replace(options or DecodeOptions(), **kwargs)
+
+    decoder: dict[str, Callable[[bytes], Document]] = {
+        "asn1": lambda data: _decode_asn1(
+            data, schema=options.asn1_schema, type_name=options.asn1_type
+        ),
+        "bson": lambda data: _decode_bson(data, types=options.bson_types),
+        "cbor": lambda data: _decode_cbor(data, sanitize_utf8=options.sanitize_utf8),
+        "csv": lambda data: _decode_csv(
+            data,
+            delimiter=options.csv_delimiter,
+            infer_types=options.infer_types,
+            input_format="csv",
+        ),
+        "gron": _decode_gron,
+        "hcl": _decode_hcl,
+        "headers": _decode_headers,
+        "hjson": lambda data: _decode_hjson(
+            data, duplicate_keys=options.duplicate_keys
+        ),
+        "ini": lambda data: _decode_ini(data, infer_types=options.infer_types),
+        "ion": _decode_ion,
+        "json": lambda data: _decode_json(
+            data,
+            big_numbers=options.big_numbers,
+            duplicate_keys=options.duplicate_keys,
+        ),
+        "json5": lambda data: _decode_json5(
+            data,
+            big_numbers=options.big_numbers,
+            duplicate_keys=options.duplicate_keys,
+        ),
+        "jsonc": lambda data: _decode_jsonc(
+            data,
+            big_numbers=options.big_numbers,
+            duplicate_keys=options.duplicate_keys,
+        ),
+        "jsonl": lambda data: _decode_jsonl(
+            data,
+            big_numbers=options.big_numbers,
+            duplicate_keys=options.duplicate_keys,
+        ),
+        "jsonnet": lambda data: _decode_jsonnet(
+            data, ext_vars=options.jsonnet_ext_vars, library_path=options.jsonnet_path
+        ),
+        "kdl": _decode_kdl,
+        "msgpack": lambda data: _decode_msgpack(
+            data, sanitize_utf8=options.sanitize_utf8
+        ),
+        "nestedtext": lambda data: _decode_nestedtext(
+            data, infer_types=options.infer_types
+        ),
+        "parquet": _decode_parquet,
+        "plist": _decode_plist,
+        "properties": lambda data: _decode_properties(
+            data, infer_types=options.infer_types
+        ),
+        "reg": _decode_reg,
+        "ron": _decode_ron,
+        "sdl": _decode_sdl,
+        "smile": _decode_smile,
+        "tnetstring": _decode_tnetstring,
+        "toml": lambda data: _decode_toml(
+            data, big_numbers=options.big_numbers, version=options.toml_version
+        ),
+        "tsv": lambda data: _decode_csv(
+            data,
+            delimiter="\t",
+            infer_types=options.infer_types,
+            input_format="tsv",
+        ),
+        "ubjson": _decode_ubjson,
+        "ucl": _decode_ucl,
+        "unit": lambda data: _decode_unit(data, infer_types=options.infer_types),
+        "urlencoded": lambda data: _decode_urlencoded(
+            data, infer_types=options.infer_types
+        ),
+        "xml": lambda data: _decode_xml(data, convention=options.xml_convention),
+        "yaml": lambda data: _decode_yaml(
+            data,
+            big_numbers=options.big_numbers,
+            duplicate_keys=options.duplicate_keys,
+            merge=options.yaml_merge,
+            stream=options.yaml_stream,
+            version=options.yaml_version,
+        ),
+    }
+
+    if input_format not in decoder:
+        msg = f"Unknown input format: {input_format}"
+        raise ValueError(msg)
+
+    if input_format in TEXT_FORMATS:
+        input_data = _validate_utf8(
+            input_format, input_data, sanitize=options.sanitize_utf8
+        )
+
+    return decoder[input_format](input_data)
+
+
+class TooManyValuesError(BaseException):
+    pass
+
+
+def _verify_roundtrip(
+    doc: Document,
+    encoded: bytes,
+    output_format: str,
+    options: DecodeOptions,
+) -> None:
+    """Decode the output and raise an error if its data differs from `doc`."""
+    if output_format not in INPUT_FORMATS:
+        msg = f"cannot verify the round trip because {output_format} cannot be read"
+        raise EncodeError(msg, format=output_format)
+
+    decoded = decode(output_format, encoded, options)
+    # Compare data wrapped for TOML without the wrapper.
+    if (
+        output_format == "toml"
+        and not isinstance(doc, Mapping)
+        and isinstance(decoded, Mapping)
+        and len(decoded) == 1
+    ):
+        decoded = next(iter(decoded.values()))
+
+    changes = _diff(doc, decoded)
+    if changes:
+        msg = (
+            f"Conversion to {output_format} does not round-trip; "
+            f"reading the output back gives:\n{_format_diff(changes).rstrip()}"
+        )
+        raise EncodeError(msg, format=output_format)
+
+
+# What output formats cannot represent without losing data.
+_STRICT_NO_NULL = {
+    "cheader",
+    "csv",
+    "headers",
+    "ini",
+    "nestedtext",
+    "plist",
+    "properties",
+    "reg",
+    "toml",
+    "tsv",
+    "unit",
+    "urlencoded",
+}
+_STRICT_DATE_TYPES: dict[str, tuple[type, ...]] = {
+    "bson": (datetime.datetime,),
+    "cbor": (datetime.date,),
+    "ion": (datetime.datetime,),
+    "msgpack": (datetime.datetime,),
+    "plist": (datetime.datetime,),
+    "sdl": (datetime.date,),
+    "toml": (datetime.date, datetime.time),
+    "yaml": (datetime.date,),
+}
+_STRICT_BINARY = {
+    "bson",
+    "cbor",
+    "cue",
+    "go",
+    "ion",
+    "msgpack",
+    "plist",
+    "pyliteral",
+    "ron",
+    "sdl",
+    "smile",
+    "sql",
+    "ubjson",
+    "yaml",
+}
+_STRICT_INT_RANGES = {
+    "bson": (-(2**63), 2**63),
+    "go": (-(2**63), 2**64),
+    "msgpack": (-(2**63), 2**64),
+    "plist": (-(2**63), 2**64),
+    "sql": (-(2**63), 2**63),
+    "toml": (-(2**63), 2**63),
+}
+
+
+def _strict_problem(x: Any, output_format: str) -> str | None:  # noqa: PLR0911.
+    if x is None:
+        return "null is not supported" if output_format in _STRICT_NO_NULL else None
+    if isinstance(x, bool):
+        return None
+    if isinstance(x, int):
+        low, high = _STRICT_INT_RANGES.get(output_format, (None, None))
+        if low is not None and high is not None and not low <= x < high:
+            return f"integer {x} is out of range"
+        return None
+    if isinstance(x, (bytes, bytearray)):
+        if output_format in _STRICT_BINARY:
+            return None
+        return "binary data is not supported"
+    if isinstance(x, (datetime.date, datetime.time)):
+        if isinstance(x, _STRICT_DATE_TYPES.get(output_format, ())):
+            return None
+        kind = "date-time" if isinstance(x, datetime.datetime) else type(x).__name__
+        return f"{kind} {x.isoformat()!r} is not supported"
+    return None
+
+
+def _check_strict(doc: Document, output_format: str) -> None:
+    """Raise an error if `output_format` cannot represent all of `doc`."""
+    problems = []
+
+    def walk(x: Any, parts: tuple[str, ...]) -> None:
+        if isinstance(x, Mapping):
+            for k, v in x.items():
+                walk(v, (*parts, str(k)))
+        elif isinstance(x, list):
+            for i, item in enumerate(x):
+                walk(item, (*parts, str(i)))
+        elif problem := _strict_problem(x, output_format):
+            path = _escape_path(parts) if parts else "(root)"
+            problems.append(f"{path}: {problem}")
+
+    walk(doc, ())
+    if problems:
+        msg = f"Conversion to {output_format} would lose data:\n" + "\n".join(
+            problems
+        )
+        raise EncodeError(msg, format=output_format)
+
+
+def _validate_value_count(doc: Document, *, maximum: int) -> None:
+    if maximum < 0:
+        return
+
+    count = 0
+
+    def count_callback(x: Any) -> Any:
+        nonlocal count, maximum
+
+        count += 1
+        if count > maximum:
+            msg = f"document contains too many values (over {maximum})"
+            raise TooManyValuesError(msg)
+
+        return x
+
+    traverse(doc, instance_callbacks=[(object, count_callback)])
+
+
+def _reject_special_keys(key: Any) -> Any:
+    if isinstance(key, bool):
+        msg = "boolean key"
+        raise TypeError(msg)
+
+    if isinstance(key, datetime.date):
+        msg = "date key"
+        raise TypeError(msg)
+
+    if isinstance(key, datetime.datetime):
+        msg = "date-time key"
+        raise TypeError(msg)
+
+    if isinstance(key, datetime.time):
+        msg = "time key"
+        raise TypeError(msg)
+
+    if key is None:
+        msg = "null key"
+        raise TypeError(msg)
+
+    return key
+
+
+def _stringify_special_keys(key: Any) -> Any:
+    if isinstance(key, bool):
+        return "true" if key else "false"
+    if isinstance(key, (datetime.date, datetime.datetime, datetime.time)):
+        return key.isoformat()
+    if key is None:
+        return "null"
+
+    return str(key)
+
+
+def _encode_bson(data: Document) -> bytes:
+    if isinstance(data, Mapping):
+        docs = [data]
+    elif isinstance(data, list) and all(isinstance(x, Mapping) for x in data):
+        docs = data
+    else:
+        msg = (
+            f"Top-level value of type '{type(data).__name__}' cannot "
+            "be encoded as BSON; it must be a map or an array of maps"
+        )
+        raise TypeError(msg)
+
+    bson = _bson()
+    try:
+        # Turn Extended JSON like `{"$oid": "..."}` back into BSON types.
+        revived = traverse(
+            docs,
+            dict_callback=lambda pairs: bson.json_util.object_hook(dict(pairs)),
+        )
+        return b"".join(bson.encode(doc) for doc in revived)
+    except (bson.errors.BSONError, TypeError, ValueError) as e:
+        msg = f"Cannot convert data to BSON ({e})"
+        raise EncodeError(msg, format="bson")
+
+
+def _cbor_head(major: int, n: int) -> bytes:
+    if n < 24:
+        return bytes([major << 5 | n])
+    for info, size in ((24, 1), (25, 2), (26, 4), (27, 8)):
+        if n < 1 << (8 * size):
+            return bytes([major << 5 | info]) + n.to_bytes(size, "big")
+    msg = f"{n} does not fit in 64 bits"
+    raise ValueError(msg)
+
+
+def _cbor_float(x: float) -> bytes:
+    if math.isnan(x):
+        return b"\xf9\x7e\x00"
+    # Use the shortest form that preserves the value.
+    for fmt, info in (("e", 0xF9), ("f", 0xFA)):
+        try:
+            packed = struct.pack(">" + fmt, x)
+        except OverflowError:
+            continue
+        if struct.unpack(">" + fmt, packed)[0] == x:
+            return bytes([info]) + packed
+    return b"\xfb" + struct.pack(">d", x)
+
+
+def _cbor_deterministic(value: Any) -> bytes:  # noqa: C901, PLR0911.
+    if value is None:
+        return b"\xf6"
+    if isinstance(value, bool):
+        return b"\xf5" if value else b"\xf4"
+    if isinstance(value, int):
+        major, n = (0, value) if value >= 0 else (1, -1 - value)
+        if n < 2**64:
+            return _cbor_head(major, n)
+        # Tags 2 and 3 are bignums.
+        raw = n.to_bytes((n.bit_length() + 7) // 8, "big")
+        return _cbor_head(6, 2 + major) + _cbor_head(2, len(raw)) + raw
+    if isinstance(value, float):
+        return _cbor_float(value)
+    if isinstance(value, bytes):
+        return _cbor_head(2, len(value)) + value
+    if isinstance(value, str):
+        raw = value.encode(UTF_8)
+        return _cbor_head(3, len(raw)) + raw
+    if isinstance(value, list):
+        return _cbor_head(4, len(value)) + b"".join(
+            _cbor_deterministic(x) for x in value
+        )
+    if isinstance(value, Mapping):
+        # Keys are sorted by their encoded bytes.
+        pairs = sorted(
+            (_cbor_deterministic(k), _cbor_deterministic(v)) for k, v in value.items()
+        )
+        return _cbor_head(5, len(pairs)) + b"".join(k + v for k, v in pairs)
+    if isinstance(value, datetime.datetime):
+        if value.tzinfo is None:
+            msg = f"naive date-time {value.isoformat()!r} has no time zone"
+            raise ValueError(msg)
+        text = value.isoformat().replace("+00:00", "Z")
+        return b"\xc0" + _cbor_deterministic(text)
+    if isinstance(value, datetime.date):
+        # Tag 1004 is an RFC 3339 full date.
+        return _cbor_head(6, 1004) + _cbor_deterministic(value.isoformat())
+
+    msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _encode_cbor(data: Document, *, canonical: bool = False) -> bytes:
+    if canonical:
+        try:
+            return _cbor_deterministic(data)
+        except (TypeError, ValueError) as e:
+            msg = f"Cannot convert data to deterministic CBOR ({e})"
+            raise EncodeError(msg, format="cbor")
+
+    try:
+        return bytes(cbor2.dumps(data))
+    except cbor2.CBOREncodeError as e:
+        msg = f"Cannot convert data to CBOR ({e})"
+        raise EncodeError(msg, format="cbor")
+
+
+def _json_default_stringify(obj: Any) -> str:
+    if isinstance(obj, (datetime.date, datetime.datetime, datetime.time)):
+        return obj.isoformat()
+    msg = f"{obj!r} is not JSON serializable"
+    raise TypeError(msg)
+
+
+_HCL_IDENTIFIER = re.compile(r"[A-Za-z_][\w-]*\Z")
+# python-hcl2 decodes expressions other than literals to strings like "${var.x}".
+_HCL_EXPRESSION = re.compile(r"\$\{((?:(?!\$\{).)*)\}\Z", re.DOTALL)
+
+
+def _gron_path(path: str, key: str) -> str:
+    if re.fullmatch(r"[A-Za-z_$][\w$]*", key, re.ASCII):
+        return f"{path}.{key}"
+
+    return f"{path}[{json.dumps(key, ensure_ascii=False)}]"
+
+
+def _encode_gron(data: Document, *, sort_keys: bool, stringify: bool) -> str:
+    if stringify:
+        default_callback = _json_default_stringify
+        key_callback = _stringify_special_keys
+    else:
+        default_callback = None
+        key_callback = _reject_special_keys
+
+    lines = []
+
+    def walk(x: Any, path: str) -> None:
+        if isinstance(x, Mapping):
+            lines.append(f"{path} = {{}};")
+            items = sorted(x.items()) if sort_keys else x.items()
+            for k, v in items:
+                walk(v, _gron_path(path, str(k)))
+        elif isinstance(x, list):
+            lines.append(f"{path} = [];")
+            for i, item in enumerate(x):
+                walk(item, f"{path}[{i}]")
+        else:
+            value = json.dumps(x, default=default_callback, ensure_ascii=False)
+            lines.append(f"{path} = {value};")
+
+    try:
+        walk(traverse(data, key_callback=key_callback), "json")
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to gron ({e})"
+        raise EncodeError(msg, format="gron")
+
+    return "".join(line + "\n" for line in lines)
+
+
+def _hcl_string(s: str, *, expressions: bool = False) -> str:
+    escaped = (
+        s.replace("\\", "\\\\")
+        .replace('"', '\\"')
+        .replace("\n", "\\n")
+        .replace("\r", "\\r")
+        .replace("\t", "\\t")
+    )
+    if not expressions:
+        # Keep "${" and "%{" from starting a template.
+        escaped = escaped.replace("${", "$${").replace("%{", "%%{")
+
+    return f'"{escaped}"'
+
+
+def _hcl_key(key: Any, *, expressions: bool = False) -> str:
+    key = str(key)
+    if _HCL_IDENTIFIER.match(key):
+        return key
+
+    return _hcl_string(key, expressions=expressions)
+
+
+def _hcl_expression(  # noqa: C901, PLR0911.
+    value: Any, *, depth: int, expressions: bool, sort_keys: bool
+) -> str:
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if value is None:
+        return "null"
+    if isinstance(value, int):
+        return str(value)
+    if isinstance(value, float):
+        if not math.isfinite(value):
+            msg = f"{value!r} has no HCL literal"
+            raise TypeError(msg)
+        return repr(value)
+    if isinstance(value, str):
+        match = _HCL_EXPRESSION.match(value) if expressions else None
+        return match.group(1) if match else _hcl_string(value, expressions=expressions)
+    if isinstance(value, (datetime.date, datetime.time)):
+        return _hcl_string(value.isoformat())
+
+    indent = "  " * (depth + 1)
+
+    if isinstance(value, list):
+        items = [
+            _hcl_expression(
+                x, depth=depth + 1, expressions=expressions, sort_keys=sort_keys
+            )
+            for x in value
+        ]
+        if not any(isinstance(x, (list, Mapping)) for x in value):
+            return "[" + ", ".join(items) + "]"
+
+        return "[\n" + "".join(f"{indent}{x},\n" for x in items) + "  " * depth + "]"
+
+    if isinstance(value, Mapping):
+        if not value:
+            return "{}"
+
+        pairs = sorted(value.items()) if sort_keys else value.items()
+        lines = [
+            f"{indent}{_hcl_key(k, expressions=expressions)} = "
+            + _hcl_expression(
+                v, depth=depth + 1, expressions=expressions, sort_keys=sort_keys
+            )
+            + "\n"
+            for k, v in pairs
+        ]
+        return "{\n" + "".join(lines) + "  " * depth + "}"
+
+    msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _hcl_is_blocks(value: Any) -> bool:
+    # python-hcl2 decodes blocks to arrays of maps.
+    return (
+        isinstance(value, list)
+        and bool(value)
+        and all(isinstance(x, Mapping) for x in value)
+    )
+
+
+def _hcl_write_body(
+    lines: list[str],
+    body: Mapping[Any, Any],
+    *,
+    depth: int,
+    expressions: bool,
+    sort_keys: bool,
+) -> None:
+    indent = "  " * depth
+    after_block = False
+
+    for key, value in sorted(body.items()) if sort_keys else body.items():
+        if not _hcl_is_blocks(value):
+            if not _HCL_IDENTIFIER.match(str(key)):
+                msg = f"{str(key)!r} is not a valid attribute name"
+                raise ValueError(msg)
+            if after_block:
+                lines.append("")
+
+            expression = _hcl_expression(
+                value, depth=depth, expressions=expressions, sort_keys=sort_keys
+            )
+            lines.append(f"{indent}{key} = {expression}")
+            after_block = False
+            continue
+
+        for block in value:
+            # Separate blocks from what comes before them.
+            if lines and lines[-1] != "" and not lines[-1].endswith("{"):
+                lines.append("")
+
+            # Block labels are nested single-key maps.
+            block_body = block
+            labels = []
+            for _ in range(HCL_BLOCK_LABELS.get(key, 0)):
+                if len(block_body) != 1:
+                    break
+                ((label, inner),) = block_body.items()
+                if not isinstance(inner, Mapping):
+                    break
+                block_body = inner
+                labels.append(_hcl_string(str(label), expressions=expressions))
+
+            header = " ".join([_hcl_key(key, expressions=expressions), *labels])
+            if not block_body:
+                lines.append(f"{indent}{header} {{}}")
+            else:
+                lines.append(f"{indent}{header} {{")
+                _hcl_write_body(
+                    lines,
+                    block_body,
+                    depth=depth + 1,
+                    expressions=expressions,
+                    sort_keys=sort_keys,
+                )
+                lines.append(f"{indent}}}")
+            after_block = True
+
+
+def _encode_hcl(data: Document, *, expressions: bool, sort_keys: bool) -> str:
+    if not isinstance(data, Mapping):
+        msg = (
+            f"Top-level value of type '{type(data).__name__}' cannot "
+            "be encoded as HCL"
+        )
+        raise TypeError(msg)
+
+    lines: list[str] = []
+
+    try:
+        _hcl_write_body(
+            lines, data, depth=0, expressions=expressions, sort_keys=sort_keys
+        )
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to HCL ({e})"
+        raise EncodeError(msg, format="hcl")
+
+    return "".join(line + "\n" for line in lines)
+
+
+def _headers_value(value: Any) -> str:
+    if isinstance(value, bool):
+        value = "true" if value else "false"
+    elif isinstance(value, (datetime.date, datetime.time)):
+        value = value.isoformat()
+    elif isinstance(value, (float, int)):
+        value = str(value)
+
+    if not isinstance(value, str):
+        if value is None:
+            msg = "null values are not supported"
+        elif isinstance(value, (list, Mapping)):
+            msg = "nested arrays and maps are not supported"
+        else:
+            msg = f"values of type '{type(value).__name__}' are not supported"
+        raise TypeError(msg)
+    if "\n" in value or "\r" in value:
+        msg = f"value {value!r} contains a line break"
+        raise ValueError(msg)
+
+    return value
+
+
+def _encode_headers(data: Document, *, sort_keys: bool) -> str:
+    if not isinstance(data, Mapping):
+        msg = (
+            f"Top-level value of type '{type(data).__name__}' cannot "
+            "be encoded as headers"
+        )
+        raise TypeError(msg)
+
+    items = list(cast(Mapping[Any, Any], data).items())
+    if sort_keys:
+        items.sort(key=lambda x: str(x[0]))
+    lines = []
+
+    try:
+        for name, value in items:
+            if not isinstance(name, str) or not _HEADERS_FIELD.match(f"{name}:"):
+                msg = f"key {name!r} is not a valid header name"
+                raise ValueError(msg)
+            # Arrays become repeated headers.
+            for item in value if isinstance(value, list) else [value]:
+                text = _headers_value(item)
+                lines.append(f"{name}: {text}\n" if text else f"{name}:\n")
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to headers ({e})"
+        raise EncodeError(msg, format="headers")
+
+    return "".join(lines)
+
+
+def _encode_ion(data: Document, *, ion_format: str, sort_keys: bool) -> bytes:
+    ion = _ion()
+
+    def day_timestamp(date: datetime.date) -> Any:
+        return ion.core.Timestamp(
+            date.year,
+            date.month,
+            date.day,
+            precision=ion.core.TimestampPrecision.DAY,
+        )
+
+    doc = traverse(
+        data,
+        dict_callback=(lambda pairs: dict(sorted(pairs))) if sort_keys else dict,
+        instance_callbacks=[
+            (datetime.datetime, identity),
+            (datetime.date, day_timestamp),
+        ],
+    )
+
+    try:
+        if ion_format == "binary":
+            return bytes(ion.simpleion.dumps(doc, binary=True))
+
+        text = ion.simpleion.dumps(
+            doc,
+            binary=False,
+            indent="  ",
+            omit_version_marker=True,
+        )
+        return (text + "\n").encode(UTF_8)
+    except (ion.exceptions.IonException, TypeError, ValueError) as e:
+        msg = f"Cannot convert data to Ion ({e})"
+        raise EncodeError(msg, format="ion")
+
+
+def _csv_value(value: Any) -> str:
+    if value is None:
+        return ""
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, (float, int, str)):
+        return str(value)
+    if isinstance(value, (datetime.date, datetime.datetime, datetime.time)):
+        return value.isoformat()
+
+    if isinstance(value, (list, Mapping)):
+        msg = "nested arrays and maps are not supported"
+    else:
+        msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _encode_csv(
+    data: Document,
+    *,
+    columns: Sequence[str] | None,
+    delimiter: str,
+    sort_keys: bool,
+) -> str:
+    if not isinstance(data, list) or not all(isinstance(x, Mapping) for x in data):
+        msg = (
+            f"Top-level value of type '{type(data).__name__}' cannot "
+            "be encoded as CSV; it must be an array of maps"
+        )
+        raise TypeError(msg)
+
+    first = list(columns or ())
+    seen = dict.fromkeys(str(key) for row in data for key in row)
+    rest = [column for column in seen if column not in first]
+    header = first + (sorted(rest) if sort_keys else rest)
+
+    output = StringIO()
+    writer = csv.writer(output, delimiter=delimiter, lineterminator="\n")
+    try:
+        writer.writerow(header)
+        for i, row in enumerate(data):
+            values = {str(key): value for key, value in row.items()}
+            try:
+                writer.writerow(
+                    [_csv_value(values.get(column)) for column in header]
+                )
+            except TypeError as e:
+                msg = f"{e} (row {i + 1})"
+                raise TypeError(msg) from None
+    except (csv.Error, TypeError) as e:
+        msg = f"Cannot convert data to CSV ({e})"
+        raise EncodeError(msg, format="csv")
+
+    return output.getvalue()
+
+
+def _encode_hjson(data: Document, *, sort_keys: bool, stringify: bool) -> str:
+    if stringify:
+        default_callback = _json_default_stringify
+        key_callback = _stringify_special_keys
+    else:
+        default_callback = None
+        key_callback = _reject_special_keys
+
+    try:
+        return (
+            hjson.dumps(
+                traverse(
+                    data,
+                    key_callback=key_callback,
+                ),
+                default=default_callback,
+                ensure_ascii=False,
+                sort_keys=sort_keys,
+            )
+            + "\n"
+        )
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to HJSON ({e})"
+        raise EncodeError(msg, format="hjson")
+
+
+_INI_KEY = re.compile(r"[^\s\[#;=:][^\n=:]*(?<=\S)\Z")
+
+
+def _ini_value(value: Any) -> str:
+    if isinstance(value, bool):
+        text = "true" if value else "false"
+    elif isinstance(value, (datetime.date, datetime.time)):
+        text = value.isoformat()
+    elif isinstance(value, (float, int, str)):
+        text = str(value)
+    elif value is None:
+        msg = "null values are not supported"
+        raise TypeError(msg)
+    else:
+        msg = f"values of type '{type(value).__name__}' are not supported"
+        raise TypeError(msg)
+
+    # The decoder splits lines like `str.splitlines` and strips them.
+    # A blank line or a comment ends a multi-line value.
+    lines = text.split("\n")
+    if (
+        len(f"{text}.".splitlines()) != len(lines)
+        or any(line != line.strip() for line in lines)
+        or any(not line or line[0] in "#;" for line in lines[1:])
+    ):
+        msg = f"value {text!r} would not read back the same from INI"
+        raise ValueError(msg)
+
+    # Indented lines continue a value.
+    return "\n    ".join(lines)
+
+
+def _ini_pairs(
+    lines: list[str], pairs: Sequence[tuple[Any, Any]], *, section: str | None
+) -> None:
+    for key, value in pairs:
+        if not _INI_KEY.match(str(key)):
+            msg = f"{str(key)!r} is not a valid key"
+            raise ValueError(msg)
+        if isinstance(value, (list, Mapping)):
+            where = "at the top level" if section is None else f"in section {section!r}"
+            msg = (
+                f"key {str(key)!r} {where} has a value of type "
+                f"'{type(value).__name__}'; use \"--flatten\" for nested data"
+            )
+            raise TypeError(msg)
+
+        lines.append(f"{key} = {_ini_value(value)}")
+
+
+def _encode_ini(data: Document, *, sort_keys: bool) -> str:
+    if not isinstance(data, Mapping):
+        msg = (
+            f"Top-level value of type '{type(data).__name__}' cannot "
+            "be encoded as INI"
+        )
+        raise TypeError(msg)
+
+    items = sorted(data.items()) if sort_keys else list(data.items())
+    lines: list[str] = []
+
+    try:
+        # Keys outside sections must come first.
+        _ini_pairs(
+            lines,
+            [(k, v) for k, v in items if not isinstance(v, Mapping)],
+            section=None,
+        )
+
+        for name, section in items:
+            if not isinstance(section, Mapping):
+                continue
+            if not _INI_KEY.match(str(name)) or "]" in str(name):
+                msg = f"{str(name)!r} is not a valid section name"
+                raise ValueError(msg)
+
+            if lines:
+                lines.append("")
+            lines.append(f"[{name}]")
+            _ini_pairs(
+                lines,
+                sorted(section.items()) if sort_keys else list(section.items()),
+                section=str(name),
+            )
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to INI ({e})"
+        raise EncodeError(msg, format="ini")
+
+    return "".join(line + "\n" for line in lines)
+
+
+# What output formats can write decimals from `--big-numbers` exactly.
+_BIG_NUMBER_FORMATS = {"json", "jsonl", "toml", "yaml"}
+
+
+class _FormattedFloat(decimal.Decimal):
+    """A float with the text `--float-format` gave it."""
+
+    text: str
+
+
+def _decimal_text(number: decimal.Decimal) -> str:
+    if isinstance(number, _FormattedFloat):
+        return number.text
+
+    # Without an exponent, and with a fraction, so it stays a float.
+    text = format(number, "f")
+    return text if "." in text else text + ".0"
+
+
+def _json_non_finite(x: float, *, style: str) -> Any:
+    if math.isfinite(x):
+        return x
+    if style == "null":
+        return None
+    if style == "string":
+        # "NaN", "Infinity", or "-Infinity", like in JavaScript.
+        return json.dumps(x)
+
+    msg = f'{x} is not valid JSON; use "--non-finite null" or "--non-finite string"'
+    raise ValueError(msg)
+
+
+def _encode_json(
+    data: Document,
+    *,
+    indent: bool | int | None,
+    non_finite: str | None = None,
+    sort_keys: bool,
+    stringify: bool,
+) -> str:
+    if indent is True:
+        indent = JSON_INDENT_TRUE
+
+    separators = (",", ": " if indent else ":")
+
+    if stringify:
+        default_callback = _json_default_stringify
+        key_callback = _stringify_special_keys
+    else:
+        default_callback = None
+        key_callback = _reject_special_keys
+
+    # `json` cannot write decimals, so they become unique strings at first.
+    marker = secrets.token_hex(8)
+    numbers: dict[str, str] = {}
+
+    def decimal_placeholder(number: decimal.Decimal) -> str:
+        placeholder = f"{marker}-{len(numbers)}"
+        numbers[f'"{placeholder}"'] = _decimal_text(number)
+        return placeholder
+
+    instance_callbacks: list[tuple[type, Any]] = [
+        (decimal.Decimal, decimal_placeholder)
+    ]
+    # Without a style, `json` writes them like JavaScript, which is not valid JSON.
+    if non_finite is not None:
+        instance_callbacks.append(
+            (float, lambda x: _json_non_finite(x, style=non_finite))
+        )
+
+    try:
+        text = json.dumps(
+            traverse(
+                data,
+                key_callback=key_callback,
+                instance_callbacks=instance_callbacks,
+            ),
+            default=default_callback,
+            ensure_ascii=False,
+            indent=indent,
+            separators=separators,
+            sort_keys=sort_keys,
+        )
+        if numbers:
+            text = re.sub(f'"{marker}-\\d+"', lambda m: numbers[m.group()], text)
+
+        return text + "\n"
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to JSON ({e})"
+        raise EncodeError(msg, format="json")
+
+
+def _jcs_number(x: float) -> str:
+    """Format a number like ECMAScript, as RFC 8785 requires."""
+    if math.isnan(x) or math.isinf(x):
+        msg = f"{x} is not supported"
+        raise ValueError(msg)
+    if x == 0:
+        return "0"
+
+    sign = "-" if x < 0 else ""
+    # `repr` gives the shortest digits that round-trip, like ECMAScript.
+    _, digit_tuple, exponent = decimal.Decimal(repr(abs(x))).normalize().as_tuple()
+    digits = "".join(map(str, digit_tuple))
+    k = len(digits)
+    # The value is 0.<digits> * 10**n.
+    n = k + cast(int, exponent)
+
+    if k <= n <= 21:
+        text = digits + "0" * (n - k)
+    elif 0 < n <= 21:
+        text = digits[:n] + "." + digits[n:]
+    elif -6 < n <= 0:
+        text = "0." + "0" * -n + digits
+    else:
+        e = n - 1
+        text = digits[0] + ("." + digits[1:] if k > 1 else "")
+        text += f"e{'+' if e > 0 else '-'}{abs(e)}"
+
+    return sign + text
+
+
+def _jcs_value(x: Any, *, stringify: bool) -> str:  # noqa: C901, PLR0911.
+    if x is None:
+        return "null"
+    if isinstance(x, bool):
+        return "true" if x else "false"
+    if isinstance(x, int):
+        # JSON numbers are IEEE 754 doubles in RFC 8785.
+        try:
+            exact = float(x) == x
+        except OverflowError:
+            exact = False
+        if not exact:
+            msg = f"integer {x} cannot be represented exactly"
+            raise ValueError(msg)
+        return _jcs_number(float(x))
+    if isinstance(x, (decimal.Decimal, float)):
+        return _jcs_number(float(x))
+    if isinstance(x, str):
+        return json.dumps(x, ensure_ascii=False)
+    if isinstance(x, list):
+        return "[" + ",".join(_jcs_value(v, stringify=stringify) for v in x) + "]"
+    if isinstance(x, Mapping):
+        key_callback = _stringify_special_keys if stringify else _reject_special_keys
+        items = [(str(key_callback(k)), v) for k, v in x.items()]
+        # Keys sort by their UTF-16 code units.
+        items.sort(key=lambda item: item[0].encode("utf-16-be"))
+        members = (
+            json.dumps(k, ensure_ascii=False) + ":" + _jcs_value(v, stringify=stringify)
+            for k, v in items
+        )
+        return "{" + ",".join(members) + "}"
+    if stringify:
+        return json.dumps(_json_default_stringify(x))
+
+    msg = f"{x!r} is not JSON serializable"
+    raise TypeError(msg)
+
+
+def _encode_jcs(data: Document, *, non_finite: str, stringify: bool) -> str:
+    try:
+        data = _map_values(
+            data, float, lambda x: _json_non_finite(x, style=non_finite)
+        )
+        # Canonical JSON has no whitespace, not even a final newline.
+        return _jcs_value(data, stringify=stringify)
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to canonical JSON ({e})"
+        raise EncodeError(msg, format="json")
+
+
+def _encode_jsonl(
+    data: Document, *, non_finite: str | None = None, sort_keys: bool, stringify: bool
+) -> str:
+    if not isinstance(data, list):
+        msg = (
+            f"Top-level value of type '{type(data).__name__}' cannot "
+            "be encoded as JSON Lines; it must be an array"
+        )
+        raise TypeError(msg)
+
+    return "".join(
+        _encode_json(
+            item,
+            indent=None,
+            non_finite=non_finite,
+            sort_keys=sort_keys,
+            stringify=stringify,
+        )
+        for item in data
+    )
+
+
+_KDL_IDENTIFIER = re.compile(r'(?![+-]?\.?\d)[^\s\\/(){}<>;\[\]=,"#]+\Z')
+_KDL_STRING_ESCAPES = {
+    '"': '\\"',
+    "\\": "\\\\",
+    "\b": "\\b",
+    "\f": "\\f",
+    "\n": "\\n",
+    "\r": "\\r",
+    "\t": "\\t",
+}
+
+
+def _kdl_quote(s: str) -> str:
+    def escape(char: str) -> str:
+        if char in _KDL_STRING_ESCAPES:
+            return _KDL_STRING_ESCAPES[char]
+        # KDL forbids control characters and treats some as newlines.
+        if not char.isprintable() and char != " ":
+            return f"\\u{{{ord(char):x}}}"
+        return char
+
+    return '"' + "".join(escape(char) for char in s) + '"'
+
+
+def _kdl_name(key: Any) -> str:
+    name = str(key)
+    if (
+        isinstance(key, str)
+        and _KDL_IDENTIFIER.match(name)
+        and name.isprintable()
+        and name not in _KDL_KEYWORDS
+    ):
+        return name
+
+    return _kdl_quote(name)
+
+
+def _kdl_scalar(value: Any) -> str:  # noqa: PLR0911.
+    if value is None:
+        return "#null"
+    if isinstance(value, bool):
+        return "#true" if value else "#false"
+    if isinstance(value, int):
+        return str(value)
+    if isinstance(value, float):
+        if math.isnan(value):
+            return "#nan"
+        if math.isinf(value):
+            return "#inf" if value > 0 else "#-inf"
+        return repr(value)
+    if isinstance(value, (datetime.date, datetime.datetime, datetime.time)):
+        return _kdl_quote(value.isoformat())
+    if isinstance(value, str):
+        return _kdl_quote(value)
+
+    msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _kdl_is_scalar(value: Any) -> bool:
+    return not isinstance(value, (list, Mapping))
+
+
+def _kdl_write_node(  # noqa: C901.
+    lines: list[str], name: str, value: Any, indent: str
+) -> None:
+    if isinstance(value, Mapping):
+        args = value.get("-", [])
+        if not isinstance(args, list):
+            args = [args]
+        if args and all(_kdl_is_scalar(arg) for arg in args):
+            value = {k: v for k, v in value.items() if k != "-"}
+        else:
+            args = []
+
+        head = indent + name + "".join(" " + _kdl_scalar(arg) for arg in args)
+        # Always write a block so that the node reads back as a map.
+        if not value:
+            lines.append(head + " {}")
+            return
+        lines.append(head + " {")
+        for k, v in value.items():
+            _kdl_write_node(lines, _kdl_name(k), v, indent + "    ")
+        lines.append(indent + "}")
+
+    elif isinstance(value, list) and all(_kdl_is_scalar(item) for item in value):
+        lines.append(indent + name + "".join(" " + _kdl_scalar(x) for x in value))
+
+    elif isinstance(value, list):
+        for item in value:
+            if isinstance(item, list) and not all(_kdl_is_scalar(x) for x in item):
+                # An array in an array is a node with children named "-".
+                lines.append(indent + name + " {")
+                for x in item:
+                    _kdl_write_node(lines, "-", x, indent + "    ")
+                lines.append(indent + "}")
+            else:
+                _kdl_write_node(lines, name, item, indent)
+
+    else:
+        lines.append(indent + name + " " + _kdl_scalar(value))
+
+
+def _encode_kdl(data: Document, *, sort_keys: bool) -> str:
+    if not isinstance(data, Mapping):
+        msg = (
+            f"Top-level value of type '{type(data).__name__}' cannot "
+            "be encoded as KDL"
+        )
+        raise TypeError(msg)
+
+    if sort_keys:
+        data = traverse(
+            data,
+            dict_callback=lambda pairs: dict(sorted(pairs, key=lambda x: str(x[0]))),
+        )
+
+    lines: list[str] = []
+    try:
+        for k, v in cast(Mapping[Any, Any], data).items():
+            _kdl_write_node(lines, _kdl_name(k), v, "")
+    except TypeError as e:
+        msg = f"Cannot convert data to KDL ({e})"
+        raise EncodeError(msg, format="kdl")
+
+    return "".join(line + "\n" for line in lines)
+
+
+def _msgpack_reject_local_datetime(obj: datetime.datetime) -> None:
+    if obj.tzinfo is None:
+        msg = "'datetime.datetime' without a time zone is unsupported"
+        raise TypeError(msg)
+
+
+def _encode_msgpack(data: Document) -> bytes:
+    try:
+        traverse(
+            data,
+            instance_callbacks=[(datetime.datetime, _msgpack_reject_local_datetime)],
+        )
+
+        return umsgpack.packb(data)
+    except (TypeError, umsgpack.UnsupportedTypeException) as e:
+        msg = f"Cannot convert data to MessagePack ({e})"
+        raise EncodeError(msg, format="msgpack")
+
+
+TOMLPath = Tuple[Union[int, str], ...]
+
+
+def _nestedtext_string(value: Any) -> str:
+    if value is None:
+        return ""
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, (float, int, str)):
+        return str(value)
+    if isinstance(value, (datetime.date, datetime.datetime, datetime.time)):
+        return value.isoformat()
+
+    msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _encode_nestedtext(data: Document, *, sort_keys: bool) -> str:
+    try:
+        # NestedText only has strings, so convert the other scalars.
+        doc = traverse(
+            data,
+            key_callback=_nestedtext_string,
+            default_callback=_nestedtext_string,
+        )
+        encoded = nestedtext.dumps(doc, indent=4, sort_keys=sort_keys)
+    except (TypeError, nestedtext.NestedTextError) as e:
+        msg = f"Cannot convert data to NestedText ({e})"
+        raise EncodeError(msg, format="nestedtext")
+
+    return encoded + "\n" if encoded else encoded
+
+
+def _plist_naive_utc(obj: datetime.datetime) -> datetime.datetime:
+    if obj.tzinfo is None:
+        return obj
+
+    return obj.astimezone(datetime.timezone.utc).replace(tzinfo=None)
+
+
+def _encode_plist(data: Document, *, plist_format: str, sort_keys: bool) -> bytes:
+    try:
+        # `plistlib` writes the fields of a date-time as is and assumes UTC.
+        doc = traverse(
+            data,
+            instance_callbacks=[(datetime.datetime, _plist_naive_utc)],
+        )
+
+        return plistlib.dumps(
+            doc,
+            fmt=plistlib.FMT_BINARY if plist_format == "binary" else plistlib.FMT_XML,
+            sort_keys=sort_keys,
+        )
+    except (OverflowError, TypeError) as e:
+        msg = f"Cannot convert data to property list ({e})"
+        raise EncodeError(msg, format="plist")
+
+
+def _properties_escape(s: str, *, key: bool) -> str:
+    escaped = ""
+
+    for i, char in enumerate(s):
+        if char == "\\":
+            escaped += "\\\\"
+        elif char in "\f\n\r\t":
+            escaped += "\\" + {"\f": "f", "\n": "n", "\r": "r", "\t": "t"}[char]
+        elif (key and char in " :=#!") or (char == " " and i == 0):
+            escaped += "\\" + char
+        elif " " <= char <= "~":
+            escaped += char
+        else:
+            # Escape everything outside printable ASCII,
+            # so the file reads the same as ISO 8859-1 and UTF-8.
+            for unit in range(0, len(char.encode("utf-16-be")), 2):
+                code = char.encode("utf-16-be")[unit : unit + 2]
+                escaped += f"\\u{int.from_bytes(code, 'big'):04x}"
+
+    return escaped
+
+
+def _properties_value(value: Any) -> str:
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, (datetime.date, datetime.time)):
+        return value.isoformat()
+    if isinstance(value, (float, int, str)):
+        return str(value)
+
+    if value is None:
+        msg = "null values are not supported"
+    elif isinstance(value, (list, Mapping)):
+        msg = "empty arrays and maps are not supported"
+    else:
+        msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _properties_key(key: Any) -> Any:
+    # Dots separate the keys of nested maps in properties.
+    if "." in str(key):
+        msg = f"key {key!r} contains a dot, which Java properties cannot escape"
+        raise ValueError(msg)
+
+    return key
+
+
+def _encode_properties(data: Document, *, flat: bool, sort_keys: bool) -> str:
+    if not isinstance(data, (list, Mapping)):
+        msg = (
+            f"Top-level value of type '{type(data).__name__}' cannot "
+            "be encoded as Java properties"
+        )
+        raise TypeError(msg)
+
+    lines = []
+
+    try:
+        # The dots in the keys of data from `--flatten` are already separators.
+        if not flat:
+            traverse(data, key_callback=_properties_key)
+        # An empty array stays an array when flattened.
+        flat = cast(Mapping[str, Any], _flatten(data) or {})
+
+        for key, value in sorted(flat.items()) if sort_keys else flat.items():
+            lines.append(
+                _properties_escape(key, key=True)
+                + "="
+                + _properties_escape(_properties_value(value), key=False)
+                + "\n"
+            )
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to Java properties ({e})"
+        raise EncodeError(msg, format="properties")
+
+    return "".join(lines)
+
+
+def _reg_quote(s: str) -> str:
+    return '"' + s.replace("\\", "\\\\").replace('"', '\\"') + '"'
+
+
+def _reg_line_break(s: str) -> bool:
+    # The decoder splits lines like `str.splitlines`.
+    return len(f"{s}.".splitlines()) > 1
+
+
+def _reg_hex(kind: int | None, raw: bytes) -> str:
+    prefix = "hex:" if kind is None else f"hex({kind:x}):"
+    return prefix + ",".join(f"{byte:02x}" for byte in raw)
+
+
+def _reg_value(value: Any) -> str:  # noqa: PLR0911.
+    if value is None:
+        return "-"
+    if isinstance(value, bool):
+        value = int(value)
+    if isinstance(value, int):
+        if 0 <= value < 2**32:
+            return f"dword:{value:08x}"
+        if 0 <= value < 2**64:
+            return _reg_hex(11, value.to_bytes(8, "little"))
+        msg = f"integer {value} is out of range"
+        raise ValueError(msg)
+    if isinstance(value, str):
+        # Quoted strings cannot span lines.
+        if _reg_line_break(value):
+            return _reg_hex(1, (value + "\0").encode("utf-16-le"))
+        return _reg_quote(value)
+    if isinstance(value, bytes):
+        return _reg_hex(None, value)
+    if isinstance(value, list) and all(isinstance(x, str) for x in value):
+        raw = "".join(x + "\0" for x in [*value, ""]).encode("utf-16-le")
+        return _reg_hex(7, raw)
+
+    msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _encode_reg(data: Document, *, sort_keys: bool) -> bytes:  # noqa: C901.
+    if not isinstance(data, Mapping):
+        msg = (
+            f"Top-level value of type '{type(data).__name__}' cannot "
+            "be encoded as a registry file"
+        )
+        raise TypeError(msg)
+
+    lines = [_REG_HEADER, ""]
+
+    def walk(parent: str, name: str, key: Mapping[Any, Any]) -> None:
+        path = f"{parent}\\{name}" if parent else name
+
+        # A backslash separates key names in a path.
+        if "\\" in name or _reg_line_break(name):
+            msg = f"key name {name!r} cannot contain a backslash or a line break"
+            raise ValueError(msg)
+
+        if name.startswith("-"):
+            if key:
+                msg = f"deleted key {path!r} must be empty"
+                raise ValueError(msg)
+            lines.extend([f"[-{path[: len(path) - len(name)]}{name[1:]}]", ""])
+            return
+
+        items = sorted(key.items()) if sort_keys else list(key.items())
+        values = [(k, v) for k, v in items if not isinstance(v, Mapping)]
+
+        # Keys that only contain other keys are created implicitly.
+        if values or len(values) == len(items):
+            lines.append(f"[{path}]")
+            for k, v in values:
+                if _reg_line_break(str(k)):
+                    msg = f"value name {k!r} cannot contain a line break"
+                    raise ValueError(msg)
+                value_name = "@" if k == "@" else _reg_quote(str(k))
+                lines.append(f"{value_name}={_reg_value(v)}")
+            lines.append("")
+
+        for k, v in items:
+            if isinstance(v, Mapping):
+                walk(path, str(k), v)
+
+    try:
+        for root, key in sorted(data.items()) if sort_keys else data.items():
+            if not isinstance(key, Mapping):
+                msg = f"value {root!r} is not under a key"
+                raise ValueError(msg)
+            walk("", str(root), key)
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to a registry file ({e})"
+        raise EncodeError(msg, format="reg")
+
+    # Write UTF-16 with a byte order mark and CRLF like Registry Editor.
+    return "\ufeff".encode("utf-16-le") + "\r\n".join(lines).encode("utf-16-le")
+
+
+_RON_IDENTIFIER = re.compile(r"[A-Za-z_]\w*\Z", re.ASCII)
+_RON_KEYWORDS = {"None", "NaN", "Some", "false", "inf", "true"}
+
+
+def _ron_string(value: str) -> str:
+    def escape(char: str) -> str:
+        if char in "\"\\":
+            return "\\" + char
+        if char in "\n\r\t":
+            return {"\n": "\\n", "\r": "\\r", "\t": "\\t"}[char]
+        if not char.isprintable():
+            return f"\\u{{{ord(char):x}}}"
+        return char
+
+    return '"' + "".join(escape(char) for char in value) + '"'
+
+
+def _ron_scalar(value: Any) -> str:  # noqa: C901, PLR0911.
+    if value is None:
+        return "None"
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, int):
+        return str(value)
+    if isinstance(value, float):
+        if math.isnan(value):
+            return "NaN"
+        if math.isinf(value):
+            return "inf" if value > 0 else "-inf"
+        return repr(value)
+    if isinstance(value, bytes):
+        escaped = "".join(
+            chr(byte) if 0x20 <= byte < 0x7F and chr(byte) not in "\"\\"
+            else f"\\x{byte:02x}"
+            for byte in value
+        )
+        return f'b"{escaped}"'
+    if isinstance(value, (datetime.date, datetime.datetime, datetime.time)):
+        value = value.isoformat()
+    if isinstance(value, str):
+        return _ron_string(value)
+
+    msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _ron_expression(value: Any, indent: str) -> str:
+    inner = indent + "    "
+
+    if isinstance(value, Mapping):
+        if not value:
+            return "{}"
+
+        # A map with identifier keys is written as a struct.
+        if all(
+            isinstance(k, str) and _RON_IDENTIFIER.match(k) and k not in _RON_KEYWORDS
+            for k in value
+        ):
+            fields = "".join(
+                f"{inner}{k}: {_ron_expression(v, inner)},\n" for k, v in value.items()
+            )
+            return "(\n" + fields + indent + ")"
+
+        entries = "".join(
+            f"{inner}{_ron_scalar(k)}: {_ron_expression(v, inner)},\n"
+            for k, v in value.items()
+        )
+        return "{\n" + entries + indent + "}"
+
+    if isinstance(value, list):
+        if not any(isinstance(x, (list, Mapping)) for x in value):
+            return "[" + ", ".join(_ron_scalar(x) for x in value) + "]"
+        items = "".join(f"{inner}{_ron_expression(x, inner)},\n" for x in value)
+        return "[\n" + items + indent + "]"
+
+    return _ron_scalar(value)
+
+
+def _encode_ron(data: Document, *, sort_keys: bool) -> str:
+    if sort_keys:
+        data = traverse(
+            data,
+            dict_callback=lambda pairs: dict(sorted(pairs, key=lambda x: str(x[0]))),
+        )
+
+    try:
+        return _ron_expression(data, "") + "\n"
+    except TypeError as e:
+        msg = f"Cannot convert data to RON ({e})"
+        raise EncodeError(msg, format="ron")
+
+
+_SDL_IDENTIFIER = re.compile(r"[A-Za-z_][\w.$-]*(?::[A-Za-z_][\w.$-]*)?\Z", re.ASCII)
+
+
+def _sdl_name(key: Any) -> str:
+    if not isinstance(key, str) or not _SDL_IDENTIFIER.match(key):
+        msg = f"key {key!r} is not an SDLang identifier"
+        raise TypeError(msg)
+    if key in _SDL_KEYWORDS:
+        msg = f"key {key!r} is an SDLang keyword"
+        raise TypeError(msg)
+    return key
+
+
+def _sdl_value(value: Any) -> str:  # noqa: C901, PLR0911.
+    if value is None:
+        return "null"
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, int):
+        # Integers are 32-bit without the suffix "L".
+        return str(value) if -(2**31) <= value < 2**31 else f"{value}L"
+    if isinstance(value, float):
+        if math.isnan(value) or math.isinf(value):
+            msg = f"{value} is not supported"
+            raise TypeError(msg)
+        # SDLang has no exponent notation.
+        text = format(decimal.Decimal(repr(value)), "f")
+        return text if "." in text else text + ".0"
+    if isinstance(value, bytes):
+        return "[" + base64.b64encode(value).decode("ascii") + "]"
+    if isinstance(value, datetime.datetime):
+        text = value.strftime("%Y/%m/%d %H:%M:%S")
+        if value.microsecond:
+            text += f".{value.microsecond // 1000:03d}"
+        offset = value.utcoffset()
+        if offset == datetime.timedelta(0):
+            text += "-UTC"
+        elif offset is not None:
+            sign = "-" if offset < datetime.timedelta(0) else "+"
+            hours, minutes = divmod(abs(int(offset.total_seconds())) // 60, 60)
+            text += f"-GMT{sign}{hours:02d}:{minutes:02d}"
+        return text
+    if isinstance(value, datetime.date):
+        return value.strftime("%Y/%m/%d")
+    if isinstance(value, datetime.time):
+        value = value.isoformat()
+    if isinstance(value, str):
+        escaped = (
+            value.replace("\\", "\\\\")
+            .replace('"', '\\"')
+            .replace("\n", "\\n")
+            .replace("\r", "\\r")
+            .replace("\t", "\\t")
+        )
+        return f'"{escaped}"'
+
+    msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _sdl_write_tag(  # noqa: C901.
+    lines: list[str], name: str, value: Any, indent: str
+) -> None:
+    if isinstance(value, list) and any(isinstance(x, (list, Mapping)) for x in value):
+        # Repeated tags become an array, so write one tag per item.
+        for item in value:
+            if isinstance(item, list) and any(
+                isinstance(x, (list, Mapping)) for x in item
+            ):
+                msg = "nested arrays of arrays or dictionaries are not supported"
+                raise TypeError(msg)
+            _sdl_write_tag(lines, name, item, indent)
+        return
+
+    if not isinstance(value, Mapping):
+        values = value if isinstance(value, list) else [value]
+        lines.append(indent + name + "".join(" " + _sdl_value(x) for x in values))
+        return
+
+    values = value.get(XML_TEXT_KEY, [])
+    if not isinstance(values, list):
+        values = [values]
+    parts = [name, *(_sdl_value(x) for x in values)]
+    attributes = []
+    children = {}
+
+    for k, v in value.items():
+        if k == XML_TEXT_KEY:
+            continue
+        if isinstance(k, str) and k.startswith(XML_ATTRIBUTE_PREFIX):
+            attribute = _sdl_name(k[len(XML_ATTRIBUTE_PREFIX) :])
+            attributes.append(f"{attribute}={_sdl_value(v)}")
+        else:
+            children[_sdl_name(k)] = v
+    parts.extend(attributes)
+
+    # A block makes a tag without attributes read back as a dictionary.
+    if children or not attributes:
+        lines.append(indent + " ".join(parts) + " {")
+        for k, v in children.items():
+            _sdl_write_tag(lines, k, v, indent + "    ")
+        lines.append(indent + "}")
+    else:
+        lines.append(indent + " ".join(parts))
+
+
+def _encode_sdl(data: Document, *, sort_keys: bool) -> str:
+    if not isinstance(data, Mapping):
+        msg = (
+            f"Top-level value of type '{type(data).__name__}' cannot "
+            "be encoded as SDLang"
+        )
+        raise TypeError(msg)
+
+    if sort_keys:
+        data = traverse(
+            data,
+            dict_callback=lambda pairs: dict(sorted(pairs, key=lambda x: str(x[0]))),
+        )
+
+    lines: list[str] = []
+    try:
+        for k, v in cast(Mapping[Any, Any], data).items():
+            _sdl_write_tag(lines, _sdl_name(k), v, "")
+    except TypeError as e:
+        msg = f"Cannot convert data to SDLang ({e})"
+        raise EncodeError(msg, format="sdl")
+
+    return "".join(line + "\n" for line in lines)
+
+
+def _smile_vint(n: int) -> bytes:
+    out = [0x80 | (n & 0x3F)]
+    n >>= 6
+    while n:
+        out.append(n & 0x7F)
+        n >>= 7
+    return bytes(reversed(out))
+
+
+def _smile_seven_bit(value: int, groups: int) -> bytes:
+    return bytes((value >> (7 * i)) & 0x7F for i in reversed(range(groups)))
+
+
+def _smile_binary(data: bytes) -> bytes:
+    out = bytearray(_smile_vint(len(data)))
+    for start in range(0, len(data), 7):
+        chunk = data[start : start + 7]
+        # The last 7-bit byte of a chunk holds as many bits as the chunk has bytes.
+        value = int.from_bytes(chunk, "big")
+        out += _smile_seven_bit(value >> len(chunk), len(chunk))
+        out.append(value & ((1 << len(chunk)) - 1))
+    return bytes(out)
+
+
+def _smile_key(key: str, names: dict[str, int]) -> bytes:
+    if key == "":
+        return b"\x20"
+    if key in names:
+        index = names[key]
+        if index < 64:
+            return bytes([0x40 | index])
+        return bytes([0x30 | (index >> 8), index & 0xFF])
+
+    raw = key.encode(UTF_8)
+    if len(raw) <= 64:
+        if len(names) >= _SMILE_MAX_SHARED:
+            names.clear()
+        names[key] = len(names)
+    if raw.isascii() and len(raw) <= 64:
+        return bytes([0x80 | (len(raw) - 1)]) + raw
+    if not raw.isascii() and len(raw) <= 57:
+        return bytes([0xC0 | (len(raw) - 2)]) + raw
+    return b"\x34" + raw + b"\xfc"
+
+
+def _smile_string(s: str) -> bytes:  # noqa: PLR0911.
+    raw = s.encode(UTF_8)
+    if not raw:
+        return b"\x20"
+    if raw.isascii():
+        if len(raw) <= 32:
+            return bytes([0x40 | (len(raw) - 1)]) + raw
+        if len(raw) <= 64:
+            return bytes([0x60 | (len(raw) - 33)]) + raw
+        return b"\xe0" + raw + b"\xfc"
+    if len(raw) <= 33:
+        return bytes([0x80 | (len(raw) - 2)]) + raw
+    if len(raw) <= 65:
+        return bytes([0xA0 | (len(raw) - 34)]) + raw
+    return b"\xe4" + raw + b"\xfc"
+
+
+def _smile_write(  # noqa: C901, PLR0912.
+    out: bytearray, value: Any, names: dict[str, int], *, stringify: bool
+) -> None:
+    if value is None:
+        out.append(0x21)
+    elif isinstance(value, bool):
+        out.append(0x23 if value else 0x22)
+    elif isinstance(value, int):
+        if -16 <= value <= 15:
+            out.append(0xC0 | (((value << 1) ^ (value >> 63)) & 0x1F))
+        elif -(2**63) <= value < 2**63:
+            out.append(0x24 if -(2**31) <= value < 2**31 else 0x25)
+            out += _smile_vint((value << 1) ^ (value >> 63))
+        else:
+            out.append(0x26)
+            length = (value.bit_length() + 8) // 8
+            out += _smile_binary(value.to_bytes(length, "big", signed=True))
+    elif isinstance(value, float):
+        out.append(0x29)
+        bits = int.from_bytes(struct.pack(">d", value), "big")
+        out += _smile_seven_bit(bits, 10)
+    elif isinstance(value, str):
+        out += _smile_string(value)
+    elif isinstance(value, bytes):
+        out.append(0xE8)
+        out += _smile_binary(value)
+    elif isinstance(value, list):
+        out.append(0xF8)
+        for item in value:
+            _smile_write(out, item, names, stringify=stringify)
+        out.append(0xF9)
+    elif isinstance(value, Mapping):
+        out.append(0xFA)
+        for k, v in value.items():
+            out += _smile_key(k, names)
+            _smile_write(out, v, names, stringify=stringify)
+        out.append(0xFB)
+    elif stringify and isinstance(
+        value, (datetime.date, datetime.datetime, datetime.time)
+    ):
+        out += _smile_string(value.isoformat())
+    else:
+        msg = f"values of type '{type(value).__name__}' are not supported"
+        raise TypeError(msg)
+
+
+def _encode_smile(data: Document, *, sort_keys: bool, stringify: bool) -> bytes:
+    key_callback = _stringify_special_keys if stringify else _ubjson_key
+
+    try:
+        prepared = traverse(
+            data,
+            dict_callback=lambda pairs: dict(sorted(pairs) if sort_keys else pairs),
+            key_callback=key_callback,
+        )
+        # Share property names like Jackson does by default.
+        out = bytearray(_SMILE_HEADER + b"\x01")
+        _smile_write(out, prepared, {}, stringify=stringify)
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to Smile ({e})"
+        raise EncodeError(msg, format="smile")
+
+    return bytes(out)
+
+
+def _tnetstring(value: Any, *, stringify: bool) -> bytes:  # noqa: C901, PLR0911.
+    def tagged(payload: bytes, kind: bytes) -> bytes:
+        return str(len(payload)).encode() + b":" + payload + kind
+
+    if value is None:
+        return b"0:~"
+    if isinstance(value, bool):
+        return tagged(b"true" if value else b"false", b"!")
+    if isinstance(value, int):
+        return tagged(str(value).encode(), b"#")
+    if isinstance(value, float):
+        return tagged(repr(value).encode(), b"^")
+    if isinstance(value, str):
+        return tagged(value.encode(UTF_8), b",")
+    if isinstance(value, bytes):
+        return tagged(value, b",")
+    if isinstance(value, list):
+        items = (_tnetstring(x, stringify=stringify) for x in value)
+        return tagged(b"".join(items), b"]")
+    if isinstance(value, Mapping):
+        pairs = (
+            _tnetstring(str(k), stringify=stringify)
+            + _tnetstring(v, stringify=stringify)
+            for k, v in value.items()
+        )
+        return tagged(b"".join(pairs), b"}")
+    if stringify and isinstance(
+        value, (datetime.date, datetime.datetime, datetime.time)
+    ):
+        return tagged(value.isoformat().encode(UTF_8), b",")
+
+    msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _encode_tnetstring(data: Document, *, sort_keys: bool, stringify: bool) -> bytes:
+    key_callback = _stringify_special_keys if stringify else _ubjson_key
+
+    try:
+        prepared = traverse(
+            data,
+            dict_callback=lambda pairs: dict(sorted(pairs) if sort_keys else pairs),
+            key_callback=key_callback,
+        )
+        return _tnetstring(prepared, stringify=stringify)
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to tnetstring ({e})"
+        raise EncodeError(msg, format="tnetstring")
+
+
+def _toml_inline_table_paths(input_data: bytes) -> set[TOMLPath]:
+    paths = set()
+
+    def walk(x: Any, path: TOMLPath) -> None:
+        if isinstance(x, tomlkit.items.InlineTable):
+            paths.add(path)
+
+        if isinstance(x, Mapping):
+            for k, v in x.items():
+                walk(v, (*path, k))
+        elif isinstance(x, list):
+            for i, v in enumerate(x):
+                walk(v, (*path, i))
+
+    try:
+        walk(tomlkit.parse(input_data.decode(UTF_8)), ())
+    except tomlkit.exceptions.ParseError as e:
+        msg = f"Cannot parse as TOML ({e})"
+        raise DecodeError(msg, format="toml", line=e.line)
+
+    return paths
+
+
+def _toml_make_inline(x: Any, paths: set[TOMLPath], path: TOMLPath = ()) -> Any:
+    if isinstance(x, Mapping):
+        items = {k: _toml_make_inline(v, paths, (*path, k)) for k, v in x.items()}
+        if path not in paths:
+            return items
+
+        table = tomlkit.inline_table()
+        table.update(items)
+        return table
+
+    if isinstance(x, list):
+        return [_toml_make_inline(v, paths, (*path, i)) for i, v in enumerate(x)]
+
+    return x
+
+
+def _toml_table_comment(lines: Sequence[str], *, first: bool) -> str:
+    return ("" if first else "\n") + "".join(f"# {line}\n" for line in lines)
+
+
+def _toml_with_descriptions(
+    data: Mapping[Any, Any],
+    descriptions: Mapping[str, str],
+    container: Any,
+    path: str = "",
+) -> Any:
+    # Emit scalars and arrays before tables.
+    # This is the order in which TOML requires them.
+    items = sorted(
+        data.items(),
+        key=lambda item: isinstance(item[1], Mapping)
+        and not isinstance(item[1], tomlkit.items.InlineTable),
+    )
+    first = True
+
+    for key, value in items:
+        key_path = f"{path}.{key}" if path else key
+        lines = descriptions[key_path].splitlines() if key_path in descriptions else []
+
+        if isinstance(value, Mapping) and not isinstance(
+            value, tomlkit.items.InlineTable
+        ):
+            table = _toml_with_descriptions(
+                value,
+                descriptions,
+                tomlkit.table(is_super_table=False if lines else None),
+                key_path,
+            )
+            if lines:
+                # A leading comment has to go into the indentation of the table.
+                # It would be separated from the header otherwise.
+                table.trivia.indent = _toml_table_comment(lines, first=first)
+            container.add(key, table)
+        else:
+            for line in lines:
+                container.add(tomlkit.comment(line))
+            container.add(key, value)
+
+        first = False
+
+    return container
+
+
+def _encode_toml(  # noqa: C901.
+    data: Mapping[Any, Any],
+    *,
+    descriptions: Mapping[str, str] | None = None,
+    inline_tables: set[TOMLPath] | None = None,
+    sort_keys: bool,
+    stringify: bool,
+    version: str = "1.0",
+) -> str:
+    if version == "0.4" and (problem := _toml_v04_problem(data)):
+        msg = f"Cannot convert data to TOML ({problem})"
+        raise EncodeError(msg, format="toml")
+
+    key_callback = _stringify_special_keys if stringify else _reject_special_keys
+
+    def reject_null(x: Any) -> Any:
+        if x is None:
+            msg = "null values are not supported"
+            raise TypeError(msg)
+
+        return x
+
+    def stringify_null(x: Any) -> Any:
+        if x is None:
+            return "null"
+
+        return x
+
+    default_callback = stringify_null if stringify else reject_null
+    # A float item with the exact digits as its text.
+    instance_callbacks = [
+        (
+            decimal.Decimal,
+            lambda x: tomlkit.items.Float(
+                float(x), tomlkit.items.Trivia(), _decimal_text(x)
+            ),
+        )
+    ]
+
+    try:
+        if descriptions or inline_tables:
+            prepared = traverse(
+                data,
+                dict_callback=lambda pairs: dict(sorted(pairs) if sort_keys else pairs),
+                key_callback=key_callback,
+                instance_callbacks=instance_callbacks,
+                default_callback=default_callback,
+            )
+            if inline_tables:
+                prepared = _toml_make_inline(prepared, inline_tables)
+
+            if descriptions:
+                prepared = _toml_with_descriptions(
+                    prepared, descriptions, tomlkit.document()
+                )
+
+            return tomlkit.dumps(prepared)
+
+        return tomlkit.dumps(
+            traverse(
+                data,
+                key_callback=key_callback,
+                instance_callbacks=instance_callbacks,
+                default_callback=default_callback,
+            ),
+            sort_keys=sort_keys,
+        )
+    except AttributeError as e:
+        if str(e) == "'list' object has no attribute 'as_string'":
+            msg = (
+                "Cannot convert non-dictionary data to TOML; "
+                'use "--wrap" to wrap it in a dictionary'
+            )
+            raise EncodeError(msg, format="toml")
+        else:
+            raise e
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to TOML ({e})"
+        raise EncodeError(msg, format="toml")
+
+
+class _YAMLRepresenter(ruamel.yaml.representer.RoundTripRepresenter):
+    def represent_decimal(self, data: decimal.Decimal) -> Any:
+        return self.represent_scalar("tag:yaml.org,2002:float", _decimal_text(data))
+
+
+_YAMLRepresenter.add_representer(decimal.Decimal, _YAMLRepresenter.represent_decimal)
+_YAMLRepresenter.add_representer(_FormattedFloat, _YAMLRepresenter.represent_decimal)
+
+
+def _encode_yaml(
+    data: Document, *, version: str = "1.2", yaml_options: YAMLOptions
+) -> str:
+    yaml = ruamel.yaml.YAML()
+    yaml.Representer = _YAMLRepresenter
+    yaml.default_flow_style = False
+    # YAML 1.1 output starts with a `%YAML 1.1` directive
+    # and quotes strings like "yes" and "on".
+    if version != "1.2":
+        yaml.version = _yaml_version(version)
+
+    yaml.default_style = yaml_options.style  # type: ignore
+    yaml.indent = yaml_options.indent
+    yaml.width = yaml_options.width
+
+    try:
+        out = StringIO()
+
+        if yaml_options.split:
+            if not isinstance(data, list):
+                msg = (
+                    f"Top-level value of type '{type(data).__name__}' cannot "
+                    "be split into YAML documents"
+                )
+                raise TypeError(msg)
+            yaml.dump_all(data, out)
+        else:
+            yaml.dump(
+                data,
+                out,
+            )
+
+        return out.getvalue()
+    except ruamel.yaml.representer.RepresenterError as e:
+        msg = f"Cannot convert data to YAML ({e})"
+        raise EncodeError(msg, format="yaml")
+
+
+def _ubjson_key(key: Any) -> str:
+    # Unlike `json`, `ubjson` does not turn number keys into strings.
+    return str(_reject_special_keys(key))
+
+
+def _encode_ubjson(data: Document, *, sort_keys: bool, stringify: bool) -> bytes:
+    if stringify:
+        default_callback = _json_default_stringify
+        key_callback = _stringify_special_keys
+    else:
+        default_callback = None
+        key_callback = _ubjson_key
+
+    try:
+        return bytes(
+            ubjson.dumpb(
+                traverse(data, key_callback=key_callback),
+                default=default_callback,
+                no_float32=True,
+                sort_keys=sort_keys,
+            )
+        )
+    except (TypeError, ValueError, ubjson.EncoderException) as e:
+        msg = f"Cannot convert data to UBJSON ({e})"
+        raise EncodeError(msg, format="ubjson")
+
+
+_UCL_KEY = re.compile(r"[A-Za-z_][\w-]*\Z", re.ASCII)
+
+
+def _ucl_key(key: Any) -> str:
+    key = str(key)
+    return key if _UCL_KEY.match(key) else json.dumps(key, ensure_ascii=False)
+
+
+def _ucl_scalar(value: Any) -> str:  # noqa: PLR0911.
+    if value is None:
+        return "null"
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, int):
+        return str(value)
+    if isinstance(value, float):
+        if math.isnan(value) or math.isinf(value):
+            msg = f"{value} is not supported"
+            raise TypeError(msg)
+        return repr(value)
+    if isinstance(value, (datetime.date, datetime.datetime, datetime.time)):
+        value = value.isoformat()
+    if isinstance(value, str):
+        return json.dumps(value, ensure_ascii=False)
+
+    msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _ucl_expression(value: Any, indent: str) -> str:
+    inner = indent + "    "
+
+    if isinstance(value, Mapping):
+        return "{\n" + _ucl_fields(value, inner) + indent + "}"
+
+    if isinstance(value, list):
+        if not any(isinstance(x, (list, Mapping)) for x in value):
+            return "[" + ", ".join(_ucl_scalar(x) for x in value) + "]"
+        items = "".join(f"{inner}{_ucl_expression(x, inner)},\n" for x in value)
+        return "[\n" + items + indent + "]"
+
+    return _ucl_scalar(value)
+
+
+def _ucl_fields(doc: Mapping[Any, Any], indent: str) -> str:
+    lines = []
+
+    for k, v in doc.items():
+        if isinstance(v, Mapping):
+            # Objects do not need "=" or ";".
+            lines.append(f"{indent}{_ucl_key(k)} {_ucl_expression(v, indent)}\n")
+        else:
+            lines.append(f"{indent}{_ucl_key(k)} = {_ucl_expression(v, indent)};\n")
+
+    return "".join(lines)
+
+
+def _encode_ucl(data: Document, *, sort_keys: bool) -> str:
+    if not isinstance(data, (list, Mapping)):
+        msg = (
+            f"Top-level value of type '{type(data).__name__}' cannot "
+            "be encoded as UCL"
+        )
+        raise TypeError(msg)
+
+    if sort_keys:
+        data = traverse(
+            data,
+            dict_callback=lambda pairs: dict(sorted(pairs, key=lambda x: str(x[0]))),
+        )
+
+    try:
+        # The fields of a top-level map do not need braces.
+        if isinstance(data, Mapping):
+            return _ucl_fields(data, "")
+        return _ucl_expression(data, "") + "\n"
+    except TypeError as e:
+        msg = f"Cannot convert data to UCL ({e})"
+        raise EncodeError(msg, format="ucl")
+
+
+_UNIT_KEY = re.compile(r"[A-Za-z0-9][\w.-]*(?:\[[^\s\[\]=]+\])?\Z", re.ASCII)
+
+
+def _unit_value(value: Any) -> str:
+    if isinstance(value, bool):
+        text = "true" if value else "false"
+    elif isinstance(value, (datetime.date, datetime.time)):
+        text = value.isoformat()
+    elif isinstance(value, (float, int, str)):
+        text = str(value)
+    elif value is None:
+        msg = "null values are not supported"
+        raise TypeError(msg)
+    else:
+        msg = f"values of type '{type(value).__name__}' are not supported"
+        raise TypeError(msg)
+
+    if "\n" in text or "\r" in text or text.endswith("\\"):
+        msg = f"{text!r} would not read back as the same value"
+        raise ValueError(msg)
+
+    return text
+
+
+def _encode_unit(data: Document, *, sort_keys: bool) -> str:  # noqa: C901.
+    if not isinstance(data, Mapping):
+        msg = (
+            f"Top-level value of type '{type(data).__name__}' cannot "
+            "be encoded as a unit file"
+        )
+        raise TypeError(msg)
+
+    lines: list[str] = []
+
+    try:
+        for name, section in sorted(data.items()) if sort_keys else data.items():
+            if not isinstance(section, Mapping):
+                msg = (
+                    f"key {str(name)!r} at the top level has a value of type "
+                    f"'{type(section).__name__}'; all keys must be in sections"
+                )
+                raise TypeError(msg)
+            if not str(name) or any(c in str(name) for c in "[]\n"):
+                msg = f"{str(name)!r} is not a valid section name"
+                raise ValueError(msg)
+
+            if lines:
+                lines.append("")
+            lines.append(f"[{name}]")
+
+            pairs = sorted(section.items()) if sort_keys else section.items()
+            for key, value in pairs:
+                if not _UNIT_KEY.match(str(key)):
+                    msg = f"{str(key)!r} is not a valid key"
+                    raise ValueError(msg)
+
+                # An array becomes a repeated key. An empty one becomes
+                # an empty assignment, which resets a list in systemd.
+                values = value if isinstance(value, list) else [value]
+                if not values:
+                    lines.append(f"{key}=")
+                for item in values:
+                    if isinstance(item, (list, Mapping)):
+                        msg = (
+                            f"key {str(key)!r} in section {str(name)!r} has "
+                            f"a value of type '{type(item).__name__}'; "
+                            'use "--flatten" for nested data'
+                        )
+                        raise TypeError(msg)
+                    lines.append(f"{key}={_unit_value(item)}")
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to a unit file ({e})"
+        raise EncodeError(msg, format="unit")
+
+    return "".join(line + "\n" for line in lines)
+
+
+def _urlencoded_value(value: Any) -> str:
+    if value is None:
+        return ""
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, (float, int, str)):
+        return str(value)
+    if isinstance(value, (datetime.date, datetime.datetime, datetime.time)):
+        return value.isoformat()
+
+    msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _encode_urlencoded(data: Document, *, sort_keys: bool, style: str) -> str:
+    if not isinstance(data, Mapping):
+        msg = (
+            f"Top-level value of type '{type(data).__name__}' cannot "
+            "be encoded as URL-encoded data"
+        )
+        raise TypeError(msg)
+
+    fields = []
+
+    def name(key: Any) -> str:
+        # Escape the characters that would otherwise nest the key.
+        return urllib.parse.quote_plus(str(key)).replace(".", "%2E")
+
+    def walk(x: Any, prefix: str) -> None:
+        if isinstance(x, Mapping):
+            items = sorted(x.items()) if sort_keys else x.items()
+        elif isinstance(x, list):
+            items = enumerate(x)
+        else:
+            fields.append((prefix, _urlencoded_value(x)))
+            return
+
+        # Empty arrays and maps have no fields.
+        for k, v in items:
+            if not prefix:
+                walk(v, name(k))
+            elif style == "dot":
+                walk(v, f"{prefix}.{name(k)}")
+            else:
+                walk(v, f"{prefix}[{name(k)}]")
+
+    try:
+        walk(data, "")
+    except TypeError as e:
+        msg = f"Cannot convert data to URL-encoded data ({e})"
+        raise EncodeError(msg, format="urlencoded")
+
+    query = "&".join(
+        key + "=" + urllib.parse.quote_plus(value) for key, value in fields
+    )
+    return query + "\n"
+
+
+_XML_NAME = re.compile(r"(?:\{([^}]*)\})?([^\W\d][\w.-]*)\Z")
+_XML_INVALID_CHARS = re.compile("[\x00-\x08\x0b\x0c\x0e-\x1f\ufffe\uffff]")
+
+
+def _xml_name(key: Any) -> tuple[str, str]:
+    """Split a name in the `{namespace}local` notation of ElementTree."""
+    match = _XML_NAME.match(str(key))
+    if not match:
+        msg = f"{key!r} is not a valid XML name"
+        raise ValueError(msg)
+
+    return match.group(1) or "", match.group(2)
+
+
+def _xml_text(value: Any) -> str:
+    if isinstance(value, bool):
+        text = "true" if value else "false"
+    elif isinstance(value, (datetime.date, datetime.time)):
+        text = value.isoformat()
+    elif isinstance(value, (float, int, str)):
+        text = str(value)
+    else:
+        msg = f"values of type '{type(value).__name__}' cannot be XML text"
+        raise TypeError(msg)
+
+    if _XML_INVALID_CHARS.search(text):
+        msg = f"{text!r} contains characters not allowed in XML"
+        raise ValueError(msg)
+
+    return text
+
+
+def _xml_write_element(  # noqa: C901.
+    lines: list[str],
+    key: Any,
+    value: Any,
+    *,
+    convention: str = "xmltodict",
+    default_namespace: str,
+    depth: int,
+    sort_keys: bool,
+) -> None:
+    attribute_prefix, text_key = _XML_KEYS[convention]
+    namespace, tag = _xml_name(key)
+    attributes = []
+    prefixes: dict[str, str] = {}
+    children = []
+    text = None
+
+    if namespace != default_namespace:
+        attributes.append(("xmlns", namespace))
+
+    if isinstance(value, Mapping):
+        items = sorted(value.items()) if sort_keys else value.items()
+
+        for k, v in items:
+            k_str = str(k)
+
+            if k_str == text_key:
+                text = _xml_text(v)
+            elif k_str.startswith(attribute_prefix):
+                attr_namespace, attr_name = _xml_name(k_str[len(attribute_prefix) :])
+                if attr_namespace:
+                    prefix = prefixes.setdefault(attr_namespace, f"ns{len(prefixes)}")
+                    attr_name = f"{prefix}:{attr_name}"
+                attributes.append((attr_name, _xml_text(v)))
+            else:
+                children.append((k, v))
+    elif isinstance(value, list) and convention == "folded":
+        children = [(_XML_ITEM_TAG, item) for item in value]
+    elif isinstance(value, list):
+        msg = "nested arrays cannot be converted to XML elements"
+        raise TypeError(msg)
+    elif value is not None:
+        text = _xml_text(value)
+
+    attributes.extend((f"xmlns:{prefix}", uri) for uri, prefix in prefixes.items())
+
+    indent = "  " * depth
+    start = tag + "".join(f" {k}={xml_quoteattr(v)}" for k, v in attributes)
+
+    if not children:
+        if text is None:
+            lines.append(f"{indent}<{start}/>")
+        else:
+            lines.append(f"{indent}<{start}>{xml_escape(text)}</{tag}>")
+        return
+
+    lines.append(f"{indent}<{start}>")
+    if text is not None:
+        lines.append(f"{indent}  {xml_escape(text)}")
+
+    for k, v in children:
+        # An array becomes repeated elements unless it is folded into one.
+        repeated = isinstance(v, list) and convention != "folded"
+        for item in v if repeated else [v]:
+            _xml_write_element(
+                lines,
+                k,
+                item,
+                convention=convention,
+                default_namespace=namespace,
+                depth=depth + 1,
+                sort_keys=sort_keys,
+            )
+
+    lines.append(f"{indent}</{tag}>")
+
+
+def _encode_xml(
+    data: Document, *, convention: str = "xmltodict", sort_keys: bool
+) -> str:
+    if not isinstance(data, Mapping) or len(data) != 1:
+        msg = (
+            "XML requires a map with a single key for the root element; "
+            'use "--wrap" to wrap the data in one'
+        )
+        raise TypeError(msg)
+
+    ((root_key, root_value),) = data.items()
+    lines = ['<?xml version="1.0" encoding="UTF-8"?>']
+
+    try:
+        if isinstance(root_value, list) and convention != "folded":
+            msg = "the root element cannot be an array"
+            raise TypeError(msg)
+
+        _xml_write_element(
+            lines,
+            root_key,
+            root_value,
+            convention=convention,
+            default_namespace="",
+            depth=0,
+            sort_keys=sort_keys,
+        )
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to XML ({e})"
+        raise EncodeError(msg, format="xml")
+
+    return "\n".join(lines) + "\n"
+
+
+def _c_identifier(key: str, *, prefix: str) -> str:
+    name = prefix + re.sub(r"[^A-Za-z0-9_]", "_", key).upper()
+    if not name:
+        msg = 'an empty key has no macro name without "--c-prefix"'
+        raise ValueError(msg)
+
+    return "_" + name if name[:1].isdigit() else name
+
+
+def _c_literal(value: Any) -> str:  # noqa: C901.
+    if isinstance(value, bool):
+        return "1" if value else "0"
+    if isinstance(value, int):
+        return str(value)
+    if isinstance(value, float):
+        if not math.isfinite(value):
+            msg = f"{value!r} has no C literal"
+            raise TypeError(msg)
+        return repr(value)
+    if isinstance(value, (datetime.date, datetime.datetime, datetime.time)):
+        value = value.isoformat()
+    if isinstance(value, str):
+        escaped = ""
+        for char in value:
+            if char in "\\\"":
+                escaped += "\\" + char
+            elif char == "\n":
+                escaped += "\\n"
+            elif char == "\t":
+                escaped += "\\t"
+            elif ord(char) < 0x20 or ord(char) == 0x7F:
+                escaped += f"\\{ord(char):03o}"
+            else:
+                escaped += char
+
+        return f'"{escaped}"'
+
+    if value is None:
+        msg = "null values are not supported"
+    elif isinstance(value, (list, Mapping)):
+        msg = "empty arrays and maps are not supported"
+    else:
+        msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _encode_cheader(data: Document, *, prefix: str, sort_keys: bool) -> str:
+    if not isinstance(data, (list, Mapping)):
+        msg = (
+            f"Top-level value of type '{type(data).__name__}' cannot "
+            "be encoded as a C header"
+        )
+        raise TypeError(msg)
+
+    names: dict[str, str] = {}
+    lines = []
+
+    try:
+        flat = cast(Mapping[str, Any], _flatten(data, separator="_") or {})
+
+        for key, value in sorted(flat.items()) if sort_keys else flat.items():
+            name = _c_identifier(key, prefix=prefix)
+            if name in names:
+                msg = f"keys {names[name]!r} and {key!r} both become {name}"
+                raise ValueError(msg)
+            names[name] = key
+
+            lines.append(f"#define {name} {_c_literal(value)}\n")
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to a C header ({e})"
+        raise EncodeError(msg, format="cheader")
+
+    return "".join(lines)
+
+
+_CUE_IDENTIFIER = re.compile(r"[A-Za-z$][\w$]*\Z")
+_CUE_KEYWORDS = {"false", "for", "if", "import", "in", "let", "null", "package", "true"}
+
+
+def _cue_label(key: Any) -> str:
+    if not isinstance(key, str):
+        msg = f"keys of type '{type(key).__name__}' are not supported"
+        raise TypeError(msg)
+
+    # Labels that start with `_` or `#` would mean hidden fields and definitions.
+    if _CUE_IDENTIFIER.match(key) and key not in _CUE_KEYWORDS:
+        return key
+
+    return json.dumps(key, ensure_ascii=False)
+
+
+def _cue_bytes(value: bytes) -> str:
+    escaped = ""
+    for byte in value:
+        char = chr(byte)
+        if char in "\\'" or not 0x20 <= byte < 0x7F:
+            escaped += f"\\x{byte:02x}"
+        else:
+            escaped += char
+
+    return f"'{escaped}'"
+
+
+def _cue_value(value: Any, indent: str) -> str:  # noqa: C901, PLR0911.
+    if isinstance(value, Mapping):
+        if not value:
+            return "{}"
+        return "{\n" + _cue_fields(value, indent + "\t") + indent + "}"
+
+    if isinstance(value, list):
+        if not value:
+            return "[]"
+        if not any(isinstance(x, (list, Mapping)) for x in value):
+            return "[" + ", ".join(_cue_value(x, indent) for x in value) + "]"
+        inner = indent + "\t"
+        items = "".join(f"{inner}{_cue_value(x, inner)},\n" for x in value)
+        return "[\n" + items + indent + "]"
+
+    if value is None:
+        return "null"
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, int):
+        return str(value)
+    if isinstance(value, float):
+        if not math.isfinite(value):
+            msg = f"{value!r} has no CUE literal"
+            raise TypeError(msg)
+        return repr(value)
+    if isinstance(value, bytes):
+        return _cue_bytes(value)
+    if isinstance(value, (datetime.date, datetime.datetime, datetime.time)):
+        value = value.isoformat()
+    if isinstance(value, str):
+        # JSON string escapes are valid in CUE.
+        return json.dumps(value, ensure_ascii=False)
+
+    msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _cue_fields(doc: Mapping[Any, Any], indent: str) -> str:
+    return "".join(
+        f"{indent}{_cue_label(key)}: {_cue_value(value, indent)}\n"
+        for key, value in doc.items()
+    )
+
+
+def _encode_cue(data: Document, *, sort_keys: bool) -> str:
+    if sort_keys:
+        data = traverse(data, dict_callback=lambda pairs: dict(sorted(pairs)))
+
+    try:
+        # A top-level map becomes the fields of the file.
+        if isinstance(data, Mapping):
+            return _cue_fields(data, "")
+        return _cue_value(data, "") + "\n"
+    except TypeError as e:
+        msg = f"Cannot convert data to CUE ({e})"
+        raise EncodeError(msg, format="cue")
+
+
+def _cue_vet(doc: Document, schema: str) -> None:
+    """Validate the data with "cue vet" against a file like "schema.cue#Config"."""
+    path, sep, definition = schema.partition("#")
+    command = ["cue", "vet"]
+    if sep:
+        # CUE definitions start with "#".
+        command += ["-d", f"#{definition}"]
+    command += [path, "json:", "-"]
+
+    # CUE reads JSON, so dates and times become strings.
+    text = _encode_json(doc, indent=None, sort_keys=False, stringify=True)
+    try:
+        result = subprocess.run(
+            command,
+            capture_output=True,
+            check=False,
+            input=text.encode(UTF_8),
+        )
+    except FileNotFoundError:
+        msg = 'CUE validation requires the program "cue"; see https://cuelang.org/'
+        raise OSError(msg)
+
+    if result.returncode != 0:
+        detail = result.stderr.decode(UTF_8, errors="replace").strip()
+        msg = f"Data does not match CUE schema {schema!r}:\n{detail}"
+        raise ValueError(msg)
+
+
+_LUA_IDENTIFIER = re.compile(r"[A-Za-z_]\w*\Z", re.ASCII)
+_LUA_KEYWORDS = {
+    "and",
+    "break",
+    "do",
+    "else",
+    "elseif",
+    "end",
+    "false",
+    "for",
+    "function",
+    "goto",
+    "if",
+    "in",
+    "local",
+    "nil",
+    "not",
+    "or",
+    "repeat",
+    "return",
+    "then",
+    "true",
+    "until",
+    "while",
+}
+
+
+def _lua_string(value: str | bytes) -> str:
+    # Lua 5.1 and LuaJIT have no Unicode escapes, so write UTF-8 as is.
+    # Bytes are escaped in full since they need not be valid UTF-8.
+    raw = value.encode(UTF_8) if isinstance(value, str) else value
+    limit = 0x7F if isinstance(value, bytes) else 0x100
+    escapes = {0x22: '\\"', 0x5C: "\\\\", 0x0A: "\\n", 0x0D: "\\r", 0x09: "\\t"}
+
+    parts = []
+    for byte in raw:
+        if byte in escapes:
+            parts.append(escapes[byte].encode())
+        elif byte < 0x20 or byte == 0x7F or byte >= limit:
+            # Three digits keep a following digit out of the escape.
+            parts.append(f"\\{byte:03d}".encode())
+        else:
+            parts.append(bytes([byte]))
+
+    return '"' + b"".join(parts).decode(UTF_8) + '"'
+
+
+def _lua_key(key: Any) -> str:
+    if isinstance(key, str) and _LUA_IDENTIFIER.match(key) and key not in _LUA_KEYWORDS:
+        return key
+
+    return f"[{_lua_value(key, '')}]"
+
+
+def _lua_value(value: Any, indent: str) -> str:  # noqa: C901, PLR0911.
+    if isinstance(value, Mapping):
+        if not value:
+            return "{}"
+        inner = indent + "  "
+        fields = "".join(
+            f"{inner}{_lua_key(k)} = {_lua_value(v, inner)},\n"
+            for k, v in value.items()
+        )
+        return "{\n" + fields + indent + "}"
+
+    if isinstance(value, list):
+        if not any(isinstance(x, (list, Mapping)) for x in value):
+            return "{" + ", ".join(_lua_value(x, indent) for x in value) + "}"
+        inner = indent + "  "
+        items = "".join(f"{inner}{_lua_value(x, inner)},\n" for x in value)
+        return "{\n" + items + indent + "}"
+
+    if value is None:
+        return "nil"
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, int):
+        return str(value)
+    if isinstance(value, float):
+        if math.isnan(value):
+            return "0/0"
+        if math.isinf(value):
+            return "math.huge" if value > 0 else "-math.huge"
+        return repr(value)
+    if isinstance(value, (datetime.date, datetime.datetime, datetime.time)):
+        value = value.isoformat()
+    if isinstance(value, (bytes, str)):
+        return _lua_string(value)
+
+    msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _encode_lua(data: Document, *, lua_return: bool, sort_keys: bool) -> str:
+    if sort_keys:
+        # Lua tables can have number and Boolean keys next to strings.
+        data = traverse(
+            data,
+            dict_callback=lambda pairs: dict(sorted(pairs, key=lambda x: str(x[0]))),
+        )
+
+    try:
+        table = _lua_value(data, "")
+    except TypeError as e:
+        msg = f"Cannot convert data to Lua ({e})"
+        raise EncodeError(msg, format="lua")
+
+    return ("return " if lua_return else "") + table + "\n"
+
+
+class _PythonExpression:
+    def __init__(self, source: str) -> None:
+        self.source = source
+
+    def __repr__(self) -> str:
+        return self.source
+
+
+def _pyliteral_float(value: float) -> float | _PythonExpression:
+    # `ast.literal_eval` cannot evaluate `inf`, but an overflowing literal works.
+    if math.isnan(value):
+        msg = "NaN has no Python literal"
+        raise ValueError(msg)
+    if math.isinf(value):
+        return _PythonExpression("1e999" if value > 0 else "-1e999")
+    return value
+
+
+def _encode_pyliteral(data: Document, *, sort_keys: bool) -> str:
+    try:
+        data = traverse(
+            data,
+            instance_callbacks=[
+                (float, _pyliteral_float),
+                (
+                    (datetime.date, datetime.datetime, datetime.time),
+                    lambda x: x.isoformat(),
+                ),
+            ],
+        )
+    except ValueError as e:
+        msg = f"Cannot convert data to Python literal ({e})"
+        raise EncodeError(msg, format="pyliteral")
+
+    return pprint.pformat(data, sort_dicts=sort_keys) + "\n"
+
+
+def _go_value(  # noqa: C901, PLR0911, PLR0912.
+    value: Any, indent: str, imports: set[str]
+) -> str:
+    if isinstance(value, Mapping):
+        key_type = (
+            "string" if all(isinstance(k, str) for k in value) else "interface{}"
+        )
+        literal_type = f"map[{key_type}]interface{{}}"
+        if not value:
+            return literal_type + "{}"
+        inner = indent + "\t"
+        fields = "".join(
+            f"{inner}{_go_value(k, inner, imports)}: {_go_value(v, inner, imports)},\n"
+            for k, v in value.items()
+        )
+        return literal_type + "{\n" + fields + indent + "}"
+
+    if isinstance(value, list):
+        if not any(isinstance(x, (list, Mapping)) for x in value):
+            items = ", ".join(_go_value(x, indent, imports) for x in value)
+            return "[]interface{}{" + items + "}"
+        inner = indent + "\t"
+        items = "".join(f"{inner}{_go_value(x, inner, imports)},\n" for x in value)
+        return "[]interface{}{\n" + items + indent + "}"
+
+    if value is None:
+        return "nil"
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, int):
+        if -(2**63) <= value < 2**63:
+            return str(value)
+        if 0 <= value < 2**64:
+            return f"uint64({value})"
+        msg = f"integer {value} does not fit in 64 bits"
+        raise ValueError(msg)
+    if isinstance(value, float):
+        if math.isnan(value) or math.isinf(value):
+            imports.add("math")
+            if math.isnan(value):
+                return "math.NaN()"
+            return f"math.Inf({1 if value > 0 else -1})"
+        # `repr` always includes a "." or an exponent, so Go reads a float64.
+        return repr(value)
+    if isinstance(value, bytes):
+        return "[]byte{" + ", ".join(f"0x{byte:02x}" for byte in value) + "}"
+    if isinstance(value, (datetime.date, datetime.datetime, datetime.time)):
+        value = value.isoformat()
+    if isinstance(value, str):
+        # JSON string escapes are a subset of Go's.
+        return json.dumps(value, ensure_ascii=False)
+
+    msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _encode_go(
+    data: Document,
+    *,
+    go_package: str | None,
+    go_var: str | None,
+    sort_keys: bool,
+) -> str:
+    if sort_keys:
+        data = traverse(
+            data,
+            dict_callback=lambda pairs: dict(sorted(pairs, key=lambda x: str(x[0]))),
+        )
+
+    imports: set[str] = set()
+    try:
+        literal = _go_value(data, "", imports)
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to Go ({e})"
+        raise EncodeError(msg, format="go")
+
+    if go_package is None and go_var is None:
+        return literal + "\n"
+
+    if go_var is None:
+        go_var = "Data"
+    # An untyped `nil` cannot initialize a variable without a type.
+    var_type = " interface{}" if data is None else ""
+    declaration = f"var {go_var}{var_type} = {literal}"
+
+    header = ""
+    if go_package is not None:
+        header = f"package {go_package}\n\n"
+        header += "".join(f'import "{name}"\n\n' for name in sorted(imports))
+
+    return header + declaration + "\n"
+
+
+def _starlark_value(value: Any, indent: str) -> str:  # noqa: C901, PLR0911.
+    if isinstance(value, Mapping):
+        if not value:
+            return "{}"
+        inner = indent + "    "
+        fields = "".join(
+            f"{inner}{_starlark_value(k, inner)}: {_starlark_value(v, inner)},\n"
+            for k, v in value.items()
+        )
+        return "{\n" + fields + indent + "}"
+
+    if isinstance(value, list):
+        if not any(isinstance(x, (list, Mapping)) for x in value):
+            return "[" + ", ".join(_starlark_value(x, indent) for x in value) + "]"
+        inner = indent + "    "
+        items = "".join(f"{inner}{_starlark_value(x, inner)},\n" for x in value)
+        return "[\n" + items + indent + "]"
+
+    if value is None:
+        return "None"
+    if isinstance(value, bool):
+        return "True" if value else "False"
+    if isinstance(value, int):
+        return str(value)
+    if isinstance(value, float):
+        if math.isnan(value) or math.isinf(value):
+            return f'float("{value}")'
+        return repr(value)
+    if isinstance(value, (datetime.date, datetime.datetime, datetime.time)):
+        value = value.isoformat()
+    if isinstance(value, str):
+        # JSON string escapes are a subset of Starlark's.
+        return json.dumps(value, ensure_ascii=False)
+
+    # Bazel has no byte strings.
+    msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _encode_starlark(
+    data: Document, *, sort_keys: bool, starlark_var: str | None
+) -> str:
+    if sort_keys:
+        data = traverse(
+            data,
+            dict_callback=lambda pairs: dict(sorted(pairs, key=lambda x: str(x[0]))),
+        )
+
+    try:
+        literal = _starlark_value(data, "")
+    except TypeError as e:
+        msg = f"Cannot convert data to Starlark ({e})"
+        raise EncodeError(msg, format="starlark")
+
+    if starlark_var is not None:
+        literal = f"{starlark_var} = {literal}"
+
+    return literal + "\n"
+
+
+def _sql_identifier(name: str) -> str:
+    # Quoted identifiers can be keywords and contain any character but NUL.
+    if not name or "\0" in name:
+        msg = f"{name!r} is not a valid identifier"
+        raise ValueError(msg)
+
+    return '"' + name.replace('"', '""') + '"'
+
+
+def _sql_literal(value: Any) -> str:  # noqa: PLR0911.
+    if value is None:
+        return "NULL"
+    if isinstance(value, bool):
+        return "TRUE" if value else "FALSE"
+    if isinstance(value, int):
+        return str(value)
+    if isinstance(value, float):
+        if not math.isfinite(value):
+            msg = f"{value!r} has no SQL literal"
+            raise TypeError(msg)
+        return repr(value)
+    if isinstance(value, bytes):
+        return f"X'{value.hex().upper()}'"
+    if isinstance(value, datetime.datetime):
+        value = value.isoformat(sep=" ")
+    elif isinstance(value, (datetime.date, datetime.time)):
+        value = value.isoformat()
+    if isinstance(value, str):
+        if "\0" in value:
+            msg = "strings with NUL characters are not supported"
+            raise ValueError(msg)
+        return "'" + value.replace("'", "''") + "'"
+
+    msg = f"values of type '{type(value).__name__}' are not supported"
+    raise TypeError(msg)
+
+
+def _encode_sql(data: Document, *, sort_keys: bool, table: str) -> str:
+    if not isinstance(data, list) or not all(isinstance(x, Mapping) for x in data):
+        msg = (
+            f"Top-level value of type '{type(data).__name__}' cannot "
+            "be encoded as SQL; it must be an array of maps"
+        )
+        raise TypeError(msg)
+
+    lines = []
+
+    try:
+        # A dotted table name like "public.users" includes the schema.
+        target = ".".join(_sql_identifier(part) for part in table.split("."))
+
+        for i, row in enumerate(data, 1):
+            if not row:
+                msg = f"row {i} has no columns"
+                raise ValueError(msg)
+
+            items = sorted(row.items()) if sort_keys else list(row.items())
+            for key, value in items:
+                if isinstance(value, (list, Mapping)):
+                    msg = (
+                        f"column {str(key)!r} in row {i} has a value of type "
+                        f"'{type(value).__name__}'; use \"--flatten\" for nested data"
+                    )
+                    raise TypeError(msg)
+
+            # Only the columns of each row so that the others get their defaults.
+            columns = ", ".join(_sql_identifier(str(k)) for k, _ in items)
+            values = ", ".join(_sql_literal(v) for _, v in items)
+            lines.append(f"INSERT INTO {target} ({columns}) VALUES ({values});\n")
+    except (TypeError, ValueError) as e:
+        msg = f"Cannot convert data to SQL ({e})"
+        raise EncodeError(msg, format="sql")
+
+    return "".join(lines)
+
+
+@dataclass(frozen=True)
+class EncodeOptions:
+    c_prefix: str = ""
+    cbor_canonical: bool = False
+    csv_columns: Sequence[str] | None = None
+    csv_delimiter: str = ","
+    go_package: str | None = None
+    go_var: str | None = None
+    hcl_expressions: bool = False
+    ion_format: str = "text"
+    json_canonical: bool = False
+    json_indent: bool | int | None = None
+    json_non_finite: str = "error"
+    lua_return: bool = False
+    plist_format: str = "xml"
+    properties_flat: bool = False
+    sort_keys: bool = True
+    sql_table: str = "data"
+    starlark_var: str | None = None
+    stringify: bool = False
+    toml_descriptions: Mapping[str, str] | None = None
+    toml_inline_tables: set[TOMLPath] | None = None
+    toml_root_key: str | None = None
+    toml_version: str = "1.0"
+    toml_wrap: bool = False
+    urlencoded_style: str = "bracket"
+    xml_convention: str = "xmltodict"
+    yaml_options: YAMLOptions = field(default_factory=YAMLOptions)
+    yaml_version: str = "1.2"
+
+
+def encode(  # noqa: C901, PLR0912.
+    output_format: str,
+    data: Document,
+    options: EncodeOptions | None = None,
+    **kwargs: Any,
+) -> bytes:
+    # Keyword arguments override the fields of `options`.
+    options = replace(options or EncodeOptions(), **kwargs)
+    sort_keys = options.sort_keys
+    stringify = options.stringify
+
+    if output_format == "bson":
+        encoded = _encode_bson(data)
+    elif output_format == "gron":
+        encoded = _encode_gron(data, sort_keys=sort_keys, stringify=stringify).encode(
+            UTF_8
+        )
+    elif output_format == "hcl":
+        encoded = _encode_hcl(
+            data, expressions=options.hcl_expressions, sort_keys=sort_keys
+        ).encode(UTF_8)
+    elif output_format == "headers":
+        encoded = _encode_headers(data, sort_keys=sort_keys).encode(UTF_8)
+    elif output_format == "hjson":
+        encoded = _encode_hjson(data, sort_keys=sort_keys, stringify=stringify).encode(
+            UTF_8
+        )
+    elif output_format == "ini":
+        encoded = _encode_ini(data, sort_keys=sort_keys).encode(UTF_8)
+    elif output_format == "ion":
+        encoded = _encode_ion(
+            data, ion_format=options.ion_format, sort_keys=sort_keys
+        )
+    elif output_format == "json" and options.json_canonical:
+        encoded = _encode_jcs(
+            data, non_finite=options.json_non_finite, stringify=stringify
+        ).encode(UTF_8)
+    elif output_format == "json":
+        encoded = _encode_json(
+            data,
+            indent=options.json_indent,
+            non_finite=options.json_non_finite,
+            sort_keys=sort_keys,
+            stringify=stringify,
+        ).encode(UTF_8)
+    elif output_format == "jsonl":
+        encoded = _encode_jsonl(
+            data,
+            non_finite=options.json_non_finite,
+            sort_keys=sort_keys,
+            stringify=stringify,
+        ).encode(UTF_8)
+    elif output_format == "kdl":
+        encoded = _encode_kdl(data, sort_keys=sort_keys).encode(UTF_8)
+    elif output_format == "ron":
+        encoded = _encode_ron(data, sort_keys=sort_keys).encode(UTF_8)
+    elif output_format == "sdl":
+        encoded = _encode_sdl(data, sort_keys=sort_keys).encode(UTF_8)
+    elif output_format == "smile":
+        encoded = _encode_smile(data, sort_keys=sort_keys, stringify=stringify)
+    elif output_format == "tnetstring":
+        encoded = _encode_tnetstring(data, sort_keys=sort_keys, stringify=stringify)
+    elif output_format == "ucl":
+        encoded = _encode_ucl(data, sort_keys=sort_keys).encode(UTF_8)
+    elif output_format == "unit":
+        encoded = _encode_unit(data, sort_keys=sort_keys).encode(UTF_8)
+    elif output_format == "msgpack":
+        encoded = _encode_msgpack(data)
+    elif output_format == "nestedtext":
+        encoded = _encode_nestedtext(data, sort_keys=sort_keys).encode(UTF_8)
+    elif output_format == "plist":
+        encoded = _encode_plist(
+            data, plist_format=options.plist_format, sort_keys=sort_keys
+        )
+    elif output_format == "properties":
+        encoded = _encode_properties(
+            data, flat=options.properties_flat, sort_keys=sort_keys
+        ).encode(UTF_8)
+    elif output_format == "reg":
+        encoded = _encode_reg(data, sort_keys=sort_keys)
+    elif output_format == "toml":
+        if not isinstance(data, Mapping) and (
+            options.toml_wrap or options.toml_root_key
+        ):
+            default_key = "items" if isinstance(data, list) else "value"
+            data = {options.toml_root_key or default_key: data}
+        if not isinstance(data, Mapping):
+            msg = (
+                f"Top-level value of type '{type(data).__name__}' cannot "
+                "be encoded as TOML"
+            )
+            raise TypeError(msg)
+        encoded = _encode_toml(
+            data,
+            descriptions=options.toml_descriptions,
+            inline_tables=options.toml_inline_tables,
+            sort_keys=sort_keys,
+            stringify=stringify,
+            version=options.toml_version,
+        ).encode(UTF_8)
+    elif output_format == "ubjson":
+        encoded = _encode_ubjson(data, sort_keys=sort_keys, stringify=stringify)
+    elif output_format == "urlencoded":
+        encoded = _encode_urlencoded(
+            data, sort_keys=sort_keys, style=options.urlencoded_style
+        ).encode(UTF_8)
+    elif output_format == "xml":
+        encoded = _encode_xml(
+            data, convention=options.xml_convention, sort_keys=sort_keys
+        ).encode(UTF_8)
+    elif output_format == "yaml":
+        encoded = _encode_yaml(
+            data, version=options.yaml_version, yaml_options=options.yaml_options
+        ).encode(UTF_8)
+    elif output_format == "cbor":
+        encoded = _encode_cbor(data, canonical=options.cbor_canonical)
+    elif output_format == "cheader":
+        encoded = _encode_cheader(
+            data, prefix=options.c_prefix, sort_keys=sort_keys
+        ).encode(UTF_8)
+    elif output_format == "lua":
+        encoded = _encode_lua(
+            data, lua_return=options.lua_return, sort_keys=sort_keys
+        ).encode(UTF_8)
+    elif output_format == "go":
+        encoded = _encode_go(
+            data,
+            go_package=options.go_package,
+            go_var=options.go_var,
+            sort_keys=sort_keys,
+        ).encode(UTF_8)
+    elif output_format == "starlark":
+        encoded = _encode_starlark(
+            data, sort_keys=sort_keys, starlark_var=options.starlark_var
+        ).encode(UTF_8)
+    elif output_format == "pyliteral":
+        encoded = _encode_pyliteral(data, sort_keys=sort_keys).encode(UTF_8)
+    elif output_format == "cue":
+        encoded = _encode_cue(data, sort_keys=sort_keys).encode(UTF_8)
+    elif output_format == "sql":
+        encoded = _encode_sql(
+            data, sort_keys=sort_keys, table=options.sql_table
+        ).encode(UTF_8)
+    elif output_format in {"csv", "tsv"}:
+        encoded = _encode_csv(
+            data,
+            columns=options.csv_columns,
+            delimiter=options.csv_delimiter if output_format == "csv" else "\t",
+            sort_keys=sort_keys,
+        ).encode(UTF_8)
+    else:
+        msg = f"Unknown output format: {output_format}"
+        raise ValueError(msg)
+
+    return encoded
+
+
+# === Transforms ===
+
+
+def _jq() -> Any:
+    try:
+        import jq  # type: ignore
+    except ModuleNotFoundError:
+        msg = 'Queries require the package "jq"; install "remarshal[jq]"'
+        raise OSError(msg)
+
+    return jq
+
+
+def _query(doc: Document, expression: str, *, all_results: bool = False) -> Document:
+    jq = _jq()
+
+    # jq only knows JSON, so dates and times become strings.
+    text = _encode_json(doc, indent=None, sort_keys=False, stringify=True)
+    try:
+        output = jq.compile(expression).input_text(text).text()
+    except ValueError as e:
+        msg = f"Cannot run query {expression!r} ({e})"
+        raise ValueError(msg)
+
+    # Parse the output text, since `all()` turns floats like 1.0 into integers.
+    results = [json.loads(line) for line in output.split("\n") if line]
+
+    if all_results:
+        return results
+    if len(results) != 1:
+        msg = (
+            f"Query {expression!r} gave {len(results)} results instead of one; "
+            'wrap it in "[...]" or use "--query-all" to get an array'
+        )
+        raise ValueError(msg)
+
+    return results[0]
+
+
+def _filter(doc: Document, command: str) -> Document:
+    # The command runs once, so a stream of documents is one array.
+    # Like with jq, dates and times become strings.
+    text = _encode_json(doc, indent=None, sort_keys=False, stringify=True)
+    try:
+        # The command is for a shell, like in a Makefile.
+        result = subprocess.run(  # noqa: S602.
+            command,
+            check=False,
+            input=text.encode(UTF_8),
+            shell=True,
+            stdout=subprocess.PIPE,
+        )
+    except OSError as e:
+        msg = f"Cannot run filter command {command!r} ({e})"
+        raise ValueError(msg)
+
+    if result.returncode != 0:
+        msg = (
+            f"Filter command {command!r} failed with exit status {result.returncode}"
+        )
+        raise ValueError(msg)
+
+    try:
+        return _decode_json(result.stdout)
+    except DecodeError as e:
+        msg = f"Cannot parse the output of filter command {command!r} ({e})"
+        raise ValueError(msg)
+
+
+def _sample_indices(length: int, n: int) -> list[int]:
+    if n >= length:
+        return list(range(length))
+    if n == 1:
+        return [0]
+
+    # Spread the indices evenly from the first to the last element.
+    return [round(i * (length - 1) / (n - 1)) for i in range(n)]
+
+
+def _sample(doc: Document, n: int) -> Document:
+    if isinstance(doc, list):
+        return [doc[i] for i in _sample_indices(len(doc), n)]
+
+    if isinstance(doc, Mapping):
+        items = list(doc.items())
+        return dict(items[i] for i in _sample_indices(len(items), n))
+
+    return doc
+
+
+def _select_doc(doc: Document, selector: int | tuple[str, Any]) -> Document:
+    """Return an element of a top-level array by index or by the value at a path.
+
+    A negative index counts from the end.
+    """
+    if not isinstance(doc, list):
+        msg = f"Top-level value of type '{type(doc).__name__}' has no documents"
+        raise TypeError(msg)
+
+    if isinstance(selector, int):
+        if not -len(doc) <= selector < len(doc):
+            msg = f"no document {selector} in {len(doc)} documents"
+            raise ValueError(msg)
+        return doc[selector]
+
+    path, value = selector
+    for x in doc:
+        with contextlib.suppress(ValueError):
+            found = _get_path(x, _dotted_path(path), path=path)
+            # `True == 1`, but the option value `true` should not match 1.
+            if found == value and isinstance(found, bool) == isinstance(value, bool):
+                return x
+
+    msg = f"no document with {value!r} at path {path!r}"
+    raise ValueError(msg)
+
+
+def _document_type(x: Any) -> str | None:
+    if x is None:
+        return "null"
+
+    # `bool` must come before `int`, its superclass.
+    for type_, name in (
+        (list, "array"),
+        (bool, "bool"),
+        ((float, int), "number"),
+        (Mapping, "object"),
+        (str, "string"),
+    ):
+        if isinstance(x, type_):
+            return name
+
+    return None
+
+
+def _canonical(x: Any) -> Any:
+    """Return a hashable form of `x` to compare values.
+
+    Numbers compare by value, so `1` equals `1.0`, but booleans are not numbers.
+    Maps compare regardless of key order.
+    """
+    if isinstance(x, Mapping):
+        return ("object", frozenset((k, _canonical(v)) for k, v in x.items()))
+    if isinstance(x, list):
+        return ("array", tuple(_canonical(item) for item in x))
+
+    return (_document_type(x) or type(x).__name__, x)
+
+
+def _dedup(items: list[Any], *, objects: bool) -> list[Any]:
+    if not objects and any(isinstance(x, (Mapping, list)) for x in items):
+        return items
+
+    seen = set()
+    unique = []
+
+    for x in items:
+        key = _canonical(x)
+        if key not in seen:
+            seen.add(key)
+            unique.append(x)
+
+    return unique
+
+
+def _merge(base: Any, overlay: Any, *, arrays: str) -> Any:
+    """Merge `overlay` into `base` recursively, combining arrays by `arrays`."""
+    if isinstance(base, Mapping) and isinstance(overlay, Mapping):
+        merged = dict(base)
+        for k, v in overlay.items():
+            merged[k] = _merge(base[k], v, arrays=arrays) if k in base else v
+        return merged
+
+    if isinstance(base, list) and isinstance(overlay, list):
+        return _merge_arrays(base, overlay, strategy=arrays)
+
+    return overlay
+
+
+def _fill_defaults(doc: Any, defaults: Any) -> Any:
+    """Add the keys of `defaults` that `doc` lacks, recursively, after its own."""
+    if not isinstance(doc, Mapping) or not isinstance(defaults, Mapping):
+        return doc
+
+    filled = {
+        k: _fill_defaults(v, defaults[k]) if k in defaults else v
+        for k, v in doc.items()
+    }
+    filled.update((k, v) for k, v in defaults.items() if k not in doc)
+
+    return filled
+
+
+def _merge_patch(target: Any, patch: Any) -> Any:
+    """Apply the RFC 7386 JSON Merge Patch `patch` to `target`."""
+    if not isinstance(patch, Mapping):
+        return patch
+
+    merged = dict(target) if isinstance(target, Mapping) else {}
+    for k, v in patch.items():
+        # Null removes a key.
+        if v is None:
+            merged.pop(k, None)
+        else:
+            merged[k] = _merge_patch(merged.get(k), v)
+
+    return merged
+
+
+def _merge_arrays(base: list[Any], overlay: list[Any], *, strategy: str) -> list[Any]:
+    if strategy == "replace":
+        return overlay
+    if strategy == "append":
+        return base + overlay
+    if strategy == "merge-by-index":
+        merged = [_merge(b, o, arrays=strategy) for b, o in zip(base, overlay)]
+        return merged + base[len(overlay) :] + overlay[len(base) :]
+
+    prefix, _, key = strategy.partition("=")
+    if prefix != "merge-by-key" or not key:
+        msg = (
+            f"unknown array merge strategy {strategy!r} "
+            '(choose from "append", "merge-by-index", "merge-by-key=<key>", '
+            '"replace")'
+        )
+        raise ValueError(msg)
+
+    # Maps with the same value of `key` are merged; other elements are appended.
+    merged = list(base)
+    index = {
+        _canonical(x[key]): i
+        for i, x in enumerate(merged)
+        if isinstance(x, Mapping) and key in x
+    }
+    for x in overlay:
+        i = None
+        if isinstance(x, Mapping) and key in x:
+            i = index.get(_canonical(x[key]))
+        if i is None:
+            merged.append(x)
+        else:
+            merged[i] = _merge(merged[i], x, arrays=strategy)
+
+    return merged
+
+
+def _array_at_path(doc: Document, path: str) -> list[Any]:
+    items = _get_path(doc, _dotted_path(path), path=path)
+    if not isinstance(items, list):
+        msg = f"value at path {path!r} is not an array"
+        raise TypeError(msg)
+
+    return items
+
+
+_ENV_REFERENCE = re.compile(
+    r"\$(?:(\$)|([A-Za-z_]\w*)|\{([A-Za-z_]\w*)(?:(:?-)([^}]*))?\})", re.ASCII
+)
+
+
+def _expand_env(s: str, env: Mapping[str, str]) -> str:
+    def replace(match: re.Match[str]) -> str:
+        dollar, name, braced_name, operator, default = match.groups()
+        if dollar:
+            return "$"
+
+        name = name or braced_name
+        value = env.get(name)
+        # Like in the shell, ":-" also uses the default for an empty variable.
+        if operator == ":-" and not value:
+            return default
+        if operator == "-" and value is None:
+            return default
+        if value is None:
+            msg = f"environment variable {name!r} is not set"
+            raise ValueError(msg)
+
+        return value
+
+    return _ENV_REFERENCE.sub(replace, s)
+
+
+def _strip(doc: Document, *, empty: bool, nulls: bool) -> Document:
+    """Remove nulls or empty values from arrays and maps recursively.
+
+    Arrays and maps that become empty are removed too with `empty`.
+    """
+
+    def drop(x: Any) -> bool:
+        if x is None:
+            return nulls
+        return empty and isinstance(x, (str, list, Mapping)) and not x
+
+    def strip(x: Any) -> Any:
+        if isinstance(x, Mapping):
+            items = ((k, strip(v)) for k, v in x.items())
+            return {k: v for k, v in items if not drop(v)}
+        if isinstance(x, list):
+            return [v for v in map(strip, x) if not drop(v)]
+        return x
+
+    return strip(doc)
+
+
+def _sort_key(x: Any) -> tuple[int, Any]:
+    """Order null, booleans, numbers, strings, dates and times, then the rest."""
+    if x is None:
+        return 0, 0
+    if isinstance(x, bool):
+        return 1, x
+    if isinstance(x, (float, int)):
+        return 2, x
+    if isinstance(x, str):
+        return 3, x
+    if isinstance(x, (datetime.date, datetime.datetime, datetime.time)):
+        return 4, x.isoformat()
+
+    return 5, str(x)
+
+
+def _sort_array(items: list[Any], key: str | None, *, path: str) -> list[Any]:
+    if key is not None:
+        if not all(isinstance(x, Mapping) for x in items):
+            msg = f"cannot sort the array at path {path!r} by a key; it has non-maps"
+            raise TypeError(msg)
+        # Maps without the key go last.
+        return sorted(items, key=lambda x: (key not in x, _sort_key(x.get(key))))
+
+    if any(isinstance(x, (list, Mapping)) for x in items):
+        msg = f"cannot sort the array at path {path!r} without a key to sort maps by"
+        raise TypeError(msg)
+
+    return sorted(items, key=_sort_key)
+
+
+def _select_type(doc: Document, type_name: str) -> Document:
+    """Drop every branch of `doc` that has no value of the type `type_name`.
+
+    Matching arrays and objects are kept whole.
+    Arrays are compacted, so elements can change their index.
+    """
+
+    def select(x: Any) -> tuple[bool, Any]:
+        if isinstance(x, Mapping):
+            items = x.items()
+        elif isinstance(x, list):
+            items = enumerate(x)
+        else:
+            return False, x
+
+        selected = []
+        for k, v in items:
+            if _document_type(v) == type_name:
+                selected.append((k, v))
+            else:
+                found, pruned = select(v)
+                if found:
+                    selected.append((k, pruned))
+
+        if isinstance(x, list):
+            return bool(selected), [v for _, v in selected]
+
+        return bool(selected), dict(selected)
+
+    return select(doc)[1]
+
+
+_SCHEMA_ZERO_VALUES = {
+    "array": [],
+    "boolean": False,
+    "integer": 0,
+    "null": None,
+    "number": 0.0,
+    "object": {},
+    "string": "",
+}
+
+
+def _schema_resolve(root: Mapping[str, Any], ref: str) -> Any:
+    if not ref.startswith("#"):
+        msg = f"cannot follow external schema reference {ref!r}"
+        raise ValueError(msg)
+
+    x: Any = root
+    for part in ref[1:].split("/")[1:]:
+        key = part.replace("~1", "/").replace("~0", "~")
+        if not isinstance(x, Mapping) or key not in x:
+            msg = f"cannot resolve schema reference {ref!r}"
+            raise ValueError(msg)
+        x = x[key]
+
+    return x
+
+
+def _schema_type(node: Mapping[str, Any]) -> str | None:
+    type_ = node.get("type")
+
+    if isinstance(type_, list):
+        # Prefer a type other than "null" for a more useful example.
+        return next((t for t in type_ if t != "null"), "null")
+
+    if type_ is None:
+        if "properties" in node:
+            return "object"
+        if "items" in node:
+            return "array"
+
+    return type_
+
+
+def _schema_example(  # noqa: C901, PLR0911.
+    node: Any,
+    *,
+    all_properties: bool,
+    refs: tuple[str, ...] = (),
+    root: Mapping[str, Any],
+) -> Any:
+    if not isinstance(node, Mapping):
+        # A boolean schema.
+        return None
+
+    def example(sub: Any, refs: tuple[str, ...] = refs) -> Any:
+        return _schema_example(sub, all_properties=all_properties, refs=refs, root=root)
+
+    if "$ref" in node:
+        ref = node["$ref"]
+        # Stop at a recursive reference.
+        if ref in refs:
+            return None
+        return example(_schema_resolve(root, ref), (*refs, ref))
+
+    for key in ("default", "const"):
+        if key in node:
+            return node[key]
+    for key in ("examples", "enum"):
+        if node.get(key):
+            return node[key][0]
+
+    if "allOf" in node:
+        merged: dict[str, Any] = {}
+        for sub in node["allOf"]:
+            value = example(sub)
+            if isinstance(value, Mapping):
+                merged.update(value)
+        return merged
+    for key in ("anyOf", "oneOf"):
+        if node.get(key):
+            return example(node[key][0])
+
+    type_ = _schema_type(node)
+
+    if type_ == "object":
+        required = node.get("required", [])
+        return {
+            k: example(v)
+            for k, v in node.get("properties", {}).items()
+            if all_properties or k in required
+        }
+
+    if type_ == "array":
+        return [example(node.get("items", {})) for _ in range(node.get("minItems", 0))]
+
+    return copy.copy(_SCHEMA_ZERO_VALUES.get(type_))
+
+
+def _document_from_schema(schema: Document, *, all_properties: bool) -> Document:
+    """Generate an example document from a JSON Schema.
+
+    Values come from `default`, `const`, `examples`, or `enum`
+    or are the zero value of the type.
+    Only required properties are included unless `all_properties` is true.
+    References are only followed within the schema.
+    """
+    if not isinstance(schema, Mapping):
+        msg = "JSON Schema must be an object"
+        raise TypeError(msg)
+
+    return _schema_example(schema, all_properties=all_properties, root=schema)
+
+
+_SCHEMA_CAST_TYPES = {
+    "boolean": "bool",
+    "integer": "int",
+    "number": "float",
+    "string": "string",
+}
+
+
+def _schema_cast_scalar(x: Any, type_: str) -> Any:
+    if type_ == "null":
+        if x is None or (isinstance(x, str) and x.strip() in {"", "null"}):
+            return None
+        msg = f"cannot coerce {x!r} to null"
+        raise ValueError(msg)
+
+    if type_ == "number":
+        if isinstance(x, (float, int)) and not isinstance(x, bool):
+            return x
+        # Keep integers like "8080" integers.
+        with contextlib.suppress(ValueError):
+            return _coerce_value(x, "int")
+
+    if type_ in _SCHEMA_CAST_TYPES:
+        return _coerce_value(x, _SCHEMA_CAST_TYPES[type_])
+
+    return x
+
+
+def _schema_cast_types(
+    node: Mapping[str, Any],
+    x: Any,
+    *,
+    cast: Callable[..., Any],
+    parts: tuple[Any, ...],
+) -> Any:
+    type_ = node.get("type")
+    types = type_ if isinstance(type_, list) else [_schema_type(node)]
+
+    if "object" in types and isinstance(x, Mapping):
+        properties = node.get("properties", {})
+        patterns = node.get("patternProperties", {})
+        additional = node.get("additionalProperties", True)
+
+        result = {}
+        for k, v in x.items():
+            if k in properties:
+                sub = properties[k]
+            else:
+                sub = next(
+                    (s for p, s in patterns.items() if re.search(p, str(k))),
+                    additional,
+                )
+            result[k] = cast(sub, v, k)
+
+        return result
+
+    if "array" in types and isinstance(x, list):
+        prefix = node.get("prefixItems", [])
+        items = node.get("items", True)
+        # Before draft 2020-12, an array of schemas in "items" was a tuple.
+        if isinstance(items, list):
+            prefix, items = items, node.get("additionalItems", True)
+
+        return [
+            cast(prefix[i] if i < len(prefix) else items, v, i)
+            for i, v in enumerate(x)
+        ]
+
+    scalars = [t for t in types if t not in {None, "array", "object"}]
+    if not scalars or isinstance(x, (list, Mapping)):
+        return x
+
+    # A value that already has one of the types stays as it is.
+    for t in scalars:
+        with contextlib.suppress(ValueError):
+            if _schema_cast_scalar(x, t) is x:
+                return x
+
+    error = None
+    for t in scalars:
+        try:
+            return _schema_cast_scalar(x, t)
+        except ValueError as e:
+            error = error or e
+
+    path = _escape_path(parts) if parts else "(root)"
+    msg = f"{error} at path {path!r}"
+    raise ValueError(msg)
+
+
+def _schema_cast(
+    node: Any,
+    x: Any,
+    *,
+    parts: tuple[Any, ...],
+    refs: tuple[str, ...] = (),
+    root: Mapping[str, Any],
+) -> Any:
+    if not isinstance(node, Mapping):
+        # A boolean schema.
+        return x
+
+    def cast(sub: Any, y: Any, *key: Any) -> Any:
+        # A reference only repeats for the same value when it is recursive.
+        return _schema_cast(
+            sub, y, parts=(*parts, *key), refs=() if key else refs, root=root
+        )
+
+    if "$ref" in node:
+        ref = node["$ref"]
+        if ref in refs:
+            return x
+        return _schema_cast(
+            _schema_resolve(root, ref), x, parts=parts, refs=(*refs, ref), root=root
+        )
+
+    for sub in node.get("allOf", ()):
+        x = cast(sub, x)
+
+    # The keywords next to "anyOf" and "oneOf" apply before the branches.
+    x = _schema_cast_types(node, x, cast=cast, parts=parts)
+
+    for key in ("anyOf", "oneOf"):
+        if node.get(key):
+            errors = []
+            for sub in node[key]:
+                try:
+                    return cast(sub, x)
+                except ValueError as e:
+                    errors.append(e)
+            raise errors[0]
+
+    return x
+
+
+def _cast_to_schema(doc: Document, schema: Document) -> Document:
+    """Convert values to the types that a JSON Schema declares.
+
+    A value that cannot be converted is an error.
+    References are only followed within the schema.
+    """
+    if not isinstance(schema, Mapping):
+        msg = "JSON Schema must be an object"
+        raise TypeError(msg)
+
+    return _schema_cast(schema, doc, parts=(), root=schema)
+
+
+def _infer_schema(x: Any) -> dict[str, Any]:  # noqa: PLR0911.
+    if isinstance(x, Mapping):
+        return {
+            "type": "object",
+            "properties": {k: _infer_schema(v) for k, v in x.items()},
+            "required": list(x),
+        }
+
+    if isinstance(x, list):
+        schema: dict[str, Any] = {"type": "array"}
+        for item in x:
+            item_schema = _infer_schema(item)
+            schema["items"] = (
+                _merge_schemas(schema["items"], item_schema)
+                if "items" in schema
+                else item_schema
+            )
+        return schema
+
+    if x is None:
+        return {"type": "null"}
+    # `bool` must come before `int`, its superclass.
+    if isinstance(x, bool):
+        return {"type": "boolean"}
+    if isinstance(x, int):
+        return {"type": "integer"}
+    if isinstance(x, float):
+        return {"type": "number"}
+    if isinstance(x, bytes):
+        return {"type": "string", "contentEncoding": "base64"}
+    # `datetime` must come before `date`, its superclass.
+    if isinstance(x, datetime.datetime):
+        return {"type": "string", "format": "date-time"}
+    if isinstance(x, datetime.date):
+        return {"type": "string", "format": "date"}
+    if isinstance(x, datetime.time):
+        return {"type": "string", "format": "time"}
+
+    return {"type": "string"}
+
+
+def _schema_kind(schema: Mapping[str, Any]) -> str:
+    # Integers and other numbers merge into numbers.
+    return "number" if schema["type"] == "integer" else schema["type"]
+
+
+def _schema_variants(schema: Mapping[str, Any]) -> list[Mapping[str, Any]]:
+    if "anyOf" in schema:
+        return list(schema["anyOf"])
+    if isinstance(schema["type"], list):
+        return [{"type": type_} for type_ in schema["type"]]
+
+    return [schema]
+
+
+def _merge_schemas(a: Mapping[str, Any], b: Mapping[str, Any]) -> dict[str, Any]:
+    """Return a schema that describes the values of both `a` and `b`.
+
+    Schemas of different types become an `anyOf`
+    or a list of types when the types are all they have.
+    """
+    variants = _schema_variants(a)
+
+    for new in _schema_variants(b):
+        for i, old in enumerate(variants):
+            if _schema_kind(old) == _schema_kind(new):
+                variants[i] = _merge_same_kind(old, new)
+                break
+        else:
+            variants.append(new)
+
+    if len(variants) == 1:
+        return dict(variants[0])
+    if all(set(x) == {"type"} for x in variants):
+        return {"type": [x["type"] for x in variants]}
+
+    return {"anyOf": variants}
+
+
+def _merge_same_kind(a: Mapping[str, Any], b: Mapping[str, Any]) -> dict[str, Any]:
+    if a["type"] == "object":
+        properties = dict(a["properties"])
+        for k, v in b["properties"].items():
+            properties[k] = _merge_schemas(properties[k], v) if k in properties else v
+        # Only properties in every sample are required.
+        required = [k for k in a["required"] if k in b["required"]]
+        return {"type": "object", "properties": properties, "required": required}
+
+    if a["type"] == "array":
+        if "items" in a and "items" in b:
+            return {"type": "array", "items": _merge_schemas(a["items"], b["items"])}
+        return dict(a if "items" in a else b)
+
+    if a["type"] != b["type"]:
+        return {"type": "number"}
+
+    # Keep a format like "date" only when every sample has it.
+    return {k: v for k, v in a.items() if b.get(k) == v}
+
+
+def _schema_from_samples(samples: Sequence[Any]) -> dict[str, Any]:
+    """Infer a JSON Schema for data like the samples."""
+    schema: dict[str, Any] = {}
+
+    for sample in samples:
+        sample_schema = _infer_schema(sample)
+        schema = _merge_schemas(schema, sample_schema) if schema else sample_schema
+
+    return {"$schema": "https://json-schema.org/draft/2020-12/schema", **schema}
+
+
+_FLOAT_TEXT = re.compile(r"\s*\+?(-?\d+)(?:\.(\d*))?([eE][-+]?\d+)?\s*\Z")
+
+
+def _reformat_float(x: float, *, float_format: str) -> decimal.Decimal | float:
+    if not math.isfinite(x):
+        return x
+
+    try:
+        text = float_format % x
+    except (TypeError, ValueError):
+        text = ""
+
+    match = _FLOAT_TEXT.match(text)
+    if not match:
+        msg = f"float format {float_format!r} does not produce a number"
+        raise ValueError(msg)
+
+    # Keep the digits and the exponent, but always with a fraction.
+    whole, fraction, exponent = match.groups()
+    number = _FormattedFloat(text)
+    number.text = f"{whole}.{fraction or '0'}{exponent or ''}"
+
+    return number
+
+
+def _convert_datetime(x: Any, *, style: str) -> Any:
+    if style == "string":
+        return x.isoformat()
+
+    if isinstance(x, datetime.time):
+        msg = f"time {x.isoformat()!r} has no date for a Unix timestamp"
+        raise ValueError(msg)
+    if not isinstance(x, datetime.datetime):
+        x = datetime.datetime.combine(x, datetime.time())
+    # Local date-times are taken to be in UTC, so the result does not depend on
+    # the time zone of the machine.
+    if x.tzinfo is None:
+        x = x.replace(tzinfo=datetime.timezone.utc)
+
+    timestamp = x.timestamp()
+    return int(timestamp) if timestamp.is_integer() else timestamp
+
+
+def _map_values(doc: Document, type_: type, callback: Callable[[Any], Any]) -> Any:
+    """Apply `callback` to every leaf value of type `type_`, not keys."""
+    return traverse(doc, instance_callbacks=[(type_, callback)])
+
+
+def _update_path(
+    doc: Document, path: str, callback: Callable[[Any], Any]
+) -> Document:
+    """Replace the value at the dotted path `path` with `callback(value)`.
+
+    Path components index arrays when the value is an array.
+    """
+    parent = None
+    key: Any = None
+    x = doc
+
+    for part in _dotted_path(path):
+        if isinstance(x, Mapping) and part in x:
+            key = part
+        elif isinstance(x, list) and part.isdigit() and int(part) < len(x):
+            key = int(part)
+        else:
+            msg = f"no value at path {path!r}"
+            raise ValueError(msg)
+
+        parent = x
+        x = x[key]
 
-    return args
+    if parent is None:
+        return callback(doc)
 
+    parent[key] = callback(x)
+    return doc
 
-# === Parser/serializer wrappers ===
 
+def _dotted_path(path: str) -> list[str]:
+    r"""Split a path like "a.b\.c" into ["a", "b.c"].
 
-def identity(x: Any) -> Any:
-    return x
+    A backslash escapes a dot or another backslash.
+    """
+    parts = [""]
 
+    for match in re.finditer(r"\\(.)|(\.)|([^\\.]+|\\\Z)", path, re.DOTALL):
+        if match.group(2):
+            parts.append("")
+        else:
+            parts[-1] += match.group(1) or match.group(3)
 
-def traverse(
-    col: Any,
-    dict_callback: Callable[[Sequence[tuple[Any, Any]]], Any] = dict,
-    list_callback: Callable[[Sequence[tuple[Any, Any]]], Any] = identity,
-    key_callback: Callable[[Any], Any] = identity,
-    instance_callbacks: Sequence[tuple[type, Any]] = (),
-    default_callback: Callable[[Any], Any] = identity,
-) -> Any:
-    if isinstance(col, dict):
-        res = dict_callback(
-            [
-                (
-                    key_callback(k),
-                    traverse(
-                        v,
-                        dict_callback,
-                        list_callback,
-                        key_callback,
-                        instance_callbacks,
-                        default_callback,
-                    ),
-                )
-                for (k, v) in col.items()
-            ]
-        )
-    elif isinstance(col, list):
-        res = list_callback(
-            [
-                traverse(
-                    x,
-                    dict_callback,
-                    list_callback,
-                    key_callback,
-                    instance_callbacks,
-                    default_callback,
-                )
-                for x in col
-            ]
-        )
-    else:
-        for t, callback in instance_callbacks:
-            if isinstance(col, t):
-                res = callback(col)
+    return parts
+
+
+def _unwrap(doc: Document, path: str) -> Document:
+    for i, key in enumerate(_dotted_path(path)):
+        if not isinstance(doc, Mapping):
+            where = "Top-level value" if i == 0 else "Value"
+            msg = f"{where} of type '{type(doc).__name__}' cannot be unwrapped"
+            raise TypeError(msg)
+        if key not in doc:
+            msg = f"no key {key!r} to unwrap"
+            raise ValueError(msg)
+        doc = doc[key]
+
+    return doc
+
+
+def _set_path(doc: Document, path: str, value: Any) -> Document:
+    """Set the value at the dotted path `path`, adding maps for missing keys.
+
+    An array index can be one past the end to append to the array.
+    """
+    parts = _dotted_path(path)
+    x: Any = doc
+
+    for i, part in enumerate(parts):
+        last = i == len(parts) - 1
+
+        if isinstance(x, list):
+            if not re.fullmatch(r"0|[1-9][0-9]*", part) or int(part) > len(x):
+                msg = f"no array index {part!r} at path {path!r}"
+                raise ValueError(msg)
+            key: Any = int(part)
+            if key == len(x):
+                x.append({})
+        elif isinstance(x, Mapping):
+            key = part
+            if key not in x:
+                x[key] = {}
+        else:
+            msg = f"cannot set path {path!r} in a value of type '{type(x).__name__}'"
+            raise TypeError(msg)
+
+        if last:
+            x[key] = value
+        else:
+            x = x[key]
+
+    return doc
+
+
+def _delete_path(doc: Document, path: str) -> Document:
+    """Remove the value at the dotted path `path` if there is one."""
+    *parents, last = _dotted_path(path)
+
+    try:
+        parent = _get_path(doc, parents, path=path)
+    except ValueError:
+        return doc
+
+    if isinstance(parent, Mapping) and last in parent:
+        del parent[last]
+    elif (
+        isinstance(parent, list)
+        and re.fullmatch(r"0|[1-9][0-9]*", last)
+        and int(last) < len(parent)
+    ):
+        del parent[int(last)]
+
+    return doc
+
+
+def _keep_paths(doc: Document, paths: Sequence[str]) -> Document:
+    """Drop every branch of `doc` that is not at or under one of `paths`.
+
+    Arrays are compacted, so elements can change their index.
+    """
+    # A tree of path components where None means to keep the whole value.
+    tree: dict[str, Any] = {}
+    for path in paths:
+        node = tree
+        *parents, last = _dotted_path(path)
+        for part in parents:
+            if node.get(part, {}) is None:
                 break
+            node = node.setdefault(part, {})
         else:
-            res = default_callback(col)
+            node[last] = None
 
-    return res
+    def keep(x: Any, node: dict[str, Any]) -> tuple[bool, Any]:
+        if isinstance(x, Mapping):
+            items = x.items()
+        elif isinstance(x, list):
+            items = enumerate(x)
+        else:
+            return False, x
 
+        kept = []
+        for k, v in items:
+            if str(k) not in node:
+                continue
+            if node[str(k)] is None:
+                kept.append((k, v))
+            else:
+                found, pruned = keep(v, node[str(k)])
+                if found:
+                    kept.append((k, pruned))
+
+        if isinstance(x, list):
+            return bool(kept), [v for _, v in kept]
+
+        return bool(kept), dict(kept)
+
+    return keep(doc, tree)[1]
+
+
+def _pairs_to_map(doc: Document, name: str, value: str) -> Document:
+    """Turn arrays like [{name: "a", value: 1}] into maps like {"a": 1}.
+
+    Only non-empty arrays of maps with exactly the two keys change,
+    and only when every name is a string.
+    """
+
+    def convert(items: list[Any]) -> Any:
+        if not items or not all(
+            isinstance(x, Mapping)
+            and set(x) == {name, value}
+            and isinstance(x[name], str)
+            for x in items
+        ):
+            return items
+
+        result = {}
+        for x in items:
+            if x[name] in result:
+                msg = f"repeated {name!r} {x[name]!r} in key/value pairs"
+                raise ValueError(msg)
+            result[x[name]] = x[value]
+
+        return result
+
+    return traverse(doc, list_callback=convert)
+
+
+def _map_to_pairs(doc: Document, path: str, name: str, value: str) -> Document:
+    """Turn the map at a dotted path into an array like [{name: k, value: v}]."""
+    x = _get_path(doc, _dotted_path(path), path=path)
+    if not isinstance(x, Mapping):
+        msg = f"value at path {path!r} is not a map"
+        raise TypeError(msg)
+
+    return _set_path(doc, path, [{name: k, value: v} for k, v in x.items()])
+
+
+def _escape_path(parts: Sequence[Any]) -> str:
+    """Join path components into a dotted path like "--set" expects."""
+    return ".".join(
+        str(part).replace("\\", "\\\\").replace(".", "\\.") for part in parts
+    )
+
+
+def _redact(doc: Document, patterns: Sequence[str], *, placeholder: str) -> Document:
+    """Replace every value whose dotted path matches a pattern with `placeholder`.
+
+    A matched array or map is replaced whole.
+    """
+    compiled = [re.compile(pattern) for pattern in patterns]
+
+    def redact(x: Any, parts: tuple[Any, ...]) -> Any:
+        if parts and any(p.search(_escape_path(parts)) for p in compiled):
+            return placeholder
+        if isinstance(x, Mapping):
+            return {k: redact(v, (*parts, k)) for k, v in x.items()}
+        if isinstance(x, list):
+            return [redact(v, (*parts, i)) for i, v in enumerate(x)]
+        return x
+
+    return redact(doc, ())
 
-Document = Union[bool, bytes, datetime.datetime, Mapping, None, Sequence, str]
 
+def _rename_path(doc: Document, old: str, new: str) -> Document:
+    """Move the value at the dotted path `old` to `new` if there is one.
+
+    A key renamed within the same map keeps its position.
+    """
+    *parents, last = _dotted_path(old)
+    *new_parents, new_last = _dotted_path(new)
 
-def _decode_cbor(input_data: bytes) -> Document:
     try:
-        doc = cbor2.loads(input_data)
-        return cast(Document, doc)
-    except cbor2.CBORDecodeError as e:
-        msg = f"Cannot parse as CBOR ({e})"
+        parent = _get_path(doc, parents, path=old)
+        value = _get_path(parent, [last], path=old)
+    except ValueError:
+        return doc
+
+    if old == new:
+        return doc
+    if parents == new_parents and isinstance(parent, dict):
+        items = [
+            (new_last if k == last else k, v)
+            for k, v in parent.items()
+            if k != new_last
+        ]
+        parent.clear()
+        parent.update(items)
+        return doc
+
+    return _set_path(_delete_path(doc, old), new, value)
+
+
+def _json_pointer(pointer: str) -> list[str]:
+    """Split an RFC 6901 JSON Pointer like "/a~1b/0" into ["a/b", "0"]."""
+    if pointer == "":
+        return []
+    if not pointer.startswith("/"):
+        msg = f"JSON Pointer {pointer!r} must be empty or start with '/'"
         raise ValueError(msg)
 
+    return [
+        part.replace("~1", "/").replace("~0", "~") for part in pointer[1:].split("/")
+    ]
 
-def _decode_json(input_data: bytes) -> Document:
-    try:
-        doc = json.loads(
-            input_data.decode(UTF_8),
+
+def _get_path(doc: Document, parts: Sequence[str], *, path: str) -> Any:
+    """Return the value at the path with the components `parts`."""
+    x = doc
+
+    for part in parts:
+        if isinstance(x, Mapping) and part in x:
+            x = x[part]
+        elif (
+            isinstance(x, list)
+            and re.fullmatch(r"0|[1-9][0-9]*", part)
+            and int(part) < len(x)
+        ):
+            x = x[int(part)]
+        else:
+            msg = f"no value at path {path!r}"
+            raise ValueError(msg)
+
+    return x
+
+
+def _diff(
+    old: Any, new: Any, parts: tuple[str, ...] = ()
+) -> list[tuple[str, tuple[str, ...], Any, Any]]:
+    """Return the changes from `old` to `new` as (kind, path, old, new) tuples.
+
+    The kind is "added", "removed", or "changed".
+    Array elements are compared by index.
+    """
+    changes: list[tuple[str, tuple[str, ...], Any, Any]] = []
+
+    if isinstance(old, Mapping) and isinstance(new, Mapping):
+        for k, v in old.items():
+            if k in new:
+                changes.extend(_diff(v, new[k], (*parts, str(k))))
+            else:
+                changes.append(("removed", (*parts, str(k)), v, None))
+        changes.extend(
+            ("added", (*parts, str(k)), None, v) for k, v in new.items() if k not in old
+        )
+    elif isinstance(old, list) and isinstance(new, list):
+        for i, v in enumerate(old[: len(new)]):
+            changes.extend(_diff(v, new[i], (*parts, str(i))))
+        # Remove from the end, so a patch made from the changes keeps working.
+        changes.extend(
+            ("removed", (*parts, str(i)), old[i], None)
+            for i in reversed(range(len(new), len(old)))
         )
+        changes.extend(
+            ("added", (*parts, str(i)), None, new[i])
+            for i in range(len(old), len(new))
+        )
+    elif _canonical(old) != _canonical(new):
+        changes.append(("changed", parts, old, new))
 
-        return cast(Document, doc)
-    except json.JSONDecodeError as e:
-        msg = f"Cannot parse as JSON ({e})"
-        raise ValueError(msg)
+    return changes
 
 
-def _decode_msgpack(input_data: bytes) -> Document:
-    try:
-        doc = umsgpack.unpackb(input_data)
-        return cast(Document, doc)
-    except umsgpack.UnpackException as e:
-        msg = f"Cannot parse as MessagePack ({e})"
+def _json_patch_from_diff(
+    changes: Sequence[tuple[str, tuple[str, ...], Any, Any]],
+) -> list[dict[str, Any]]:
+    ops = {"added": "add", "changed": "replace", "removed": "remove"}
+    patch = []
+
+    for kind, parts, _, new in changes:
+        pointer = "".join(
+            "/" + part.replace("~", "~0").replace("/", "~1") for part in parts
+        )
+        operation = {"op": ops[kind], "path": pointer}
+        if kind != "removed":
+            operation["value"] = new
+        patch.append(operation)
+
+    return patch
+
+
+def _patch_add(doc: Document, pointer: str, value: Any) -> Document:
+    parts = _json_pointer(pointer)
+    if not parts:
+        return value
+
+    *parents, last = parts
+    parent = _get_path(doc, parents, path=pointer)
+    if isinstance(parent, list):
+        if last == "-":
+            parent.append(value)
+        elif re.fullmatch(r"0|[1-9][0-9]*", last) and int(last) <= len(parent):
+            parent.insert(int(last), value)
+        else:
+            msg = f"no array index {last!r} at path {pointer!r}"
+            raise ValueError(msg)
+    elif isinstance(parent, Mapping):
+        parent[last] = value
+    else:
+        msg = f"cannot add to a value of type '{type(parent).__name__}'"
         raise ValueError(msg)
 
+    return doc
 
-def _decode_toml(input_data: bytes) -> Document:
-    try:
-        doc = tomllib.loads(input_data.decode(UTF_8))
-        return cast(Document, doc)
-    except tomllib.TOMLDecodeError as e:
-        msg = f"Cannot parse as TOML ({e})"
+
+def _patch_remove(doc: Document, pointer: str) -> tuple[Document, Any]:
+    parts = _json_pointer(pointer)
+    if not parts:
+        msg = "cannot remove the whole document"
         raise ValueError(msg)
 
+    *parents, last = parts
+    parent = _get_path(doc, parents, path=pointer)
+    value = _get_path(parent, [last], path=pointer)
+    del parent[int(last) if isinstance(parent, list) else last]
 
-def _decode_yaml(input_data: bytes) -> Document:
-    try:
-        yaml = ruamel.yaml.YAML(typ="safe")
-        doc = yaml.load(input_data)
+    return doc, value
 
-        return cast(Document, doc)
-    except (ruamel.yaml.scanner.ScannerError, ruamel.yaml.parser.ParserError) as e:
-        msg = f"Cannot parse as YAML ({e})"
+
+def _json_patch(doc: Document, patch: Document) -> Document:  # noqa: C901.
+    """Apply the RFC 6902 JSON Patch `patch` to `doc`."""
+    if not isinstance(patch, list):
+        msg = "JSON Patch must be an array of operations"
+        raise TypeError(msg)
+
+    for i, operation in enumerate(patch):
+        if (
+            not isinstance(operation, Mapping)
+            or not isinstance(operation.get("op"), str)
+            or not isinstance(operation.get("path"), str)
+        ):
+            msg = f'JSON Patch operation {i} must be a map with "op" and "path"'
+            raise TypeError(msg)
+        op, path = operation["op"], operation["path"]
+
+        try:
+            if op in {"add", "replace", "test"} and "value" not in operation:
+                msg = 'missing "value"'
+                raise ValueError(msg)
+            if op in {"copy", "move"} and not isinstance(operation.get("from"), str):
+                msg = 'missing "from"'
+                raise ValueError(msg)
+
+            if op == "add":
+                doc = _patch_add(doc, path, copy.deepcopy(operation["value"]))
+            elif op == "remove":
+                doc, _ = _patch_remove(doc, path)
+            elif op == "replace":
+                value = copy.deepcopy(operation["value"])
+                if path == "":
+                    doc = value
+                else:
+                    doc, _ = _patch_remove(doc, path)
+                    doc = _patch_add(doc, path, value)
+            elif op == "move":
+                source = operation["from"]
+                if path.startswith(source + "/"):
+                    msg = f"cannot move {source!r} into itself"
+                    raise ValueError(msg)
+                if path != source:
+                    doc, value = _patch_remove(doc, source)
+                    doc = _patch_add(doc, path, value)
+            elif op == "copy":
+                source = operation["from"]
+                value = _get_path(doc, _json_pointer(source), path=source)
+                doc = _patch_add(doc, path, copy.deepcopy(value))
+            elif op == "test":
+                value = _get_path(doc, _json_pointer(path), path=path)
+                if _canonical(value) != _canonical(operation["value"]):
+                    msg = f"value at path {path!r} is not {operation['value']!r}"
+                    raise ValueError(msg)
+            else:
+                msg = f"unknown operation {op!r}"
+                raise ValueError(msg)
+        except ValueError as e:
+            msg = f"JSON Patch operation {i} ({op}) failed: {e}"
+            raise ValueError(msg)
+
+    return doc
+
+
+def _coerce_type(value: str) -> Any:
+    if value.lower() == "null":
+        return None
+
+    return _infer_type(value)
+
+
+_COERCE_BOOLS = {
+    "0": False,
+    "1": True,
+    "false": False,
+    "no": False,
+    "off": False,
+    "on": True,
+    "true": True,
+    "yes": True,
+}
+
+
+def _coerce_value(value: Any, type_name: str) -> Any:  # noqa: C901, PLR0911.
+    if type_name == "bool":
+        if isinstance(value, bool):
+            return value
+        if isinstance(value, int) and value in (0, 1):
+            return bool(value)
+        if isinstance(value, str) and value.strip().lower() in _COERCE_BOOLS:
+            return _COERCE_BOOLS[value.strip().lower()]
+
+    elif type_name == "float":
+        if isinstance(value, (float, int)) and not isinstance(value, bool):
+            return float(value)
+        if isinstance(value, str):
+            with contextlib.suppress(ValueError):
+                return float(value)
+
+    elif type_name == "int":
+        if isinstance(value, int) and not isinstance(value, bool):
+            return value
+        if isinstance(value, float) and value.is_integer():
+            return int(value)
+        if isinstance(value, str):
+            with contextlib.suppress(ValueError):
+                return int(value)
+
+    elif type_name == "string":
+        if isinstance(value, str):
+            return value
+        if isinstance(value, bool):
+            return "true" if value else "false"
+        if isinstance(value, (float, int)):
+            return str(value)
+        if isinstance(value, (datetime.date, datetime.time)):
+            return value.isoformat()
+
+    else:
+        msg = f"unknown type {type_name!r}"
         raise ValueError(msg)
 
+    msg = f"cannot coerce {value!r} to {type_name}"
+    raise ValueError(msg)
+
+
+def _coerce(doc: Document, rules: Mapping[str, str]) -> Document:
+    for path, type_name in rules.items():
+
+        def callback(x: Any, path: str = path, type_name: str = type_name) -> Any:
+            try:
+                return _coerce_value(x, type_name)
+            except ValueError as e:
+                msg = f"{e} at path {path!r}"
+                raise ValueError(msg)
+
+        doc = _update_path(doc, path, callback)
+
+    return doc
+
+
+_KEY_WORD_BOUNDARY = re.compile(
+    r"[_\-\s]+|(?<=[a-z0-9])(?=[A-Z])|(?<=[A-Z])(?=[A-Z][a-z])"
+)
+
+
+def _convert_key_case(key: str, case: str) -> str:
+    # Keep leading and trailing separators, like in "_id" and "__init__".
+    match = re.fullmatch(r"([_\-]*)(.*?)([_\-]*)", key, re.DOTALL)
+    prefix, body, suffix = cast("re.Match[str]", match).groups()
+    words = [word for word in _KEY_WORD_BOUNDARY.split(body) if word]
+    if not words:
+        return key
+
+    if case == "snake":
+        body = "_".join(word.lower() for word in words)
+    elif case == "kebab":
+        body = "-".join(word.lower() for word in words)
+    else:
+        body = "".join(word.capitalize() for word in words)
+        if case == "camel":
+            body = words[0].lower() + body[len(words[0]) :]
+
+    return prefix + body + suffix
+
+
+def _key_case(doc: Document, case: str) -> Document:
+    def rename(pairs: Sequence[tuple[Any, Any]]) -> dict[Any, Any]:
+        renamed: dict[Any, Any] = {}
+        original = {}
+
+        for k, v in pairs:
+            new_key = _convert_key_case(k, case) if isinstance(k, str) else k
+            if new_key in renamed:
+                msg = (
+                    f"keys {original[new_key]!r} and {k!r} "
+                    f"both become {new_key!r} in {case} case"
+                )
+                raise ValueError(msg)
+            renamed[new_key] = v
+            original[new_key] = k
+
+        return renamed
+
+    return traverse(doc, dict_callback=rename)
+
+
+def _string_key(key: Any) -> str:
+    if isinstance(key, tuple):
+        # A complex key, like a YAML sequence, becomes its JSON text.
+        return _encode_json(
+            list(key), indent=None, sort_keys=True, stringify=True
+        ).strip()
+
+    return str(_stringify_special_keys(key))
+
+
+def _apply_key_policy(doc: Document, policy: str) -> Document:
+    def convert_keys(pairs: Sequence[tuple[Any, Any]]) -> dict[Any, Any]:
+        converted: dict[Any, Any] = {}
+        original = {}
+
+        for k, v in pairs:
+            if isinstance(k, str):
+                new_key = k
+            elif policy == "error":
+                msg = f"key {k!r} of type '{type(k).__name__}' is not a string"
+                raise ValueError(msg)
+            else:
+                new_key = _string_key(k)
+
+            if new_key in converted:
+                msg = f"keys {original[new_key]!r} and {k!r} both become {new_key!r}"
+                raise ValueError(msg)
+            converted[new_key] = v
+            original[new_key] = k
+
+        return converted
+
+    return traverse(doc, dict_callback=convert_keys)
+
+
+def _flatten(
+    doc: Document, *, brackets: bool = False, separator: str = "."
+) -> Document:
+    # An empty map or array has no keys to flatten.
+    if not isinstance(doc, (Mapping, list)) or not doc:
+        return doc
+
+    flat = {}
+    paths: dict[str, list[Any]] = {}
+
+    def walk(x: Any, prefix: str, path: list[Any]) -> None:
+        if isinstance(x, Mapping) and x:
+            items = x.items()
+        elif isinstance(x, list) and x:
+            if brackets:
+                for i, v in enumerate(x):
+                    walk(v, f"{prefix}[{i}]", [*path, i])
+                return
+            items = enumerate(x)
+        else:
+            if prefix in paths:
+                msg = (
+                    f"paths {paths[prefix]!r} and {path!r} "
+                    f"both flatten to the key {prefix!r}"
+                )
+                raise ValueError(msg)
+            flat[prefix] = x
+            paths[prefix] = path
+            return
+
+        for k, v in items:
+            walk(v, f"{prefix}{separator}{k}" if prefix else str(k), [*path, k])
+
+    walk(doc, "", [])
+
+    return flat
+
+
+def _lists_from_index_dicts(x: Any) -> Any:
+    if isinstance(x, dict) and x and list(x) == [str(i) for i in range(len(x))]:
+        return list(x.values())
+
+    return x
+
+
+def _flat_key_parts(key: str, *, brackets: bool, separator: str) -> list[str]:
+    """Split a flat key like "a.b[0]" into ["a", "b", "0"]."""
+    if not brackets:
+        return key.split(separator)
+
+    parts = []
+    for part in key.split(separator):
+        match = re.fullmatch(r"(.*?)((?:\[(?:0|[1-9][0-9]*)\])*)", part, re.DOTALL)
+        name, indices = cast("re.Match[str]", match).groups()
+        if name or not indices:
+            parts.append(name)
+        parts.extend(re.findall(r"\d+", indices))
+
+    return parts
+
+
+def _unflatten(
+    doc: Document, *, brackets: bool = False, separator: str = "."
+) -> Document:
+    if not isinstance(doc, Mapping):
+        return doc
+
+    return _unflatten_paths(
+        (
+            str(key),
+            _flat_key_parts(str(key), brackets=brackets, separator=separator),
+            value,
+        )
+        for key, value in doc.items()
+    )
+
+
+def _unflatten_paths(items: Iterable[tuple[str, list[str], Any]]) -> Document:
+    """Nest the values at paths, reporting a conflict by the flat key."""
+    nested: dict[str, Any] = {}
+
+    for key, path, value in items:
+        *parents, last = path
+
+        target = nested
+        for part in parents:
+            child = target.setdefault(part, {})
+            if not isinstance(child, dict):
+                msg = f"key {key!r} conflicts with a non-map value at {part!r}"
+                raise ValueError(msg)
+            target = child
+
+        if last in target:
+            msg = f"key {key!r} conflicts with another key"
+            raise ValueError(msg)
+        target[last] = value
+
+    # Turn maps with the keys "0", "1", ..., "n-1" back into lists.
+    return traverse(
+        nested, dict_callback=lambda pairs: _lists_from_index_dicts(dict(pairs))
+    )
+
+
+def _template_to_yaml(x: Any) -> str:
+    text = _encode_yaml(x, yaml_options=YAMLOptions())
+    # Like Sprig, leave out the end of a scalar document and the last newline.
+    if text.endswith("\n...\n"):
+        text = text[: -len("...\n")]
+    return text.rstrip("\n")
+
+
+def _render_template(text: str, values: Document) -> str:
+    # The template module does not depend on this one, so YAML comes from here.
+    return render_template(text, values, functions={"toYaml": _template_to_yaml})
+
+
+def _k8s_sort(doc: Document, *, kind_order: Sequence[str]) -> Document:
+    if not isinstance(doc, list) or not all(isinstance(x, Mapping) for x in doc):
+        msg = "Kubernetes resources must be an array of maps"
+        raise TypeError(msg)
+
+    rank = {kind: i for i, kind in enumerate(kind_order)}
+
+    # Resources of unknown kinds, like custom resources, go last.
+    # The sort is stable, so the input order is kept within a kind.
+    return sorted(doc, key=lambda x: rank.get(x.get("kind"), len(rank)))
+
+
+# === Main ===
+
+
+@dataclass(frozen=True)
+class ConvertOptions(DecodeOptions, EncodeOptions):
+    """The options of `convert`.
+
+    They include the options of `decode` and `encode`.
+    """
+
+    all_properties: bool = False
+    array_merge: str = "replace"
+    cast_schema: Document | None = None
+    coerce: Mapping[str, str] | None = None
+    coerce_types: bool = False
+    cue_schema: str | None = None
+    datetime_style: str = "native"
+    dedup_arrays: bool = False
+    dedup_objects: bool = False
+    dedup_paths: Sequence[str] | None = None
+    defaults: Sequence[Document] | None = None
+    delete: Sequence[str] | None = None
+    doc: int | tuple[str, Any] | None = None
+    expand_env: bool = False
+    filter_commands: Sequence[str] | None = None
+    flatten: bool = False
+    flatten_style: str = "dot"
+    float_format: str | None = None
+    from_schema: bool = False
+    k8s_kind_order: Sequence[str] | None = None
+    k8s_sort: bool = False
+    keep: Sequence[str] | None = None
+    key_case: str | None = None
+    key_policy: str | None = None
+    map_to_pairs: Sequence[tuple[str, str, str]] | None = None
+    max_values: int = DEFAULT_MAX_VALUES
+    merge: Sequence[Document] | None = None
+    merge_patch: Sequence[Document] | None = None
+    pairs_to_map: tuple[str, str] | None = None
+    patch: Sequence[Document] | None = None
+    query: str | None = None
+    query_all: bool = False
+    redact: Sequence[str] | None = None
+    redact_placeholder: str = "***"
+    rename: Sequence[tuple[str, str]] | None = None
+    sample: int | None = None
+    select_type: str | None = None
+    set_values: Sequence[tuple[str, Any]] | None = None
+    sort_arrays: bool = False
+    sort_paths: Sequence[tuple[str, str | None]] | None = None
+    strict: bool = False
+    stringify_all: bool = False
+    strip_empty: bool = False
+    strip_nulls: bool = False
+    template: bool = False
+    template_values: Document = None
+    toml_preserve_inline: bool = False
+    transform: Callable[[Document], Document] | None = None
+    trim_strings: bool = False
+    unflatten: bool = False
+    unwrap: str | None = None
+    unwrap_pointer: str | None = None
+    verify_roundtrip: bool = False
+    wrap: str | None = None
+
+
+def _toml_moved_paths(paths: set[TOMLPath], options: ConvertOptions) -> set[TOMLPath]:
+    """Follow the paths of tables in the input through unwrapping and wrapping."""
+    # Flattening leaves no tables.
+    if options.flatten:
+        return set()
+
+    removed: list[str] = []
+    if options.unwrap is not None:
+        removed += _dotted_path(options.unwrap)
+    if options.unwrap_pointer is not None:
+        removed += _json_pointer(options.unwrap_pointer)
+    added = [] if options.wrap is None else _dotted_path(options.wrap)
+
+    moved = set()
+    for path in paths:
+        if [str(k) for k in path[: len(removed)]] != removed:
+            continue
+        # The top level cannot be an inline table.
+        new_path = (*added, *path[len(removed) :])
+        if new_path:
+            moved.add(new_path)
+
+    return moved
+
+
+def convert(  # noqa: C901, PLR0912, PLR0915.
+    input_format: str,
+    output_format: str,
+    input_data: bytes,
+    options: ConvertOptions | None = None,
+    **kwargs: Any,
+) -> bytes:
+    # Keyword arguments override the fields of `options`.
+    options = replace(options or ConvertOptions(), **kwargs)
+
+    if options.template:
+        text = _strip_bom(input_data.decode(UTF_8))
+        input_data = _render_template(text, options.template_values).encode(UTF_8)
+
+    parsed = decode(
+        input_format,
+        input_data,
+        replace(
+            options,
+            duplicate_keys=(
+                "error"
+                if options.strict and options.duplicate_keys is None
+                else options.duplicate_keys
+            ),
+            # Every YAML document is an element to select from.
+            yaml_stream=options.yaml_stream or options.doc is not None,
+        ),
+    )
+
+    input_inline_tables = None
+    if options.toml_preserve_inline:
+        if (input_format, output_format) != ("toml", "toml"):
+            msg = "inline tables can only be preserved from TOML to TOML"
+            raise ValueError(msg)
+
+        input_inline_tables = _toml_inline_table_paths(input_data)
+
+    _validate_value_count(parsed, maximum=options.max_values)
+
+    if options.doc is not None:
+        parsed = _select_doc(parsed, options.doc)
+
+    if options.expand_env:
+        parsed = _map_values(parsed, str, lambda x: _expand_env(x, os.environ))
+
+    if options.from_schema:
+        parsed = _document_from_schema(
+            parsed, all_properties=options.all_properties
+        )
+
+    if options.unwrap is not None:
+        parsed = _unwrap(parsed, options.unwrap)
+    if options.unwrap_pointer is not None:
+        parsed = _get_path(
+            parsed,
+            _json_pointer(options.unwrap_pointer),
+            path=options.unwrap_pointer,
+        )
+    if options.wrap is not None:
+        for key in reversed(_dotted_path(options.wrap)):
+            parsed = {key: parsed}
+
+    if options.query is not None:
+        parsed = _query(parsed, options.query, all_results=options.query_all)
+    for command in options.filter_commands or ():
+        parsed = _filter(parsed, command)
+
+    # Later defaults win like later overlays, but the input wins over both.
+    # The data takes copies of the documents in the options
+    # because later steps change it in place.
+    for fallback in reversed(options.defaults or ()):
+        parsed = _fill_defaults(parsed, copy.deepcopy(fallback))
+    for overlay in options.merge or ():
+        parsed = _merge(parsed, copy.deepcopy(overlay), arrays=options.array_merge)
+
+    for operations in options.patch or ():
+        parsed = _json_patch(parsed, operations)
+    for overlay in options.merge_patch or ():
+        parsed = _merge_patch(parsed, copy.deepcopy(overlay))
+
+    if options.pairs_to_map is not None:
+        parsed = _pairs_to_map(parsed, *options.pairs_to_map)
+
+    for old, new in options.rename or ():
+        parsed = _rename_path(parsed, old, new)
+    for path, value in options.set_values or ():
+        parsed = _set_path(parsed, path, copy.deepcopy(value))
+    for path in options.delete or ():
+        parsed = _delete_path(parsed, path)
+    if options.keep:
+        parsed = _keep_paths(parsed, options.keep)
+    if options.redact:
+        parsed = _redact(
+            parsed, options.redact, placeholder=options.redact_placeholder
+        )
+    for path, name, value in options.map_to_pairs or ():
+        parsed = _map_to_pairs(parsed, path, name, value)
+
+    if options.sample is not None:
+        parsed = _sample(parsed, options.sample)
+
+    if options.trim_strings:
+        parsed = _map_values(parsed, str, str.strip)
+    if options.coerce_types:
+        parsed = _map_values(parsed, str, _coerce_type)
+    if options.coerce:
+        parsed = _coerce(parsed, options.coerce)
+    if options.cast_schema is not None:
+        parsed = _cast_to_schema(parsed, options.cast_schema)
+    float_format = options.float_format
+    if float_format is not None:
+        parsed = _map_values(
+            parsed, float, lambda x: _reformat_float(x, float_format=float_format)
+        )
+    datetime_style = options.datetime_style
+    if datetime_style != "native":
+        for type_ in (datetime.date, datetime.time):
+            parsed = _map_values(
+                parsed, type_, lambda x: _convert_datetime(x, style=datetime_style)
+            )
+    if options.strip_empty or options.strip_nulls:
+        parsed = _strip(
+            parsed, empty=options.strip_empty, nulls=options.strip_nulls
+        )
+    if options.stringify_all:
+        parsed = traverse(
+            parsed,
+            default_callback=lambda x: "" if x is None else _coerce_value(x, "string"),
+        )
+
+    if options.key_policy is not None:
+        parsed = _apply_key_policy(parsed, options.key_policy)
+    if options.key_case is not None:
+        parsed = _key_case(parsed, options.key_case)
+
+    if options.flatten:
+        parsed = _flatten(parsed, brackets=options.flatten_style == "bracket")
+    if options.unflatten:
+        parsed = _unflatten(parsed, brackets=options.flatten_style == "bracket")
+
+    toml_inline_tables = options.toml_inline_tables
+    if input_inline_tables is not None:
+        toml_inline_tables = _toml_moved_paths(input_inline_tables, options)
+
+    # Select after flattening, so flat keys keep the original array indices.
+    if options.select_type is not None:
+        parsed = _select_type(parsed, options.select_type)
+
+    dedup_objects = options.dedup_objects
+    if options.dedup_arrays or dedup_objects:
+        parsed = traverse(
+            parsed, list_callback=lambda items: _dedup(items, objects=dedup_objects)
+        )
+    for path in options.dedup_paths or ():
+        items = _array_at_path(parsed, path)
+        items[:] = _dedup(items, objects=True)
+
+    if options.sort_arrays:
+        parsed = traverse(
+            parsed,
+            list_callback=lambda items: (
+                items
+                if any(isinstance(x, (list, Mapping)) for x in items)
+                else sorted(items, key=_sort_key)
+            ),
+        )
+    for path, key in options.sort_paths or ():
+        items = _array_at_path(parsed, path)
+        items[:] = _sort_array(items, key, path=path)
 
-def decode(input_format: str, input_data: bytes) -> Document:
-    decoder = {
-        "cbor": _decode_cbor,
-        "json": _decode_json,
-        "msgpack": _decode_msgpack,
-        "toml": _decode_toml,
-        "yaml": _decode_yaml,
-    }
+    if options.transform:
+        parsed = options.transform(parsed)
 
-    if input_format not in decoder:
-        msg = f"Unknown input format: {input_format}"
-        raise ValueError(msg)
+    yaml_options = options.yaml_options
 
-    return decoder[input_format](input_data)
+    if options.k8s_sort:
+        if output_format != "yaml":
+            msg = "Kubernetes resources can only be sorted for YAML output"
+            raise ValueError(msg)
 
+        parsed = _k8s_sort(
+            parsed,
+            kind_order=(
+                K8S_KIND_ORDER
+                if options.k8s_kind_order is None
+                else options.k8s_kind_order
+            ),
+        )
+        yaml_options = replace(yaml_options, split=True)
+
+    if options.cue_schema is not None:
+        _cue_vet(parsed, options.cue_schema)
+
+    # Numbers from `--big-numbers` and `--float-format` are decimals.
+    decimals = options.big_numbers or float_format is not None
+    if decimals and output_format not in _BIG_NUMBER_FORMATS:
+        # Other formats get the closest float.
+        parsed = _map_values(parsed, decimal.Decimal, float)
+
+    if options.strict:
+        _check_strict(parsed, output_format)
+
+    encoded = encode(
+        output_format,
+        parsed,
+        replace(
+            options,
+            # python-hcl2 decodes expressions to strings like "${var.x}".
+            hcl_expressions=options.hcl_expressions or input_format == "hcl",
+            properties_flat=options.properties_flat or options.flatten,
+            toml_inline_tables=toml_inline_tables,
+            yaml_options=yaml_options,
+        ),
+    )
 
-class TooManyValuesError(BaseException):
-    pass
+    if options.verify_roundtrip:
+        _verify_roundtrip(
+            parsed,
+            encoded,
+            output_format,
+            DecodeOptions(
+                big_numbers=decimals,
+                csv_delimiter=options.csv_delimiter,
+                toml_version=options.toml_version,
+                xml_convention=options.xml_convention,
+                yaml_stream=yaml_options.split,
+                yaml_version=options.yaml_version,
+            ),
+        )
 
+    return encoded
 
-def _validate_value_count(doc: Document, *, maximum: int) -> None:
-    if maximum < 0:
-        return
 
-    count = 0
+def _freeze(x: Any) -> Any:
+    """Turn `x` into a hashable value for a cache key.
 
-    def count_callback(x: Any) -> Any:
-        nonlocal count, maximum
+    The type of every value is part of the result so that values that
+    compare equal, like `True`, `1`, and `1.0`, give different keys.
+    """
+    if isinstance(x, Mapping):
+        return (type(x), tuple((_freeze(k), _freeze(v)) for k, v in x.items()))
+    if isinstance(x, (set, frozenset)):
+        return (type(x), frozenset(_freeze(item) for item in x))
+    if isinstance(x, (list, tuple)):
+        return (type(x), tuple(_freeze(item) for item in x))
 
-        count += 1
-        if count > maximum:
-            msg = f"document contains too many values (over {maximum})"
-            raise TooManyValuesError(msg)
+    return (type(x), x)
 
-        return x
 
-    traverse(doc, instance_callbacks=[(object, count_callback)])
+class CachedConverter:
+    """An in-process LRU cache in front of `convert`.
 
+    The cache is keyed by the SHA-256 hash of the input data, the formats,
+    and the options.
+    The method `convert` accepts the same arguments as the function `convert`.
+    """
 
-def _reject_special_keys(key: Any) -> Any:
-    if isinstance(key, bool):
-        msg = "boolean key"
-        raise TypeError(msg)
+    def __init__(self, size: int) -> None:
+        if size < 1:
+            msg = f"cache size must be positive, got {size}"
+            raise ValueError(msg)
 
-    if isinstance(key, datetime.date):
-        msg = "date key"
-        raise TypeError(msg)
+        self.size = size
+        self.hits = 0
+        self.misses = 0
+        self._cache: OrderedDict[tuple[Any, ...], bytes] = OrderedDict()
+
+    def convert(
+        self,
+        input_format: str,
+        output_format: str,
+        input_data: bytes,
+        options: ConvertOptions | None = None,
+        **kwargs: Any,
+    ) -> bytes:
+        options = replace(options or ConvertOptions(), **kwargs)
+
+        key = (
+            hashlib.sha256(input_data).digest(),
+            input_format,
+            output_format,
+            _freeze(vars(options)),
+        )
 
-    if isinstance(key, datetime.datetime):
-        msg = "date-time key"
-        raise TypeError(msg)
+        if key in self._cache:
+            self.hits += 1
+            self._cache.move_to_end(key)
+            return self._cache[key]
 
-    if isinstance(key, datetime.time):
-        msg = "time key"
-        raise TypeError(msg)
+        self.misses += 1
+        encoded = convert(input_format, output_format, input_data, options)
 
-    if key is None:
-        msg = "null key"
-        raise TypeError(msg)
+        self._cache[key] = encoded
+        if len(self._cache) > self.size:
+            self._cache.popitem(last=False)
 
-    return key
+        return encoded
 
 
-def _stringify_special_keys(key: Any) -> Any:
-    if isinstance(key, bool):
-        return "true" if key else "false"
-    if isinstance(key, (datetime.date, datetime.datetime, datetime.time)):
-        return key.isoformat()
-    if key is None:
-        return "null"
+def _pyperclip() -> Any:
+    try:
+        import pyperclip  # type: ignore
+    except ModuleNotFoundError:
+        msg = (
+            'clipboard support requires the package "pyperclip"; '
+            'install "remarshal[clipboard]"'
+        )
+        raise OSError(msg)
 
-    return str(key)
+    return pyperclip
 
 
-def _encode_cbor(data: Document) -> bytes:
-    try:
-        return bytes(cbor2.dumps(data))
-    except cbor2.CBOREncodeError as e:
-        msg = f"Cannot convert data to CBOR ({e})"
-        raise ValueError(msg)
+def _clipboard_paste() -> bytes:
+    pyperclip = _pyperclip()
 
+    try:
+        return pyperclip.paste().encode(UTF_8)
+    except pyperclip.PyperclipException as e:
+        msg = f"Cannot read from the clipboard ({e})"
+        raise OSError(msg)
 
-def _json_default_stringify(obj: Any) -> str:
-    if isinstance(obj, (datetime.date, datetime.datetime, datetime.time)):
-        return obj.isoformat()
-    msg = f"{obj!r} is not JSON serializable"
-    raise TypeError(msg)
 
+def _clipboard_copy(data: bytes) -> None:
+    pyperclip = _pyperclip()
 
-def _encode_json(
-    data: Document,
-    *,
-    indent: bool | int | None,
-    sort_keys: bool,
-    stringify: bool,
-) -> str:
-    if indent is True:
-        indent = JSON_INDENT_TRUE
+    try:
+        text = data.decode(UTF_8)
+    except UnicodeDecodeError:
+        msg = "Cannot copy binary data to the clipboard"
+        raise ValueError(msg)
 
-    separators = (",", ": " if indent else ":")
+    try:
+        pyperclip.copy(text)
+    except pyperclip.PyperclipException as e:
+        msg = f"Cannot write to the clipboard ({e})"
+        raise OSError(msg)
 
-    if stringify:
-        default_callback = _json_default_stringify
-        key_callback = _stringify_special_keys
-    else:
-        default_callback = None
-        key_callback = _reject_special_keys
 
+def _file_has_content(path: Path, data: bytes) -> bool:
     try:
         return (
-            json.dumps(
-                traverse(
-                    data,
-                    key_callback=key_callback,
-                ),
-                default=default_callback,
-                ensure_ascii=False,
-                indent=indent,
-                separators=separators,
-                sort_keys=sort_keys,
-            )
-            + "\n"
+            path.is_file()
+            and path.stat().st_size == len(data)
+            and path.read_bytes() == data
         )
-    except (TypeError, ValueError) as e:
-        msg = f"Cannot convert data to JSON ({e})"
-        raise ValueError(msg)
+    except OSError:
+        return False
 
 
-def _msgpack_reject_local_datetime(obj: datetime.datetime) -> None:
-    if obj.tzinfo is None:
-        msg = "'datetime.datetime' without a time zone is unsupported"
-        raise TypeError(msg)
+def _read_input(input: Path | str) -> bytes:
+    if input == CLIPBOARD:
+        return _clipboard_paste()
+    if input == "-":
+        return sys.stdin.buffer.read()
 
+    return Path(input).read_bytes()
 
-def _encode_msgpack(data: Document) -> bytes:
-    try:
-        traverse(
-            data,
-            instance_callbacks=[(datetime.datetime, _msgpack_reject_local_datetime)],
-        )
 
-        return umsgpack.packb(data)
-    except (TypeError, umsgpack.UnsupportedTypeException) as e:
-        msg = f"Cannot convert data to MessagePack ({e})"
-        raise ValueError(msg)
+def _write_output(output: Path | str, data: bytes, *, force: bool) -> None:
+    if output == CLIPBOARD:
+        _clipboard_copy(data)
+        return
+    if output == "-":
+        sys.stdout.buffer.write(data)
+        return
+
+    # Do not touch an output file that already has the same content.
+    # This keeps its modification time.
+    output_path = Path(output)
+    if not force and _file_has_content(output_path, data):
+        return
 
+    output_path.write_bytes(data)
 
-def _encode_toml(
-    data: Mapping[Any, Any],
+
+def remarshal(
+    input_format: str,
+    output_format: str,
+    input: Path | str,
+    output: Path | str,
+    options: ConvertOptions | None = None,
     *,
-    sort_keys: bool,
-    stringify: bool,
-) -> str:
-    key_callback = _stringify_special_keys if stringify else _reject_special_keys
+    force: bool = False,
+    **kwargs: Any,
+) -> None:
+    # Keyword arguments override the fields of `options`.
+    options = replace(options or ConvertOptions(), **kwargs)
 
-    def reject_null(x: Any) -> Any:
-        if x is None:
-            msg = "null values are not supported"
-            raise TypeError(msg)
+    input_data = _read_input(input)
+    if not isinstance(input_data, bytes):
+        msg = "input_data must be bytes"
+        raise TypeError(msg)
 
-        return x
+    if input_format == "jsonnet" and input not in {"-", CLIPBOARD}:
+        # Look for imports next to the input file first.
+        options = replace(
+            options,
+            jsonnet_path=[str(Path(input).parent), *(options.jsonnet_path or [])],
+        )
 
-    def stringify_null(x: Any) -> Any:
-        if x is None:
-            return "null"
+    encoded = convert(input_format, output_format, input_data, options)
 
-        return x
+    _write_output(output, encoded, force=force)
 
-    default_callback = stringify_null if stringify else reject_null
 
-    try:
-        return tomlkit.dumps(
-            traverse(
-                data,
-                key_callback=key_callback,
-                default_callback=default_callback,
-            ),
-            sort_keys=sort_keys,
-        )
-    except AttributeError as e:
-        if str(e) == "'list' object has no attribute 'as_string'":
-            msg = (
-                "Cannot convert non-dictionary data to TOML; "
-                'use "--wrap" to wrap it in a dictionary'
-            )
-            raise ValueError(msg)
+def _watch(
+    path: Path,
+    callback: Callable[[], None],
+    *,
+    debounce: float = 0.2,
+    interval: float = 0.1,
+    stop: threading.Event | None = None,
+) -> None:
+    """Call `callback` every time the file at `path` changes.
+
+    The file is polled every `interval` seconds.
+    The callback only runs once the file has not changed for `debounce` seconds,
+    so an editor that saves in several steps triggers a single call.
+    Return when `stop` is set.
+    """
+    if stop is None:
+        stop = threading.Event()
+
+    def status() -> tuple[int, int, int] | None:
+        try:
+            stat = path.stat()
+        except FileNotFoundError:
+            # Editors that save by renaming can briefly remove the file.
+            return None
+
+        return (stat.st_ino, stat.st_mtime_ns, stat.st_size)
+
+    last = status()
+    changed_at = None
+
+    while not stop.wait(interval):
+        current = status()
+        now = time.monotonic()
+
+        if current != last:
+            last = current
+            changed_at = now
+        elif (
+            current is not None
+            and changed_at is not None
+            and now - changed_at >= debounce
+        ):
+            changed_at = None
+            callback()
+
+
+def _error_info(e: BaseException, args: argparse.Namespace) -> dict[str, Any]:
+    fmt = None
+    line = None
+
+    if isinstance(e, DecodeError):
+        stage = "decode"
+        fmt = e.format
+        line = e.line
+    elif isinstance(e, EncodeError):
+        stage = "encode"
+        fmt = e.format
+    elif isinstance(e, OSError):
+        # Tell reading from writing by the function that raised the error.
+        functions = {frame.name for frame in traceback.extract_tb(e.__traceback__)}
+        if "_read_input" in functions:
+            stage = "read"
+            fmt = args.input_format
+        elif "_write_output" in functions:
+            stage = "write"
+            fmt = args.output_format
         else:
-            raise e
-    except (TypeError, ValueError) as e:
-        msg = f"Cannot convert data to TOML ({e})"
-        raise ValueError(msg)
+            stage = "convert"
+    elif isinstance(e, TooManyValuesError):
+        stage = "decode"
+        fmt = args.input_format
+    else:
+        stage = "convert"
 
+    return {
+        "error": str(e),
+        "stage": stage,
+        "format": fmt,
+        "line": line,
+    }
 
-def _encode_yaml(data: Document, *, yaml_options: YAMLOptions) -> str:
-    yaml = ruamel.yaml.YAML()
-    yaml.default_flow_style = False
 
-    yaml.default_style = yaml_options.style  # type: ignore
-    yaml.indent = yaml_options.indent
-    yaml.width = yaml_options.width
+def _print_error(e: BaseException, args: argparse.Namespace) -> None:
+    if args.error_format == "json":
+        msg = json.dumps(_error_info(e, args), ensure_ascii=False) + "\n"
+    elif args.verbose:
+        msg = traceback.format_exc()
+    else:
+        msg = f"Error: {e}\n"
+    print(msg, end="", file=sys.stderr)  # noqa: T201
+
 
+def _diff_value(x: Any) -> str:
     try:
-        out = StringIO()
-        yaml.dump(
-            data,
-            out,
-        )
+        return _encode_json(x, indent=None, sort_keys=True, stringify=True).strip()
+    except EncodeError:
+        return repr(x)
 
-        return out.getvalue()
-    except ruamel.yaml.representer.RepresenterError as e:
-        msg = f"Cannot convert data to YAML ({e})"
-        raise ValueError(msg)
 
+def _format_diff(changes: Sequence[tuple[str, tuple[str, ...], Any, Any]]) -> str:
+    lines = []
 
-def encode(
-    output_format: str,
-    data: Document,
-    *,
-    json_indent: bool | int | None,
-    sort_keys: bool,
-    stringify: bool,
-    yaml_options: YAMLOptions,
-) -> bytes:
-    if output_format == "json":
-        encoded = _encode_json(
-            data,
-            indent=json_indent,
-            sort_keys=sort_keys,
-            stringify=stringify,
-        ).encode(UTF_8)
-    elif output_format == "msgpack":
-        encoded = _encode_msgpack(data)
-    elif output_format == "toml":
-        if not isinstance(data, Mapping):
-            msg = (
-                f"Top-level value of type '{type(data).__name__}' cannot "
-                "be encoded as TOML"
-            )
-            raise TypeError(msg)
-        encoded = _encode_toml(data, sort_keys=sort_keys, stringify=stringify).encode(
-            UTF_8
-        )
-    elif output_format == "yaml":
-        encoded = _encode_yaml(data, yaml_options=yaml_options).encode(UTF_8)
-    elif output_format == "cbor":
-        encoded = _encode_cbor(data)
-    else:
-        msg = f"Unknown output format: {output_format}"
-        raise ValueError(msg)
+    for kind, parts, old, new in changes:
+        # Escape the paths like "--set" and "--delete" expect them.
+        path = _escape_path(parts) if parts else "(root)"
 
-    return encoded
+        if kind == "added":
+            lines.append(f"+ {path}: {_diff_value(new)}")
+        elif kind == "removed":
+            lines.append(f"- {path}: {_diff_value(old)}")
+        else:
+            line = f"~ {path}: {_diff_value(old)} -> {_diff_value(new)}"
+            old_type = _document_type(old) or type(old).__name__
+            new_type = _document_type(new) or type(new).__name__
+            if old_type != new_type:
+                line += f" ({old_type} -> {new_type})"
+            lines.append(line)
 
+    return "".join(line + "\n" for line in lines)
 
-# === Main ===
 
+def _diff_main(argv: Sequence[str]) -> int:
+    """Run "remarshal diff" and return the exit status like diff(1) does."""
+    args = _parse_diff_command_line(argv)
 
-def remarshal(
-    input_format: str,
-    output_format: str,
-    input: Path | str,
-    output: Path | str,
-    *,
-    json_indent: bool | int | None = None,
-    max_values: int = DEFAULT_MAX_VALUES,
-    sort_keys: bool = True,
-    stringify: bool = False,
-    transform: Callable[[Document], Document] | None = None,
-    unwrap: str | None = None,
-    wrap: str | None = None,
-    yaml_options: YAMLOptions | None = None,
-) -> None:
-    input_file = None
-    output_file = None
+    try:
+        old = decode(args.old_format, _read_input(args.old))
+        new = decode(args.new_format, _read_input(args.new))
+        changes = _diff(old, new)
+        if args.json_patch:
+            output = encode(
+                args.output_format,
+                _json_patch_from_diff(changes),
+                EncodeOptions(sort_keys=False),
+            )
+        else:
+            output = _format_diff(changes).encode(UTF_8)
+    except (OSError, TypeError, ValueError) as e:
+        print(f"Error: {e}", file=sys.stderr)  # noqa: T201
+        return 2
+
+    sys.stdout.buffer.write(output)
+    return 1 if changes else 0
+
+
+def _schema_main(argv: Sequence[str]) -> int:
+    """Run "remarshal schema" and return the exit status."""
+    args = _parse_schema_command_line(argv)
 
     try:
-        input_file = sys.stdin.buffer if input == "-" else Path(input).open("rb")
-        output_file = sys.stdout.buffer if output == "-" else Path(output).open("wb")
+        samples = []
+        for path in args.inputs:
+            input_format = args.input_format or _extension_to_format(
+                path, INPUT_FORMATS
+            )
+            doc = decode(input_format, _read_input(path))
+            if args.each:
+                if not isinstance(doc, list):
+                    msg = f"top-level value in {path!r} is not an array"
+                    raise TypeError(msg)
+                samples.extend(doc)
+            else:
+                samples.append(doc)
+
+        output = encode(
+            args.output_format,
+            _schema_from_samples(samples),
+            EncodeOptions(json_indent=4, sort_keys=False),
+        )
+    except (OSError, TypeError, ValueError) as e:
+        print(f"Error: {e}", file=sys.stderr)  # noqa: T201
+        return 1
 
-        input_data = input_file.read()
-        if not isinstance(input_data, bytes):
-            msg = "input_data must be bytes"
-            raise TypeError(msg)
+    sys.stdout.buffer.write(output)
+    return 0
 
-        parsed = decode(input_format, input_data)
 
-        _validate_value_count(parsed, maximum=max_values)
+def _validate_main(argv: Sequence[str]) -> int:
+    """Run "remarshal validate" and return 1 if any input has an error."""
+    args = _parse_validate_command_line(argv)
+    status = 0
 
-        if unwrap is not None:
-            if not isinstance(parsed, Mapping):
-                msg = (
-                    f"Top-level value of type '{type(parsed).__name__}' "
-                    "cannot be unwrapped"
-                )
-                raise TypeError(msg)
-            parsed = parsed[unwrap]
-        if wrap is not None:
-            temp = {}
-            temp[wrap] = parsed
-            parsed = temp
+    for path in args.inputs:
+        input_format = args.input_format or _extension_to_format(path, INPUT_FORMATS)
+        try:
+            decode(input_format, _read_input(path))
+        except (OSError, TypeError, ValueError) as e:
+            print(f"{path}: {e}", file=sys.stderr)  # noqa: T201
+            status = 1
 
-        if transform:
-            parsed = transform(parsed)
+    return status
 
-        encoded = encode(
-            output_format,
-            parsed,
-            json_indent=json_indent,
-            sort_keys=sort_keys,
-            stringify=stringify,
-            yaml_options=YAMLOptions() if yaml_options is None else yaml_options,
-        )
 
-        output_file.write(encoded)
-    finally:
-        if input_file is not None:
-            input_file.close()
-        if output != "-" and output_file is not None:
-            output_file.close()
+def _convert_options(args: argparse.Namespace) -> ConvertOptions:
+    """Return the conversion options with the names of command-line options."""
+    names = {field.name for field in fields(ConvertOptions)}
+    options = ConvertOptions(**{k: v for k, v in vars(args).items() if k in names})
 
+    # Wrap rather than fail on data TOML cannot represent.
+    return replace(options, toml_wrap=True)
+
+
+def main() -> None:  # noqa: C901.
+    # "remarshal diff", "remarshal schema", and "remarshal validate"
+    # are subcommands unless the format comes from the name.
+    if _argv0_to_format(Path(sys.argv[0]).name)[1] == "":
+        if sys.argv[1:2] == ["diff"]:
+            sys.exit(_diff_main(sys.argv[2:]))
+        if sys.argv[1:2] == ["schema"]:
+            sys.exit(_schema_main(sys.argv[2:]))
+        if sys.argv[1:2] == ["validate"]:
+            sys.exit(_validate_main(sys.argv[2:]))
 
-def main() -> None:
     args = _parse_command_line(sys.argv)
+    errors = (OSError, TooManyValuesError, TypeError, ValueError)
+
+    options = _convert_options(args)
+
+    if args.check_syntax:
+        try:
+            decode(
+                args.input_format,
+                _read_input(args.input),
+                replace(
+                    options,
+                    duplicate_keys=(
+                        "error"
+                        if args.strict and args.duplicate_keys is None
+                        else args.duplicate_keys
+                    ),
+                ),
+            )
+        except errors as e:
+            _print_error(e, args)
+            sys.exit(1)
 
-    try:
+        return
+
+    def run() -> None:
         remarshal(
             args.input_format,
             args.output_format,
             args.input,
             args.output,
-            json_indent=args.json_indent,
-            max_values=args.max_values,
-            sort_keys=args.sort_keys,
-            stringify=args.stringify,
-            unwrap=args.unwrap,
-            wrap=args.wrap,
-            yaml_options=args.yaml_options,
+            options,
+            force=args.force,
         )
+
+    if args.watch:
+
+        def reconvert() -> None:
+            # Keep watching after an error; the next save may fix the input.
+            try:
+                run()
+            except errors as e:
+                _print_error(e, args)
+
+        reconvert()
+
+        with contextlib.suppress(KeyboardInterrupt):
+            _watch(Path(args.input), reconvert)
+
+        return
+
+    try:
+        run()
     except KeyboardInterrupt:
         pass
-    except (OSError, TooManyValuesError, TypeError, ValueError) as e:
-        msg = traceback.format_exc() if args.verbose else f"Error: {e}\n"
-        print(msg, end="", file=sys.stderr)  # noqa: T201
+    except errors as e:
+        _print_error(e, args)
         sys.exit(1)
 
 
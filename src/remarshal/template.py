@@ -0,0 +1,577 @@
+# Remarshal, a utility to convert between serialization formats.
+# Copyright (c) 2014-2020, 2024 D. Bohdan
+# License: MIT
+
+from __future__ import annotations
+
+import datetime
+import decimal
+import json
+import os
+import re
+from collections import ChainMap
+from typing import Any, Callable, Mapping, cast
+
+_ACTION = re.compile(
+    r"""
+    \{\{(-\s)?
+    # Strings and comments can contain "}}".
+    ((?:"(?:[^"\\\n]|\\.)*"|`[^`]*`|/\*.*?\*/|[^"`}]|\}(?!\}))*?)
+    (\s-)?\}\}
+    """,
+    re.DOTALL | re.VERBOSE,
+)
+_TOKEN = re.compile(
+    r"""
+    (?P<space>\s+)
+    | (?P<string>"(?:[^"\\\n]|\\.)*"|`[^`]*`)
+    | (?P<number>-?\d+(?:\.\d+)?(?:[Ee][+-]?\d+)?)
+    | (?P<field>\$\w*(?:\.\w+)*|(?:\.\w+)+|\.)
+    | (?P<declare>:?=)
+    | (?P<punct>[|(),])
+    | (?P<word>[A-Za-z_]\w*)
+    """,
+    re.VERBOSE,
+)
+_KEYWORDS = {"else", "end", "if", "range", "with"}
+_WORDS = {"true": True, "false": False, "nil": None}
+
+
+def _error(message: str, lineno: int) -> ValueError:
+    return ValueError(f"Cannot render template (line {lineno}: {message})")
+
+
+def _truth(x: Any) -> bool:
+    # Like in Go, zero numbers and empty strings, arrays, and maps are false.
+    if isinstance(x, (float, int, str, list, Mapping)):
+        return bool(x)
+    return x is not None
+
+
+def _text(x: Any) -> str:
+    if x is None:
+        return ""
+    if isinstance(x, bool):
+        return "true" if x else "false"
+    if isinstance(x, (list, Mapping)):
+        return _json(x)
+
+    return str(x)
+
+
+def _json_key(key: Any) -> Any:
+    # `json` itself writes keys that are numbers, booleans, or null as text.
+    if key is None or isinstance(key, (str, float, int)):
+        return key
+    return str(_json_value(key))
+
+
+def _json_value(x: Any) -> Any:
+    if isinstance(x, (datetime.date, datetime.time)):
+        return x.isoformat()
+    if isinstance(x, decimal.Decimal):
+        return float(x)
+    if isinstance(x, Mapping):
+        return {_json_key(k): _json_value(v) for k, v in x.items()}
+    if isinstance(x, (list, tuple)):
+        return [_json_value(item) for item in x]
+    return x
+
+
+def _json(x: Any) -> str:
+    return json.dumps(_json_value(x), ensure_ascii=False, separators=(",", ":"))
+
+
+def _required(message: str, x: Any) -> Any:
+    if x is None or x == "":
+        raise ValueError(message)
+    return x
+
+
+def _index(x: Any, *keys: Any) -> Any:
+    for key in keys:
+        # Like in Go, a missing key gives the zero value.
+        x = x.get(key) if isinstance(x, Mapping) else x[key]
+    return x
+
+
+def _kind(x: Any) -> str:
+    if isinstance(x, bool):
+        return "bool"
+    if isinstance(x, (float, int)):
+        return "number"
+    if isinstance(x, (list, Mapping)):
+        msg = f"non-comparable type '{type(x).__name__}'"
+        raise TypeError(msg)
+    return type(x).__name__
+
+
+def _eq(x: Any, *ys: Any) -> bool:
+    for y in ys:
+        if x is None or y is None:
+            if x is y:
+                return True
+        # Unlike in Python, `true` is not equal to 1.
+        elif _kind(x) != _kind(y):
+            msg = "incompatible types for comparison"
+            raise TypeError(msg)
+        elif x == y:
+            return True
+
+    return False
+
+
+def _lt(x: Any, y: Any) -> bool:
+    kind = _kind(x)
+    if kind != _kind(y):
+        msg = "incompatible types for comparison"
+        raise TypeError(msg)
+    if kind not in {"number", "str"}:
+        msg = f"invalid type '{type(x).__name__}' for comparison"
+        raise TypeError(msg)
+    return x < y
+
+
+_VERB = re.compile(r"%([-+# 0]*)(\d*)(?:\.(\d+))?(.)", re.DOTALL)
+
+
+def _printf(format_: str, *args: Any) -> str:
+    """Format like Go's `fmt.Sprintf` with the common verbs."""
+    rest = list(args)
+
+    def substitute(match: re.Match[str]) -> str:
+        flags, width, precision, verb = match.groups()
+        if verb == "%":
+            return "%"
+        if not rest:
+            msg = f"missing argument for %{verb}"
+            raise ValueError(msg)
+        x = rest.pop(0)
+
+        number = isinstance(x, (float, int)) and not isinstance(x, bool)
+        if verb in "bdoxX" and number and isinstance(x, int):
+            type_ = verb
+        elif verb in "eEfFgG" and number:
+            x, type_ = float(x), verb
+        elif verb in "xX" and isinstance(x, str):
+            x, type_ = x.encode("utf-8").hex(), "s"
+            x = x.upper() if verb == "X" else x
+        elif verb in "sv" or (verb == "t" and isinstance(x, bool)):
+            x, type_ = _text(x), "s"
+        elif verb == "q":
+            x, type_ = json.dumps(_text(x), ensure_ascii=False), "s"
+        else:
+            msg = f"bad verb %{verb} for a value of type '{type(x).__name__}'"
+            raise ValueError(msg)
+
+        # Go pads on the left unless the flag "-" is given.
+        align = "<" if "-" in flags else "" if number else ">"
+        sign = next((c for c in "+ " if c in flags), "") if number else ""
+        spec = (
+            align
+            + sign
+            + ("#" if "#" in flags else "")
+            + ("0" if "0" in flags and number and "-" not in flags else "")
+            + width
+            + (f".{precision}" if precision else "")
+            + type_
+        )
+        return format(x, spec)
+
+    result = _VERB.sub(substitute, format_)
+    if rest:
+        msg = f"{len(rest)} extra argument(s)"
+        raise ValueError(msg)
+    return result
+
+
+def _indent(width: int, s: str) -> str:
+    return "\n".join(" " * width + line for line in s.split("\n"))
+
+
+_FUNCTIONS: dict[str, Callable[..., Any]] = {
+    "and": lambda *xs: next((x for x in xs if not _truth(x)), xs[-1]),
+    "contains": lambda sub, s: sub in s,
+    "default": lambda default, x=None: x if _truth(x) else default,
+    "env": lambda name: os.environ.get(name, ""),
+    "eq": _eq,
+    "ge": lambda x, y: not _lt(x, y),
+    "gt": lambda x, y: _lt(y, x),
+    "hasPrefix": lambda prefix, s: s.startswith(prefix),
+    "hasSuffix": lambda suffix, s: s.endswith(suffix),
+    "indent": _indent,
+    "index": _index,
+    "join": lambda sep, xs: sep.join(_text(x) for x in xs),
+    "le": lambda x, y: not _lt(y, x),
+    "len": len,
+    "lower": lambda s: s.lower(),
+    "lt": _lt,
+    "ne": lambda x, y: not _eq(x, y),
+    "nindent": lambda width, s: "\n" + _indent(width, s),
+    "not": lambda x: not _truth(x),
+    "or": lambda *xs: next((x for x in xs if _truth(x)), xs[-1]),
+    "print": lambda *xs: "".join(_text(x) for x in xs),
+    "printf": _printf,
+    "quote": lambda x: json.dumps(_text(x), ensure_ascii=False),
+    "replace": lambda old, new, s: s.replace(old, new),
+    "required": _required,
+    "squote": lambda x: "'" + _text(x) + "'",
+    "title": lambda s: s.title(),
+    "toJson": _json,
+    "trim": lambda s: s.strip(),
+    "upper": lambda s: s.upper(),
+}
+
+
+def _tokens(action: str, lineno: int) -> list[tuple[str, Any]]:
+    tokens = []
+    pos = 0
+
+    while pos < len(action):
+        match = _TOKEN.match(action, pos)
+        if not match:
+            msg = f"unexpected {action[pos]!r}"
+            raise _error(msg, lineno)
+        kind = cast(str, match.lastgroup)
+        token = match.group()
+        pos = match.end()
+
+        if kind == "string":
+            value = token[1:-1] if token.startswith("`") else json.loads(token)
+            tokens.append(("literal", value))
+        elif kind == "number":
+            number = float(token) if any(c in token for c in ".Ee") else int(token)
+            tokens.append(("literal", number))
+        elif kind == "word" and token in _WORDS:
+            tokens.append(("literal", _WORDS[token]))
+        elif kind == "punct" or kind == "declare":
+            tokens.append((token, None))
+        elif kind != "space":
+            tokens.append((kind, token))
+
+    tokens.append(("eof", None))
+    return tokens
+
+
+def _pipeline(
+    tokens: list[tuple[str, Any]], pos: int, lineno: int
+) -> tuple[list[list[Any]], int]:
+    commands: list[list[Any]] = [[]]
+
+    while tokens[pos][0] not in {"eof", ")"}:
+        kind, value = tokens[pos]
+        if kind == "|":
+            if not commands[-1]:
+                msg = "missing command before '|'"
+                raise _error(msg, lineno)
+            commands.append([])
+            pos += 1
+        elif kind == "(":
+            pipeline, pos = _pipeline(tokens, pos + 1, lineno)
+            if tokens[pos][0] != ")":
+                msg = "unclosed '('"
+                raise _error(msg, lineno)
+            commands[-1].append(("pipeline", pipeline))
+            pos += 1
+        elif kind in {"field", "literal", "word"}:
+            commands[-1].append((kind, value))
+            pos += 1
+        else:
+            msg = f"unexpected {kind!r}"
+            raise _error(msg, lineno)
+
+    if not commands[-1]:
+        msg = "missing value"
+        raise _error(msg, lineno)
+    return commands, pos
+
+
+def _statement(
+    tokens: list[tuple[str, Any]], lineno: int
+) -> tuple[list[str], bool, list[list[Any]]]:
+    """Parse "$x := pipeline", "$x = pipeline", "$i, $x := pipeline",
+    or a plain pipeline.
+
+    Return the variable names, whether they are declared rather than assigned,
+    and the pipeline.
+    """
+    names: list[str] = []
+    pos = 0
+
+    while (
+        tokens[pos][0] == "field"
+        and re.fullmatch(r"\$\w*", tokens[pos][1])
+        and tokens[pos + 1][0] in {",", ":=", "="}
+    ):
+        names.append(tokens[pos][1])
+        pos += 2
+        if tokens[pos - 1][0] != ",":
+            break
+
+    declare = not names or tokens[pos - 1][0] != "="
+
+    pipeline, pos = _pipeline(tokens, pos, lineno)
+    if tokens[pos][0] != "eof":
+        msg = "unexpected ')'"
+        raise _error(msg, lineno)
+    return names, declare, pipeline
+
+
+def _parse(text: str) -> list[Any]:  # noqa: C901.
+    actions: list[tuple[str, Any, int]] = []
+    pos = 0
+    lineno = 1
+    trim_next = False
+
+    for match in _ACTION.finditer(text):
+        before = text[pos : match.start()]
+        if "{{" in before:
+            msg = "unclosed action"
+            line = lineno + before.count("\n", 0, before.index("{{"))
+            raise _error(msg, line)
+        if trim_next:
+            before = before.lstrip()
+        if match.group(1):
+            before = before.rstrip()
+        actions.append(("text", before, lineno))
+        lineno += text.count("\n", pos, match.start())
+
+        action = match.group(2).strip()
+        if not (action.startswith("/*") and action.endswith("*/")):
+            tokens = _tokens(action, lineno)
+            keyword = tokens[0][1] if tokens[0][0] == "word" else None
+            if keyword in _KEYWORDS:
+                actions.append((keyword, tokens[1:], lineno))
+            elif keyword in {"block", "define", "template"}:
+                msg = f'"{keyword}" is not supported'
+                raise _error(msg, lineno)
+            else:
+                actions.append(("action", tokens, lineno))
+
+        lineno += match.group().count("\n")
+        pos = match.end()
+        trim_next = bool(match.group(3))
+
+    rest = text[pos:]
+    if "{{" in rest:
+        msg = "unclosed action"
+        line = lineno + rest.count("\n", 0, rest.index("{{"))
+        raise _error(msg, line)
+    actions.append(("text", rest.lstrip() if trim_next else rest, lineno))
+    actions.append(("eof", None, lineno))
+
+    def block(i: int) -> tuple[list[Any], int]:
+        nodes: list[Any] = []
+
+        while True:
+            kind, value, lineno = actions[i]
+            if kind in {"else", "end", "eof"}:
+                return nodes, i
+            if kind == "text":
+                nodes.append(("text", value))
+                i += 1
+            elif kind == "action":
+                nodes.append(("action", *_statement(value, lineno), lineno))
+                i += 1
+            else:
+                node, i = control(kind, value, lineno, i + 1)
+                nodes.append(node)
+
+    def control(kind: str, tokens: Any, lineno: int, i: int) -> tuple[Any, int]:
+        names, declare, pipeline = _statement(tokens, lineno)
+        body, i = block(i)
+        else_body: list[Any] = []
+
+        end_kind, end_tokens, end_lineno = actions[i]
+        if end_kind == "else":
+            if end_tokens[0] == ("word", "if") and kind == "if":
+                # "else if" continues the chain up to a single "end".
+                node, i = control("if", end_tokens[1:], end_lineno, i + 1)
+                return (kind, names, declare, pipeline, body, [node], lineno), i
+            if end_tokens[0][0] != "eof":
+                msg = "unexpected tokens after \"else\""
+                raise _error(msg, end_lineno)
+            else_body, i = block(i + 1)
+            end_kind, _, end_lineno = actions[i]
+        if end_kind != "end":
+            msg = f'missing "end" for "{kind}"'
+            raise _error(msg, lineno)
+
+        return (kind, names, declare, pipeline, body, else_body, lineno), i + 1
+
+    nodes, i = block(0)
+    if actions[i][0] != "eof":
+        msg = f'unexpected "{actions[i][0]}"'
+        raise _error(msg, actions[i][2])
+    return nodes
+
+
+def _field(
+    field: str, dot: Any, variables: Mapping[str, Any], lineno: int
+) -> Any:
+    name, *keys = field.split(".")
+    if name:
+        if name not in variables:
+            msg = f"undefined variable {name!r}"
+            raise _error(msg, lineno)
+        x = variables[name]
+    else:
+        x = dot
+        keys = [key for key in keys if key]
+
+    for key in keys:
+        if isinstance(x, Mapping):
+            x = x.get(key)
+        elif x is not None:
+            msg = f"cannot get {key!r} from a value of type '{type(x).__name__}'"
+            raise _error(msg, lineno)
+
+    return x
+
+
+def _evaluate(
+    pipeline: list[list[Any]],
+    dot: Any,
+    variables: Mapping[str, Any],
+    functions: Mapping[str, Callable[..., Any]],
+    lineno: int,
+) -> Any:
+    def operand(item: tuple[str, Any]) -> Any:
+        kind, x = item
+        if kind == "field":
+            return _field(x, dot, variables, lineno)
+        if kind == "pipeline":
+            return _evaluate(x, dot, variables, functions, lineno)
+        if kind == "word":
+            msg = f"function {x!r} needs to come first"
+            raise _error(msg, lineno)
+        return x
+
+    value: Any = None
+
+    for i, command in enumerate(pipeline):
+        kind, name = command[0]
+        if kind != "word":
+            if len(command) > 1 or i > 0:
+                msg = "cannot give arguments to a value that is not a function"
+                raise _error(msg, lineno)
+            value = operand(command[0])
+            continue
+
+        if name not in functions:
+            msg = f"unknown function {name!r}"
+            raise _error(msg, lineno)
+        args = [operand(x) for x in command[1:]]
+        if i > 0:
+            # A pipeline passes the value on as the last argument.
+            args.append(value)
+        try:
+            value = functions[name](*args)
+        except (KeyError, IndexError, TypeError, ValueError) as e:
+            msg = f"{name}: {e}"
+            raise _error(msg, lineno)
+
+    return value
+
+
+def _set(
+    variables: ChainMap[str, Any],
+    name: str,
+    value: Any,
+    *,
+    declare: bool,
+    lineno: int,
+) -> None:
+    if declare:
+        variables[name] = value
+        return
+
+    # Like in Go, "=" changes the variable in the scope that declared it.
+    for scope in variables.maps:
+        if name in scope:
+            scope[name] = value
+            return
+
+    msg = f"undefined variable {name!r}"
+    raise _error(msg, lineno)
+
+
+def _execute(  # noqa: C901.
+    nodes: list[Any],
+    dot: Any,
+    variables: ChainMap[str, Any],
+    functions: Mapping[str, Callable[..., Any]],
+    out: list[str],
+) -> None:
+    for node in nodes:
+        if node[0] == "text":
+            out.append(node[1])
+            continue
+
+        if node[0] == "action":
+            _, names, declare, pipeline, lineno = node
+            value = _evaluate(pipeline, dot, variables, functions, lineno)
+            if names:
+                _set(
+                    variables, names[-1], value, declare=declare, lineno=lineno
+                )
+            else:
+                out.append(_text(value))
+            continue
+
+        kind, names, declare, pipeline, body, else_body, lineno = node
+        value = _evaluate(pipeline, dot, variables, functions, lineno)
+        # Variables declared in a block are local to it.
+        scope = variables.new_child()
+
+        if kind in {"if", "with"} and names:
+            _set(scope, names[-1], value, declare=declare, lineno=lineno)
+
+        if kind == "if":
+            branch = body if _truth(value) else else_body
+            _execute(branch, dot, scope, functions, out)
+        elif kind == "with":
+            if _truth(value):
+                _execute(body, value, scope, functions, out)
+            else:
+                _execute(else_body, dot, scope, functions, out)
+        else:
+            if isinstance(value, Mapping):
+                items = sorted(value.items(), key=lambda x: str(x[0]))
+            elif isinstance(value, list):
+                items = list(enumerate(value))
+            elif value is None:
+                items = []
+            else:
+                msg = f"cannot range over a value of type '{type(value).__name__}'"
+                raise _error(msg, lineno)
+
+            for k, v in items:
+                for name, x in zip(names, (k, v) if len(names) == 2 else (v,)):
+                    _set(scope, name, x, declare=declare, lineno=lineno)
+                # Each iteration has its own scope.
+                _execute(body, v, scope.new_child(), functions, out)
+            if not items:
+                _execute(else_body, dot, scope, functions, out)
+
+
+def render_template(
+    text: str,
+    values: Any,
+    *,
+    functions: Mapping[str, Callable[..., Any]] | None = None,
+) -> str:
+    """Render a subset of Go's text/template with `values` as the dot.
+
+    `functions` adds to or overrides the built-in functions.
+    """
+    out: list[str] = []
+    _execute(
+        _parse(text),
+        values,
+        ChainMap({"$": values}),
+        {**_FUNCTIONS, **(functions or {})},
+        out,
+    )
+
+    return "".join(out)
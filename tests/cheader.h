@@ -0,0 +1,7 @@
+#define CONFIG_PORT 8080
+#define CONFIG_HOST "local\"host\"\n"
+#define CONFIG_DEBUG 1
+#define CONFIG_RATIO 0.5
+#define CONFIG_LOG_LEVEL "info"
+#define CONFIG_SERVERS_0_IP "10.0.0.1"
+#define CONFIG_SERVERS_1_IP "10.0.0.2"
@@ -0,0 +1,20 @@
+return {
+  name = "web",
+  replicas = 3,
+  ratio = 0.5,
+  enabled = true,
+  owner = nil,
+  ports = {80, 443},
+  _private = "hidden?",
+  ["if"] = "keyword",
+  ["content-type"] = "text/html",
+  labels = {},
+  containers = {
+    {
+      image = "nginx:1.25",
+      args = {"-g", "daemon off;"},
+    },
+    {},
+  },
+  note = "a \\(b) \"c\"\n",
+}
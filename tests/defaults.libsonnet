@@ -0,0 +1,4 @@
+{
+  replicas: 1,
+  image: 'nginx',
+}
@@ -0,0 +1,28 @@
+region = "us-east-1"
+instance_count = 2
+enabled = true
+zones = ["a", "b"]
+tags = {
+  Name = "web"
+  cost-center = "42"
+}
+
+terraform {}
+
+variable "image" {
+  type = string
+  default = "ami-123"
+}
+
+resource "aws_instance" "web" {
+  ami = var.image
+  count = var.instance_count
+}
+
+resource "aws_eip" "ip" {
+  instance = aws_instance.web.id
+}
+
+locals {
+  greeting = "Hello, ${var.name}!"
+}
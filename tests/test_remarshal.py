@@ -5,21 +5,44 @@
 
 from __future__ import annotations
 
+import ast
+import dataclasses
 import datetime
+import decimal
 import errno
 import functools
-import inspect
+import importlib
+import json
+import math
+import os
 import re
 import secrets
 import sys
+import threading
+import time
+import types
+import warnings
 from pathlib import Path
-from typing import TYPE_CHECKING, Any, Callable
+from typing import TYPE_CHECKING, Any
 
 import cbor2  # type: ignore
 import pytest
 
 import remarshal
-from remarshal.main import YAMLOptions, _argv0_to_format, _parse_command_line
+from remarshal.main import (
+    ConvertOptions,
+    DecodeOptions,
+    YAMLOptions,
+    _argv0_to_format,
+    _diff_main,
+    _freeze,
+    _load_renames,
+    _parse_command_line,
+    _render_template,
+    _schema_main,
+    _validate_main,
+    _watch,
+)
 
 if TYPE_CHECKING:
     from collections.abc import Mapping, Sequence
@@ -27,6 +50,32 @@ if TYPE_CHECKING:
 TEST_PATH = Path(__file__).resolve().parent
 
 
+def _missing(module: str) -> bool:
+    try:
+        importlib.import_module(module)
+    except ImportError:
+        return True
+
+    return False
+
+
+# Tests for the optional extras in pyproject.toml.
+needs_asn1tools = pytest.mark.skipif(
+    _missing("asn1tools"), reason='needs "remarshal[asn1]"'
+)
+needs_bson = pytest.mark.skipif(_missing("bson"), reason='needs "remarshal[bson]"')
+needs_ion = pytest.mark.skipif(
+    _missing("amazon.ion.simpleion"), reason='needs "remarshal[ion]"'
+)
+needs_jq = pytest.mark.skipif(_missing("jq"), reason='needs "remarshal[jq]"')
+needs_jsonnet = pytest.mark.skipif(
+    _missing("_jsonnet"), reason='needs "remarshal[jsonnet]"'
+)
+needs_pyarrow = pytest.mark.skipif(
+    _missing("pyarrow"), reason='needs "remarshal[parquet]"'
+)
+
+
 def data_file_path(filename: str) -> str:
     path_list = []
     if re.match(r"example\.(json|msgpack|toml|yaml|cbor)$", filename):
@@ -43,10 +92,17 @@ def read_file(filename: str) -> bytes:
 def run(*argv: str) -> None:
     # The `list()` call is to satisfy the type checker.
     args_d = vars(_parse_command_line(list(argv)))
-    sig = inspect.signature(remarshal.remarshal)
-    re_args = {param: args_d[param] for param in sig.parameters if param in args_d}
+    names = {field.name for field in dataclasses.fields(ConvertOptions)}
+    options = ConvertOptions(**{k: v for k, v in args_d.items() if k in names})
 
-    remarshal.remarshal(**re_args)
+    remarshal.remarshal(
+        args_d["input_format"],
+        args_d["output_format"],
+        args_d["input"],
+        args_d["output"],
+        options,
+        force=args_d["force"],
+    )
 
 
 def assert_cbor_same(output: bytes, reference: bytes) -> None:
@@ -88,32 +144,37 @@ def toml_signature(data: bytes | str) -> list[str]:
 output_file = None
 
 
+class FakeClipboard(types.ModuleType):
+    class PyperclipException(RuntimeError):  # noqa: N818
+        pass
+
+    def __init__(self, text: str = "") -> None:
+        super().__init__("pyperclip")
+        self.text = text
+
+    def copy(self, text: str) -> None:
+        self.text = text
+
+    def paste(self) -> str:
+        return self.text
+
+
 def _convert_and_read(
     input_filename: str,
     input_format: str,
     output_format: str,
     *,
+    force: bool = False,
     output_filename: str,
-    json_indent: bool | int | None = True,
-    sort_keys: bool = False,
-    stringify: bool = False,
-    transform: Callable[[remarshal.Document], remarshal.Document] | None = None,
-    unwrap: str | None = None,
-    wrap: str | None = None,
-    yaml_options: YAMLOptions | None = None,
+    **options: Any,
 ) -> bytes:
     remarshal.remarshal(
         input_format,
         output_format,
         data_file_path(input_filename),
         output_filename,
-        json_indent=json_indent,
-        sort_keys=sort_keys,
-        stringify=stringify,
-        transform=transform,
-        unwrap=unwrap,
-        wrap=wrap,
-        yaml_options=yaml_options,
+        ConvertOptions(**{"json_indent": True, "sort_keys": False, **options}),
+        force=force,
     )
 
     return read_file(output_filename)
@@ -324,6 +385,30 @@ class TestRemarshal:
         reference = read_file("array.toml")
         assert output == reference
 
+    def test_toml_wrap(self, convert_and_read) -> None:
+        output = convert_and_read("array.json", "json", "toml", toml_root_key="data")
+        reference = convert_and_read("array.json", "json", "toml", wrap="data")
+        assert output == reference
+
+        output = remarshal.convert(
+            "json", "toml", b"[1, 2]", ConvertOptions(toml_wrap=True)
+        )
+        assert output == b"items = [1, 2]\n"
+        output = remarshal.convert(
+            "json", "toml", b'"hi"', ConvertOptions(toml_wrap=True)
+        )
+        assert output == b'value = "hi"\n'
+        output = remarshal.convert(
+            "json", "toml", b'{"a": 1}', ConvertOptions(toml_wrap=True)
+        )
+        assert output == b"a = 1\n"
+
+    def test_toml_root_key_cli(self) -> None:
+        args = _parse_command_line(
+            [sys.argv[0], "--toml-root-key", "data", "in.json", "out.toml"]
+        )
+        assert args.toml_root_key == "data"
+
     def test_unwrap(self, convert_and_read) -> None:
         output = convert_and_read(
             "array.toml", "toml", "json", json_indent=None, unwrap="data"
@@ -331,6 +416,57 @@ class TestRemarshal:
         reference = read_file("array.json")
         assert output == reference
 
+    def test_unwrap_path(self) -> None:
+        input_data = b'{"a": {"b.c": {"d": 1}, "e": 2}}'
+        output = remarshal.convert(
+            "json", "json", input_data, ConvertOptions(unwrap="a.b\\.c")
+        )
+        assert output == b'{"d":1}\n'
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("json", "json", input_data, ConvertOptions(unwrap="a.x"))
+        assert "no key 'x' to unwrap" in str(cm.value)
+
+        with pytest.raises(TypeError) as cm:
+            remarshal.convert(
+                "json", "json", input_data, ConvertOptions(unwrap="a.e.f")
+            )
+        assert "Value of type 'int' cannot be unwrapped" in str(cm.value)
+
+    def test_wrap_path(self) -> None:
+        output = remarshal.convert(
+            "json", "json", b"[1]", ConvertOptions(wrap="a.b\\.c")
+        )
+        assert output == b'{"a":{"b.c":[1]}}\n'
+
+    def test_unwrap_pointer(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "k8s.json", "json", "json", json_indent=None, unwrap_pointer="/2/metadata"
+        )
+        assert output == b'{"name":"web"}\n'
+
+    def test_unwrap_pointer_escapes(self) -> None:
+        output = remarshal.convert(
+            "json",
+            "json",
+            b'{"a/b": {"~c": 1}}',
+            ConvertOptions(unwrap_pointer="/a~1b/~0c"),
+        )
+        assert output == b"1\n"
+
+    def test_unwrap_pointer_missing(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "json", "json", b"[1, 2]", ConvertOptions(unwrap_pointer="/2")
+            )
+        assert "no value at path '/2'" in str(cm.value)
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "json", "json", b"[1, 2]", ConvertOptions(unwrap_pointer="0")
+            )
+        assert "must be empty or start with '/'" in str(cm.value)
+
     def test_malformed_json(self, convert_and_read) -> None:
         with pytest.raises(ValueError):
             convert_and_read("garbage", "json", "yaml")
@@ -410,6 +546,11 @@ class TestRemarshal:
         test_format_string("{0}2{1}.exe")
         test_format_string("{0}2{1}-script.py")
 
+        assert _argv0_to_format("yaml2cheader") == ("yaml", "cheader")
+        assert _argv0_to_format("json52yaml") == ("json5", "yaml")
+        assert _argv0_to_format("ini2yaml") == ("ini", "yaml")
+        assert _argv0_to_format("yaml2ini") == ("yaml", "ini")
+
     def test_format_detection(self) -> None:
         ext_to_fmt = {
             "json": "json",
@@ -494,7 +635,7 @@ class TestRemarshal:
             )
 
     def test_ordered_simple(self, convert_and_read) -> None:
-        formats = ("json", "toml")
+        formats = ("json", "toml", "yaml")
         for from_ in formats:
             for to in formats:
                 output = convert_and_read("order." + from_, from_, to)
@@ -735,6 +876,4077 @@ class TestRemarshal:
         with pytest.raises(ValueError):
             convert_and_read("time.toml", "toml", "yaml")
 
+    def test_cached_converter_hit(self) -> None:
+        converter = remarshal.CachedConverter(2)
+        input_data = read_file("example.json")
+
+        first = converter.convert("json", "yaml", input_data)
+        second = converter.convert("json", "yaml", input_data)
+
+        assert first == second == read_file("example.yaml").replace(
+            b"1979-05-27 07:32:00+00:00", b"'1979-05-27T07:32:00+00:00'"
+        )
+        assert (converter.hits, converter.misses) == (1, 1)
+
+    def test_cached_converter_options_in_key(self) -> None:
+        converter = remarshal.CachedConverter(2)
+        input_data = read_file("order.json")
+
+        unsorted = converter.convert(
+            "json", "json", input_data, ConvertOptions(sort_keys=False)
+        )
+        sorted_ = converter.convert(
+            "json", "json", input_data, ConvertOptions(sort_keys=True)
+        )
+
+        assert unsorted != sorted_
+        assert (converter.hits, converter.misses) == (0, 2)
+
+    def test_cached_converter_eviction(self) -> None:
+        converter = remarshal.CachedConverter(1)
+
+        converter.convert("json", "json", b"[1]")
+        converter.convert("json", "json", b"[2]")
+        converter.convert("json", "json", b"[1]")
+
+        assert (converter.hits, converter.misses) == (0, 3)
+
+    def test_cached_converter_least_recently_used(self) -> None:
+        converter = remarshal.CachedConverter(2)
+
+        for input_data in [b"[1]", b"[2]", b"[1]", b"[3]", b"[1]", b"[2]"]:
+            converter.convert("json", "json", input_data)
+
+        # Reading [1] again keeps it, so [3] evicts [2].
+        assert (converter.hits, converter.misses) == (2, 4)
+
+    def test_cached_converter_option_types(self) -> None:
+        converter = remarshal.CachedConverter(4)
+        input_data = b'{"a": [1]}'
+
+        indent_true = converter.convert("json", "json", input_data, json_indent=True)
+        indent_one = converter.convert("json", "json", input_data, json_indent=1)
+        set_true = converter.convert(
+            "json", "json", input_data, set_values=[("b", True)]
+        )
+        set_one = converter.convert("json", "json", input_data, set_values=[("b", 1)])
+
+        assert indent_true != indent_one
+        assert set_true != set_one
+        assert (converter.hits, converter.misses) == (0, 4)
+        assert _freeze({"a": 1}) != _freeze([("a", 1)])
+
+    def test_keyword_options(self, tmp_path) -> None:
+        input_data = read_file("example.json")
+        options = ConvertOptions(json_indent=4, sort_keys=False, wrap="a")
+
+        assert remarshal.decode(
+            "yaml", b"a: 1\n", yaml_stream=True
+        ) == remarshal.decode("yaml", b"a: 1\n", DecodeOptions(yaml_stream=True))
+        assert remarshal.encode(
+            "json",
+            {"b": 1, "a": 2},
+            json_indent=None,
+            sort_keys=True,
+            stringify=False,
+            yaml_options=YAMLOptions(),
+        ) == remarshal.encode("json", {"b": 1, "a": 2})
+        assert remarshal.convert(
+            "json", "json", input_data, json_indent=4, sort_keys=False, wrap="a"
+        ) == remarshal.convert("json", "json", input_data, options)
+
+        output = tmp_path / "output.json"
+        remarshal.remarshal(
+            "json",
+            "json",
+            data_file_path("example.json"),
+            output,
+            json_indent=4,
+            sort_keys=False,
+            wrap="a",
+        )
+        assert output.read_bytes() == remarshal.convert(
+            "json", "json", input_data, options
+        )
+
+        with pytest.raises(TypeError):
+            remarshal.encode("json", {}, no_such_option=True)
+
+    def test_cached_converter_size(self) -> None:
+        with pytest.raises(ValueError):
+            remarshal.CachedConverter(0)
+
+    def test_toml_descriptions(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "descriptions.json",
+            "json",
+            "toml",
+            toml_descriptions={
+                "title": "The title of the document",
+                "owner": "The owner of the project",
+                "owner.name": "The full name",
+            },
+        )
+        reference = read_file("descriptions.toml")
+        assert output == reference
+
+    def test_toml_descriptions_cli(self, tmp_path) -> None:
+        output_filename = str(tmp_path / "output.toml")
+        run(
+            sys.argv[0],
+            "--descriptions",
+            data_file_path("descriptions.yaml"),
+            data_file_path("descriptions.json"),
+            output_filename,
+        )
+        assert read_file(output_filename) == read_file("descriptions.toml")
+
+    def test_toml_descriptions_bad_file(self) -> None:
+        with pytest.raises(SystemExit) as cm:
+            _parse_command_line(
+                [
+                    sys.argv[0],
+                    "--descriptions",
+                    data_file_path("garbage"),
+                    "input.json",
+                    "output.toml",
+                ]
+            )
+        assert cm.value.code == 2
+
+    def test_flatten(self, convert_and_read) -> None:
+        output = convert_and_read("flatten.json", "json", "json", flatten=True)
+        reference = read_file("flatten-flat.json")
+        assert output == reference
+
+    def test_unflatten(self, convert_and_read) -> None:
+        output = convert_and_read("flatten-flat.json", "json", "json", unflatten=True)
+        reference = read_file("flatten.json")
+        assert output == reference
+
+    def test_flatten_unflatten_round_trip(self, tmp_path) -> None:
+        flat_filename = str(tmp_path / "flat.json")
+        output_filename = str(tmp_path / "output.json")
+        run(
+            "yaml2json",
+            "--flatten",
+            "--stringify",
+            "-i",
+            data_file_path("example.yaml"),
+            "-o",
+            flat_filename,
+        )
+        run("json2yaml", "--unflatten", "-i", flat_filename, "-o", output_filename)
+        assert read_file(output_filename) == read_file("example.yaml").replace(
+            b"1979-05-27 07:32:00+00:00", b"'1979-05-27T07:32:00+00:00'"
+        )
+
+    def test_flatten_top_level_array(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "array.json", "json", "json", flatten=True, json_indent=None
+        )
+        assert output == b'{"0.a":"b","1.c.0":1,"1.c.1":2,"1.c.2":3}\n'
+
+    def test_flatten_empty(self) -> None:
+        for input_data in (b"{}", b"[]"):
+            output = remarshal.convert(
+                "json", "json", input_data, ConvertOptions(flatten=True)
+            )
+            assert output == input_data + b"\n"
+
+            for output_format in ("cheader", "properties"):
+                output = remarshal.convert("json", output_format, input_data)
+                assert output == b""
+
+    def test_flatten_collision(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "json",
+                "json",
+                b'{"a.b": 1, "a": {"b": 2}}',
+                ConvertOptions(flatten=True),
+            )
+        assert str(cm.value) == (
+            "paths ['a.b'] and ['a', 'b'] both flatten to the key 'a.b'"
+        )
+
+        with pytest.raises(remarshal.EncodeError) as cm:
+            remarshal.convert("json", "cheader", b'{"a": {"b": 1}, "a_b": 2}')
+        assert "paths ['a', 'b'] and ['a_b'] both flatten" in str(cm.value)
+
+    def test_flatten_brackets(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "flatten.json", "json", "json", flatten=True, flatten_style="bracket"
+        )
+        assert list(json.loads(output)) == [
+            "name",
+            "database.ports[0]",
+            "database.ports[1]",
+            "database.enabled",
+            "servers[0].ip",
+            "servers[0].tags",
+            "servers[1].ip",
+            "servers[1].options",
+        ]
+
+        output = convert_and_read(
+            "array.json",
+            "json",
+            "json",
+            flatten=True,
+            flatten_style="bracket",
+            json_indent=None,
+        )
+        assert output == b'{"[0].a":"b","[1].c[0]":1,"[1].c[1]":2,"[1].c[2]":3}\n'
+
+    def test_unflatten_brackets(self) -> None:
+        input_data = b'{"a[0].b": 1, "a[1]": 2, "c[0][0]": 3, "d[x]": 4, "e.0": 5}'
+        output = remarshal.convert(
+            "json",
+            "json",
+            input_data,
+            ConvertOptions(
+                flatten_style="bracket",
+                json_indent=None,
+                sort_keys=False,
+                unflatten=True,
+            ),
+        )
+        assert output == b'{"a":[{"b":1},2],"c":[[3]],"d[x]":4,"e":[5]}\n'
+
+    def test_unflatten_conflict(self, tmp_path) -> None:
+        input_filename = tmp_path / "input.json"
+        input_filename.write_text('{"a": 1, "a.b": 2}')
+        with pytest.raises(ValueError):
+            run(
+                "json2json",
+                "--unflatten",
+                "-i",
+                str(input_filename),
+                "-o",
+                str(tmp_path / "output.json"),
+            )
+
+    def test_flatten_unflatten_exclusive(self) -> None:
+        with pytest.raises(SystemExit) as cm:
+            _parse_command_line(["json2json", "--flatten", "--unflatten"])
+        assert cm.value.code == 2
+
+    def test_yaml_split(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "array.json", "json", "yaml", yaml_options=YAMLOptions(split=True)
+        )
+        assert output == b"a: b\n---\nc:\n- 1\n- 2\n- 3\n"
+
+    def test_yaml_split_not_array(self, convert_and_read) -> None:
+        with pytest.raises(TypeError):
+            convert_and_read(
+                "order.json", "json", "yaml", yaml_options=YAMLOptions(split=True)
+            )
+
+    def test_k8s_sort(self, convert_and_read) -> None:
+        output = convert_and_read("k8s.json", "json", "yaml", k8s_sort=True)
+        reference = read_file("k8s-sorted.yaml")
+        assert output == reference
+
+    def test_k8s_kind_order(self, tmp_path) -> None:
+        output_filename = str(tmp_path / "output.yaml")
+        run(
+            "json2yaml",
+            "--k8s-sort",
+            "--k8s-kind-order",
+            "Widget, Deployment",
+            "-i",
+            data_file_path("k8s.json"),
+            "-o",
+            output_filename,
+        )
+        output = read_file(output_filename).decode("utf-8")
+        assert re.findall(r"^kind: (.*)$", output, re.MULTILINE) == [
+            "Widget",
+            "Deployment",
+            "Service",
+            "CustomResourceDefinition",
+            "ConfigMap",
+            "Namespace",
+            "ConfigMap",
+        ]
+
+    def test_k8s_sort_not_yaml(self, convert_and_read) -> None:
+        with pytest.raises(ValueError):
+            convert_and_read("k8s.json", "json", "json", k8s_sort=True)
+
+    def test_decode_error_line(self, convert_and_read) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            convert_and_read("garbage", "yaml", "json")
+        assert (cm.value.format, cm.value.line) == ("yaml", 1)
+
+    def test_encode_error_format(self, convert_and_read) -> None:
+        with pytest.raises(remarshal.EncodeError) as cm:
+            convert_and_read("date.toml", "toml", "json")
+        assert cm.value.format == "json"
+
+    def test_error_format_json_decode(self, capsys, monkeypatch) -> None:
+        monkeypatch.setattr(
+            sys,
+            "argv",
+            ["json2yaml", "--error-format", "json", "-i", data_file_path("garbage")],
+        )
+        with pytest.raises(SystemExit) as cm:
+            remarshal.main()
+        assert cm.value.code == 1
+
+        error = json.loads(capsys.readouterr().err)
+        assert set(error) == {"error", "stage", "format", "line"}
+        assert error["error"].startswith("Cannot parse as JSON")
+        assert (error["stage"], error["format"], error["line"]) == ("decode", "json", 1)
+
+    def test_error_format_json_read(self, capsys, monkeypatch, tmp_path) -> None:
+        input_filename = str(tmp_path / "missing.json")
+        monkeypatch.setattr(
+            sys, "argv", ["json2yaml", "--error-format", "json", "-i", input_filename]
+        )
+        with pytest.raises(SystemExit):
+            remarshal.main()
+
+        error = json.loads(capsys.readouterr().err)
+        assert error["stage"] == "read"
+        assert error["format"] == "json"
+        assert error["line"] is None
+
+    def test_error_format_json_clipboard(self, capsys, monkeypatch) -> None:
+        # The error about the missing package does not name a file.
+        monkeypatch.setitem(sys.modules, "pyperclip", None)
+        monkeypatch.setattr(
+            sys,
+            "argv",
+            ["json2yaml", "--error-format", "json", "-i", "clipboard", "-o", "-"],
+        )
+        with pytest.raises(SystemExit):
+            remarshal.main()
+
+        error = json.loads(capsys.readouterr().err)
+        assert (error["stage"], error["format"]) == ("read", "json")
+
+    def test_error_format_json_write(self, capsys, monkeypatch, tmp_path) -> None:
+        monkeypatch.setattr(
+            sys,
+            "argv",
+            [
+                "json2yaml",
+                "--error-format",
+                "json",
+                "-i",
+                data_file_path("example.json"),
+                "-o",
+                str(tmp_path),
+            ],
+        )
+        with pytest.raises(SystemExit):
+            remarshal.main()
+
+        error = json.loads(capsys.readouterr().err)
+        assert (error["stage"], error["format"]) == ("write", "yaml")
+
+    def test_error_format_text(self, capsys, monkeypatch) -> None:
+        monkeypatch.setattr(sys, "argv", ["json2yaml", "-i", data_file_path("garbage")])
+        with pytest.raises(SystemExit):
+            remarshal.main()
+        assert capsys.readouterr().err.startswith("Error: Cannot parse as JSON")
+
+    def test_trim_strings(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "padded.json", "json", "json", json_indent=None, trim_strings=True
+        )
+        reference = read_file("trimmed.json")
+        assert output == reference
+
+    def test_trim_strings_off(self, convert_and_read) -> None:
+        output = convert_and_read("padded.json", "json", "yaml")
+        assert b"'  Tom '" in output
+
+    def test_clipboard(self, monkeypatch) -> None:
+        clipboard = FakeClipboard('{"a": [1, 2]}')
+        monkeypatch.setitem(sys.modules, "pyperclip", clipboard)
+
+        run("json2yaml", "-i", "clipboard", "-o", "clipboard")
+
+        assert clipboard.text == "a:\n- 1\n- 2\n"
+
+    def test_clipboard_binary(self, monkeypatch) -> None:
+        monkeypatch.setitem(sys.modules, "pyperclip", FakeClipboard("[1]"))
+
+        with pytest.raises(ValueError):
+            run("json2cbor", "-i", "clipboard", "-o", "clipboard")
+
+    def test_clipboard_missing(self, monkeypatch) -> None:
+        monkeypatch.setitem(sys.modules, "pyperclip", None)
+
+        with pytest.raises(OSError):
+            run("json2yaml", "-i", "clipboard")
+
+    def test_big_numbers(self) -> None:
+        input_data = b'{"a": 3.141592653589793238462643383279, "b": 1e30, "c": 1.0}'
+
+        output = remarshal.convert(
+            "json",
+            "json",
+            input_data,
+            ConvertOptions(big_numbers=True, json_indent=None),
+        )
+        assert output == (
+            b'{"a":3.141592653589793238462643383279,'
+            b'"b":1000000000000000000000000000000.0,"c":1.0}\n'
+        )
+
+        output = remarshal.convert(
+            "json", "toml", input_data, ConvertOptions(big_numbers=True)
+        )
+        assert output.startswith(b"a = 3.141592653589793238462643383279\n")
+
+        output = remarshal.convert(
+            "json", "yaml", input_data, ConvertOptions(big_numbers=True)
+        )
+        assert output.startswith(b"a: 3.141592653589793238462643383279\n")
+
+        output = remarshal.convert(
+            "json", "json", input_data, ConvertOptions(json_indent=None)
+        )
+        assert output == b'{"a":3.141592653589793,"b":1e+30,"c":1.0}\n'
+
+    def test_big_numbers_input(self) -> None:
+        for input_format, input_data in (
+            ("json5", b"{a: 0.1000000000000000000001, b: Infinity}"),
+            ("toml", b"a = 0.1000000000000000000001\nb = inf\n"),
+            ("yaml", b"a: 0.1000000000000000000001\nb: .inf\n"),
+        ):
+            doc = remarshal.decode(
+                input_format, input_data, DecodeOptions(big_numbers=True)
+            )
+            assert doc == {
+                "a": decimal.Decimal("0.1000000000000000000001"),
+                "b": math.inf,
+            }
+
+    def test_big_numbers_other_formats(self) -> None:
+        output = remarshal.convert(
+            "json",
+            "msgpack",
+            b'{"a": 0.1000000000000000000001}',
+            ConvertOptions(big_numbers=True),
+        )
+        assert remarshal.decode("msgpack", output) == {"a": 0.1}
+
+    def test_float_format(self, tmp_path) -> None:
+        input_filename = tmp_path / "input.json"
+        input_filename.write_text('{"a": 0.30000000000000004, "b": [1e-07, 2, 1.5]}')
+        output_filename = str(tmp_path / "output.json")
+
+        run(
+            "json2json",
+            "--float-format",
+            "%.6g",
+            "-i",
+            str(input_filename),
+            "-o",
+            output_filename,
+        )
+
+        assert read_file(output_filename) == b'{"a":0.3,"b":[1.0e-07,2,1.5]}\n'
+
+    def test_float_format_fixed(self, tmp_path) -> None:
+        input_filename = tmp_path / "input.yaml"
+        input_filename.write_text("pi: 3.14159\nn: 7\n")
+        output_filename = str(tmp_path / "output.yaml")
+
+        run(
+            "yaml2yaml",
+            "--float-format",
+            "%.2f",
+            "-i",
+            str(input_filename),
+            "-o",
+            output_filename,
+        )
+
+        assert read_file(output_filename) == b"pi: 3.14\nn: 7\n"
+
+    def test_float_format_text(self) -> None:
+        input_data = b'{"a": 1.5, "b": 12345.678}'
+        for float_format, output_format, expected in [
+            ("%.3f", "json", b'{"a":1.500,"b":12345.678}\n'),
+            ("%.2e", "json", b'{"a":1.50e+00,"b":1.23e+04}\n'),
+            ("%.3f", "toml", b"a = 1.500\nb = 12345.678\n"),
+            ("%.2e", "yaml", b"a: 1.50e+00\nb: 1.23e+04\n"),
+        ]:
+            output = remarshal.convert(
+                "json",
+                output_format,
+                input_data,
+                ConvertOptions(float_format=float_format, verify_roundtrip=True),
+            )
+            assert output == expected
+
+        # Other formats get the closest float.
+        output = remarshal.convert(
+            "json", "msgpack", input_data, ConvertOptions(float_format="%.2e")
+        )
+        assert remarshal.decode("msgpack", output) == {"a": 1.5, "b": 12300.0}
+
+    def test_float_format_invalid(self) -> None:
+        with pytest.raises(SystemExit) as cm:
+            _parse_command_line(["json2json", "--float-format", "%s!"])
+        assert cm.value.code == 2
+
+    def test_datetime_style(self) -> None:
+        input_data = (
+            b"a = 1979-05-27T07:32:00Z\nb = 1979-05-27T07:32:00.5\nc = 1979-05-27\n"
+        )
+        output = remarshal.convert(
+            "toml", "json", input_data, ConvertOptions(datetime_style="string")
+        )
+        assert json.loads(output) == {
+            "a": "1979-05-27T07:32:00+00:00",
+            "b": "1979-05-27T07:32:00.500000",
+            "c": "1979-05-27",
+        }
+
+        output = remarshal.convert(
+            "toml", "json", input_data, ConvertOptions(datetime_style="epoch")
+        )
+        assert json.loads(output) == {
+            "a": 296638320,
+            "b": 296638320.5,
+            "c": 296611200,
+        }
+
+        output = remarshal.convert("toml", "yaml", input_data)
+        assert output.startswith(b"a: 1979-05-27 07:32:00+00:00\n")
+
+    def test_datetime_style_time(self) -> None:
+        output = remarshal.convert(
+            "toml", "toml", b"a = 07:32:00\n", ConvertOptions(datetime_style="string")
+        )
+        assert output == b'a = "07:32:00"\n'
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "toml",
+                "json",
+                b"a = 07:32:00\n",
+                ConvertOptions(datetime_style="epoch"),
+            )
+        assert str(cm.value) == "time '07:32:00' has no date for a Unix timestamp"
+
+    def test_unchanged_output_not_rewritten(self, tmp_path) -> None:
+        output_path = tmp_path / "output.json"
+        output_path.write_bytes(read_file("example.json"))
+        os.utime(output_path, (0, 0))
+
+        run(
+            "json2json",
+            "--json-indent",
+            "4",
+            "-i",
+            data_file_path("example.json"),
+            "-o",
+            str(output_path),
+        )
+
+        assert output_path.stat().st_mtime == 0
+
+    def test_changed_output_rewritten(self, tmp_path) -> None:
+        output_path = tmp_path / "output.json"
+        output_path.write_bytes(b"{}\n")
+        os.utime(output_path, (0, 0))
+
+        run("json2json", "-i", data_file_path("array.json"), "-o", str(output_path))
+
+        assert output_path.stat().st_mtime != 0
+        assert output_path.read_bytes() == read_file("array.json")
+
+    def test_force_rewrites_unchanged_output(self, tmp_path) -> None:
+        output_path = tmp_path / "output.json"
+        output_path.write_bytes(read_file("array.json"))
+        os.utime(output_path, (0, 0))
+
+        run(
+            "json2json",
+            "--force",
+            "-i",
+            data_file_path("array.json"),
+            "-o",
+            str(output_path),
+        )
+
+        assert output_path.stat().st_mtime != 0
+
+    def test_in_place(self, tmp_path) -> None:
+        path = tmp_path / "data.json"
+        path.write_bytes(read_file("example.json"))
+
+        run("json2json", "-i", str(path), "-o", str(path))
+
+        assert json.loads(path.read_bytes()) == json.loads(read_file("example.json"))
+
+    def test_invalid_utf8(self, tmp_path) -> None:
+        for input_format in ("json", "toml", "yaml"):
+            input_path = tmp_path / "input"
+            input_path.write_bytes(b'a = "b"\nc = "\xffd"\n')
+
+            with pytest.raises(remarshal.DecodeError) as cm:
+                run(f"{input_format}2json", "-i", str(input_path))
+
+            cm.match("invalid UTF-8 at byte offset 13")
+            assert cm.value.line == 2
+
+    def test_sanitize_utf8(self, tmp_path) -> None:
+        input_path = tmp_path / "input.json"
+        input_path.write_bytes(b'{"a": "b\xc3(c"}')
+        output_filename = str(tmp_path / "output.json")
+
+        run(
+            "json2json", "--sanitize-utf8", "-i", str(input_path), "-o", output_filename
+        )
+
+        assert read_file(output_filename) == '{"a":"b\ufffd(c"}\n'.encode()
+
+    def test_sanitize_utf8_cbor(self, tmp_path) -> None:
+        input_path = tmp_path / "input.cbor"
+        # A map with a text string value that contains an invalid byte.
+        input_path.write_bytes(b"\xa1\x61a\x63b\xffc")
+        output_filename = str(tmp_path / "output.json")
+
+        with pytest.raises(ValueError):
+            run("cbor2json", "-i", str(input_path), "-o", output_filename)
+
+        run(
+            "cbor2json", "--sanitize-utf8", "-i", str(input_path), "-o", output_filename
+        )
+
+        assert read_file(output_filename) == '{"a":"b\ufffdc"}\n'.encode()
+
+    def test_sample(self, tmp_path) -> None:
+        cases = [
+            (10, 1, [0]),
+            (10, 2, [0, 9]),
+            (10, 4, [0, 3, 6, 9]),
+            (10, 10, list(range(10))),
+            (3, 5, [0, 1, 2]),
+            (0, 3, []),
+        ]
+        for size, n, reference in cases:
+            input_path = tmp_path / "input.json"
+            input_path.write_text(json.dumps(list(range(size))))
+            output_path = tmp_path / "output.json"
+
+            run(
+                "json2json",
+                "--sample",
+                str(n),
+                "-i",
+                str(input_path),
+                "-o",
+                str(output_path),
+            )
+
+            assert json.loads(output_path.read_bytes()) == reference
+
+    def test_sample_map(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "example.json", "json", "json", json_indent=None, sample=2
+        )
+        assert list(json.loads(output)) == ["title", "products"]
+
+    def test_sample_unwrap(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "example.json",
+            "json",
+            "json",
+            json_indent=None,
+            sample=1,
+            unwrap="products",
+        )
+        assert json.loads(output) == [{"name": "Hammer", "sku": 738594937}]
+
+    def test_sample_invalid(self) -> None:
+        with pytest.raises(SystemExit) as cm:
+            _parse_command_line(["json2json", "--sample", "0"])
+        assert cm.value.code == 2
+
+    def test_toml_preserve_inline(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "inline-table.toml", "toml", "toml", toml_preserve_inline=True
+        )
+        reference = read_file("inline-table.toml")
+        assert output == reference
+
+    def test_toml_preserve_inline_moved(self) -> None:
+        for input_data, options in [
+            (b"a.p = {x = 1}\n", {"unwrap": "a"}),
+            (b"a.p = {x = 1}\n", {"unwrap_pointer": "/a"}),
+            (b"p = {x = 1}\n", {"wrap": "a"}),
+            (b"p = {x = 1}\n", {"flatten": True}),
+        ]:
+            output = remarshal.convert(
+                "toml",
+                "toml",
+                input_data,
+                ConvertOptions(toml_preserve_inline=True, **options),
+            )
+            expected = b'"p.x" = 1' if options.get("flatten") else b"p = {x = 1}"
+            assert expected in output
+            assert b"[p]" not in output
+
+    def test_toml_inline_expanded_by_default(self, convert_and_read) -> None:
+        output = convert_and_read("inline-table.toml", "toml", "toml")
+        assert b"[point]\n" in output
+        assert b"{" not in output
+
+    def test_toml_preserve_inline_not_toml(self, convert_and_read) -> None:
+        with pytest.raises(ValueError):
+            convert_and_read(
+                "inline-table.toml", "toml", "json", toml_preserve_inline=True
+            )
+
+    def test_cheader(self, convert_and_read) -> None:
+        output = convert_and_read("cheader.json", "json", "cheader", c_prefix="CONFIG_")
+        reference = read_file("cheader.h")
+        assert output == reference
+
+    def test_cheader_extension(self, tmp_path) -> None:
+        output_filename = str(tmp_path / "config.h")
+        run(sys.argv[0], data_file_path("cheader.json"), output_filename)
+        assert read_file(output_filename).startswith(b"#define PORT 8080\n")
+
+    def test_cheader_null(self, convert_and_read) -> None:
+        with pytest.raises(ValueError):
+            convert_and_read("numeric-key-null-value.yaml", "yaml", "cheader")
+
+    def test_cheader_empty_key(self) -> None:
+        with pytest.raises(remarshal.EncodeError) as cm:
+            remarshal.convert("json", "cheader", b'{"": 1}')
+        assert "an empty key has no macro name" in str(cm.value)
+
+        output = remarshal.convert(
+            "json", "cheader", b'{"": 1}', ConvertOptions(c_prefix="CONFIG")
+        )
+        assert output == b"#define CONFIG 1\n"
+
+    def test_cheader_not_input_format(self) -> None:
+        with pytest.raises(SystemExit) as cm:
+            _parse_command_line([sys.argv[0], "input.h", "output.json"])
+        assert cm.value.code == 2
+
+    def test_watch(self, tmp_path) -> None:
+        input_path = tmp_path / "input.json"
+        output_path = tmp_path / "output.yaml"
+        input_path.write_bytes(b'{"foo": 1}')
+        stop = threading.Event()
+
+        def callback() -> None:
+            remarshal.remarshal("json", "yaml", input_path, output_path)
+            stop.set()
+
+        thread = threading.Thread(
+            target=_watch,
+            args=(input_path, callback),
+            kwargs={"debounce": 0.05, "interval": 0.01, "stop": stop},
+        )
+        thread.start()
+        time.sleep(0.1)
+        input_path.write_bytes(b'{"foo": 2}')
+        thread.join(timeout=5)
+
+        assert stop.is_set()
+        assert output_path.read_bytes() == b"foo: 2\n"
+
+    def test_watch_debounce(self, tmp_path) -> None:
+        input_path = tmp_path / "input.json"
+        input_path.write_bytes(b"")
+        calls = []
+        stop = threading.Event()
+
+        thread = threading.Thread(
+            target=_watch,
+            args=(input_path, lambda: calls.append(input_path.read_bytes())),
+            kwargs={"debounce": 0.2, "interval": 0.01, "stop": stop},
+        )
+        thread.start()
+        for i in range(5):
+            time.sleep(0.02)
+            input_path.write_bytes(b"x" * (i + 1))
+        time.sleep(0.5)
+        stop.set()
+        thread.join(timeout=5)
+
+        assert calls == [b"xxxxx"]
+
+    def test_watch_stdin(self) -> None:
+        with pytest.raises(SystemExit) as cm:
+            _parse_command_line([sys.argv[0], "--watch", "--of", "json"])
+        assert cm.value.code == 2
+
+    def test_coerce(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "coerce.json",
+            "json",
+            "json",
+            coerce={
+                "enabled": "bool",
+                "port": "int",
+                "ratio": "float",
+                "servers.0.port": "int",
+                "version": "string",
+            },
+        )
+        assert json.loads(output) == {
+            "port": 8080,
+            "enabled": True,
+            "version": "1.2",
+            "ratio": 0.5,
+            "servers": [{"host": "example.com", "port": 443}],
+        }
+
+    def test_coerce_cli(self, tmp_path) -> None:
+        output_filename = str(tmp_path / "output.json")
+        run(
+            "json2json",
+            "--coerce",
+            "port=int,enabled=bool",
+            "--coerce",
+            "version=string",
+            data_file_path("coerce.json"),
+            output_filename,
+        )
+        output = json.loads(read_file(output_filename))
+        assert (output["port"], output["enabled"], output["version"]) == (
+            8080,
+            True,
+            "1.2",
+        )
+
+    def test_coerce_impossible(self, convert_and_read) -> None:
+        with pytest.raises(ValueError) as cm:
+            convert_and_read("coerce.json", "json", "json", coerce={"port": "bool"})
+        assert str(cm.value) == "cannot coerce '8080' to bool at path 'port'"
+
+    def test_coerce_missing_path(self, convert_and_read) -> None:
+        with pytest.raises(ValueError) as cm:
+            convert_and_read(
+                "coerce.json", "json", "json", coerce={"servers.1.port": "int"}
+            )
+        assert str(cm.value) == "no value at path 'servers.1.port'"
+
+    def test_coerce_escaped_dot(self) -> None:
+        output = remarshal.convert(
+            "json",
+            "json",
+            b'{"a.b": "1", "a": {"b": "2"}}',
+            ConvertOptions(coerce={"a\\.b": "int"}),
+        )
+        assert json.loads(output) == {"a.b": 1, "a": {"b": "2"}}
+
+    def test_coerce_unknown_type(self) -> None:
+        with pytest.raises(SystemExit) as cm:
+            _parse_command_line([sys.argv[0], "--coerce", "port=integer"])
+        assert cm.value.code == 2
+
+    def test_cue_vet(self, monkeypatch, tmp_path) -> None:
+        # A fake "cue" that accepts data with a "name".
+        cue = tmp_path / "cue"
+        cue.write_text(
+            f"#!{sys.executable}\n"
+            "import json, sys\n"
+            "args = ['vet', '-d', '#Config', 'schema.cue', 'json:', '-']\n"
+            "assert sys.argv[1:] == args\n"
+            "if 'name' not in json.load(sys.stdin):\n"
+            "    sys.exit('name: incomplete value string')\n"
+        )
+        cue.chmod(0o755)
+        monkeypatch.setenv("PATH", str(tmp_path))
+
+        output = remarshal.convert(
+            "json",
+            "yaml",
+            b'{"name": "web"}',
+            ConvertOptions(cue_schema="schema.cue#Config"),
+        )
+        assert output == b"name: web\n"
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "json", "yaml", b"{}", ConvertOptions(cue_schema="schema.cue#Config")
+            )
+        assert str(cm.value) == (
+            "Data does not match CUE schema 'schema.cue#Config':\n"
+            "name: incomplete value string"
+        )
+
+    def test_cue_vet_missing(self, monkeypatch, tmp_path) -> None:
+        monkeypatch.setenv("PATH", str(tmp_path))
+        with pytest.raises(OSError) as cm:
+            remarshal.convert(
+                "json", "json", b"{}", ConvertOptions(cue_schema="schema.cue")
+            )
+        assert 'requires the program "cue"' in str(cm.value)
+
+    def test_cast_schema(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "config.ini",
+            "ini",
+            "json",
+            cast_schema=json.loads(read_file("cast-schema.json")),
+        )
+        assert json.loads(output) == {
+            "name": "demo",
+            "debug": False,
+            "server": {
+                "host": "example.com",
+                "port": 8080,
+                "zip": "02134",
+                "ratio": 0.5,
+                "motd": "Hello,\nworld!",
+            },
+            "DEFAULT": {"timeout": 30},
+        }
+
+    def test_cast_schema_union(self) -> None:
+        schema = {
+            "type": "array",
+            "prefixItems": [{"type": "number"}, {"type": ["null", "boolean"]}],
+            "items": {"anyOf": [{"type": "integer"}, {"type": "string"}]},
+        }
+        output = remarshal.convert(
+            "json",
+            "json",
+            b'["1.5", "", "7", "x", 2]',
+            ConvertOptions(cast_schema=schema),
+        )
+        assert output == b'[1.5,null,7,"x",2]\n'
+
+    def test_cast_schema_union_siblings(self) -> None:
+        schema = {
+            "type": "object",
+            "properties": {
+                "a": {"type": "integer"},
+                "b": {"type": "integer", "oneOf": [{"minimum": 0}, {"const": -1}]},
+            },
+            "anyOf": [{"required": ["a"]}, {"required": ["b"]}],
+        }
+        for input_data, expected in (
+            (b'{"a": "1"}', {"a": 1}),
+            (b'{"b": "-1"}', {"b": -1}),
+        ):
+            output = remarshal.convert(
+                "json", "json", input_data, ConvertOptions(cast_schema=schema)
+            )
+            assert json.loads(output) == expected
+
+    def test_cast_schema_impossible(self) -> None:
+        schema = {"properties": {"a": {"items": {"type": "integer"}}}}
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "json", "json", b'{"a": ["1", "b"]}', ConvertOptions(cast_schema=schema)
+            )
+        assert str(cm.value) == "cannot coerce 'b' to int at path 'a.1'"
+
+    def test_cast_schema_recursive(self) -> None:
+        schema = {
+            "$ref": "#/$defs/node",
+            "$defs": {
+                "node": {
+                    "properties": {
+                        "n": {"type": "integer"},
+                        "children": {"items": {"$ref": "#/$defs/node"}},
+                    }
+                }
+            },
+        }
+        input_data = b'{"n": "1", "children": [{"n": "2", "children": []}]}'
+        output = remarshal.convert(
+            "json", "json", input_data, ConvertOptions(cast_schema=schema)
+        )
+        assert json.loads(output) == {"n": 1, "children": [{"n": 2, "children": []}]}
+
+    def test_select_type(self, convert_and_read) -> None:
+        servers = json.loads(read_file("select-type.json"))["servers"]
+        expected = {
+            "array": {"servers": servers, "tags": ["web", "prod"]},
+            "bool": {"debug": False, "servers": [{"tls": True}]},
+            "null": {"proxy": None, "servers": [{"backup": None}]},
+            "number": {"timeout": 30, "servers": [{"port": 80}]},
+            "object": {"servers": servers, "limits": {}},
+            "string": {
+                "name": "app",
+                "servers": [{"host": "a.example.com"}, {"host": "b.example.com"}],
+                "tags": ["web", "prod"],
+            },
+        }
+
+        for type_name, reference in expected.items():
+            output = convert_and_read(
+                "select-type.json", "json", "json", select_type=type_name
+            )
+            assert json.loads(output) == reference, type_name
+
+    def test_select_type_flatten(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "select-type.json", "json", "json", flatten=True, select_type="null"
+        )
+        assert json.loads(output) == {"proxy": None, "servers.1.backup": None}
+
+    def test_select_type_none(self, convert_and_read) -> None:
+        output = convert_and_read("array.json", "json", "json", select_type="null")
+        assert json.loads(output) == []
+
+    def test_from_schema(self, convert_and_read) -> None:
+        output = convert_and_read("schema.json", "json", "json", from_schema=True)
+        assert json.loads(output) == {
+            "name": "",
+            "port": 8080,
+            "server": {"host": "localhost"},
+        }
+
+    def test_from_schema_all_properties(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "schema.json", "json", "json", all_properties=True, from_schema=True
+        )
+        assert json.loads(output) == {
+            "name": "",
+            "port": 8080,
+            "debug": False,
+            "ratio": 0.0,
+            "level": "info",
+            "tags": [],
+            "server": {"host": "localhost", "tls": True},
+        }
+
+    def test_from_schema_recursive(self) -> None:
+        schema = {
+            "$defs": {
+                "node": {
+                    "type": "object",
+                    "required": ["children"],
+                    "properties": {
+                        "children": {
+                            "type": "array",
+                            "minItems": 1,
+                            "items": {"$ref": "#/$defs/node"},
+                        }
+                    },
+                }
+            },
+            "$ref": "#/$defs/node",
+        }
+        output = remarshal.convert(
+            "json",
+            "json",
+            json.dumps(schema).encode("utf-8"),
+            ConvertOptions(from_schema=True),
+        )
+        assert json.loads(output) == {"children": [None]}
+
+    def test_from_schema_bad_ref(self) -> None:
+        schema = b'{"$ref": "other.json#/foo"}'
+        with pytest.raises(ValueError):
+            remarshal.convert("json", "json", schema, ConvertOptions(from_schema=True))
+
+    def test_dedup_arrays(self, convert_and_read) -> None:
+        output = convert_and_read("dedup.json", "json", "json", dedup_arrays=True)
+        reference = json.loads(read_file("dedup.json"))
+        assert json.loads(output) == {
+            **reference,
+            "plugins": ["auth", "cache", "log"],
+            "ports": [80, 443, True, 1],
+            "nested": {"tags": ["x"]},
+        }
+
+    def test_dedup_objects(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "dedup.json", "json", "json", dedup_arrays=True, dedup_objects=True
+        )
+        assert json.loads(output) == {
+            "plugins": ["auth", "cache", "log"],
+            "ports": [80, 443, True, 1],
+            "nested": {"tags": ["x"]},
+            "servers": [{"host": "a", "port": 1}, {"host": "b"}],
+            "matrix": [[1, 2]],
+        }
+
+    def test_xml_decode(self, convert_and_read) -> None:
+        output = convert_and_read("config.xml", "xml", "json")
+        reference = read_file("config-xml.json")
+        assert json.loads(output) == json.loads(reference)
+
+    def test_xml_round_trip(self, convert_and_read) -> None:
+        output = convert_and_read("config.xml", "xml", "xml")
+        assert remarshal.decode("xml", output) == json.loads(
+            read_file("config-xml.json")
+        )
+
+    def test_xml_encode(self) -> None:
+        output = remarshal.convert(
+            "json", "xml", b'{"items": {"a": "b", "c": [1, 2, 3]}}'
+        )
+        assert output == (
+            b'<?xml version="1.0" encoding="UTF-8"?>\n'
+            b"<items>\n"
+            b"  <a>b</a>\n"
+            b"  <c>1</c>\n"
+            b"  <c>2</c>\n"
+            b"  <c>3</c>\n"
+            b"</items>\n"
+        )
+
+    def test_xml_encode_no_root(self, convert_and_read) -> None:
+        with pytest.raises(TypeError):
+            convert_and_read("array.json", "json", "xml")
+        with pytest.raises(ValueError):
+            convert_and_read("array.json", "json", "xml", wrap="items")
+
+    def test_xml_encode_bad_name(self, convert_and_read) -> None:
+        with pytest.raises(ValueError):
+            convert_and_read("numeric-key-null-value.yaml", "yaml", "xml", wrap="x")
+
+    def test_xml_decode_error(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("xml", b"<a>\n<b></a>")
+        assert cm.value.line == 2
+
+    def test_hcl_encode(self, convert_and_read) -> None:
+        output = convert_and_read("hcl.json", "json", "hcl", hcl_expressions=True)
+        reference = read_file("hcl.tf")
+        assert output == reference
+
+    def test_hcl_encode_templates(self) -> None:
+        output = remarshal.convert(
+            "json", "hcl", b'{"a": "${var.x}", "b": "%{ if x }y", "c": "$5"}'
+        )
+        assert output == b'a = "$${var.x}"\nb = "%%{ if x }y"\nc = "$5"\n'
+
+    def test_hcl_decode(self, convert_and_read) -> None:
+        output = convert_and_read("hcl.tf", "hcl", "json")
+        reference = read_file("hcl.json")
+        assert json.loads(output) == json.loads(reference)
+
+    def test_hcl_extension(self, tmp_path) -> None:
+        output_filename = str(tmp_path / "terraform.tfvars")
+        run(sys.argv[0], data_file_path("hcl.json"), output_filename)
+        assert read_file(output_filename).startswith(b'region = "us-east-1"\n')
+
+    def test_hcl_bad_attribute_name(self) -> None:
+        with pytest.raises(ValueError):
+            remarshal.convert("json", "hcl", b'{"not valid": 1}')
+
+    def test_json5(self, convert_and_read) -> None:
+        output = convert_and_read("config.json5", "json5", "json")
+        reference = read_file("config-json5.json")
+        assert json.loads(output) == json.loads(reference)
+
+    def test_json5_error(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("json5", b"{\n  a: 1,\n  b: }\n")
+        assert cm.value.line == 3
+
+    def test_json5_not_output_format(self) -> None:
+        with pytest.raises(SystemExit) as cm:
+            _parse_command_line([sys.argv[0], "input.json", "output.json5"])
+        assert cm.value.code == 2
+
+    def test_hjson_decode(self, convert_and_read) -> None:
+        output = convert_and_read("config.hjson", "hjson", "json")
+        reference = read_file("config-hjson.json")
+        assert json.loads(output) == json.loads(reference)
+
+    def test_hjson_round_trip(self, convert_and_read) -> None:
+        output = convert_and_read("config-hjson.json", "json", "hjson")
+        reference = read_file("config-hjson.json")
+        assert remarshal.decode("hjson", output) == json.loads(reference)
+
+    def test_hjson_date(self, convert_and_read) -> None:
+        with pytest.raises(ValueError):
+            convert_and_read("date.toml", "toml", "hjson")
+
+        output = convert_and_read("date.toml", "toml", "hjson", stringify=True)
+        assert b"2012-12-12" in output
+
+    def test_ini_decode(self, convert_and_read) -> None:
+        output = convert_and_read("config.ini", "ini", "json")
+        reference = read_file("config-ini.json")
+        assert json.loads(output) == json.loads(reference)
+
+    def test_ini_infer_types(self, convert_and_read) -> None:
+        output = convert_and_read("config.ini", "ini", "json", infer_types=True)
+        doc = json.loads(output)
+        assert doc["debug"] is False
+        assert doc["server"]["port"] == 8080
+        assert doc["server"]["ratio"] == 0.5
+        assert doc["server"]["zip"] == "02134"
+
+    def test_ini_encode(self, convert_and_read) -> None:
+        output = convert_and_read("config-ini.json", "json", "ini")
+        reference = read_file("config-normalized.ini")
+        assert output == reference
+
+    def test_ini_encode_nested(self, convert_and_read) -> None:
+        with pytest.raises(ValueError):
+            convert_and_read("example.json", "json", "ini")
+
+    def test_ini_round_trip(self) -> None:
+        doc = {"a": {"b": "c\nd e", "f": "", "g": "#h", "i": "j; k"}}
+        output = remarshal.encode("ini", doc)
+        assert remarshal.decode("ini", output) == doc
+
+    def test_ini_encode_unsafe_value(self) -> None:
+        for value in ["a ", " a", "a\r\nb", "a\x0bb", "a\x1cb", "a\n\nb", "a\n#b"]:
+            with pytest.raises(remarshal.EncodeError) as cm:
+                remarshal.encode("ini", {"a": value})
+            assert "would not read back the same" in str(cm.value)
+
+    def test_ini_duplicate_key(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("ini", b"[a]\nb = 1\nb = 2\n")
+        assert cm.value.line == 3
+
+    def test_properties_decode(self, convert_and_read) -> None:
+        output = convert_and_read("config.properties", "properties", "json")
+        reference = read_file("config-properties.json")
+        assert json.loads(output) == json.loads(reference)
+
+    def test_properties_encode(self, convert_and_read) -> None:
+        output = convert_and_read("config-properties.json", "json", "properties")
+        reference = read_file("config-normalized.properties")
+        assert output == reference
+
+    def test_properties_iso_8859_1(self) -> None:
+        doc = remarshal.decode("properties", "name = Gr\xfc\xdfe\n".encode("latin-1"))
+        assert doc == {"name": "Grüße"}
+
+    def test_properties_conflict(self) -> None:
+        for input_data, message in [
+            (b"a = 1\nb = 2\na.b = 3\n", "key 'a.b' conflicts with key 'a' on line 1"),
+            (b"a.b.c = 1\n\na.b = 2\n", "key 'a.b' conflicts with key 'a.b.c'"),
+        ]:
+            with pytest.raises(remarshal.DecodeError) as cm:
+                remarshal.decode("properties", input_data)
+            assert message in str(cm.value)
+            assert cm.value.line == 3
+
+    def test_properties_dotted_key(self) -> None:
+        for input_data in (b'{"a.b": "x"}', b'{"a": [{"b.c": "x"}]}'):
+            with pytest.raises(remarshal.EncodeError) as cm:
+                remarshal.convert("json", "properties", input_data)
+            assert "contains a dot" in str(cm.value)
+
+        # The keys from --flatten are meant to have dots.
+        output = remarshal.convert(
+            "json",
+            "properties",
+            b'{"a": {"b": [1]}}',
+            ConvertOptions(flatten=True, flatten_style="bracket"),
+        )
+        assert output == b"a.b[0]=1\n"
+
+    def test_properties_bad_escape(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("properties", b"a = 1\nb = \\u12\n")
+        assert cm.value.line == 2
+
+    @needs_bson
+    def test_bson_native(self, convert_and_read) -> None:
+        output = convert_and_read("mongo.bson", "bson", "yaml")
+        assert remarshal.decode("yaml", output) == {
+            "_id": "5f43a1b2c3d4e5f6a7b8c9d0",
+            "name": "demo",
+            "created": datetime.datetime(
+                2020, 1, 2, 3, 4, 5, tzinfo=datetime.timezone.utc
+            ),
+            "data": b"\x00\x01",
+            "count": 5,
+        }
+
+    @needs_bson
+    def test_bson_string(self, convert_and_read) -> None:
+        output = convert_and_read("mongo.bson", "bson", "json", bson_types="string")
+        assert json.loads(output) == {
+            "_id": "5f43a1b2c3d4e5f6a7b8c9d0",
+            "name": "demo",
+            "created": "2020-01-02T03:04:05+00:00",
+            "data": "AAE=",
+            "count": 5,
+        }
+
+    @needs_bson
+    def test_bson_extended(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "mongo.bson", "bson", "json", bson_types="extended"
+        )
+        reference = read_file("mongo-extended.json")
+        assert json.loads(output) == json.loads(reference)
+
+    @needs_bson
+    def test_bson_encode_extended(self, convert_and_read) -> None:
+        output = convert_and_read("mongo-extended.json", "json", "bson")
+        reference = read_file("mongo.bson")
+        assert output == reference
+
+    @needs_bson
+    def test_bson_multiple_documents(self) -> None:
+        data = read_file("mongo.bson") * 2
+        output = remarshal.convert(
+            "bson", "json", data, ConvertOptions(bson_types="string")
+        )
+        assert len(json.loads(output)) == 2
+
+    @needs_bson
+    def test_bson_not_map(self) -> None:
+        with pytest.raises(TypeError) as cm:
+            remarshal.convert("json", "bson", b"[1, 2]")
+        assert "cannot be encoded as BSON" in str(cm.value)
+
+    def test_plist_decode(self, convert_and_read) -> None:
+        output = convert_and_read("launch-agent.plist", "plist", "yaml")
+        assert remarshal.decode("yaml", output) == {
+            "Label": "com.example.backup",
+            "ProgramArguments": ["/usr/local/bin/backup", "--quiet"],
+            "RunAtLoad": True,
+            "StartInterval": 3600,
+            "Nice": 1.5,
+            "Created": datetime.datetime(
+                2024, 1, 2, 3, 4, 5, tzinfo=datetime.timezone.utc
+            ),
+            "Token": b"\x00\x01\x02",
+        }
+
+    def test_plist_round_trip(self, convert_and_read) -> None:
+        output = convert_and_read("launch-agent.plist", "plist", "plist")
+        reference = read_file("launch-agent.plist")
+        assert output == reference
+
+    def test_plist_binary(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "launch-agent.plist", "plist", "plist", plist_format="binary"
+        )
+        assert output.startswith(b"bplist00")
+        assert remarshal.decode("plist", output) == remarshal.decode(
+            "plist", read_file("launch-agent.plist")
+        )
+
+    def test_plist_time_zone(self) -> None:
+        output = remarshal.convert(
+            "toml",
+            "plist",
+            b"t = 2024-01-02T05:04:05+02:00",
+            ConvertOptions(sort_keys=False),
+        )
+        assert b"<date>2024-01-02T03:04:05Z</date>" in output
+
+    def test_plist_null(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("json", "plist", b'{"a": null}')
+        assert "Cannot convert data to property list" in str(cm.value)
+
+    def test_plist_error(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.decode("plist", b"<plist><dict><key>a</key></plist>")
+        assert "Cannot parse as property list" in str(cm.value)
+
+    def test_csv(self, convert_and_read) -> None:
+        output = convert_and_read("table.json", "json", "csv")
+        reference = read_file("table.csv")
+        assert output == reference
+
+    def test_csv_columns(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "table.json", "json", "csv", csv_columns=["email", "name"], sort_keys=True
+        )
+        assert output.splitlines()[0] == b"email,name,admin,age,note"
+
+    def test_csv_delimiter(self, convert_and_read) -> None:
+        output = convert_and_read("table.json", "json", "csv", csv_delimiter="\t")
+        assert output.splitlines()[3] == b"Carol, Jr.\t41.5\t\t\t\"said \"\"hi\"\"\""
+
+    def test_csv_delimiter_cli(self) -> None:
+        args = _parse_command_line(
+            ["remarshal", "-if", "json", "-of", "csv", "--csv-delimiter", "\\t"]
+        )
+        assert args.csv_delimiter == "\t"
+
+    def test_csv_nested(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("json", "csv", b'[{"a": 1}, {"a": [1]}]')
+        assert "not supported (row 2)" in str(cm.value)
+
+    def test_csv_not_array(self, convert_and_read) -> None:
+        with pytest.raises(TypeError):
+            convert_and_read("example.toml", "toml", "csv")
+
+    def test_csv_decode(self, convert_and_read) -> None:
+        output = convert_and_read("table.csv", "csv", "json")
+        assert json.loads(output) == [
+            {"name": "Alice", "age": "30", "admin": "true", "email": "", "note": ""},
+            {
+                "name": "Bob",
+                "age": "",
+                "admin": "",
+                "email": "bob@example.com",
+                "note": "",
+            },
+            {
+                "name": "Carol, Jr.",
+                "age": "41.5",
+                "admin": "",
+                "email": "",
+                "note": 'said "hi"',
+            },
+        ]
+
+    def test_tsv_infer_types(self, convert_and_read) -> None:
+        output = convert_and_read("table.tsv", "tsv", "json", infer_types=True)
+        assert json.loads(output) == [
+            {
+                "id": 1,
+                "name": "Alice",
+                "zip": "02134",
+                "score": 9.5,
+                "active": True,
+                "note": None,
+            },
+            {
+                "id": 2,
+                "name": "Bob",
+                "zip": 10001,
+                "score": None,
+                "active": False,
+                "note": "tab\tinside",
+            },
+        ]
+
+    def test_tsv_round_trip(self, convert_and_read) -> None:
+        output = convert_and_read("table.tsv", "tsv", "tsv")
+        reference = read_file("table.tsv")
+        assert output == reference
+
+    def test_csv_delimiter_decode(self) -> None:
+        output = remarshal.convert(
+            "csv",
+            "json",
+            b"a;b\n1;2\n",
+            ConvertOptions(csv_delimiter=";", json_indent=None),
+        )
+        assert json.loads(output) == [{"a": "1", "b": "2"}]
+
+    def test_csv_blank_lines(self) -> None:
+        doc = remarshal.decode("csv", b"a,b\n1,2\n\n3,4\n")
+        assert doc == [{"a": "1", "b": "2"}, {"a": "3", "b": "4"}]
+
+    def test_csv_bom(self) -> None:
+        doc = remarshal.decode("csv", b"\xef\xbb\xbfa\n1\n")
+        assert doc == [{"a": "1"}]
+
+    def test_csv_field_count(self) -> None:
+        for input_data, line, message in [
+            (b"a,b\n1,2\n1,2,3\n", 3, "row has 3 fields but header has 2"),
+            (b"a,b\n1,2\n\n1\n", 4, "row has 1 fields but header has 2"),
+        ]:
+            with pytest.raises(remarshal.DecodeError) as cm:
+                remarshal.decode("csv", input_data)
+            assert cm.value.line == line
+            assert message in str(cm.value)
+
+    def test_csv_duplicate_column(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("csv", b"a,b,a\n")
+        assert "duplicate column 'a'" in str(cm.value)
+
+    def test_cue(self, convert_and_read) -> None:
+        output = convert_and_read("cue.json", "json", "cue")
+        reference = read_file("cue.cue")
+        assert output == reference
+
+    def test_cue_bytes(self) -> None:
+        output = remarshal.convert("yaml", "cue", b"data: !!binary AAFcJw==")
+        assert output == b"data: '\\x00\\x01\\x5c\\x27'\n"
+
+    def test_cue_top_level_array(self) -> None:
+        output = remarshal.convert("json", "cue", b"[1, [2], {}]")
+        assert output == b"[\n\t1,\n\t[2],\n\t{},\n]\n"
+
+    def test_cue_non_finite(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("toml", "cue", b"x = nan")
+        assert "Cannot convert data to CUE" in str(cm.value)
+
+    def test_nestedtext_decode(self, convert_and_read) -> None:
+        output = convert_and_read("config.nt", "nestedtext", "json")
+        reference = read_file("config-nt.json")
+        assert json.loads(output) == json.loads(reference)
+
+    def test_nestedtext_infer_types(self, convert_and_read) -> None:
+        output = convert_and_read("config.nt", "nestedtext", "json", infer_types=True)
+        doc = json.loads(output)
+        assert doc["port"] == 8080
+        assert doc["debug"] is False
+        assert doc["servers"][0]["zip"] == "02134"
+
+    def test_nestedtext_encode(self) -> None:
+        output = remarshal.convert(
+            "json",
+            "nestedtext",
+            b'{"name": "web", "port": 8080, "debug": true, "owner": null, '
+            b'"tags": ["a", "b"], "db": {"host": "localhost"}}',
+            ConvertOptions(sort_keys=False),
+        )
+        assert output == (
+            b"name: web\n"
+            b"port: 8080\n"
+            b"debug: true\n"
+            b"owner:\n"
+            b"tags:\n"
+            b"    - a\n"
+            b"    - b\n"
+            b"db:\n"
+            b"    host: localhost\n"
+        )
+
+    def test_nestedtext_error(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("nestedtext", b"a: 1\n  b: 2\n")
+        assert cm.value.line == 2
+        assert "Cannot parse as NestedText" in str(cm.value)
+
+    def test_json_canonical(self) -> None:
+        # The examples from RFC 8785, sections 3.2.2 and 3.2.3.
+        input_data = (
+            b'{"numbers": [333333333.33333329, 1E30, 4.50, 2e-3, '
+            b"0.000000000000000000000000001],"
+            b' "string": "\\u20ac$\\u000F\\u000aA\'\\u0042\\u0022\\u005c\\\\\\"\\/",'
+            b' "literals": [null, true, false]}'
+        )
+        output = remarshal.convert(
+            "json", "json", input_data, ConvertOptions(json_canonical=True)
+        )
+        assert output == (
+            '{"literals":[null,true,false],'
+            '"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],'
+            '"string":"€$\\u000f\\nA\'B\\"\\\\\\\\\\"/"}'
+        ).encode()
+
+        input_data = (
+            b'{"\\u20ac": 1, "\\r": 2, "\\ufb33": 3, "1": 4, '
+            b'"\\ud83d\\ude00": 5, "\\u0080": 6, "\\u00f6": 7}'
+        )
+        output = remarshal.convert(
+            "json", "json", input_data, ConvertOptions(json_canonical=True)
+        )
+        assert list(json.loads(output)) == [
+            "\r",
+            "1",
+            "\u0080",
+            "\u00f6",
+            "\u20ac",
+            "\U0001f600",
+            "\ufb33",
+        ]
+
+    def test_json_canonical_errors(self) -> None:
+        for input_data in (b"[9007199254740993]", b"[1" + b"0" * 400 + b"]"):
+            with pytest.raises(remarshal.EncodeError) as cm:
+                remarshal.convert(
+                    "json", "json", input_data, ConvertOptions(json_canonical=True)
+                )
+            assert "cannot be represented exactly" in str(cm.value)
+
+        with pytest.raises(remarshal.EncodeError):
+            remarshal.convert(
+                "toml", "json", b"a = 1979-05-27", ConvertOptions(json_canonical=True)
+            )
+        output = remarshal.convert(
+            "toml",
+            "json",
+            b"a = 1979-05-27",
+            ConvertOptions(json_canonical=True, stringify=True),
+        )
+        assert output == b'{"a":"1979-05-27"}'
+
+    def test_json_canonical_cli(self) -> None:
+        args = _parse_command_line([sys.argv[0], "--canonical", "in.yaml", "out.json"])
+        assert args.json_canonical
+
+    def test_json_non_finite(self) -> None:
+        input_data = b"a = nan\nb = inf\nc = -inf\nd = 1.5\n"
+
+        with pytest.raises(remarshal.EncodeError) as cm:
+            remarshal.convert("toml", "json", input_data)
+        assert '"--non-finite null"' in str(cm.value)
+
+        output = remarshal.convert(
+            "toml",
+            "json",
+            input_data,
+            ConvertOptions(json_indent=None, json_non_finite="null"),
+        )
+        assert output == b'{"a":null,"b":null,"c":null,"d":1.5}\n'
+
+        output = remarshal.convert(
+            "toml",
+            "json",
+            input_data,
+            ConvertOptions(json_indent=None, json_non_finite="string"),
+        )
+        assert output == b'{"a":"NaN","b":"Infinity","c":"-Infinity","d":1.5}\n'
+
+    def test_json_non_finite_other_json(self) -> None:
+        output = remarshal.convert(
+            "yaml", "jsonl", b"- .nan\n- 1\n", ConvertOptions(json_non_finite="null")
+        )
+        assert output == b"null\n1\n"
+
+        output = remarshal.convert(
+            "yaml",
+            "json",
+            b"- -.inf\n",
+            ConvertOptions(json_canonical=True, json_non_finite="string"),
+        )
+        assert output == b'["-Infinity"]'
+
+        with pytest.raises(remarshal.EncodeError) as cm:
+            remarshal.convert(
+                "yaml", "json", b"- .nan\n", ConvertOptions(json_canonical=True)
+            )
+        assert '"--non-finite string"' in str(cm.value)
+
+    def test_cbor_canonical(self) -> None:
+        # The examples from RFC 8949, appendix A.
+        output = remarshal.convert(
+            "yaml",
+            "cbor",
+            b"[1.5, 100000.0, 1.1, -0.0, .inf, .nan, 1000000, "
+            b"18446744073709551616, -18446744073709551617]",
+            ConvertOptions(cbor_canonical=True),
+        )
+        assert output.hex() == (
+            "89f93e00fa47c35000fb3ff199999999999af98000f97c00f97e00"
+            "1a000f4240c249010000000000000000c349010000000000000000"
+        )
+
+        output = remarshal.convert(
+            "yaml",
+            "cbor",
+            b"{aa: 1, b: 2, 10: 3, 100: 4, -1: 5}",
+            ConvertOptions(cbor_canonical=True),
+        )
+        assert output.hex() == "a50a03186404200561620262616101"
+
+    def test_cbor_canonical_dates(self) -> None:
+        for name in ("date", "datetime-tz"):
+            output = remarshal.convert(
+                "toml",
+                "cbor",
+                read_file(f"{name}.toml"),
+                ConvertOptions(cbor_canonical=True),
+            )
+            assert output == read_file(f"{name}.cbor")
+
+        with pytest.raises(remarshal.EncodeError) as cm:
+            remarshal.convert(
+                "toml",
+                "cbor",
+                read_file("datetime-local.toml"),
+                ConvertOptions(cbor_canonical=True),
+            )
+        assert "has no time zone" in str(cm.value)
+
+    def test_cbor_canonical_cli(self) -> None:
+        args = _parse_command_line(
+            [sys.argv[0], "--cbor-canonical", "in.yaml", "out.cbor"]
+        )
+        assert args.cbor_canonical
+
+    def test_jsonl_decode(self, convert_and_read) -> None:
+        output = convert_and_read("events.jsonl", "jsonl", "json")
+        assert json.loads(output) == [
+            {"id": 1, "event": "login", "user": "alice"},
+            {"id": 2, "event": "logout", "user": "alice", "tags": ["web"]},
+            {"id": 3, "event": "login", "user": "bob\u2028"},
+        ]
+
+    def test_jsonl_round_trip(self, convert_and_read) -> None:
+        output = convert_and_read("events.jsonl", "jsonl", "jsonl")
+        assert output.decode("utf-8").split("\n") == [
+            '{"id":1,"event":"login","user":"alice"}',
+            '{"id":2,"event":"logout","user":"alice","tags":["web"]}',
+            '{"id":3,"event":"login","user":"bob\u2028"}',
+            "",
+        ]
+
+    def test_jsonl_yaml_split(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "events.jsonl", "jsonl", "yaml", yaml_options=YAMLOptions(split=True)
+        )
+        assert output.count(b"---") == 2
+
+    def test_jsonl_error(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("jsonl", b'{"a": 1}\n{"a": }\n')
+        assert cm.value.line == 2
+        assert "line 2 column 7" in str(cm.value)
+
+    def test_jsonl_not_array(self) -> None:
+        with pytest.raises(TypeError) as cm:
+            remarshal.convert("json", "jsonl", b'{"a": 1}')
+        assert "must be an array" in str(cm.value)
+
+    def test_yaml_merge(self) -> None:
+        input_data = b"base: &base {a: 1, b: 2}\nc:\n  <<: *base\n  b: 3\n"
+
+        doc = remarshal.decode("yaml", input_data)
+        assert doc == {"base": {"a": 1, "b": 2}, "c": {"a": 1, "b": 3}}
+
+        doc = remarshal.decode("yaml", input_data, DecodeOptions(yaml_merge="keep"))
+        assert doc == {"base": {"a": 1, "b": 2}, "c": {"<<": {"a": 1, "b": 2}, "b": 3}}
+
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("yaml", input_data, DecodeOptions(yaml_merge="error"))
+        assert 'found a merge key "<<"' in str(cm.value)
+        assert cm.value.line == 3
+
+    def test_yaml_merge_keep_round_trip(self) -> None:
+        output = remarshal.convert(
+            "yaml",
+            "yaml",
+            b"a: &a {b: 1}\nc: {<<: *a}\n",
+            ConvertOptions(yaml_merge="keep"),
+        )
+        doc = remarshal.decode("yaml", output)
+        assert doc == {"a": {"b": 1}, "c": {"<<": {"b": 1}}}
+
+    def test_yaml_stream(self, convert_and_read) -> None:
+        output = convert_and_read("manifests.yaml", "yaml", "json")
+        doc = json.loads(output)
+        assert [x["kind"] for x in doc] == ["Namespace", "ConfigMap"]
+
+    def test_yaml_stream_round_trip(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "manifests.yaml", "yaml", "yaml", yaml_options=YAMLOptions(split=True)
+        )
+        reference = read_file("manifests.yaml")
+        assert output == reference
+
+    def test_yaml_stream_single(self) -> None:
+        assert remarshal.decode("yaml", b"a: 1\n") == {"a": 1}
+        assert remarshal.decode(
+            "yaml", b"a: 1\n", DecodeOptions(yaml_stream=True)
+        ) == [{"a": 1}]
+        assert remarshal.decode("yaml", b"", DecodeOptions(yaml_stream=True)) == []
+
+    def test_doc(self, convert_and_read) -> None:
+        output = convert_and_read("manifests.yaml", "yaml", "json", doc=-1)
+        assert json.loads(output)["kind"] == "ConfigMap"
+
+        output = convert_and_read(
+            "manifests.yaml", "yaml", "json", doc=("metadata.name", "demo")
+        )
+        assert json.loads(output)["kind"] == "Namespace"
+
+    def test_doc_single_yaml_document(self) -> None:
+        output = remarshal.convert("yaml", "json", b"- a\n- b\n", ConvertOptions(doc=0))
+        assert output == b'["a","b"]\n'
+
+    def test_doc_array_element(self) -> None:
+        input_data = b'[{"id": 1, "on": true}, {"id": 2, "on": 1}]'
+        output = remarshal.convert(
+            "json", "json", input_data, ConvertOptions(doc=("id", 2))
+        )
+        assert output == b'{"id":2,"on":1}\n'
+        output = remarshal.convert(
+            "json", "json", input_data, ConvertOptions(doc=("on", 1))
+        )
+        assert output == b'{"id":2,"on":1}\n'
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("json", "json", input_data, ConvertOptions(doc=2))
+        assert str(cm.value) == "no document 2 in 2 documents"
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "json", "json", input_data, ConvertOptions(doc=("id", "1"))
+            )
+        assert str(cm.value) == "no document with '1' at path 'id'"
+
+        with pytest.raises(TypeError):
+            remarshal.convert("json", "json", b'{"id": 1}', ConvertOptions(doc=0))
+
+    def test_doc_cli(self) -> None:
+        args = _parse_command_line([sys.argv[0], "--doc", "-1", "in.yaml", "out.json"])
+        assert args.doc == -1
+
+        args = _parse_command_line(
+            [sys.argv[0], "--doc", "kind=Service", "in.yaml", "out.json"]
+        )
+        assert args.doc == ("kind", "Service")
+
+    @needs_ion
+    def test_ion_decode(self) -> None:
+        doc = remarshal.decode("ion", read_file("config.ion"))
+        assert doc == {
+            "name": "web",
+            "kind": "server",
+            "port": 8080,
+            "ratio": 1.5,
+            "scale": 2.5,
+            "debug": True,
+            "owner": None,
+            "created": datetime.datetime(
+                2024, 1, 2, 3, 4, 5, tzinfo=datetime.timezone.utc
+            ),
+            "key": b"\x00\x01\x02",
+            "tags": ["a", "b"],
+        }
+
+    @needs_ion
+    def test_ion_text_round_trip(self, convert_and_read) -> None:
+        ion = convert_and_read("example.json", "json", "ion")
+        output = remarshal.convert("ion", "json", ion, ConvertOptions(json_indent=None))
+        reference = read_file("example.json")
+        assert json.loads(output) == json.loads(reference)
+
+    @needs_ion
+    def test_ion_binary(self, convert_and_read) -> None:
+        output = convert_and_read("config.ion", "ion", "ion", ion_format="binary")
+        assert output.startswith(b"\xe0\x01\x00\xea")
+        assert remarshal.decode("ion", output) == remarshal.decode(
+            "ion", read_file("config.ion")
+        )
+
+    @needs_ion
+    def test_ion_stream(self) -> None:
+        assert remarshal.decode("ion", b"1 two {three: 3}") == [
+            1,
+            "two",
+            {"three": 3},
+        ]
+
+    def test_ubjson_round_trip(self, convert_and_read) -> None:
+        ubjson = convert_and_read("example.json", "json", "ubjson")
+        output = remarshal.convert(
+            "ubjson", "json", ubjson, ConvertOptions(json_indent=None)
+        )
+        reference = read_file("example.json")
+        assert json.loads(output) == json.loads(reference)
+
+    def test_ubjson_decode(self) -> None:
+        doc = remarshal.decode("ubjson", b"{U\x01aU\x01U\x01b[HU\x0512345HU\x031.0]}")
+        assert doc == {"a": 1, "b": [12345, 1.0]}
+        assert isinstance(doc["b"][1], float)
+
+    def test_ubjson_big_int(self) -> None:
+        output = remarshal.convert("json", "ubjson", b"[1180591620717411303424]")
+        assert remarshal.decode("ubjson", output) == [2**70]
+
+    def test_ubjson_date_time(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("toml", "ubjson", b"t = 2024-01-02T03:04:05Z")
+        assert "Cannot convert data to UBJSON" in str(cm.value)
+
+        output = remarshal.convert(
+            "toml",
+            "ubjson",
+            b"t = 2024-01-02T03:04:05Z",
+            ConvertOptions(stringify=True),
+        )
+        assert remarshal.decode("ubjson", output) == {"t": "2024-01-02T03:04:05+00:00"}
+
+    def test_jsonc(self, convert_and_read) -> None:
+        output = convert_and_read("settings.jsonc", "jsonc", "json")
+        assert json.loads(output) == {
+            "editor.fontSize": 14,
+            "files.exclude": {"**/.git": True, "**/node_modules": True},
+            "url": "https://example.com/*not-a-comment*/",
+            "list": [1, 2, 3],
+        }
+
+    def test_jsonc_string_escapes(self) -> None:
+        doc = remarshal.decode("jsonc", b'["a\\"// b", "c\\\\", // d\n]')
+        assert doc == ['a"// b', "c\\"]
+
+    def test_jsonc_error_line(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("jsonc", b"/* one\ntwo */\n{\n  x\n}\n")
+        assert cm.value.line == 4
+
+    def test_jsonc_unterminated_comment(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("jsonc", b"{}\n/* oops")
+        assert cm.value.line == 2
+        assert "unterminated comment" in str(cm.value)
+
+    @needs_pyarrow
+    def test_parquet(self) -> None:
+        import pyarrow
+        import pyarrow.parquet
+
+        table = pyarrow.table(
+            {
+                "id": [1, 2],
+                "name": ["alice", None],
+                "joined": [datetime.date(2024, 1, 2), datetime.date(2024, 3, 4)],
+                "tags": [["a", "b"], []],
+                "attrs": pyarrow.array(
+                    [[("k", "v")], []],
+                    type=pyarrow.map_(pyarrow.string(), pyarrow.string()),
+                ),
+            }
+        )
+        sink = pyarrow.BufferOutputStream()
+        pyarrow.parquet.write_table(table, sink)
+
+        doc = remarshal.decode("parquet", sink.getvalue().to_pybytes())
+        assert doc == [
+            {
+                "id": 1,
+                "name": "alice",
+                "joined": datetime.date(2024, 1, 2),
+                "tags": ["a", "b"],
+                "attrs": {"k": "v"},
+            },
+            {
+                "id": 2,
+                "name": None,
+                "joined": datetime.date(2024, 3, 4),
+                "tags": [],
+                "attrs": {},
+            },
+        ]
+
+    @needs_pyarrow
+    def test_parquet_error(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("parquet", b"not parquet")
+        assert "Cannot parse as Parquet" in str(cm.value)
+
+    def test_urlencoded_decode(self) -> None:
+        doc = remarshal.decode(
+            "urlencoded",
+            b"?a=1&b[0]=x&b[1]=y&c.d=z&tag=p&tag=q&e[]=only&f[g][]=1&sp=a+b%26c\n",
+        )
+        assert doc == {
+            "a": "1",
+            "b": ["x", "y"],
+            "c": {"d": "z"},
+            "tag": ["p", "q"],
+            "e": ["only"],
+            "f": {"g": ["1"]},
+            "sp": "a b&c",
+        }
+
+    def test_urlencoded_infer_types(self) -> None:
+        doc = remarshal.decode(
+            "urlencoded", b"n=5&b=true&s=", DecodeOptions(infer_types=True)
+        )
+        assert doc == {"n": 5, "b": True, "s": ""}
+
+    def test_urlencoded_encode(self) -> None:
+        data = b'{"a": 1, "b": ["x", "y"], "c": {"d": "y z&"}, "n": null, "t": true}'
+        output = remarshal.convert(
+            "json", "urlencoded", data, ConvertOptions(sort_keys=False)
+        )
+        assert output == b"a=1&b[0]=x&b[1]=y&c[d]=y+z%26&n=&t=true\n"
+
+        output = remarshal.convert(
+            "json",
+            "urlencoded",
+            data,
+            ConvertOptions(sort_keys=False, urlencoded_style="dot"),
+        )
+        assert output == b"a=1&b.0=x&b.1=y&c.d=y+z%26&n=&t=true\n"
+
+    def test_urlencoded_conflict(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("urlencoded", b"a=1&a[b]=2")
+        assert "key 'a[b]' conflicts" in str(cm.value)
+
+    def test_urlencoded_escaped_keys(self) -> None:
+        doc = remarshal.decode("urlencoded", b"b[x.y]=1&a%2Eb=2&c.d%5B0%5D=3")
+        assert doc == {"b": {"x.y": "1"}, "a.b": "2", "c": {"d[0]": "3"}}
+
+        data = b'{"a.b": 1, "c": {"x.y": {"[z]": 2}}}'
+        for style in ("bracket", "dot"):
+            output = remarshal.convert(
+                "json", "urlencoded", data, ConvertOptions(urlencoded_style=style)
+            )
+            doc = remarshal.decode(
+                "urlencoded", output, DecodeOptions(infer_types=True)
+            )
+            assert doc == json.loads(data)
+
+    def test_reg_decode(self) -> None:
+        doc = remarshal.decode("reg", read_file("registry.reg"))
+        assert doc == {
+            "HKEY_CURRENT_USER": {
+                "Software": {
+                    "Example": {
+                        "@": "Example app",
+                        "Path": "C:\\Program Files\\Example",
+                        "Count": 10,
+                        "Data": b"\x01\x02\x03",
+                        "Big": 2**32,
+                        "Dirs": ["a", "b"],
+                        "Home": "%U",
+                        "Old": None,
+                        "Window": {'Say "hi"': "yes"},
+                    },
+                    "-Obsolete": {},
+                }
+            }
+        }
+
+    def test_reg_encode(self, convert_and_read) -> None:
+        output = convert_and_read("registry.reg", "reg", "reg")
+        reference = read_file("registry-normalized.reg")
+        assert output == reference
+        assert output.startswith(b"\xff\xfe")
+
+    def test_reg_utf8(self) -> None:
+        doc = remarshal.decode(
+            "reg", b"REGEDIT4\n\n[HKEY_CLASSES_ROOT\\.txt]\n@=\"txtfile\"\n"
+        )
+        assert doc == {"HKEY_CLASSES_ROOT": {".txt": {"@": "txtfile"}}}
+
+    def test_reg_header(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("reg", b'[HKEY_CURRENT_USER]\n"a"="b"\n')
+        assert cm.value.line == 1
+
+    def test_reg_round_trip(self) -> None:
+        doc = {
+            "HKEY_CURRENT_USER": {
+                "a b": {
+                    'c\\"d': "e\\f",
+                    "@": "g\nh",
+                    "i": "j\x0bk",
+                    "l": "m\u2028",
+                },
+            }
+        }
+        output = remarshal.encode("reg", doc)
+        assert remarshal.decode("reg", output) == doc
+
+    def test_reg_invalid_names(self) -> None:
+        for doc, message in [
+            ({"a\\b": {"c": 1}}, "key name 'a\\\\b' cannot contain a backslash"),
+            ({"a": {"b\nc": {}}}, "key name 'b\\nc' cannot contain"),
+            ({"a": {"b\x1cc": {}}}, "key name 'b\\x1cc' cannot contain"),
+            ({"a": {"b\nc": 1}}, "value name 'b\\nc' cannot contain a line break"),
+        ]:
+            with pytest.raises(remarshal.EncodeError) as cm:
+                remarshal.encode("reg", doc)
+            assert message in str(cm.value)
+
+    def test_reg_value_outside_key(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("json", "reg", b'{"a": "b"}')
+        assert "value 'a' is not under a key" in str(cm.value)
+
+    def test_gron_encode(self) -> None:
+        output = remarshal.convert(
+            "json",
+            "gron",
+            b'{"name": "web", "ports": [80], "content-type": "text", "e": {}}',
+            ConvertOptions(sort_keys=False),
+        )
+        assert output == (
+            b"json = {};\n"
+            b'json.name = "web";\n'
+            b"json.ports = [];\n"
+            b"json.ports[0] = 80;\n"
+            b'json["content-type"] = "text";\n'
+            b"json.e = {};\n"
+        )
+
+    def test_gron_round_trip(self, convert_and_read) -> None:
+        gron = convert_and_read("example.json", "json", "gron")
+        output = remarshal.convert(
+            "gron", "json", gron, ConvertOptions(json_indent=None)
+        )
+        reference = read_file("example.json")
+        assert json.loads(output) == json.loads(reference)
+
+    def test_gron_filtered(self) -> None:
+        doc = remarshal.decode("gron", b'json.a.b[1] = "x";\njson["c d"].e = true;\n')
+        assert doc == {"a": {"b": [None, "x"]}, "c d": {"e": True}}
+
+    def test_gron_error(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("gron", b"json = [];\njson.a = 1;\n")
+        assert cm.value.line == 2
+        assert "cannot index list with 'a'" in str(cm.value)
+
+    def test_lua(self, convert_and_read) -> None:
+        output = convert_and_read("cue.json", "json", "lua", lua_return=True)
+        reference = read_file("config.lua")
+        assert output == reference
+
+    def test_lua_escapes(self) -> None:
+        input_data = b"a: !!binary AAFc/w==\nb: \"\\te\"\n"
+        output = remarshal.convert("yaml", "lua", input_data)
+        assert output == b'{\n  a = "\\000\\001\\\\\\255",\n  b = "\\te",\n}\n'
+
+    def test_lua_non_string_keys(self) -> None:
+        output = remarshal.convert("yaml", "lua", b"5: .inf\ntrue: .nan\n")
+        assert output == b"{\n  [5] = math.huge,\n  [true] = 0/0,\n}\n"
+
+    def test_lua_cli(self) -> None:
+        args = _parse_command_line(["remarshal", "-if", "json", "-of", "lua"])
+        assert args.lua_return is False
+
+    def test_pyliteral(self, convert_and_read) -> None:
+        output = convert_and_read("example.toml", "toml", "pyliteral")
+        reference = remarshal.decode("toml", read_file("example.toml"))
+        reference["owner"]["dob"] = reference["owner"]["dob"].isoformat()
+        assert ast.literal_eval(output.decode("utf-8")) == reference
+
+    def test_pyliteral_special_values(self) -> None:
+        output = remarshal.convert("yaml", "pyliteral", b"[.inf, -.inf, !!binary AAE=]")
+        assert output == b"[1e999, -1e999, b'\\x00\\x01']\n"
+        assert ast.literal_eval(output.decode("utf-8")) == [
+            float("inf"),
+            float("-inf"),
+            b"\x00\x01",
+        ]
+
+    def test_pyliteral_nan(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("yaml", "pyliteral", b"a: .nan")
+        assert "Cannot convert data to Python literal" in str(cm.value)
+
+    def test_go(self) -> None:
+        input_data = b'{"name": "web", "ports": [80, 443], "tls": {"on": null}}'
+        output = remarshal.convert(
+            "json", "go", input_data, ConvertOptions(sort_keys=False)
+        )
+        assert output == (
+            b"map[string]interface{}{\n"
+            b'\t"name": "web",\n'
+            b'\t"ports": []interface{}{80, 443},\n'
+            b'\t"tls": map[string]interface{}{\n'
+            b'\t\t"on": nil,\n'
+            b"\t},\n"
+            b"}\n"
+        )
+
+    def test_go_package(self) -> None:
+        output = remarshal.convert(
+            "yaml",
+            "go",
+            b"1: [.inf, !!binary AAE=]",
+            ConvertOptions(go_package="fixtures"),
+        )
+        assert output == (
+            b"package fixtures\n\n"
+            b'import "math"\n\n'
+            b"var Data = map[interface{}]interface{}{\n"
+            b"\t1: []interface{}{math.Inf(1), []byte{0x00, 0x01}},\n"
+            b"}\n"
+        )
+
+    def test_go_var_nil(self) -> None:
+        output = remarshal.convert(
+            "yaml", "go", b"null", ConvertOptions(go_var="Empty")
+        )
+        assert output == b"var Empty interface{} = nil\n"
+
+    def test_go_int_overflow(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("json", "go", b"[18446744073709551616]")
+        assert "Cannot convert data to Go" in str(cm.value)
+
+    def test_starlark(self) -> None:
+        input_data = b"deps: ['//a:b', .inf]\nattrs: {public: true, owner: null}\n"
+        output = remarshal.convert(
+            "yaml",
+            "starlark",
+            input_data,
+            ConvertOptions(sort_keys=False, starlark_var="METADATA"),
+        )
+        assert output == (
+            b"METADATA = {\n"
+            b'    "deps": ["//a:b", float("inf")],\n'
+            b'    "attrs": {\n'
+            b'        "public": True,\n'
+            b'        "owner": None,\n'
+            b"    },\n"
+            b"}\n"
+        )
+
+    def test_starlark_top_level_list(self) -> None:
+        output = remarshal.convert("json", "starlark", b'[1, [2], "\\u00e9\\n"]')
+        assert output == '[\n    1,\n    [2],\n    "\u00e9\\n",\n]\n'.encode()
+
+    def test_starlark_bytes(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("yaml", "starlark", b"a: !!binary AAE=")
+        assert "Cannot convert data to Starlark" in str(cm.value)
+
+    def test_kdl_decode(self, convert_and_read) -> None:
+        output = convert_and_read("config.kdl", "kdl", "json")
+        reference = read_file("config-kdl.json")
+        assert json.loads(output) == json.loads(reference)
+
+    def test_kdl_round_trip(self) -> None:
+        reference = remarshal.decode("kdl", read_file("config.kdl"))
+        output = remarshal.convert("kdl", "kdl", read_file("config.kdl"))
+        assert remarshal.decode("kdl", output) == reference
+
+    def test_kdl_encode(self) -> None:
+        input_data = b'{"a": [1, {"b": null}], "c d": {"-": [1.5, "x"]}, "e": []}'
+        output = remarshal.convert(
+            "json", "kdl", input_data, ConvertOptions(sort_keys=False)
+        )
+        assert output == (
+            b"a 1\n"
+            b"a {\n"
+            b"    b #null\n"
+            b"}\n"
+            b'"c d" 1.5 "x" {}\n'
+            b"e\n"
+        )
+
+    def test_kdl_error(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("kdl", b"a 1\nb {\n    c 1.2.3\n}\n")
+        assert cm.value.line == 3
+        assert "invalid number '1.2.3'" in str(cm.value)
+
+    def test_kdl_unicode_escape(self) -> None:
+        assert remarshal.decode("kdl", b'a "\\u{1F600}"\n') == {"a": "\U0001f600"}
+
+        for escape in ("110000", "D800"):
+            with pytest.raises(remarshal.DecodeError) as cm:
+                remarshal.decode("kdl", b'a 1\nb "\\u{' + escape.encode() + b'}"\n')
+            assert cm.value.line == 2
+            assert "invalid code point" in str(cm.value)
+
+    def test_kdl_top_level_array(self) -> None:
+        with pytest.raises(TypeError) as cm:
+            remarshal.convert("json", "kdl", b"[1, 2]")
+        assert "cannot be encoded as KDL" in str(cm.value)
+
+    def test_sdl_decode(self) -> None:
+        doc = remarshal.decode("sdl", read_file("config.sdl"))
+        assert doc == {
+            "title": "Hello, World",
+            "server": {
+                "#text": "web",
+                "@port": 8080,
+                "@secure": True,
+                "alias": ["www", "www2"],
+                "timeout": 90.0,
+                "created": datetime.datetime(
+                    2024, 1, 15, 10, 30, tzinfo=datetime.timezone.utc
+                ),
+                "since": datetime.date(2024, 1, 15),
+            },
+            "route": ["/a", {"#text": "/b", "@method": "POST"}],
+            "size": 9000000000,
+            "ratio": 0.75,
+            "key": b"\x00\x01\x02\x03",
+            "raw": "C:\\path",
+            "content": "anonymous value",
+            "list": [1, 2, 3],
+            "empty": None,
+            "nothing": None,
+        }
+
+    def test_sdl_round_trip(self) -> None:
+        reference = remarshal.decode("sdl", read_file("config.sdl"))
+        output = remarshal.convert("sdl", "sdl", read_file("config.sdl"))
+        assert remarshal.decode("sdl", output) == reference
+
+    def test_sdl_encode(self) -> None:
+        input_data = b'{"a": {"#text": 1, "@b": 2.5e20}, "c": {}, "d": [[1, 2], [3]]}'
+        output = remarshal.convert(
+            "json", "sdl", input_data, ConvertOptions(sort_keys=False)
+        )
+        assert output == (
+            b"a 1 b=250000000000000000000.0\n"
+            b"c {\n"
+            b"}\n"
+            b"d 1 2\n"
+            b"d 3\n"
+        )
+
+    def test_sdl_error(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("sdl", b"a 1\nb {\n    c 2024/01/15 10:30:00-JST\n}\n")
+        assert cm.value.line == 3
+        assert "unsupported time zone 'JST'" in str(cm.value)
+
+    def test_sdl_invalid_name(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("json", "sdl", b'{"a b": 1}')
+        assert "not an SDLang identifier" in str(cm.value)
+
+    def test_ucl_decode(self, convert_and_read) -> None:
+        output = convert_and_read("rspamd.ucl", "ucl", "json")
+        reference = read_file("rspamd-ucl.json")
+        assert json.loads(output) == json.loads(reference)
+
+    def test_ucl_round_trip(self) -> None:
+        reference = remarshal.decode("ucl", read_file("rspamd.ucl"))
+        output = remarshal.convert("ucl", "ucl", read_file("rspamd.ucl"))
+        assert remarshal.decode("ucl", output) == reference
+
+    def test_ucl_encode(self) -> None:
+        input_data = b'{"a b": [1, {"c": null}], "d": {"e": ["x"]}}'
+        output = remarshal.convert(
+            "json", "ucl", input_data, ConvertOptions(sort_keys=False)
+        )
+        assert output == (
+            b'"a b" = [\n'
+            b"    1,\n"
+            b"    {\n"
+            b"        c = null;\n"
+            b"    },\n"
+            b"];\n"
+            b"d {\n"
+            b'    e = ["x"];\n'
+            b"}\n"
+        )
+
+    def test_ucl_error(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("ucl", b"a = 1;\nb {\n    c = 1 2;\n}\n")
+        assert cm.value.line == 3
+        assert "expected ';' or a newline" in str(cm.value)
+
+    @needs_jsonnet
+    def test_jsonnet(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "service.jsonnet",
+            "jsonnet",
+            "json",
+            jsonnet_ext_vars={"env": "prod"},
+        )
+        assert json.loads(output) == {
+            "image": "nginx:1.25",
+            "name": "web-prod",
+            "ports": [80, 81],
+            "replicas": 3,
+        }
+
+    @needs_jsonnet
+    def test_jsonnet_error(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("jsonnet", b"{\n  a: 1,\n  b: error 'nope',\n}\n")
+        assert cm.value.line == 3
+        assert "Cannot evaluate Jsonnet" in str(cm.value)
+
+    def test_jsonnet_ext_var_cli(self, monkeypatch) -> None:
+        monkeypatch.setenv("REMARSHAL_TEST_ENV", "dev")
+        args = _parse_command_line(
+            [
+                "remarshal",
+                "-if",
+                "jsonnet",
+                "-of",
+                "json",
+                "--jsonnet-ext-var",
+                "region=eu",
+                "--jsonnet-ext-var",
+                "REMARSHAL_TEST_ENV",
+            ]
+        )
+        assert args.jsonnet_ext_vars == {"region": "eu", "REMARSHAL_TEST_ENV": "dev"}
+
+    def test_headers(self, convert_and_read) -> None:
+        output = convert_and_read("response.headers", "headers", "json")
+        assert json.loads(output) == {
+            "Cache-Control": "max-age=604800, must-revalidate",
+            "Content-Type": "text/html; charset=utf-8",
+            "Set-Cookie": ["a=1", "b=2"],
+            "X-Empty": "",
+        }
+
+    def test_headers_roundtrip(self, convert_and_read) -> None:
+        output = convert_and_read("response.headers", "headers", "headers")
+        assert output == (
+            b"Content-Type: text/html; charset=utf-8\n"
+            b"Cache-Control: max-age=604800, must-revalidate\n"
+            b"Set-Cookie: a=1\n"
+            b"Set-Cookie: b=2\n"
+            b"X-Empty:\n"
+        )
+
+    def test_headers_errors(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("headers", b"Subject: hi\n\nbody\n")
+        assert cm.value.line == 3
+
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("headers", b"Subject: hi\nnot a header\n")
+        assert "expected 'Name: value'" in str(cm.value)
+
+        with pytest.raises(remarshal.EncodeError) as cm:
+            remarshal.convert("json", "headers", b'{"Subject": "a\\nb"}')
+        assert "line break" in str(cm.value)
+
+    def test_toml_version_1_1(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "toml11.toml", "toml", "json", stringify=True, toml_version="1.1"
+        )
+        assert json.loads(output) == {
+            "escape": "\x1b[1mbold\x1b[0m A",
+            "server": {"host": "example.com", "port": 8080},
+            "start": "07:30:00",
+        }
+
+        with pytest.raises(remarshal.DecodeError):
+            convert_and_read("toml11.toml", "toml", "json")
+
+    def test_toml_version_0_4(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode(
+                "toml", b"a = 1\nb.c = 2\n", DecodeOptions(toml_version="0.4")
+            )
+        assert cm.value.line == 2
+        assert "dotted keys" in str(cm.value)
+
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode(
+                "toml", b'a = [1, "b"]\n', DecodeOptions(toml_version="0.4")
+            )
+        assert "mix types" in str(cm.value)
+
+        with pytest.raises(remarshal.EncodeError) as cm:
+            remarshal.convert(
+                "json", "toml", b'{"a": [1, 2.5]}', ConvertOptions(toml_version="0.4")
+            )
+        assert "mix types" in str(cm.value)
+
+        output = remarshal.convert(
+            "toml",
+            "json",
+            b"[a.b]\nc = [[1], ['d']]\n",
+            ConvertOptions(toml_version="0.4"),
+        )
+        assert json.loads(output) == {"a": {"b": {"c": [[1], ["d"]]}}}
+
+    def test_yaml_version_input(self, convert_and_read) -> None:
+        output = convert_and_read("yaml11.yaml", "yaml", "json")
+        assert json.loads(output) == {
+            "answer": "yes",
+            "duration": "1:30",
+            "enabled": "on",
+            "mode": 644,
+        }
+
+        output = convert_and_read("yaml11.yaml", "yaml", "json", yaml_version="1.1")
+        assert json.loads(output) == {
+            "answer": True,
+            "duration": 90,
+            "enabled": True,
+            "mode": 420,
+        }
+
+    def test_yaml_version_output(self) -> None:
+        data = b'{"a": "on", "b": "yes", "c": "0o10"}'
+        output = remarshal.convert("json", "yaml", data)
+        assert output == b"a: on\nb: yes\nc: '0o10'\n"
+
+        output = remarshal.convert(
+            "json", "yaml", data, ConvertOptions(yaml_version="1.1")
+        )
+        assert output == b"%YAML 1.1\n---\na: 'on'\nb: 'yes'\nc: 0o10\n"
+
+        reread = remarshal.decode("yaml", output, DecodeOptions(yaml_version="1.1"))
+        assert reread == {"a": "on", "b": "yes", "c": "0o10"}
+
+    def test_yaml_float_without_dot(self) -> None:
+        data = b"a: 1.0\nb: 1e3\nc: 1.\nd: 1_000\n"
+        for yaml_version in ("1.1", "1.2"):
+            with warnings.catch_warnings():
+                warnings.simplefilter("error")
+                doc = remarshal.decode(
+                    "yaml", data, DecodeOptions(yaml_version=yaml_version)
+                )
+            assert doc == {"a": 1.0, "b": 1000.0, "c": 1.0, "d": 1000}
+            assert [type(v) for v in doc.values()] == [float, float, float, int]
+
+    def test_xml_convention_badgerfish(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "convention.xml", "xml", "json", xml_convention="badgerfish"
+        )
+        assert json.loads(output)["library"] == {
+            "@name": "city",
+            "books": {"book": [{"$": "Dune", "@id": "1"}, {"$": "Emma", "@id": "2"}]},
+            "note": {},
+            "owner": {"$": "Ada"},
+            "tags": {"tag": [{"$": "fiction"}, {"$": "classic"}]},
+        }
+
+    def test_xml_convention_mxj(self, convert_and_read) -> None:
+        output = convert_and_read("convention.xml", "xml", "json", xml_convention="mxj")
+        library = json.loads(output)["library"]
+        assert library["-name"] == "city"
+        assert library["books"]["book"][0] == {"#text": "Dune", "-id": "1"}
+        assert library["note"] == ""
+
+    def test_xml_convention_folded(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "convention.xml", "xml", "json", xml_convention="folded"
+        )
+        assert json.loads(output)["library"] == {
+            "@name": "city",
+            "books": [{"#text": "Dune", "@id": "1"}, {"#text": "Emma", "@id": "2"}],
+            "note": None,
+            "owner": "Ada",
+            "tags": ["fiction", "classic"],
+        }
+
+        output = remarshal.convert(
+            "json",
+            "xml",
+            b'{"tags": ["a", "b"]}',
+            ConvertOptions(xml_convention="folded"),
+        )
+        assert output == (
+            b'<?xml version="1.0" encoding="UTF-8"?>\n'
+            b"<tags>\n"
+            b"  <item>a</item>\n"
+            b"  <item>b</item>\n"
+            b"</tags>\n"
+        )
+
+    def test_smile_round_trip(self, convert_and_read) -> None:
+        smile = convert_and_read("example.json", "json", "smile")
+        assert smile.startswith(b":)\n")
+        output = remarshal.convert(
+            "smile", "json", smile, ConvertOptions(json_indent=None)
+        )
+        reference = read_file("example.json")
+        assert json.loads(output) == json.loads(reference)
+
+    def test_smile_encode(self) -> None:
+        output = remarshal.convert("json", "smile", b'{"a": 1, "b": [true, "x"]}')
+        assert output == b":)\n\x01\xfa\x80a\xc2\x80b\xf8\x23\x40x\xf9\xfb"
+
+    def test_smile_decode(self) -> None:
+        # Shared string values, a 32-bit float, and a 7-bit binary value.
+        smile = (
+            b":)\n\x03\xf8\x41ab\x01\x28\x03\x7e\x40\x00\x00"
+            b"\xe8\x83\x00\x20\x30\x03\xf9\xff"
+        )
+        assert remarshal.decode("smile", smile) == ["ab", "ab", 1.625, b"\x00\x81\x83"]
+
+    def test_smile_shared_names(self) -> None:
+        data = [{f"key{i}": i} for i in range(1500)] * 2
+        output = remarshal.convert("json", "smile", json.dumps(data).encode("utf-8"))
+        assert remarshal.decode("smile", output) == data
+
+    def test_smile_errors(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("smile", b'{"a": 1}')
+        assert "missing the header" in str(cm.value)
+
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("smile", b":)\n\x00\xfa\x80a")
+        assert "unexpected end of input" in str(cm.value)
+
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("smile", b":)\n\x00\xe8\x81\x7f\xff")
+        assert "offset 7: invalid 7-bit byte" in str(cm.value)
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("toml", "smile", b"t = 2024-01-02T03:04:05Z")
+        assert "Cannot convert data to Smile" in str(cm.value)
+
+    def test_asn1_der(self) -> None:
+        der = (
+            b"0#\x02\x01\x05\x0c\x02hi\x06\x06*\x86H\x86\xf7\r"
+            b"\xa0\x03\x01\x01\xff\x17\r240102030405Z"
+        )
+        assert remarshal.decode("asn1", der) == [
+            5,
+            "hi",
+            "1.2.840.113549",
+            {"[0]": [True]},
+            datetime.datetime(2024, 1, 2, 3, 4, 5, tzinfo=datetime.timezone.utc),
+        ]
+
+    def test_asn1_pem(self) -> None:
+        pem = (
+            b"-----BEGIN EXAMPLE-----\n"
+            b"MCMCAQUMAmhpBgYqhkiG9w2gAwEB/xcNMjQwMTAyMDMwNDA1Wg==\n"
+            b"-----END EXAMPLE-----\n"
+        )
+        output = remarshal.convert("asn1", "json", pem, ConvertOptions(stringify=True))
+        assert json.loads(output) == [
+            5,
+            "hi",
+            "1.2.840.113549",
+            {"[0]": [True]},
+            "2024-01-02T03:04:05+00:00",
+        ]
+
+    def test_asn1_ber(self) -> None:
+        # Indefinite lengths, a segmented octet string, a real, and a bit string.
+        ber = (
+            b"\x30\x80\x24\x80\x04\x02ab\x04\x01c\x00\x00"
+            b"\x09\x03\x80\xfe\x03\x03\x02\x05\xa0\x00\x00"
+        )
+        assert remarshal.decode("asn1", ber) == [b"abc", 0.75, "101"]
+
+    def test_asn1_errors(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("asn1", b"\x30\x05\x02\x01")
+        assert "runs past the end" in str(cm.value)
+
+        with pytest.raises(SystemExit):
+            _parse_command_line(
+                ["remarshal", "-if", "asn1", "-of", "json", "--asn1-schema", "a.asn"]
+            )
+
+    @needs_asn1tools
+    def test_asn1_schema(self) -> None:
+        output = remarshal.decode(
+            "asn1",
+            b"0\n\x80\x01\x01\x81\x01\x02\x82\x02hi",
+            DecodeOptions(asn1_schema=[data_file_path("point.asn")], asn1_type="Point"),
+        )
+        assert output == {"label": "hi", "x": 1, "y": 2}
+
+    def test_tnetstring_round_trip(self, convert_and_read) -> None:
+        tnetstring = convert_and_read("example.json", "json", "tnetstring")
+        output = remarshal.convert(
+            "tnetstring", "json", tnetstring, ConvertOptions(json_indent=None)
+        )
+        reference = read_file("example.json")
+        assert json.loads(output) == json.loads(reference)
+
+    def test_tnetstring_encode(self) -> None:
+        output = remarshal.convert("json", "tnetstring", b'{"a": [1, 2.5, null, true]}')
+        assert output == b"28:1:a,20:1:1#3:2.5^0:~4:true!]}"
+
+    def test_tnetstring_stream(self) -> None:
+        assert remarshal.decode("tnetstring", b"1:a,\n1:1#") == ["a", 1]
+
+    def test_tnetstring_stringify(self) -> None:
+        output = remarshal.convert(
+            "toml", "tnetstring", b"d = 2024-01-02", ConvertOptions(stringify=True)
+        )
+        assert output == b"18:1:d,10:2024-01-02,}"
+
+    def test_tnetstring_errors(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("tnetstring", b"2:ab?")
+        assert "invalid type '?'" in str(cm.value)
+
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("tnetstring", b"5:ab,")
+        assert "value runs past the end" in str(cm.value)
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("toml", "tnetstring", b"t = 2024-01-02T03:04:05Z")
+        assert "Cannot convert data to tnetstring" in str(cm.value)
+
+    def test_unit_decode(self, convert_and_read) -> None:
+        output = convert_and_read("nginx.service", "unit", "json")
+        service = json.loads(output)["Service"]
+        assert service["ExecStartPre"] == [
+            "/usr/bin/rm -f /run/nginx.pid",
+            "/usr/sbin/nginx -t",
+        ]
+        assert service["Environment"] == "LANG=C LC_ALL=C"
+
+    def test_unit_round_trip(self, convert_and_read) -> None:
+        output = convert_and_read("nginx.service", "unit", "unit")
+        assert remarshal.decode("unit", output) == remarshal.decode(
+            "unit", read_file("nginx.service")
+        )
+
+    def test_unit_desktop_entry(self) -> None:
+        args = _parse_command_line([sys.argv[0], "app.desktop", "app.json"])
+        assert args.input_format == "unit"
+
+        output = remarshal.decode(
+            "unit",
+            b"[Desktop Entry]\nName=Foo\nName[de]=Fu\nTerminal=false\n",
+            DecodeOptions(infer_types=True),
+        )
+        assert output == {
+            "Desktop Entry": {"Name": "Foo", "Name[de]": "Fu", "Terminal": False}
+        }
+
+    def test_unit_encode(self) -> None:
+        output = remarshal.convert(
+            "json",
+            "unit",
+            b'{"Socket": {"ListenStream": [80, 443], "Accept": true}}',
+            ConvertOptions(sort_keys=False),
+        )
+        assert output == b"[Socket]\nListenStream=80\nListenStream=443\nAccept=true\n"
+
+    def test_unit_errors(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("unit", b"Description=x\n")
+        assert "outside of a section" in str(cm.value)
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("json", "unit", b'{"Description": "x"}')
+        assert "all keys must be in sections" in str(cm.value)
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("json", "unit", b'{"Unit": {"Description": "a\\nb"}}')
+        assert "would not read back" in str(cm.value)
+
+    def test_sql(self, convert_and_read) -> None:
+        output = convert_and_read("users.yaml", "yaml", "sql", sql_table="users")
+        reference = read_file("users.sql")
+        assert output == reference
+
+    def test_sql_schema_table(self) -> None:
+        output = remarshal.convert(
+            "json",
+            "sql",
+            b'[{"b": 1, "a": "x"}]',
+            ConvertOptions(sql_table="public.my table"),
+        )
+        assert output == (
+            b'INSERT INTO "public"."my table" ("a", "b") VALUES (\'x\', 1);\n'
+        )
+
+    def test_sql_table_cli(self) -> None:
+        args = _parse_command_line(
+            [sys.argv[0], "-of", "sql", "--sql-table", "users", "input.json"]
+        )
+        assert args.sql_table == "users"
+
+    def test_sql_errors(self) -> None:
+        with pytest.raises(TypeError) as cm:
+            remarshal.convert("json", "sql", b'{"a": 1}')
+        assert "it must be an array of maps" in str(cm.value)
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("json", "sql", b'[{"a": {"b": 1}}]')
+        assert '"--flatten"' in str(cm.value)
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("yaml", "sql", b"- x: .inf")
+        assert "has no SQL literal" in str(cm.value)
+
+    def test_ron_decode(self, convert_and_read) -> None:
+        output = convert_and_read("game.ron", "ron", "json")
+        reference = read_file("game.json")
+        assert json.loads(output) == json.loads(reference)
+
+    def test_ron_round_trip(self) -> None:
+        reference = remarshal.decode("ron", read_file("game.ron"))
+        output = remarshal.convert("ron", "ron", read_file("game.ron"))
+        assert remarshal.decode("ron", output) == reference
+
+    def test_ron_literals(self) -> None:
+        output = remarshal.decode(
+            "ron", b'[0b101, -0x1F, 1_000u32, 1e-5, -inf, 2.0f32, b"\\xff", Foo(1, 2)]'
+        )
+        assert output == [5, -31, 1000, 1e-5, float("-inf"), 2.0, b"\xff", [1, 2]]
+
+    def test_ron_encode(self) -> None:
+        input_data = b'{"a": [1, {"b": null}], "c d": {"e": "\\u0001"}, "f": {}}'
+        output = remarshal.convert(
+            "json", "ron", input_data, ConvertOptions(sort_keys=False)
+        )
+        assert output == (
+            b"{\n"
+            b'    "a": [\n'
+            b"        1,\n"
+            b"        (\n"
+            b"            b: None,\n"
+            b"        ),\n"
+            b"    ],\n"
+            b'    "c d": (\n'
+            b'        e: "\\u{1}",\n'
+            b"    ),\n"
+            b'    "f": {},\n'
+            b"}\n"
+        )
+
+    def test_ron_error(self) -> None:
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("ron", b"(\n    a: 1,\n    a: 2,\n)")
+        assert "duplicate key 'a'" in str(cm.value)
+
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("ron", b"(a: 1")
+        assert "line 1" in str(cm.value)
+
+    @needs_jq
+    def test_query(self, convert_and_read) -> None:
+        output = convert_and_read("table.json", "json", "json", query="[.[].name]")
+        assert json.loads(output) == ["Alice", "Bob", "Carol, Jr."]
+
+    @needs_jq
+    def test_query_several_results(self) -> None:
+        output = remarshal.convert(
+            "toml",
+            "json",
+            b"a = 1\nb = 1979-05-27",
+            ConvertOptions(query=".[]", query_all=True, json_indent=None),
+        )
+        assert output == b'[1,"1979-05-27"]\n'
+
+        for query in (".[]", "empty"):
+            with pytest.raises(ValueError) as cm:
+                remarshal.convert(
+                    "json", "json", b"[1, 2]", ConvertOptions(query=query)
+                )
+            assert "instead of one" in str(cm.value)
+
+    @needs_jq
+    def test_query_all_one_result(self) -> None:
+        output = remarshal.convert(
+            "json",
+            "json",
+            b"[1, 2]",
+            ConvertOptions(query=".", query_all=True, json_indent=None),
+        )
+        assert output == b"[[1,2]]\n"
+
+    @needs_jq
+    def test_query_numbers(self) -> None:
+        output = remarshal.convert(
+            "json",
+            "json",
+            b'{"a": [1, 1.0, 1e3]}',
+            ConvertOptions(query=".a", json_indent=None),
+        )
+        assert output == b"[1,1.0,1000.0]\n"
+
+    @needs_jq
+    def test_query_error(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert("json", "json", b"{}", ConvertOptions(query=".["))
+        assert "Cannot run query" in str(cm.value)
+
+    def test_query_cli(self) -> None:
+        args = _parse_command_line([sys.argv[0], "-q", ".a", "in.json", "out.yaml"])
+        assert args.query == ".a"
+
+    def test_filter(self) -> None:
+        script = "import json, sys; d = json.load(sys.stdin); d['n'] += 1; print(d)"
+        command = f'"{sys.executable}" -c "{script}"'
+        # `print(d)` outputs a Python literal, which is not JSON.
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "json", "json", b'{"n": 1}', ConvertOptions(filter_commands=[command])
+            )
+        assert "Cannot parse the output of filter command" in str(cm.value)
+
+        script = script.replace("print(d)", "json.dump(d, sys.stdout)")
+        command = f'"{sys.executable}" -c "{script}"'
+        output = remarshal.convert(
+            "toml",
+            "json",
+            b"n = 1\nd = 1979-05-27",
+            ConvertOptions(filter_commands=[command, command]),
+        )
+        assert json.loads(output) == {"n": 3, "d": "1979-05-27"}
+
+    def test_filter_yaml_stream(self) -> None:
+        script = "import json, sys; print(len(json.load(sys.stdin)))"
+        command = f'"{sys.executable}" -c "{script}"'
+        # The command runs once for the whole stream.
+        output = remarshal.convert(
+            "yaml",
+            "json",
+            b"a: 1\n---\nb: 2\n",
+            ConvertOptions(filter_commands=[command]),
+        )
+        assert json.loads(output) == 2
+
+    def test_filter_failure(self) -> None:
+        command = f'"{sys.executable}" -c "import sys; sys.exit(3)"'
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "json", "json", b"{}", ConvertOptions(filter_commands=[command])
+            )
+        assert "failed with exit status 3" in str(cm.value)
+
+    def test_filter_cli(self) -> None:
+        args = _parse_command_line(
+            [sys.argv[0], "--filter", "jq .a", "--filter", "cat", "in.json", "out.json"]
+        )
+        assert args.filter_commands == ["jq .a", "cat"]
+
+    def test_set(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "coerce.json",
+            "json",
+            "json",
+            set_values=[
+                ("version", "1.3"),
+                ("enabled", True),
+                ("servers.0.port", 8443),
+                ("servers.1", {"host": "example.org"}),
+                ("tls.cert", "server.pem"),
+            ],
+        )
+        doc = json.loads(output)
+        assert doc["version"] == "1.3"
+        assert doc["enabled"] is True
+        assert doc["servers"] == [
+            {"host": "example.com", "port": 8443},
+            {"host": "example.org"},
+        ]
+        assert doc["tls"] == {"cert": "server.pem"}
+
+    def test_set_cli(self) -> None:
+        args = _parse_command_line(
+            [
+                sys.argv[0],
+                "--set",
+                "a.b=[1, null]",
+                "--set",
+                "version=1.2.3",
+                "--set-string",
+                "port=8080",
+                "in.json",
+                "out.json",
+            ]
+        )
+        assert args.set_values == [
+            ("a.b", [1, None]),
+            ("version", "1.2.3"),
+            ("port", "8080"),
+        ]
+
+    def test_set_errors(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "json", "json", b'{"a": [1]}', ConvertOptions(set_values=[("a.2", 0)])
+            )
+        assert "no array index '2' at path 'a.2'" in str(cm.value)
+
+        with pytest.raises(TypeError) as cm:
+            remarshal.convert(
+                "json", "json", b'{"a": 1}', ConvertOptions(set_values=[("a.b", 0)])
+            )
+        assert "in a value of type 'int'" in str(cm.value)
+
+        with pytest.raises(SystemExit) as cm:
+            _parse_command_line([sys.argv[0], "--set", "a", "in.json", "out.json"])
+        assert cm.value.code == 2
+
+    def test_delete(self) -> None:
+        input_data = (
+            b"kind: Pod\n"
+            b"metadata:\n"
+            b"  name: web\n"
+            b"  managedFields: [{manager: kubectl}]\n"
+            b"status: {phase: Running}\n"
+        )
+        output = remarshal.convert(
+            "yaml",
+            "json",
+            input_data,
+            ConvertOptions(
+                delete=["status", "metadata.managedFields"], json_indent=None
+            ),
+        )
+        assert output == b'{"kind":"Pod","metadata":{"name":"web"}}\n'
+
+    def test_delete_array_element(self) -> None:
+        output = remarshal.convert(
+            "json", "json", b'{"a": [1, 2, 3]}', ConvertOptions(delete=["a.0", "a.0"])
+        )
+        assert output == b'{"a":[3]}\n'
+
+    def test_delete_missing_path(self) -> None:
+        input_data = b'{"a": [1], "b": 2}'
+        output = remarshal.convert(
+            "json",
+            "json",
+            input_data,
+            ConvertOptions(delete=["a.1", "b.c", "c"], sort_keys=False),
+        )
+        assert output == b'{"a":[1],"b":2}\n'
+
+    def test_delete_cli(self) -> None:
+        args = _parse_command_line(
+            [sys.argv[0], "--delete", "status", "--delete", "a.b", "in.json", "o.json"]
+        )
+        assert args.delete == ["status", "a.b"]
+
+    def test_keep(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "example.toml",
+            "toml",
+            "json",
+            keep=["title", "database.ports.0", "servers.alpha.ip", "clients.data"],
+            sort_keys=False,
+        )
+        assert json.loads(output) == {
+            "title": "TOML Example",
+            "database": {"ports": [8001]},
+            "servers": {"alpha": {"ip": "10.0.0.1"}},
+            "clients": {"data": [["gamma", "delta"], [1, 2]]},
+        }
+
+    def test_keep_missing_path(self) -> None:
+        input_data = b'{"a": {"b": 1}, "c": [1, 2]}'
+        output = remarshal.convert(
+            "json", "json", input_data, ConvertOptions(keep=["a.x", "c.1"])
+        )
+        assert output == b'{"c":[2]}\n'
+
+    def test_keep_cli(self) -> None:
+        args = _parse_command_line(
+            [sys.argv[0], "--keep", "a", "--keep", "b.c", "in.json", "out.json"]
+        )
+        assert args.keep == ["a", "b.c"]
+
+    def test_redact(self) -> None:
+        input_data = (
+            b'{"db": {"user": "app", "password": "hunter2"}, '
+            b'"api": {"tokens": ["a", "b"]}, "a.secret": 1}'
+        )
+        output = remarshal.convert(
+            "json",
+            "json",
+            input_data,
+            ConvertOptions(redact=["password|token", r"a\\.secret"]),
+        )
+        assert json.loads(output) == {
+            "db": {"user": "app", "password": "***"},
+            "api": {"tokens": "***"},
+            "a.secret": "***",
+        }
+
+        output = remarshal.convert(
+            "json",
+            "json",
+            b'[{"name": "x", "Key": "y"}]',
+            ConvertOptions(redact=["(?i)^0\\.key$"], redact_placeholder="REDACTED"),
+        )
+        assert json.loads(output) == [{"name": "x", "Key": "REDACTED"}]
+
+    def test_redact_cli(self) -> None:
+        args = _parse_command_line(
+            [sys.argv[0], "--redact", "password", "in.json", "out.json"]
+        )
+        assert args.redact == ["password"]
+        assert args.redact_placeholder == "***"
+
+        with pytest.raises(SystemExit):
+            _parse_command_line([sys.argv[0], "--redact", "(", "in.json", "out.json"])
+
+    def test_pairs_to_map(self) -> None:
+        input_data = (
+            b'{"env": [{"name": "A", "value": "1"}, {"name": "B", "value": "2"}], '
+            b'"other": [{"name": "C"}], "empty": []}'
+        )
+        output = remarshal.convert(
+            "json", "json", input_data, ConvertOptions(pairs_to_map=("name", "value"))
+        )
+        assert json.loads(output) == {
+            "env": {"A": "1", "B": "2"},
+            "other": [{"name": "C"}],
+            "empty": [],
+        }
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "json",
+                "json",
+                b'[{"k": "a", "v": 1}, {"k": "a", "v": 2}]',
+                ConvertOptions(pairs_to_map=("k", "v")),
+            )
+        assert str(cm.value) == "repeated 'k' 'a' in key/value pairs"
+
+    def test_map_to_pairs(self) -> None:
+        input_data = b'{"spec": {"env": {"A": "1", "B": "2"}}}'
+        output = remarshal.convert(
+            "json",
+            "json",
+            input_data,
+            ConvertOptions(map_to_pairs=[("spec.env", "name", "value")]),
+        )
+        assert json.loads(output) == {
+            "spec": {"env": [{"name": "A", "value": "1"}, {"name": "B", "value": "2"}]}
+        }
+
+        with pytest.raises(TypeError):
+            remarshal.convert(
+                "json",
+                "json",
+                b'{"a": [1]}',
+                ConvertOptions(map_to_pairs=[("a", "name", "value")]),
+            )
+
+    def test_pairs_cli(self) -> None:
+        args = _parse_command_line(
+            [
+                sys.argv[0],
+                "--pairs-to-map",
+                "key,val",
+                "--map-to-pairs",
+                "env",
+                "--map-to-pairs",
+                "labels=k,v",
+                "in.json",
+                "out.json",
+            ]
+        )
+        assert args.pairs_to_map == ("key", "val")
+        assert args.map_to_pairs == [("env", "name", "value"), ("labels", "k", "v")]
+
+        with pytest.raises(SystemExit):
+            _parse_command_line(
+                [sys.argv[0], "--pairs-to-map", "name", "in.json", "out.json"]
+            )
+
+    def test_rename(self) -> None:
+        input_data = b'{"name": "web", "port": 80, "tls": {"cert": "a.pem"}}'
+        output = remarshal.convert(
+            "json",
+            "json",
+            input_data,
+            ConvertOptions(
+                rename=[("port", "listen"), ("tls.cert", "certificate"), ("x", "y")],
+                sort_keys=False,
+            ),
+        )
+        assert output == b'{"name":"web","listen":80,"tls":{},"certificate":"a.pem"}\n'
+
+    def test_rename_array_element(self) -> None:
+        output = remarshal.convert(
+            "json", "json", b'{"a": [1, 2]}', ConvertOptions(rename=[("a.0", "b.0")])
+        )
+        assert output == b'{"a":[2],"b":{"0":1}}\n'
+
+    def test_rename_cli(self) -> None:
+        args = _parse_command_line(
+            [
+                sys.argv[0],
+                "--rename",
+                "a=b",
+                "--rename-file",
+                data_file_path("renames.yaml"),
+                "in.json",
+                "out.json",
+            ]
+        )
+        assert args.rename == [
+            ("a", "b"),
+            ("owner.dob", "owner.birthday"),
+            ("database.server", "database.host"),
+            ("servers.alpha", "servers.primary"),
+        ]
+
+        with pytest.raises(SystemExit) as cm:
+            _parse_command_line([sys.argv[0], "--rename", "a=", "in.json", "o.json"])
+        assert cm.value.code == 2
+
+    def test_rename_file(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "example.toml",
+            "toml",
+            "json",
+            rename=_load_renames(data_file_path("renames.yaml")),
+            sort_keys=False,
+            stringify=True,
+        )
+        doc = json.loads(output)
+        assert list(doc["owner"]) == ["name", "organization", "bio", "birthday"]
+        assert doc["database"]["host"] == "192.168.1.1"
+        assert list(doc["servers"]) == ["primary", "beta"]
+
+    def test_merge(self, convert_and_read) -> None:
+        overlay = remarshal.decode("yaml", read_file("values-prod.yaml"))
+        output = convert_and_read(
+            "values.yaml", "yaml", "json", merge=[overlay], sort_keys=False
+        )
+        assert json.loads(output) == {
+            "image": {"repository": "nginx", "tag": "1.27"},
+            "replicas": 3,
+            "ports": [443],
+            "env": [
+                {"name": "LOG_LEVEL", "value": "warn"},
+                {"name": "REGION", "value": "eu-west-1"},
+            ],
+        }
+
+    def test_defaults(self, convert_and_read) -> None:
+        defaults = remarshal.decode("yaml", read_file("values.yaml"))
+        output = remarshal.convert(
+            "yaml",
+            "json",
+            read_file("values-prod.yaml"),
+            ConvertOptions(
+                defaults=[defaults, {"replicas": 2, "debug": False}], sort_keys=False
+            ),
+        )
+        doc = json.loads(output)
+        assert list(doc) == ["image", "replicas", "ports", "env", "debug"]
+        assert doc == {
+            "image": {"tag": "1.27", "repository": "nginx"},
+            "replicas": 3,
+            "ports": [443],
+            "env": [
+                {"name": "LOG_LEVEL", "value": "warn"},
+                {"name": "REGION", "value": "eu-west-1"},
+            ],
+            "debug": False,
+        }
+
+        output = remarshal.convert(
+            "json",
+            "json",
+            b'{"a": null}',
+            ConvertOptions(defaults=[{"a": 1}, {"a": 2, "b": 2}]),
+        )
+        assert output == b'{"a":null,"b":2}\n'
+
+        args = _parse_command_line(
+            [
+                sys.argv[0],
+                "--defaults",
+                data_file_path("values.yaml"),
+                "in.json",
+                "out.json",
+            ]
+        )
+        assert args.defaults[0]["replicas"] == 1
+
+    def test_array_merge(self, convert_and_read) -> None:
+        overlay = remarshal.decode("yaml", read_file("values-prod.yaml"))
+
+        def merged(strategy: str) -> tuple[list[int], list[tuple[str, str]]]:
+            output = convert_and_read(
+                "values.yaml", "yaml", "json", array_merge=strategy, merge=[overlay]
+            )
+            doc = json.loads(output)
+            return doc["ports"], [(x["name"], x["value"]) for x in doc["env"]]
+
+        assert merged("append") == (
+            [80, 443],
+            [
+                ("LOG_LEVEL", "info"),
+                ("WORKERS", "2"),
+                ("LOG_LEVEL", "warn"),
+                ("REGION", "eu-west-1"),
+            ],
+        )
+        assert merged("merge-by-index") == (
+            [443],
+            [("LOG_LEVEL", "warn"), ("REGION", "eu-west-1")],
+        )
+        assert merged("merge-by-key=name") == (
+            [80, 443],
+            [("LOG_LEVEL", "warn"), ("WORKERS", "2"), ("REGION", "eu-west-1")],
+        )
+
+        with pytest.raises(ValueError) as cm:
+            merged("merge-by")
+        assert "unknown array merge strategy 'merge-by'" in str(cm.value)
+
+    def test_merge_options_unchanged(self) -> None:
+        options = ConvertOptions(
+            defaults=[{"d": [1]}],
+            merge=[{"m": [1]}],
+            patch=[[{"op": "add", "path": f"/{key}/-", "value": 2} for key in "dm"]],
+            merge_patch=[{"p": [2, 1]}],
+            set_values=[("s", [2, 1])],
+            sort_paths=[("p", None), ("s", None)],
+        )
+        expected = {"d": [1, 2], "m": [1, 2], "p": [1, 2], "s": [1, 2]}
+
+        # The same options give the same output every time.
+        for _ in range(2):
+            output = remarshal.convert("json", "json", b"{}", options)
+            assert json.loads(output) == expected
+
+        assert options.defaults == [{"d": [1]}]
+        assert options.merge == [{"m": [1]}]
+        assert options.merge_patch == [{"p": [2, 1]}]
+        assert options.set_values == [("s", [2, 1])]
+
+    def test_merge_cli(self) -> None:
+        args = _parse_command_line(
+            [
+                sys.argv[0],
+                "--merge",
+                data_file_path("values-prod.yaml"),
+                "--array-merge",
+                "merge-by-key=name",
+                data_file_path("values.yaml"),
+                "out.json",
+            ]
+        )
+        assert args.merge[0]["replicas"] == 3
+        assert args.array_merge == "merge-by-key=name"
+
+        with pytest.raises(SystemExit) as cm:
+            _parse_command_line(
+                [sys.argv[0], "--array-merge", "merge-by-key=", "in.json", "o.json"]
+            )
+        assert cm.value.code == 2
+
+    def test_json_patch(self, convert_and_read) -> None:
+        patch = remarshal.decode("yaml", read_file("patch.yaml"))
+        output = convert_and_read(
+            "values.yaml", "yaml", "json", patch=[patch], sort_keys=False
+        )
+        assert json.loads(output) == {
+            "image": {"repository": "nginx", "tag": "1.25"},
+            "replicas": 3,
+            "ports": [80, 443],
+            "version": "1.25",
+            "environment": [{"name": "LOG_LEVEL", "value": "info"}],
+        }
+
+    def test_json_patch_insert(self) -> None:
+        patch = [
+            {"op": "add", "path": "/a/0", "value": 0},
+            {"op": "add", "path": "/b~1c", "value": {}},
+            {"op": "replace", "path": "", "value": {"d": [1]}},
+            {"op": "test", "path": "/d/0", "value": 1.0},
+        ]
+        output = remarshal.convert(
+            "json", "json", b'{"a": [1]}', ConvertOptions(patch=[patch])
+        )
+        assert output == b'{"d":[1]}\n'
+
+        output = remarshal.convert(
+            "json", "json", b'{"a": [1]}', ConvertOptions(patch=[patch[:2]])
+        )
+        assert output == b'{"a":[0,1],"b/c":{}}\n'
+
+    def test_json_patch_errors(self) -> None:
+        for patch, error in [
+            ({"op": "add"}, TypeError),
+            ([{"op": "add", "path": "/a"}], ValueError),
+            ([{"op": "remove", "path": "/b"}], ValueError),
+            ([{"op": "add", "path": "/a/5", "value": 1}], ValueError),
+            ([{"op": "test", "path": "/a", "value": [2]}], ValueError),
+            ([{"op": "move", "from": "/a", "path": "/a/0"}], ValueError),
+            ([{"op": "frobnicate", "path": "/a"}], ValueError),
+        ]:
+            with pytest.raises(error):
+                remarshal.convert(
+                    "json", "json", b'{"a": [1]}', ConvertOptions(patch=[patch])
+                )
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "json",
+                "json",
+                b"{}",
+                ConvertOptions(patch=[[{"op": "remove", "path": "/x"}]]),
+            )
+        assert str(cm.value) == (
+            "JSON Patch operation 0 (remove) failed: no value at path '/x'"
+        )
+
+    def test_json_patch_cli(self) -> None:
+        args = _parse_command_line(
+            [sys.argv[0], "--patch", data_file_path("patch.yaml"), "in.json", "o.json"]
+        )
+        assert args.patch[0][1] == {"op": "replace", "path": "/replicas", "value": 3}
+
+    def test_merge_patch(self, convert_and_read) -> None:
+        patch = remarshal.decode("yaml", read_file("merge-patch.yaml"))
+        output = convert_and_read(
+            "values.yaml", "yaml", "json", merge_patch=[patch], sort_keys=False
+        )
+        assert json.loads(output) == {
+            "image": {"repository": "nginx", "tag": "1.27"},
+            "replicas": 1,
+            "env": [{"name": "REGION", "value": "eu-west-1"}],
+        }
+
+    def test_merge_patch_rfc_examples(self) -> None:
+        for target, patch, result in [
+            ({"a": "b"}, {"a": "c"}, {"a": "c"}),
+            ({"a": "b"}, {"b": "c"}, {"a": "b", "b": "c"}),
+            ({"a": "b"}, {"a": None}, {}),
+            ({"a": [{"b": "c"}]}, {"a": [1]}, {"a": [1]}),
+            (["a", "b"], {"a": "c"}, {"a": "c"}),
+            ({"a": "foo"}, "bar", "bar"),
+            ({"e": None}, {"a": 1}, {"e": None, "a": 1}),
+            ({}, {"a": {"bb": {"ccc": None}}}, {"a": {"bb": {}}}),
+        ]:
+            output = remarshal.convert(
+                "json",
+                "json",
+                json.dumps(target).encode(),
+                ConvertOptions(merge_patch=[patch], sort_keys=False),
+            )
+            assert json.loads(output) == result
+
+    def test_merge_patch_cli(self) -> None:
+        args = _parse_command_line(
+            [
+                sys.argv[0],
+                "--merge-patch",
+                data_file_path("merge-patch.yaml"),
+                "in.json",
+                "out.json",
+            ]
+        )
+        assert args.merge_patch[0]["ports"] is None
+
+    def test_diff(self, capsys) -> None:
+        status = _diff_main(
+            [data_file_path("diff-old.toml"), data_file_path("diff-new.yaml")]
+        )
+        assert status == 1
+        assert capsys.readouterr().out == (
+            "- tags.1: \"prod\"\n"
+            '~ server.port: 80 -> "8080" (number -> string)\n'
+            "~ server.tls\\.enabled: false -> true\n"
+            "+ server.timeout: 30\n"
+            '- limits: {"requests":100}\n'
+        )
+
+    def test_diff_json_patch(self, capsys) -> None:
+        old = data_file_path("diff-old.toml")
+        new = data_file_path("diff-new.yaml")
+        assert _diff_main(["--json-patch", old, new]) == 1
+        patch = json.loads(capsys.readouterr().out)
+        assert patch == [
+            {"op": "remove", "path": "/tags/1"},
+            {"op": "replace", "path": "/server/port", "value": "8080"},
+            {"op": "replace", "path": "/server/tls.enabled", "value": True},
+            {"op": "add", "path": "/server/timeout", "value": 30},
+            {"op": "remove", "path": "/limits"},
+        ]
+
+        output = remarshal.convert(
+            "toml", "json", read_file("diff-old.toml"), ConvertOptions(patch=[patch])
+        )
+        assert json.loads(output) == remarshal.decode(
+            "yaml", read_file("diff-new.yaml")
+        )
+
+    def test_diff_json_patch_yaml(self, capsys, tmp_path) -> None:
+        old = tmp_path / "old.json"
+        old.write_text('{"a": [1, 2, 3], "b/c": 1}')
+        new = tmp_path / "new.json"
+        new.write_text('{"a": [1]}')
+        assert _diff_main(["--json-patch", "--to", "yaml", str(old), str(new)]) == 1
+        assert capsys.readouterr().out == (
+            "- op: remove\n"
+            "  path: /a/2\n"
+            "- op: remove\n"
+            "  path: /a/1\n"
+            "- op: remove\n"
+            "  path: /b~1c\n"
+        )
+
+    def test_diff_same(self, capsys) -> None:
+        status = _diff_main(
+            [data_file_path("example.toml"), data_file_path("example.yaml")]
+        )
+        assert status == 0
+        assert capsys.readouterr().out == ""
+
+    def test_diff_subcommand(self, capsys, monkeypatch) -> None:
+        monkeypatch.setattr(
+            sys,
+            "argv",
+            [
+                "remarshal",
+                "diff",
+                "--new-format",
+                "json",
+                data_file_path("array.json"),
+                data_file_path("array.toml"),
+            ],
+        )
+        with pytest.raises(SystemExit) as cm:
+            remarshal.main()
+        assert cm.value.code == 2
+        assert "Cannot parse as JSON" in capsys.readouterr().err
+
+    def test_schema_infer(self, capsys) -> None:
+        status = _schema_main(
+            [
+                "infer",
+                data_file_path("diff-old.toml"),
+                data_file_path("diff-new.yaml"),
+            ]
+        )
+        assert status == 0
+        assert json.loads(capsys.readouterr().out) == {
+            "$schema": "https://json-schema.org/draft/2020-12/schema",
+            "type": "object",
+            "properties": {
+                "title": {"type": "string"},
+                "tags": {"type": "array", "items": {"type": "string"}},
+                "server": {
+                    "type": "object",
+                    "properties": {
+                        "host": {"type": "string"},
+                        "port": {"type": ["integer", "string"]},
+                        "tls.enabled": {"type": "boolean"},
+                        "timeout": {"type": "integer"},
+                    },
+                    "required": ["host", "port", "tls.enabled"],
+                },
+                "limits": {
+                    "type": "object",
+                    "properties": {"requests": {"type": "integer"}},
+                    "required": ["requests"],
+                },
+            },
+            "required": ["title", "tags", "server"],
+        }
+
+    def test_schema_infer_each(self, capsys, tmp_path) -> None:
+        path = tmp_path / "events.json"
+        path.write_text(
+            '[{"id": 1, "at": null, "tags": []}, '
+            '{"id": 1.5, "at": "x", "tags": [{"a": 1}, "b"]}]'
+        )
+        assert _schema_main(["infer", "--each", "--to", "yaml", str(path)]) == 0
+        schema = remarshal.decode("yaml", capsys.readouterr().out.encode())
+        assert schema["properties"] == {
+            "id": {"type": "number"},
+            "at": {"type": ["null", "string"]},
+            "tags": {
+                "type": "array",
+                "items": {
+                    "anyOf": [
+                        {
+                            "type": "object",
+                            "properties": {"a": {"type": "integer"}},
+                            "required": ["a"],
+                        },
+                        {"type": "string"},
+                    ]
+                },
+            },
+        }
+
+        assert _schema_main(["infer", "--each", data_file_path("example.toml")]) == 1
+        assert "is not an array" in capsys.readouterr().err
+
+    def test_verify_roundtrip(self) -> None:
+        output = remarshal.convert(
+            "json",
+            "toml",
+            b'{"a": [1, 2.5], "b": {"c": null}}',
+            ConvertOptions(stringify=True),
+        )
+        assert output.startswith(b"a = ")
+
+        with pytest.raises(remarshal.EncodeError) as cm:
+            remarshal.convert(
+                "json",
+                "toml",
+                b'{"a": [1, 2.5], "b": {"c": null}}',
+                ConvertOptions(stringify=True, verify_roundtrip=True),
+            )
+        assert str(cm.value) == (
+            "Conversion to toml does not round-trip; "
+            "reading the output back gives:\n"
+            '~ b.c: null -> "null" (null -> string)'
+        )
+
+        output = remarshal.convert(
+            "yaml",
+            "toml",
+            b"- 1\n- 2\n",
+            ConvertOptions(toml_wrap=True, verify_roundtrip=True),
+        )
+        assert output == b"items = [1, 2]\n"
+
+    def test_verify_roundtrip_unreadable(self) -> None:
+        with pytest.raises(remarshal.EncodeError) as cm:
+            remarshal.convert(
+                "json", "lua", b'{"a": 1}', ConvertOptions(verify_roundtrip=True)
+            )
+        assert "lua cannot be read" in str(cm.value)
+
+    def test_int_float_round_trip(self) -> None:
+        data = {"i": 1, "f": 1.0, "e": 1e3, "h": 1e16, "z": -0.0, "b": 2**53 + 1}
+        input_data = json.dumps(data).encode()
+        assert json.loads(input_data) == data
+
+        for output_format in (
+            "cbor",
+            "gron",
+            "json",
+            "kdl",
+            "msgpack",
+            "ron",
+            "sdl",
+            "smile",
+            "tnetstring",
+            "toml",
+            "ucl",
+            "yaml",
+        ):
+            output = remarshal.convert("json", output_format, input_data)
+            doc = remarshal.decode(output_format, output)
+            assert doc == data
+            assert {k: type(v) for k, v in doc.items()} == {
+                k: type(v) for k, v in data.items()
+            }, output_format
+
+        output = remarshal.convert(
+            "json", "yaml", input_data, ConvertOptions(yaml_version="1.1")
+        )
+        assert b"h: 1.0e+16\n" in output
+        assert remarshal.decode(
+            "yaml", output, DecodeOptions(yaml_version="1.1")
+        ) == data
+
+    def test_strict(self) -> None:
+        input_data = (
+            b'{"a": null, "b": [18446744073709551616, "x"], "c": "1979-05-27"}'
+        )
+        output = remarshal.convert(
+            "json", "yaml", input_data, ConvertOptions(strict=True)
+        )
+        assert output.startswith(b"a:\nb:\n")
+
+        with pytest.raises(remarshal.EncodeError) as cm:
+            remarshal.convert(
+                "json", "toml", input_data, ConvertOptions(stringify=True, strict=True)
+            )
+        assert str(cm.value) == (
+            "Conversion to toml would lose data:\n"
+            "a: null is not supported\n"
+            "b.0: integer 18446744073709551616 is out of range"
+        )
+
+        with pytest.raises(remarshal.EncodeError) as cm:
+            remarshal.convert(
+                "toml",
+                "json",
+                b"a = 1979-05-27",
+                ConvertOptions(stringify=True, strict=True),
+            )
+        assert "a: date '1979-05-27' is not supported" in str(cm.value)
+
+        with pytest.raises(remarshal.EncodeError) as cm:
+            remarshal.convert(
+                "yaml", "json", b"a: !!binary AAE=", ConvertOptions(strict=True)
+            )
+        assert "a: binary data is not supported" in str(cm.value)
+
+    def test_strict_duplicate_keys(self) -> None:
+        input_data = b'{"a": 1, "b": {"c": 2, "c": 3}}'
+        output = remarshal.convert("json", "json", input_data)
+        assert json.loads(output) == {"a": 1, "b": {"c": 3}}
+
+        for input_format in ("json", "json5", "jsonc", "jsonl"):
+            with pytest.raises(remarshal.DecodeError) as cm:
+                remarshal.convert(
+                    input_format, "json", input_data, ConvertOptions(strict=True)
+                )
+            assert "duplicate key 'c'" in str(cm.value)
+
+    def test_duplicate_keys(self) -> None:
+        for input_format, input_data in (
+            ("hjson", b'{"a": 1, "b": 2, "a": 3}'),
+            ("json", b'{"a": 1, "b": 2, "a": 3}'),
+            ("json5", b"{a: 1, b: 2, a: 3}"),
+            ("yaml", b"a: 1\nb: 2\na: 3\n"),
+        ):
+            doc = remarshal.decode(
+                input_format, input_data, DecodeOptions(duplicate_keys="first")
+            )
+            assert doc == {"a": 1, "b": 2}
+
+            doc = remarshal.decode(
+                input_format, input_data, DecodeOptions(duplicate_keys="last")
+            )
+            assert doc == {"a": 3, "b": 2}
+
+            with pytest.raises(remarshal.DecodeError):
+                remarshal.decode(
+                    input_format, input_data, DecodeOptions(duplicate_keys="error")
+                )
+
+        with pytest.raises(remarshal.DecodeError) as cm:
+            remarshal.decode("yaml", b"a: 1\na: 2\n")
+        assert "duplicate key" in str(cm.value)
+        assert cm.value.line == 2
+
+        output = remarshal.convert(
+            "json",
+            "json",
+            b'{"a": 1, "a": 2}',
+            ConvertOptions(duplicate_keys="last", strict=True),
+        )
+        assert json.loads(output) == {"a": 2}
+
+    def test_validate(self, capsys, tmp_path) -> None:
+        bad = tmp_path / "bad.toml"
+        bad.write_text('a = 1\nb = "\n')
+        good = data_file_path("example.toml")
+        assert _validate_main([good]) == 0
+        assert capsys.readouterr().err == ""
+
+        assert _validate_main([good, str(bad), str(tmp_path / "missing.json")]) == 1
+        lines = capsys.readouterr().err.splitlines()
+        assert len(lines) == 2
+        assert lines[0].startswith(f"{bad}: Cannot parse as TOML")
+        assert lines[1].startswith(f"{tmp_path / 'missing.json'}: ")
+
+    def test_check_syntax(self, capsys, monkeypatch, tmp_path) -> None:
+        path = tmp_path / "config"
+        path.write_text("a: [1\n")
+        monkeypatch.setattr(
+            sys,
+            "argv",
+            ["remarshal", "--check-syntax", "--if", "yaml", str(path)],
+        )
+        with pytest.raises(SystemExit) as cm:
+            remarshal.main()
+        assert cm.value.code == 1
+        captured = capsys.readouterr()
+        assert captured.out == ""
+        assert "Cannot parse as YAML" in captured.err
+
+        path.write_text("a: [1]\n")
+        remarshal.main()
+        assert capsys.readouterr() == ("", "")
+
+    def test_schema_subcommand(self, capsys, monkeypatch) -> None:
+        monkeypatch.setattr(
+            sys, "argv", ["remarshal", "schema", "infer", data_file_path("array.json")]
+        )
+        with pytest.raises(SystemExit) as cm:
+            remarshal.main()
+        assert cm.value.code == 0
+        assert json.loads(capsys.readouterr().out)["type"] == "array"
+
+    def test_dedup_paths(self) -> None:
+        input_data = (
+            b'{"a": [{"x": 1, "y": 2}, {"y": 2, "x": 1}, {"x": 2}], '
+            b'"b": {"c": [1, 1.0, true, "1"]}, "d": [1, 1]}'
+        )
+        output = remarshal.convert(
+            "json", "json", input_data, ConvertOptions(dedup_paths=["a", "b.c"])
+        )
+        assert output == (
+            b'{"a":[{"x":1,"y":2},{"x":2}],"b":{"c":[1,true,"1"]},"d":[1,1]}\n'
+        )
+
+        with pytest.raises(TypeError) as cm:
+            remarshal.convert(
+                "json", "json", input_data, ConvertOptions(dedup_paths=["b"])
+            )
+        assert "value at path 'b' is not an array" in str(cm.value)
+
+    def test_expand_env(self, monkeypatch) -> None:
+        monkeypatch.setenv("HOST", "example.com")
+        monkeypatch.setenv("EMPTY", "")
+        monkeypatch.delenv("UNSET", raising=False)
+        input_data = (
+            b"url: https://$HOST:${UNSET:-8080}/\n"
+            b"price: $$5 and $ 6\n"
+            b'empty: ["${EMPTY:-a}", "${EMPTY-b}", "${UNSET-c}", "${UNSET:-}"]\n'
+            b"$HOST: 1\n"
+        )
+        output = remarshal.convert(
+            "yaml", "json", input_data, ConvertOptions(expand_env=True, sort_keys=False)
+        )
+        assert json.loads(output) == {
+            "url": "https://example.com:8080/",
+            "price": "$5 and $ 6",
+            "empty": ["a", "", "c", ""],
+            "$HOST": 1,
+        }
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "json", "json", b'["$UNSET"]', ConvertOptions(expand_env=True)
+            )
+        assert "environment variable 'UNSET' is not set" in str(cm.value)
+
+    def test_template(self, convert_and_read) -> None:
+        values = remarshal.decode("toml", read_file("template-values.toml"))
+        output = convert_and_read(
+            "template.yaml",
+            "yaml",
+            "json",
+            sort_keys=False,
+            template=True,
+            template_values=values,
+        )
+        assert json.loads(output) == {
+            "name": "web",
+            "replicas": 1,
+            "logLevel": "debug",
+            "ports": [80, 443],
+            "labels": {"app": "NGINX", "tier": "FRONTEND"},
+        }
+
+    def test_template_functions(self) -> None:
+        for template, expected in [
+            ('{{ eq .m.k "x" "v" }} {{ "a" | eq "b" }}', "true false"),
+            ("{{ and 1 0 }} {{ or 0 2 }} {{ not .x }}", "0 2 true"),
+            ("{{ index .a 1 }} {{ len .a }} {{ join \"-\" .a }}", "3 2 2-3"),
+            ("{{ .a }}{{ toJson .m }}", '[2,3]{"k":"v"}'),
+            ('{{ .m.k | replace "v" "w" | squote }}', "'w'"),
+            ("a\n  {{- /* trimmed */ -}}  \nb", "ab"),
+            ("{{ with $m := .m }}{{ $m.k }}{{ .k }}{{ end }}", "vv"),
+            ("{{ if .x }}x{{ else if .a }}a{{ else }}-{{ end }}", "a"),
+            ("{{ range .x }}x{{ else }}empty{{ end }}", "empty"),
+            ("{{ $v := 1 }}{{ if .a }}{{ $v := 2 }}{{ end }}{{ $v }}", "1"),
+        ]:
+            doc = {"a": [2, 3], "m": {"k": "v"}}
+            assert _render_template(template, doc) == expected
+
+    def test_template_go_conformance(self) -> None:
+        # The expected output is what Go's text/template gives.
+        for template, expected in [
+            ('{{ printf "%s=%05.1f|%-3d|%q" "x" 3.14159 7 "a" }}', 'x=003.1|7  |"a"'),
+            ('{{ 5 | printf "%d%%" }} {{ printf "%v %t" 1.5 true }}', "5% 1.5 true"),
+            ("{{ $v := 1 }}{{ if .a }}{{ $v = 2 }}{{ end }}{{ $v }}", "2"),
+            ("{{ $n := 0 }}{{ range .a }}{{ $n = . }}{{ end }}{{ $n }}", "3"),
+            ('{{ index .m "x" | not }} {{ index .m "k" }}', "true v"),
+            ('{{ "}}" }}{{ `{{` }}', "}}{{"),
+            ('{{ eq 1 1 }} {{ lt 1 2 }} {{ ge "b" "a" }}', "true true true"),
+            ("{{ toYaml .m }}", "k: v"),
+        ]:
+            doc = {"a": [2, 3], "m": {"k": "v"}}
+            assert _render_template(template, doc) == expected
+
+    def test_template_errors(self) -> None:
+        for template, message in [
+            ("a\n{{ if .a }}", 'line 2: missing "end" for "if"'),
+            ("{{ end }}", 'unexpected "end"'),
+            ('{{ required "need b" .b }}', "required: need b"),
+            ("{{ .a.b }}", "cannot get 'b' from a value of type 'int'"),
+            ("{{ $x }}", "undefined variable '$x'"),
+            ('{{ template "x" }}', '"template" is not supported'),
+            ("{{ eq true 1 }}", "eq: incompatible types for comparison"),
+            ("{{ $y = 1 }}", "undefined variable '$y'"),
+            ('{{ printf "%d" }}', "printf: missing argument for %d"),
+            ("a\n{{ .a", "line 2: unclosed action"),
+        ]:
+            with pytest.raises(ValueError) as cm:
+                remarshal.convert(
+                    "json",
+                    "json",
+                    template.encode(),
+                    ConvertOptions(template=True, template_values={"a": 1}),
+                )
+            assert message in str(cm.value)
+
+    def test_coerce_types(self) -> None:
+        input_data = (
+            b"PORT=8080\nRATIO=0.5\nDEBUG=False\nZIP=02134\n"
+            b"PROXY=null\nNAME=web\nEMPTY=\n"
+        )
+        output = remarshal.convert(
+            "properties",
+            "json",
+            input_data,
+            ConvertOptions(coerce={"ZIP": "int"}, coerce_types=True, sort_keys=False),
+        )
+        assert output == (
+            b'{"PORT":8080,"RATIO":0.5,"DEBUG":false,"ZIP":2134,'
+            b'"PROXY":null,"NAME":"web","EMPTY":""}\n'
+        )
+
+    def test_stringify_all(self) -> None:
+        input_data = (
+            b"data:\n"
+            b"  replicas: 3\n"
+            b"  ratio: 0.5\n"
+            b"  debug: true\n"
+            b"  proxy: null\n"
+            b"  since: 2024-01-02\n"
+            b"  hosts: [a, 1]\n"
+        )
+        output = remarshal.convert(
+            "yaml",
+            "json",
+            input_data,
+            ConvertOptions(sort_keys=False, stringify_all=True),
+        )
+        assert json.loads(output) == {
+            "data": {
+                "replicas": "3",
+                "ratio": "0.5",
+                "debug": "true",
+                "proxy": "",
+                "since": "2024-01-02",
+                "hosts": ["a", "1"],
+            }
+        }
+
+    def test_strip(self) -> None:
+        input_data = (
+            b'{"a": null, "b": "", "c": [null, "", [], {}], '
+            b'"d": {"e": {"f": null}}, "g": 0, "h": false, "i": [" "]}'
+        )
+        for options, expected in [
+            (
+                {"strip_nulls": True},
+                b'{"b":"","c":["",[],{}],"d":{"e":{}},"g":0,"h":false,"i":[" "]}\n',
+            ),
+            (
+                {"strip_empty": True},
+                b'{"a":null,"c":[null],"d":{"e":{"f":null}},'
+                b'"g":0,"h":false,"i":[" "]}\n',
+            ),
+            (
+                {"strip_empty": True, "strip_nulls": True, "trim_strings": True},
+                b'{"g":0,"h":false}\n',
+            ),
+        ]:
+            output = remarshal.convert(
+                "json", "json", input_data, ConvertOptions(sort_keys=False, **options)
+            )
+            assert output == expected
+
+    def test_strip_nulls_toml(self) -> None:
+        input_data = b'{"a": 1, "b": null, "c": {"d": null}, "e": [1, null]}'
+        output = remarshal.convert(
+            "json", "toml", input_data, ConvertOptions(strip_nulls=True)
+        )
+        assert output == b"a = 1\ne = [1]\n\n[c]\n"
+
+    def test_sort_arrays(self) -> None:
+        input_data = (
+            b'{"a": [3, "b", null, 1.5, true, "a"], '
+            b'"b": [{"x": 2}, {"x": 1}], "c": [[2, 1], 0]}'
+        )
+        output = remarshal.convert(
+            "json", "json", input_data, ConvertOptions(sort_arrays=True)
+        )
+        assert output == (
+            b'{"a":[null,true,1.5,3,"a","b"],"b":[{"x":2},{"x":1}],"c":[[1,2],0]}\n'
+        )
+
+    def test_sort_paths(self, convert_and_read) -> None:
+        output = convert_and_read(
+            "values.yaml",
+            "yaml",
+            "json",
+            sort_paths=[("env", "name"), ("ports", None)],
+            sort_keys=False,
+        )
+        doc = json.loads(output)
+        assert [x["name"] for x in doc["env"]] == ["LOG_LEVEL", "WORKERS"]
+
+        input_data = b'{"a": [{"k": "b"}, {"j": 1}, {"k": "a"}]}'
+        output = remarshal.convert(
+            "json", "json", input_data, ConvertOptions(sort_paths=[("a", "k")])
+        )
+        assert output == b'{"a":[{"k":"a"},{"k":"b"},{"j":1}]}\n'
+
+    def test_sort_paths_errors(self) -> None:
+        for sort_paths, error in [
+            ([("a", None)], TypeError),
+            ([("a.0", None)], TypeError),
+            ([("b", None)], ValueError),
+            ([("c", "k")], TypeError),
+        ]:
+            with pytest.raises(error):
+                remarshal.convert(
+                    "json",
+                    "json",
+                    b'{"a": [{}], "c": [1]}',
+                    ConvertOptions(sort_paths=sort_paths),
+                )
+
+        args = _parse_command_line(
+            [sys.argv[0], "--sort-path", "a", "--sort-path", "b=k", "in.json", "o.json"]
+        )
+        assert args.sort_paths == [("a", None), ("b", "k")]
+
+    def test_key_case(self) -> None:
+        input_data = (
+            b"server_name: web\n"
+            b"HTTPPort: 80\n"
+            b"tls-options: [{cert_file: a.pem}]\n"
+            b"_id: 1\n"
+        )
+        for key_case, expected in [
+            (
+                "camel",
+                b'{"serverName":"web","httpPort":80,'
+                b'"tlsOptions":[{"certFile":"a.pem"}],"_id":1}\n',
+            ),
+            (
+                "kebab",
+                b'{"server-name":"web","http-port":80,'
+                b'"tls-options":[{"cert-file":"a.pem"}],"_id":1}\n',
+            ),
+            (
+                "pascal",
+                b'{"ServerName":"web","HttpPort":80,'
+                b'"TlsOptions":[{"CertFile":"a.pem"}],"_Id":1}\n',
+            ),
+            (
+                "snake",
+                b'{"server_name":"web","http_port":80,'
+                b'"tls_options":[{"cert_file":"a.pem"}],"_id":1}\n',
+            ),
+        ]:
+            output = remarshal.convert(
+                "yaml",
+                "json",
+                input_data,
+                ConvertOptions(json_indent=None, key_case=key_case, sort_keys=False),
+            )
+            assert output == expected
+
+    def test_key_case_collision(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "json", "json", b'{"a_b": 1, "aB": 2}', ConvertOptions(key_case="snake")
+            )
+        assert "keys 'a_b' and 'aB' both become 'a_b'" in str(cm.value)
+
+    def test_key_policy(self) -> None:
+        input_data = (
+            b"1: a\ntrue: b\nnull: c\n2024-01-01: d\n1.5: e\n? [1, 2]\n: f\nx: {2: g}\n"
+        )
+
+        for output_format in ("json", "toml"):
+            output = remarshal.convert(
+                "yaml",
+                output_format,
+                input_data,
+                ConvertOptions(key_policy="stringify"),
+            )
+            assert remarshal.decode(output_format, output) == {
+                "1": "a",
+                "true": "b",
+                "null": "c",
+                "2024-01-01": "d",
+                "1.5": "e",
+                "[1,2]": "f",
+                "x": {"2": "g"},
+            }
+
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "yaml", "json", b"a: {1: b}", ConvertOptions(key_policy="error")
+            )
+        assert "key 1 of type 'int' is not a string" in str(cm.value)
+
+    def test_key_policy_collision(self) -> None:
+        with pytest.raises(ValueError) as cm:
+            remarshal.convert(
+                "yaml",
+                "json",
+                b"1: a\n'1': b\n",
+                ConvertOptions(key_policy="stringify"),
+            )
+        assert "keys 1 and '1' both become '1'" in str(cm.value)
+
 
 if __name__ == "__main__":
     pytest.main()
@@ -0,0 +1,309 @@
+#! /usr/bin/env python
+# Remarshal, a utility to convert between serialization formats.
+# Copyright (c) 2014-2020, 2024 D. Bohdan
+# License: MIT
+
+from __future__ import annotations
+
+import datetime
+import decimal
+
+import pytest
+
+from remarshal.template import render_template
+
+VALUES = {
+    "a": [2, 3],
+    "m": {"k": "v", "b": "w"},
+    "n": 0,
+    "s": "Hello, World",
+    "t": True,
+}
+
+
+def render(text: str, values: object = None) -> str:
+    return render_template(text, VALUES if values is None else values)
+
+
+class TestTemplate:
+    def test_text(self) -> None:
+        for template, expected in [
+            ("", ""),
+            ("no actions\n", "no actions\n"),
+            ("{ {} }", "{ {} }"),
+            ("{{ .s }}!", "Hello, World!"),
+            ("{{ .missing }}|{{ nil }}", "|"),
+            ("{{ .t }} {{ false }}", "true false"),
+            ("{{ .n }} {{ 1.5 }}", "0 1.5"),
+            ("{{ .a }} {{ .m }}", '[2,3] {"k":"v","b":"w"}'),
+        ]:
+            assert render(template) == expected
+
+    def test_text_special_values(self) -> None:
+        values = {
+            "d": datetime.date(2024, 1, 2),
+            "x": decimal.Decimal("1.5"),
+            "l": [datetime.time(3, 4), decimal.Decimal("2.5")],
+            "k": {1: "i", None: "n", False: "b", datetime.date(2024, 1, 2): "d"},
+            "u": ["é"],
+        }
+        for template, expected in [
+            ("{{ .d }} {{ .x }}", "2024-01-02 1.5"),
+            ("{{ .l }}", '["03:04:00",2.5]'),
+            ("{{ .k }}", '{"1":"i","null":"n","false":"b","2024-01-02":"d"}'),
+            ("{{ .u }}", '["é"]'),
+        ]:
+            assert render(template, values) == expected
+
+    def test_fields(self) -> None:
+        values = {"a": {"b": {"c": 1}}, "d": None}
+        for template, expected in [
+            ("{{ .a.b.c }}", "1"),
+            ("{{ .a.x.c }}", ""),
+            ("{{ .d.e }}", ""),
+            ("{{ $.a.b.c }}", "1"),
+            ("{{ with .a.b }}{{ .c }}{{ $.a.b.c }}{{ end }}", "11"),
+            ("{{ . }}", '{"a":{"b":{"c":1}},"d":null}'),
+        ]:
+            assert render(template, values) == expected
+
+    def test_literals(self) -> None:
+        for template, expected in [
+            ('{{ "a\\tb\\u00e9" }}', "a\tbé"),
+            ("{{ `a\\tb` }}", "a\\tb"),
+            ('{{ "}}" }}{{ `{{` }}', "}}{{"),
+            ("{{ 42 }} {{ -7 }} {{ 2.5 }} {{ 1e3 }}", "42 -7 2.5 1000.0"),
+            ("{{ true }} {{ false }} {{ nil }}.", "true false ."),
+        ]:
+            assert render(template) == expected
+
+    def test_if(self) -> None:
+        for template, expected in [
+            ("{{ if .t }}yes{{ end }}", "yes"),
+            ("{{ if .n }}yes{{ else }}no{{ end }}", "no"),
+            ("{{ if .n }}n{{ else if .missing }}m{{ else if .a }}a{{ end }}", "a"),
+            ("{{ if .n }}n{{ else if .missing }}m{{ else }}-{{ end }}", "-"),
+            ("{{ if $x := .s }}{{ $x }}{{ end }}", "Hello, World"),
+        ]:
+            assert render(template) == expected
+
+    def test_truth(self) -> None:
+        for value, expected in [
+            (None, "F"),
+            (False, "F"),
+            (0, "F"),
+            (0.0, "F"),
+            ("", "F"),
+            ([], "F"),
+            ({}, "F"),
+            (True, "T"),
+            (-1, "T"),
+            ("0", "T"),
+            ([0], "T"),
+            ({"": None}, "T"),
+            (datetime.date(2024, 1, 2), "T"),
+        ]:
+            template = "{{ if .x }}T{{ else }}F{{ end }}"
+            assert render(template, {"x": value}) == expected
+
+    def test_with(self) -> None:
+        for template, expected in [
+            ("{{ with .m }}{{ .k }}{{ end }}", "v"),
+            ("{{ with .missing }}x{{ else }}{{ .n }}{{ end }}", "0"),
+            ("{{ with $m := .m }}{{ $m.b }}{{ end }}", "w"),
+            ("{{ with .m.k }}{{ . }}{{ end }}", "v"),
+        ]:
+            assert render(template) == expected
+
+    def test_range(self) -> None:
+        for template, expected in [
+            ("{{ range .a }}<{{ . }}>{{ end }}", "<2><3>"),
+            ("{{ range $i, $x := .a }}{{ $i }}={{ $x }};{{ end }}", "0=2;1=3;"),
+            ("{{ range $x := .a }}{{ $x }}{{ end }}", "23"),
+            # Maps are visited in the order of their keys.
+            ("{{ range $k, $v := .m }}{{ $k }}={{ $v }};{{ end }}", "b=w;k=v;"),
+            ("{{ range .m }}{{ . }}{{ end }}", "wv"),
+            ("{{ range .missing }}x{{ else }}none{{ end }}", "none"),
+            ("{{ range .a }}{{ range $.a }}{{ . }}{{ end }};{{ end }}", "23;23;"),
+            ("{{ range .a }}{{ if eq . 3 }}three{{ end }}{{ end }}", "three"),
+        ]:
+            assert render(template) == expected
+
+        assert render("{{ range . }}x{{ else }}empty{{ end }}", []) == "empty"
+        assert render("{{ range . }}x{{ else }}empty{{ end }}", {}) == "empty"
+
+    def test_variables(self) -> None:
+        for template, expected in [
+            ("{{ $v := 1 }}{{ $v }}", "1"),
+            ("{{ $v := 1 }}{{ $v = 2 }}{{ $v }}", "2"),
+            ("{{ $v := .m }}{{ $v.k }}", "v"),
+            # A declaration in a block is local to it.
+            ("{{ $v := 1 }}{{ if .t }}{{ $v := 2 }}{{ end }}{{ $v }}", "1"),
+            ("{{ $v := 1 }}{{ if .t }}{{ $v = 2 }}{{ end }}{{ $v }}", "2"),
+            ("{{ $n := 0 }}{{ range .a }}{{ $n = . }}{{ end }}{{ $n }}", "3"),
+            # Each iteration of "range" has its own variables.
+            ("{{ range .a }}{{ $x := . }}{{ $x }}{{ end }}", "23"),
+            ("{{ with .m }}{{ $.n }}{{ end }}", "0"),
+        ]:
+            assert render(template) == expected
+
+    def test_trim(self) -> None:
+        for template, expected in [
+            ("a  {{- .n }}  b", "a0  b"),
+            ("a  {{ .n -}}  b", "a  0b"),
+            ("a\n  {{- .n -}}\n  b", "a0b"),
+            ("a {{ -1 }} b", "a -1 b"),
+            ("a\n  {{- /* trimmed */ -}}  \nb", "ab"),
+            (
+                "{{- range .a }}\n  - {{ . }}\n{{- end }}\n",
+                "\n  - 2\n  - 3\n",
+            ),
+        ]:
+            assert render(template) == expected
+
+    def test_comments(self) -> None:
+        for template, expected in [
+            ("a{{/* comment */}}b", "ab"),
+            ("a{{ /* }} is allowed */ }}b", "ab"),
+            ("a{{/* spans\nlines */}}b", "ab"),
+        ]:
+            assert render(template) == expected
+
+        # Lines in comments count toward the line numbers of errors.
+        with pytest.raises(ValueError, match="line 3: undefined variable"):
+            render("a{{/* spans\nlines */}}\n{{ $x }}")
+
+    def test_pipelines(self) -> None:
+        for template, expected in [
+            ('{{ .s | lower | replace "l" "L" }}', "heLLo, worLd"),
+            ("{{ .a | len }}", "2"),
+            ('{{ printf "%d-%d" (index .a 0) (len .a) }}', "2-2"),
+            ('{{ ("x") }}{{ (len .a) }}', "x2"),
+            ('{{ upper (printf "%s" (.m.k)) }}', "V"),
+            ('{{ 5 | printf "%d%%" }}', "5%"),
+            ('{{ "a" | eq "b" }}', "false"),
+        ]:
+            assert render(template) == expected
+
+    def test_functions(self, monkeypatch) -> None:
+        monkeypatch.setenv("REMARSHAL_TEMPLATE_TEST", "set")
+        monkeypatch.delenv("REMARSHAL_TEMPLATE_UNSET", raising=False)
+
+        for template, expected in [
+            ("{{ and 1 0 2 }} {{ and 1 2 }} {{ and .t }}", "0 2 true"),
+            ("{{ or 0 2 3 }} {{ or 0 nil }} {{ or .n }}", "2  0"),
+            ("{{ not .n }} {{ not .a }}", "true false"),
+            ('{{ contains "World" .s }} {{ .s | contains "x" }}', "true false"),
+            ('{{ default "x" .missing }} {{ .n | default "x" }}', "x x"),
+            ('{{ default "x" .s }} {{ default "x" }}', "Hello, World x"),
+            ('{{ env "REMARSHAL_TEMPLATE_TEST" }}', "set"),
+            ('[{{ env "REMARSHAL_TEMPLATE_UNSET" }}]', "[]"),
+            ('{{ eq .m.k "x" "v" }} {{ eq nil nil }}', "true true"),
+            ("{{ eq .n nil }} {{ eq .n 0 }}", "false true"),
+            ("{{ eq 1 1.0 }} {{ ne 1 2 }} {{ ne .s .s }}", "true true false"),
+            ("{{ lt 1 2 }} {{ le 2 2 }} {{ gt 1 2 }}", "true true false"),
+            ("{{ ge 2 1 }} {{ ge 1 2 }} {{ le 2 1 }}", "true false false"),
+            ('{{ lt "a" "b" }} {{ gt "a" "b" }}', "true false"),
+            ('{{ hasPrefix "Hel" .s }} {{ hasSuffix "Hel" .s }}', "true false"),
+            ('{{ indent 2 "a\\nb" }}|{{ nindent 2 "a" }}', "  a\n  b|\n  a"),
+            ('{{ index .a 1 }} {{ index .m "k" }} {{ index .m "x" }}.', "3 v ."),
+            ('{{ index . "m" "k" }} {{ index .m }}', 'v {"k":"v","b":"w"}'),
+            ('{{ join ", " .a }}', "2, 3"),
+            ("{{ len .a }} {{ len .m }} {{ len .s }}", "2 2 12"),
+            ("{{ lower .s }} {{ upper .s }}", "hello, world HELLO, WORLD"),
+            ('{{ title "hello world" }}', "Hello World"),
+            ('{{ print "a" 1 nil true .a }}', "a1true[2,3]"),
+            ('{{ quote .s }} {{ quote 1 }}', '"Hello, World" "1"'),
+            ('{{ quote "\\"é\\"" }}', '"\\"é\\""'),
+            ("{{ squote .s }} {{ squote nil }}", "'Hello, World' ''"),
+            ('{{ replace "o" "0" .s }}', "Hell0, W0rld"),
+            ('{{ required "need s" .s }}', "Hello, World"),
+            ("{{ toJson .m }} {{ toJson .a }}", '{"k":"v","b":"w"} [2,3]'),
+            ("{{ toJson .s }} {{ toJson nil }}", '"Hello, World" null'),
+            ('{{ trim "  a b \\n" }}.', "a b."),
+        ]:
+            assert render(template) == expected
+
+    def test_printf(self) -> None:
+        # The expected output is what Go's fmt.Sprintf gives.
+        for template, expected in [
+            ('{{ printf "%s=%05.1f|%-3d|%q" "x" 3.14159 7 "a" }}', 'x=003.1|7  |"a"'),
+            ('{{ printf "%v %t %v %v" 1.5 true nil .a }}', "1.5 true  [2,3]"),
+            ('{{ printf "%d %+d % d %5d|%-5d|" 1 2 3 4 5 }}', "1 +2  3     4|5    |"),
+            ('{{ printf "%x %X %o %b %#x" 255 255 8 5 255 }}', "ff FF 10 101 0xff"),
+            ('{{ printf "%x %X" "hi" "hi" }}', "6869 6869"),
+            ('{{ printf "%.2f %e %g" 3.14159 1000.0 0.5 }}', "3.14 1.000000e+03 0.5"),
+            ('{{ printf "%5s|%-5s|%.2s" "ab" "ab" "abc" }}', "   ab|ab   |ab"),
+            ('{{ printf "%q" "a\\"b" }}', '"a\\"b"'),
+            ('{{ printf "100%%" }}', "100%"),
+            ('{{ printf "%f" 2 }}', "2.000000"),
+        ]:
+            assert render(template) == expected
+
+    def test_custom_functions(self) -> None:
+        functions = {
+            "double": lambda x: x * 2,
+            "upper": lambda s: f"<{s}>",
+        }
+        for template, expected in [
+            ("{{ double 2 }} {{ .a | len | double }}", "4 4"),
+            # The given functions take the place of the built-in ones.
+            ('{{ upper "a" }} {{ lower "B" }}', "<a> b"),
+        ]:
+            assert render_template(template, VALUES, functions=functions) == expected
+
+        with pytest.raises(ValueError, match="unknown function 'double'"):
+            render("{{ double 2 }}")
+
+    def test_parse_errors(self) -> None:
+        for template, message in [
+            ("a\n{{ if .a }}", 'line 2: missing "end" for "if"'),
+            ("{{ range .a }}{{ else }}", 'line 1: missing "end" for "range"'),
+            ("{{ if .t }}{{ else .n }}{{ end }}", 'unexpected tokens after "else"'),
+            ("{{ with .m }}{{ else if .t }}{{ end }}", "after \"else\""),
+            ("{{ end }}", 'line 1: unexpected "end"'),
+            ("a\n\n{{ else }}", 'line 3: unexpected "else"'),
+            ('{{ template "x" }}', '"template" is not supported'),
+            ('{{ define "x" }}{{ end }}', '"define" is not supported'),
+            ('{{ block "x" . }}{{ end }}', '"block" is not supported'),
+            ("a\n{{ .a", "line 2: unclosed action"),
+            ("{{ .a }}\n{{ .a }}\n{{", "line 3: unclosed action"),
+            ("{{ .a ; }}", "line 1: unexpected ';'"),
+            ("{{ (.a }}", "unclosed '('"),
+            ("{{ .a) }}", "unexpected ')'"),
+            ("{{ }}", "missing value"),
+            ("{{ | len }}", "missing command before '|'"),
+            ("{{ .a | }}", "missing value"),
+            ("{{ $x := }}", "missing value"),
+            ('{{ "a\nb" }}', "unclosed action"),
+        ]:
+            with pytest.raises(ValueError, match="Cannot render template") as cm:
+                render(template)
+            assert message in str(cm.value)
+
+    def test_execution_errors(self) -> None:
+        for template, message in [
+            ('{{ required "need b" .b }}', "required: need b"),
+            ('{{ required "need e" "" }}', "required: need e"),
+            ("\n{{ .s.b }}", "line 2: cannot get 'b' from a value of type 'str'"),
+            ("{{ $x }}", "undefined variable '$x'"),
+            ("{{ $y = 1 }}", "undefined variable '$y'"),
+            ("{{ if .t }}{{ $z := 1 }}{{ end }}{{ $z }}", "undefined variable '$z'"),
+            ("{{ nope 1 }}", "unknown function 'nope'"),
+            ("{{ .s 1 }}", "cannot give arguments to a value that is not a function"),
+            ("{{ .s | .n }}", "cannot give arguments to a value"),
+            ("{{ len len }}", "function 'len' needs to come first"),
+            ("{{ eq true 1 }}", "eq: incompatible types for comparison"),
+            ('{{ lt 1 "a" }}', "lt: incompatible types for comparison"),
+            ("{{ lt .t .t }}", "lt: invalid type 'bool' for comparison"),
+            ("{{ eq .a .a }}", "eq: non-comparable type 'list'"),
+            ('{{ printf "%d" }}', "printf: missing argument for %d"),
+            ('{{ printf "%d" "a" }}', "printf: bad verb %d for a value of type 'str'"),
+            ('{{ printf "" 1 }}', "printf: 1 extra argument(s)"),
+            ("{{ index .a 5 }}", "index: list index out of range"),
+            ("{{ len .n }}", "len: "),
+            ("{{ range .s }}{{ end }}", "cannot range over a value of type 'str'"),
+        ]:
+            with pytest.raises(ValueError, match="Cannot render template") as cm:
+                render(template)
+            assert message in str(cm.value)
@@ -0,0 +1,3 @@
+INSERT INTO "users" ("id", "name", "admin", "joined") VALUES (1, 'O''Brien', TRUE, '2024-01-02 03:04:05+00:00');
+INSERT INTO "users" ("id", "name", "avatar") VALUES (2, 'Zoë', X'00015C27');
+INSERT INTO "users" ("id", "name") VALUES (3, NULL);